@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/amonks/genres/readthrough"
+)
+
+// openCache returns the response cache of the given kind, as named by the
+// -cache flag, along with a function to close it.
+func openCache(kind, dir string) (readthrough.Cache, func() error, error) {
+	switch kind {
+	case "dir":
+		return readthrough.New(dir, "req-"), func() error { return nil }, nil
+	case "sqlite":
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, nil, fmt.Errorf("error creating cache dir '%s': %w", dir, err)
+		}
+		cache, err := readthrough.OpenSQLite(filepath.Join(dir, "cache.db"))
+		if err != nil {
+			return nil, nil, err
+		}
+		return cache, cache.Close, nil
+	case "none":
+		return readthrough.Nop{}, func() error { return nil }, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown cache '%s'", kind)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/amonks/genres/spotify"
+)
+
+const credentialsHelp = `file of spotify credentials, one "client_id client_secret" pair per line
+if unset, credentials come from SPOTIFY_CLIENT_ID and SPOTIFY_CLIENT_SECRET,
+and from SPOTIFY_CLIENT_ID_<n> and SPOTIFY_CLIENT_SECRET_<n> for any suffix <n>`
+
+// loadCredentials returns the credentials in the given file, or, if filename
+// is empty, those in the environment.
+func loadCredentials(filename string) ([]spotify.Credential, error) {
+	if filename != "" {
+		return readCredentialsFile(filename)
+	}
+	return credentialsFromEnv(os.Environ())
+}
+
+// readCredentialsFile reads a file with a client ID and secret on each line.
+// Blank lines and lines starting with # are ignored.
+func readCredentialsFile(filename string) ([]spotify.Credential, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening credentials file: %w", err)
+	}
+	defer f.Close()
+
+	var credentials []spotify.Credential
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a client ID and a client secret", filename, line)
+		}
+		credentials = append(credentials, spotify.Credential{ClientID: fields[0], ClientSecret: fields[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading credentials file: %w", err)
+	}
+	if len(credentials) == 0 {
+		return nil, fmt.Errorf("no credentials in '%s'", filename)
+	}
+	return credentials, nil
+}
+
+// credentialsFromEnv finds SPOTIFY_CLIENT_ID and SPOTIFY_CLIENT_SECRET, and
+// any pairs of them with the same suffix, such as SPOTIFY_CLIENT_ID_2 and
+// SPOTIFY_CLIENT_SECRET_2, in the given environment.
+func credentialsFromEnv(environ []string) ([]spotify.Credential, error) {
+	vars := map[string]string{}
+	for _, kv := range environ {
+		k, v, _ := strings.Cut(kv, "=")
+		vars[k] = v
+	}
+
+	var suffixes []string
+	for k := range vars {
+		if suffix, ok := strings.CutPrefix(k, "SPOTIFY_CLIENT_ID"); ok && (suffix == "" || strings.HasPrefix(suffix, "_")) {
+			suffixes = append(suffixes, suffix)
+		}
+	}
+	sort.Strings(suffixes)
+
+	var credentials []spotify.Credential
+	for _, suffix := range suffixes {
+		id, secret := vars["SPOTIFY_CLIENT_ID"+suffix], vars["SPOTIFY_CLIENT_SECRET"+suffix]
+		if id == "" || secret == "" {
+			return nil, fmt.Errorf("must set both SPOTIFY_CLIENT_ID%s and SPOTIFY_CLIENT_SECRET%s", suffix, suffix)
+		}
+		credentials = append(credentials, spotify.Credential{ClientID: id, ClientSecret: secret})
+	}
+	if len(credentials) == 0 {
+		return nil, fmt.Errorf("must set SPOTIFY_CLIENT_ID and SPOTIFY_CLIENT_SECRET")
+	}
+	return credentials, nil
+}
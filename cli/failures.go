@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/amonks/genres/db"
+	"github.com/amonks/genres/subcmd"
+)
+
+func failures(ctx context.Context, database *db.DB, args []string) error {
+	subcmd := subcmd.New("failures", "list, inspect, and requeue the rows each stage of the fetcher has failed for\nwithout -stage, counts the failures of every stage")
+	stageName := subcmd.String("stage", "", "which stage's failures to list; valid options are {genre_artists, artist_albums, artist_tracks, album_tracks, track_analysis, related_artists, playlists}")
+	dead := subcmd.Bool("dead", false, "only list dead rows, which won't be retried unless they're requeued")
+	limit := subcmd.Int("limit", 50, "how many failures to list")
+	show := subcmd.String("show", "", "print the failure of the row with this key in full, instead of listing failures")
+	requeue := subcmd.Bool("requeue", false, "requeue the rows with the given keys, or with -dead, every dead row, so they're fetched as if they'd never been tried")
+	subcmd.SetArg("keys", "...string", "with -requeue, the keys of the rows to requeue")
+	if err := subcmd.Parse(args); err != nil {
+		return fmt.Errorf("flag parsing err: %w", err)
+	}
+
+	if *stageName == "" {
+		if *show != "" || *requeue {
+			return fmt.Errorf("-show and -requeue need a -stage")
+		}
+		return printFailureCounts(database)
+	}
+	stage, err := db.LookupStage(*stageName)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *show != "":
+		return printFailure(database, stage, *show)
+
+	case *requeue:
+		var n int
+		if keys := subcmd.Args(); len(keys) > 0 {
+			n, err = database.Requeue(stage, keys)
+		} else if *dead {
+			n, err = database.RequeueDead(stage)
+		} else {
+			return fmt.Errorf("-requeue needs either keys or -dead")
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("requeued %d %s rows\n", n, stage.Name)
+		return nil
+
+	default:
+		failures, err := database.ListFailures(stage, *dead, *limit)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "key\tfailures\tfailed at\tretry at\terror\n")
+		for _, f := range failures {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", f.Key, f.Failures, formatTime(f.FailedAt), formatRetry(f), truncate(f.LastError, 60))
+		}
+		return w.Flush()
+	}
+}
+
+func printFailureCounts(database *db.DB) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "stage\tretrying\tdead\n")
+	for _, stage := range db.Stages {
+		count, err := database.CountFailures(stage)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\n", count.Stage, count.Retrying, count.Dead)
+	}
+	return w.Flush()
+}
+
+func printFailure(database *db.DB, stage db.Stage, key string) error {
+	f, err := database.GetFailure(stage, key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("stage:     %s\n", f.Stage)
+	fmt.Printf("key:       %s\n", f.Key)
+	fmt.Printf("failures:  %d of %d\n", f.Failures, db.MaxFailures)
+	fmt.Printf("failed at: %s\n", formatTime(f.FailedAt))
+	fmt.Printf("retry at:  %s\n", formatRetry(f))
+	fmt.Printf("error:     %s\n", f.LastError)
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	return t.Local().Format(time.DateTime)
+}
+
+func formatRetry(f db.Failure) string {
+	if f.Dead() {
+		return "dead"
+	}
+	return formatTime(f.RetryAt.Time)
+}
+
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return s
+}
@@ -3,10 +3,13 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"os"
+	"slices"
 	"strings"
 
 	"github.com/amonks/genres/db"
+	"github.com/amonks/genres/metrics"
 	"github.com/amonks/genres/setflag"
 	"github.com/amonks/genres/spotify"
 	"github.com/amonks/genres/subcmd"
@@ -14,35 +17,124 @@ import (
 )
 
 func fetch(ctx context.Context, db *db.DB, args []string) error {
-	var allowedWorkers = []string{
-		"album_tracks",
-		"artist_albums",
-		"genre_artists",
-		"genres",
-		"track_analysis",
-		"album_tracks_refetch",
-	}
+	allowedWorkers := workers.Names()
 
-	subcmd := subcmd.New("fetch", "fetch data from spotify to populate the database\nrequires SPOTIFY_CLIENT_ID and SPOTIFY_CLIENT_SECRET")
+	subcmd := subcmd.New("fetch", "fetch data from spotify to populate the database\nrequires spotify credentials; see -credentials")
 	fWorkers := setflag.New(allowedWorkers...)
-	subcmd.Var(fWorkers, "workers", fmt.Sprintf("Workers to run; valid options are {%s}", strings.Join(allowedWorkers, ", ")))
+	subcmd.Var(fWorkers, "workers", fmt.Sprintf("Workers to run; valid options are {%s}\ndefaults to {%s}, plus playlists if any playlists are seeded", strings.Join(allowedWorkers, ", "), strings.Join(workers.Defaults(), ", ")))
+	cacheKind := subcmd.String("cache", "dir", "how to cache responses; valid options are {dir, sqlite, none}")
+	cacheDir := subcmd.String("cache-dir", spotify.DefaultCacheDir, "directory for cached responses; with -cache sqlite, holds cache.db")
+	limiterFile := subcmd.String("limiter-file", spotify.DefaultLimiterFile, "prefix of the files for persisting each credential's rate limiter state")
+	credentialsFile := subcmd.String("credentials", "", credentialsHelp)
+	graph := subcmd.Bool("graph", false, "print the workers, what they consume and produce, and which trigger which, then exit")
+	controlAddr := subcmd.String("control", "", "address to serve the worker status and control API on, like localhost:9998 or unix:/tmp/genres.sock\nGET /workers lists the workers; POST /workers/{name}/{pause,resume,trigger} controls them")
+	metricsAddr := subcmd.String("metrics", "", "address to serve prometheus metrics on, at /metrics, like localhost:9997; may be the same as -control")
+	priorities := subcmd.String("priority", "", fmt.Sprintf("comma-separated worker=priority pairs, like track_analysis=coverage, setting the order in which workers fetch rows; every worker's default is none, which is fastest\nvalid workers are {%s}; valid priorities are {%s}", strings.Join(workers.Prioritized(), ", "), strings.Join(priorityNames(), ", ")))
+	var seedGenres, seedArtists, seedPlaylists listFlag
+	subcmd.Var(&seedGenres, "genre", "seed genre; if any seeds are given, only what's reachable from them is fetched: their artists, and those artists' albums and tracks\nmay be given more than once")
+	subcmd.Var(&seedArtists, "artist", "seed artist, as a spotify ID or link; may be given more than once")
+	subcmd.Var(&seedPlaylists, "playlist", "seed playlist, as a spotify ID or link; its tracks are fetched and analyzed\nmay be given more than once")
+	seedsFile := subcmd.String("seeds", "", seedsHelp)
+	concurrency := subcmd.Int("concurrency", spotify.DefaultConcurrency, "number of requests to spotify which may be in flight at once")
 	if err := subcmd.Parse(args); err != nil {
 		return fmt.Errorf("flag parsing err: %w", err)
 	}
 
+	workerPriorities, err := parsePriorities(*priorities)
+	if err != nil {
+		return err
+	}
+
+	scope, err := loadScope(seedGenres, seedArtists, seedPlaylists, *seedsFile)
+	if err != nil {
+		return err
+	}
+
 	workersList := fWorkers.List()
 	if len(workersList) == 0 {
-		workersList = allowedWorkers
+		workersList = workers.Defaults()
+		if scope != nil && len(scope.Playlists) > 0 {
+			workersList = append(workersList, "playlists")
+		}
+	}
+	if *graph {
+		return workers.PrintGraph(os.Stdout, workersList)
+	}
+
+	cache, closeCache, err := openCache(*cacheKind, *cacheDir)
+	if err != nil {
+		return err
+	}
+	defer closeCache()
+
+	options := []spotify.Option{
+		spotify.WithCache(cache),
+		spotify.WithLimiterFile(*limiterFile),
+		spotify.WithConcurrency(*concurrency),
 	}
 
-	clientID, clientSecret := os.Getenv("SPOTIFY_CLIENT_ID"), os.Getenv("SPOTIFY_CLIENT_SECRET")
-	if clientID == "" || clientSecret == "" {
-		return fmt.Errorf("must set SPOTIFY_CLIENT_ID and SPOTIFY_CLIENT_SECRET")
+	credentials, err := loadCredentials(*credentialsFile)
+	if err != nil {
+		return err
 	}
-	spo, err := spotify.New(clientID, clientSecret)
+	spo, err := spotify.New(credentials, options...)
 	if err != nil {
 		return fmt.Errorf("error creating spotify client: %w", err)
 	}
+	defer spo.Close()
+
+	control := workers.NewControl()
+	muxes := map[string]*http.ServeMux{}
+	handle := func(addr, pattern string, handler http.Handler) {
+		if addr == "" {
+			return
+		}
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		muxes[addr].Handle(pattern, handler)
+	}
+	handle(*controlAddr, "/workers", control)
+	handle(*controlAddr, "/workers/", control)
+	handle(*metricsAddr, "/metrics", metrics.Default)
+	for addr, mux := range muxes {
+		stop, err := listenAndServe(addr, mux)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	return workers.Run(ctx, db, spo, workersList, workers.WithControl(control), workers.WithPriorities(workerPriorities), workers.WithScope(scope))
+}
+
+func priorityNames() []string {
+	names := make([]string, len(db.Priorities))
+	for i, p := range db.Priorities {
+		names[i] = string(p)
+	}
+	return names
+}
 
-	return workers.Run(ctx, db, spo, workersList)
+// parsePriorities parses a -priority flag.
+func parsePriorities(flag string) (map[string]db.Priority, error) {
+	priorities := map[string]db.Priority{}
+	if flag == "" {
+		return priorities, nil
+	}
+	for _, pair := range strings.Split(flag, ",") {
+		name, priority, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid priority '%s': expected worker=priority", pair)
+		}
+		if !slices.Contains(workers.Prioritized(), name) {
+			return nil, fmt.Errorf("invalid priority '%s': worker '%s' has no priority", pair, name)
+		}
+		p, err := db.ParsePriority(priority)
+		if err != nil {
+			return nil, fmt.Errorf("invalid priority for %s: %w", name, err)
+		}
+		priorities[name] = p
+	}
+	return priorities, nil
 }
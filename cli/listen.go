@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// listenAndServe serves the given handler at addr, which is either a TCP
+// address, like localhost:9998, or a unix socket path prefixed with "unix:".
+// It returns a function which stops the server.
+func listenAndServe(addr string, handler http.Handler) (func(), error) {
+	var (
+		listener net.Listener
+		err      error
+	)
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		// A socket left behind by a process which didn't exit cleanly
+		// would stop us from listening.
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("error removing old socket: %w", err)
+		}
+		listener, err = net.Listen("unix", path)
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listening on '%s': %w", addr, err)
+	}
+
+	srv := http.Server{Handler: handler}
+	go func() {
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("error serving on '%s': %s", addr, err)
+		}
+	}()
+	log.Printf("listening on %s", addr)
+
+	return func() { srv.Shutdown(context.Background()) }, nil
+}
@@ -31,7 +31,7 @@ func run() error {
 		fmt.Fprintf(os.Stderr, "  genres [flags] $cmd <defined by cmd...>\n\n")
 		fmt.Fprintf(os.Stderr, "flags:\n")
 		flag.PrintDefaults()
-		fmt.Fprintf(os.Stderr, "  $cmd {fetch, search, find, path, neighbors, serve, progress}\n")
+		fmt.Fprintf(os.Stderr, "  $cmd {fetch, search, find, path, neighbors, serve, progress, failures, migrate, replay}\n")
 		fmt.Fprintf(os.Stderr, "  \twhich command to run\n")
 		fmt.Fprintf(os.Stderr, "  \trun `flag $cmd -help for more details about specific commands.\n")
 	}
@@ -41,18 +41,24 @@ func run() error {
 		return nil
 	}
 
-	db, err := db.Open(*dbFilename)
-	if err != nil {
-		return fmt.Errorf("db open error: %w", err)
-	}
-	defer db.Close()
-
 	args := flag.Args()
 	if len(args) < 1 {
 		flag.CommandLine.Parse([]string{"-help"})
 		return nil
 	}
 	cmd, args := args[0], args[1:]
+
+	// Every command but migrate requires a migrated database.
+	open := db.Open
+	if cmd == "migrate" {
+		open = db.OpenUnmigrated
+	}
+	db, err := open(*dbFilename)
+	if err != nil {
+		return fmt.Errorf("db open error: %w", err)
+	}
+	defer db.Close()
+
 	switch cmd {
 	case "serve":
 		return serve(ctx, db, args)
@@ -68,8 +74,12 @@ func run() error {
 		return path(ctx, db, args)
 	case "neighbors":
 		return neighbors(ctx, db, args)
+	case "failures":
+		return failures(ctx, db, args)
+	case "replay":
+		return replay(ctx, db, args)
 	case "migrate":
-		return nil
+		return migrate(ctx, db, args)
 	default:
 		return fmt.Errorf("unknown cmd: '%s'", cmd)
 	}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/amonks/genres/db"
+	"github.com/amonks/genres/subcmd"
+)
+
+func migrate(ctx context.Context, db *db.DB, args []string) error {
+	subcmd := subcmd.New("migrate", "apply pending schema migrations")
+	dryRun := subcmd.Bool("dry-run", false, "list pending migrations without applying them")
+	if err := subcmd.Parse(args); err != nil {
+		return fmt.Errorf("flag parsing err: %w", err)
+	}
+
+	statuses, err := db.MigrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+	pending := 0
+	for _, s := range statuses {
+		if s.AppliedAt.Valid {
+			fmt.Printf("%04d  %-30s  applied %s\n", s.Version, s.Name, s.AppliedAt.Time.Format("2006-01-02 15:04:05"))
+		} else {
+			fmt.Printf("%04d  %-30s  pending\n", s.Version, s.Name)
+			pending++
+		}
+	}
+
+	if pending == 0 {
+		fmt.Println("up to date")
+		return nil
+	}
+	if *dryRun {
+		fmt.Printf("%d migrations to apply\n", pending)
+		return nil
+	}
+
+	applied, err := db.Migrate(ctx)
+	for _, m := range applied {
+		fmt.Printf("applied %04d %s\n", m.Version, m.Name)
+	}
+	return err
+}
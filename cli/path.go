@@ -33,9 +33,10 @@ func path(ctx context.Context, db *db.DB, args []string) error {
 		return fmt.Errorf("error getting 'to' track '%s': %w", *to, err)
 	}
 
-	fromVec, toVec := fromTrack.Vector(), toTrack.Vector()
-	delta := fromVec.Delta(toVec)
-	path := fromVec.Path(delta, *steps)
+	playlist, err := db.Path(ctx, fromTrack, toTrack, *steps)
+	if err != nil {
+		return err
+	}
 
 	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
 
@@ -72,14 +73,8 @@ func path(ctx context.Context, db *db.DB, args []string) error {
 		}, "\t")+"\n")
 	}
 
-	printTrack(fromTrack, 0)
-
-	for i, vec := range path {
-		results, err := db.NearestTracks(ctx, 1, vec)
-		if err != nil {
-			return fmt.Errorf("error getting nearest track for step %d: %w", i+1, err)
-		}
-		printTrack(&results[0], vec.Distance(results[0].Vector()))
+	for _, step := range playlist {
+		printTrack(&step.Track, step.Distance)
 	}
 
 	tw.Flush()
@@ -2,95 +2,373 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"slices"
 	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/amonks/genres/data"
 	"github.com/amonks/genres/db"
+	"github.com/amonks/genres/forecast"
+	"github.com/amonks/genres/limiter"
+	"github.com/amonks/genres/spotify"
 	"github.com/amonks/genres/subcmd"
+	"github.com/amonks/genres/workers"
 
 	"golang.org/x/text/language"
 	"golang.org/x/text/message"
 )
 
 func progress(ctx context.Context, db *db.DB, args []string) error {
-	subcmd := subcmd.New("progress", "report progress from the fetcher")
+	subcmd := subcmd.New("progress", "report progress from the fetcher, and forecast when each stage will be done")
+	limiterFile := subcmd.String("limiter-file", spotify.DefaultLimiterFile, "prefix of the files where each credential's rate limiter state is persisted")
+	credentialsFile := subcmd.String("credentials", "", credentialsHelp)
+	windows := subcmd.String("windows", "1h,24h,168h", "comma-separated windows over which to measure each stage's rate")
+	asJSON := subcmd.Bool("json", false, "print the report as json")
+	history := subcmd.Bool("history", false, "print the snapshots of the crawl's progress recorded by the fetcher's reporter, instead of the report")
+	since := subcmd.Duration("since", 7*24*time.Hour, "with -history, how far back to print snapshots")
+	every := subcmd.Duration("every", time.Hour, "with -history, how far apart to print snapshots")
+	importFile := subcmd.String("import", "", "import the snapshots in a log.tsv file written by an older fetcher, then exit")
 	if err := subcmd.Parse(args); err != nil {
 		return fmt.Errorf("flag parsing err: %w", err)
 	}
 
-	genresKnown, err := db.CountGenresKnown()
-	if err != nil {
-		return err
+	if *importFile != "" {
+		return importLog(db, *importFile)
 	}
-	genresFetchedArtists, err := db.CountGenresWithFetchedArtists()
-	if err != nil {
-		return err
+	if *history {
+		return printHistory(db, time.Now().Add(-*since), *every, *asJSON)
 	}
 
-	artistsKnown, err := db.CountArtistsKnown()
-	if err != nil {
-		return err
+	var durations []time.Duration
+	for _, w := range strings.Split(*windows, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(w))
+		if err != nil {
+			return fmt.Errorf("invalid window '%s': %w", w, err)
+		}
+		durations = append(durations, d)
 	}
-	artistsFetchedAlbums, err := db.CountArtistsWithFetchedAlbums()
+
+	now := time.Now()
+	sections, current, err := countProgress(db)
 	if err != nil {
 		return err
 	}
-	artistsFetchedTracks, err := db.CountArtistsWithFetchedTracks()
+	current.TakenAt = now
+
+	snapshots, err := db.GetProgressSnapshots(now.Add(-slices.Max(durations)))
 	if err != nil {
 		return err
 	}
+	snapshots = append(snapshots, current)
 
-	albumsKnown, err := db.CountAlbumsKnown()
-	if err != nil {
+	report := progressReport{
+		At:       now,
+		Sections: sections,
+	}
+
+	// Credentials are optional here, since only their usage is reported,
+	// and the rate limit is assumed to be that of one credential without
+	// them.
+	credentials, err := loadCredentials(*credentialsFile)
+	if err != nil && *credentialsFile != "" {
 		return err
+	} else if err == nil {
+		usages, err := credentialUsages(*limiterFile, credentials)
+		if err != nil {
+			return err
+		}
+		report.Credentials = usages
+	}
+	report.RequestsPerDay = limiter.DefaultConfig.DailyQuota
+	if len(report.Credentials) > 0 {
+		report.RequestsPerDay = 0
+		for _, usage := range report.Credentials {
+			report.RequestsPerDay += usage.DailyQuota
+		}
+	}
+
+	report.Forecasts = forecast.Project(snapshots, durations, report.RequestsPerDay)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
 	}
-	albumsFetchedTracks, err := db.CountAlbumsWithFetchedTracks()
+	return report.print(os.Stdout)
+}
+
+type progressReport struct {
+	At             time.Time           `json:"at"`
+	Sections       []progressSection   `json:"sections"`
+	RequestsPerDay int                 `json:"requests_per_day"`
+	Forecasts      []forecast.Forecast `json:"forecasts"`
+	Credentials    []credentialUsage   `json:"credentials,omitempty"`
+}
+
+type progressSection struct {
+	Name  string `json:"name"`
+	Known int    `json:"known"`
+	// Target is roughly how many there are on Spotify, or 0 if we
+	// don't know.
+	Target int             `json:"target,omitempty"`
+	Done   []progressCount `json:"done"`
+}
+
+type progressCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+type credentialUsage struct {
+	ClientID   string    `json:"client_id"`
+	Requests   int       `json:"requests"`
+	DailyQuota int       `json:"daily_quota"`
+	ReadyAt    time.Time `json:"ready_at"`
+}
+
+// countProgress counts what's known and done in the database, both as
+// sections to print, and as a snapshot to forecast from.
+func countProgress(db *db.DB) ([]progressSection, data.ProgressSnapshot, error) {
+	var (
+		snapshot data.ProgressSnapshot
+
+		genresKnown, genresFetchedArtists int
+	)
+	for _, count := range []struct {
+		dest *int
+		f    func() (int, error)
+	}{
+		{&genresKnown, db.CountGenresKnown},
+		{&genresFetchedArtists, db.CountGenresWithFetchedArtists},
+		{&snapshot.ArtistsKnown, db.CountArtistsKnown},
+		{&snapshot.ArtistAlbumsDone, db.CountArtistsWithFetchedAlbums},
+		{&snapshot.ArtistTracksDone, db.CountArtistsWithFetchedTracks},
+		{&snapshot.AlbumsKnown, db.CountAlbumsKnown},
+		{&snapshot.AlbumsDone, db.CountAlbumsWithFetchedTracks},
+		{&snapshot.TracksKnown, db.CountTracksKnown},
+		{&snapshot.TracksIndexed, db.CountTracksIndexed},
+		{&snapshot.TracksDone, db.CountTracksWithFetchedAnalysis},
+	} {
+		n, err := count.f()
+		if err != nil {
+			return nil, data.ProgressSnapshot{}, err
+		}
+		*count.dest = n
+	}
+
+	sections := []progressSection{
+		{"genres", genresKnown, 6_291, []progressCount{
+			{"fetched artists", genresFetchedArtists},
+		}},
+		{"artists", snapshot.ArtistsKnown, 11_000_000, []progressCount{
+			{"fetched top tracks", snapshot.ArtistTracksDone},
+			{"fetched albums", snapshot.ArtistAlbumsDone},
+		}},
+		{"albums", snapshot.AlbumsKnown, 0, []progressCount{
+			{"fetched tracks", snapshot.AlbumsDone},
+		}},
+		{"tracks", snapshot.TracksKnown, 100_000_000, []progressCount{
+			{"indexed", snapshot.TracksIndexed},
+			{"fetched analysis", snapshot.TracksDone},
+		}},
+	}
+	return sections, snapshot, nil
+}
+
+// importLog imports the snapshots in the given log.tsv file into the
+// database.
+func importLog(db *db.DB, filename string) error {
+	f, err := os.Open(filename)
 	if err != nil {
-		return err
+		return fmt.Errorf("error opening log: %w", err)
 	}
+	defer f.Close()
 
-	tracksKnown, err := db.CountTracksKnown()
+	snapshots, err := workers.ReadLog(f)
 	if err != nil {
-		return err
+		return fmt.Errorf("error reading '%s': %w", filename, err)
 	}
-	tracksIndexed, err := db.CountTracksIndexed()
+	imported, err := db.InsertProgressSnapshots(snapshots)
 	if err != nil {
 		return err
 	}
-	tracksFetchedAnalysis, err := db.CountTracksWithFetchedAnalysis()
+	humanPrinter.Printf("imported %d of %d snapshots from %s\n", imported, len(snapshots), filename)
+	return nil
+}
+
+// A historyRow is a snapshot, as printed by -history.
+type historyRow struct {
+	TakenAt               time.Time `json:"taken_at"`
+	GenresToFetchArtists  *int64    `json:"genres_to_fetch_artists"`
+	ArtistsToFetchTracks  int       `json:"artists_to_fetch_tracks"`
+	ArtistsToFetchAlbums  int       `json:"artists_to_fetch_albums"`
+	AlbumsToFetchTracks   int       `json:"albums_to_fetch_tracks"`
+	TracksToFetchAnalysis int       `json:"tracks_to_fetch_analysis"`
+	ArtistsKnown          int       `json:"artists_known"`
+	ArtistsDone           int       `json:"artists_done"`
+	ArtistAlbumsDone      int       `json:"artist_albums_done"`
+	ArtistTracksDone      int       `json:"artist_tracks_done"`
+	AlbumsKnown           int       `json:"albums_known"`
+	AlbumsDone            int       `json:"albums_done"`
+	TracksKnown           int       `json:"tracks_known"`
+	TracksDone            int       `json:"tracks_done"`
+	TracksIndexed         int       `json:"tracks_indexed"`
+	SpotifyRequests       *int64    `json:"spotify_requests"`
+}
+
+// printHistory prints the snapshots taken since the given time, skipping any
+// taken within every of the last one printed.
+func printHistory(db *db.DB, since time.Time, every time.Duration, asJSON bool) error {
+	snapshots, err := db.GetProgressSnapshots(since)
 	if err != nil {
 		return err
 	}
 
-	printSection("genres", genresKnown, 6_291, map[string]int{
-		"fetched artists": genresFetchedArtists,
-	})
-	printSection("artists", artistsKnown, 11_000_000, map[string]int{
-		"fetched top tracks": artistsFetchedTracks,
-		"fetched albums":     artistsFetchedAlbums,
-	})
-	printSection("albums", albumsKnown, 0, map[string]int{
-		"fetched tracks": albumsFetchedTracks,
-	})
-	printSection("tracks", tracksKnown, 100_000_000, map[string]int{
-		"indexed":          tracksIndexed,
-		"fetched analysis": tracksFetchedAnalysis,
-	})
+	var rows []historyRow
+	for _, s := range snapshots {
+		if len(rows) > 0 && s.TakenAt.Sub(rows[len(rows)-1].TakenAt) < every {
+			continue
+		}
+		nullable := func(n sql.NullInt64) *int64 {
+			if !n.Valid {
+				return nil
+			}
+			return &n.Int64
+		}
+		rows = append(rows, historyRow{
+			TakenAt:               s.TakenAt.Local(),
+			GenresToFetchArtists:  nullable(s.GenresToFetchArtists),
+			ArtistsToFetchTracks:  s.ArtistsToFetchTracks,
+			ArtistsToFetchAlbums:  s.ArtistsToFetchAlbums,
+			AlbumsToFetchTracks:   s.AlbumsToFetchTracks,
+			TracksToFetchAnalysis: s.TracksToFetchAnalysis,
+			ArtistsKnown:          s.ArtistsKnown,
+			ArtistsDone:           s.ArtistsDone,
+			ArtistAlbumsDone:      s.ArtistAlbumsDone,
+			ArtistTracksDone:      s.ArtistTracksDone,
+			AlbumsKnown:           s.AlbumsKnown,
+			AlbumsDone:            s.AlbumsDone,
+			TracksKnown:           s.TracksKnown,
+			TracksDone:            s.TracksDone,
+			TracksIndexed:         s.TracksIndexed,
+			SpotifyRequests:       nullable(s.SpotifyRequests),
+		})
+	}
 
-	return nil
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if rows == nil {
+			rows = []historyRow{}
+		}
+		return enc.Encode(rows)
+	}
+
+	if len(rows) == 0 {
+		humanPrinter.Printf("no snapshots since %s\n", since.Format(time.DateTime))
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "TAKEN AT\tARTISTS\tALBUMS FETCHED\tTOP TRACKS FETCHED\tALBUMS\tTRACKS FETCHED\tTRACKS\tANALYZED\tINDEXED\tREQUESTS (24H)\t\n")
+	for _, row := range rows {
+		requests := "-"
+		if row.SpotifyRequests != nil {
+			requests = humanPrinter.Sprintf("%d", *row.SpotifyRequests)
+		}
+		humanPrinter.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t\n",
+			row.TakenAt.Format("2006-01-02 15:04"),
+			row.ArtistsKnown, row.ArtistAlbumsDone, row.ArtistTracksDone,
+			row.AlbumsKnown, row.AlbumsDone,
+			row.TracksKnown, row.TracksDone, row.TracksIndexed,
+			requests)
+	}
+	return tw.Flush()
 }
 
-var humanPrinter = message.NewPrinter(language.English)
+func credentialUsages(limiterFile string, credentials []spotify.Credential) ([]credentialUsage, error) {
+	var usages []credentialUsage
+	for _, cred := range credentials {
+		lim := limiter.New(spotify.LimiterFile(limiterFile, cred.ClientID), limiter.DefaultConfig)
+		usage, err := lim.Usage()
+		if err != nil {
+			return nil, fmt.Errorf("error reading usage of '%s': %w", cred.ClientID, err)
+		}
+		usages = append(usages, credentialUsage{
+			ClientID:   cred.ClientID,
+			Requests:   usage.Requests,
+			DailyQuota: usage.DailyQuota,
+			ReadyAt:    usage.ReadyAt,
+		})
+	}
+	return usages, nil
+}
+
+func (report progressReport) print(w io.Writer) error {
+	for _, section := range report.Sections {
+		humanPrinter.Fprintf(w, "%s\n", strings.ToUpper(section.Name))
+		if section.Target != 0 {
+			humanPrinter.Fprintf(w, "  %d\tknown (%.2f%%)\n", section.Known, 100.0*float64(section.Known)/float64(section.Target))
+		} else {
+			humanPrinter.Fprintf(w, "  %d\tknown\n", section.Known)
+		}
+		for _, done := range section.Done {
+			humanPrinter.Fprintf(w, "  %d\t%s (%.2f%%)\n", done.Count, done.Name, 100.0*float64(done.Count)/float64(section.Known))
+		}
+		humanPrinter.Fprintf(w, "\n")
+	}
+
+	humanPrinter.Fprintf(w, "FORECAST (with at most %d requests per day)\n", report.RequestsPerDay)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, f := range report.Forecasts {
+		humanPrinter.Fprintf(tw, "  %s\t%d of %d %s left\n", f.Stage, f.Remaining, f.Known, f.Unit)
+		for _, rate := range f.Rates {
+			humanPrinter.Fprintf(tw, "    over %s\t%.1f/h\t%s\n", rate.Window, rate.PerHour, formatDoneAt(report.At, rate))
+		}
+		if f.Limit != nil {
+			humanPrinter.Fprintf(tw, "    at the rate limit\t%.1f/h\t%s\n", f.Limit.PerHour, formatDoneAt(report.At, *f.Limit))
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	humanPrinter.Fprintf(w, "\n")
 
-func printSection(name string, known, target int, done map[string]int) {
-	humanPrinter.Printf("%s\n", strings.ToUpper(name))
-	if target != 0 {
-		humanPrinter.Printf("  %d\tknown (%.2f%%)\n", known, 100.0*float64(known)/float64(target))
-	} else {
-		humanPrinter.Printf("  %d\tknown\n", known)
+	if len(report.Credentials) > 0 {
+		humanPrinter.Fprintf(w, "CREDENTIALS\n")
+		for _, usage := range report.Credentials {
+			ready := "ready now"
+			if wait := usage.ReadyAt.Sub(report.At); wait > time.Second {
+				ready = fmt.Sprintf("ready in %s", wait.Truncate(time.Second))
+			}
+			humanPrinter.Fprintf(w, "  %d\tof %d requests in the last 24h by %s (%s)\n", usage.Requests, usage.DailyQuota, usage.ClientID, ready)
+		}
+		humanPrinter.Fprintf(w, "\n")
 	}
-	for k, v := range done {
-		humanPrinter.Printf("  %d\t%s (%.2f%%)\n", v, k, 100.0*float64(v)/float64(known))
+	return nil
+}
+
+func formatDoneAt(now time.Time, rate forecast.Rate) string {
+	switch {
+	case rate.Window != "" && rate.Samples < 2:
+		return "too little history"
+	case rate.DoneAt == nil && rate.PerHour > 0:
+		return "done in centuries"
+	case rate.DoneAt == nil:
+		return "not progressing"
+	case !rate.DoneAt.After(now):
+		return "done"
 	}
-	humanPrinter.Printf("\n")
+	until := rate.DoneAt.Sub(now)
+	if until >= 48*time.Hour {
+		return fmt.Sprintf("done %s (in %d days)", rate.DoneAt.Format(time.DateOnly), int(until.Hours()/24))
+	}
+	return fmt.Sprintf("done %s (in %s)", rate.DoneAt.Format(time.DateTime), until.Truncate(time.Minute))
 }
+
+var humanPrinter = message.NewPrinter(language.English)
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/amonks/genres/db"
+	"github.com/amonks/genres/spotify"
+	"github.com/amonks/genres/subcmd"
+	"github.com/amonks/genres/workers"
+)
+
+func replay(ctx context.Context, db *db.DB, args []string) error {
+	subcmd := subcmd.New("replay", "rebuild the database from cached spotify responses, without any requests to spotify\nintended for a fresh -dbfile\nresponses cached before their URLs were recorded are found by the ids already in the database,\nexcept albums' tracks and tracks' analyses, which were fetched in batches and can't be found")
+	cacheKind := subcmd.String("cache", "dir", "how responses were cached; valid options are {dir, sqlite}")
+	cacheDir := subcmd.String("cache-dir", spotify.DefaultCacheDir, "directory of cached responses; with -cache sqlite, holds cache.db")
+	enao := subcmd.Bool("enao", true, "fetch genres from everynoise.com first, as the genres worker does")
+	if err := subcmd.Parse(args); err != nil {
+		return fmt.Errorf("flag parsing err: %w", err)
+	}
+	if *cacheKind == "none" {
+		return fmt.Errorf("can't replay without a cache")
+	}
+
+	cache, closeCache, err := openCache(*cacheKind, *cacheDir)
+	if err != nil {
+		return err
+	}
+	defer closeCache()
+
+	spo, err := spotify.New(nil, spotify.WithCache(cache), spotify.WithCacheOnly())
+	if err != nil {
+		return fmt.Errorf("error creating spotify client: %w", err)
+	}
+	defer spo.Close()
+
+	return workers.Replay(ctx, db, spo, cache, *enao)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/amonks/genres/db"
+)
+
+const seedsHelp = `file of seed artists and playlists, one per line, as a spotify:artist: or spotify:playlist: URI, or an open.spotify.com/artist/ or /playlist/ link
+bare spotify IDs are artists; blank lines and lines starting with # are ignored`
+
+// listFlag holds each value of a flag which may be given more than once.
+type listFlag []string
+
+func (lf *listFlag) String() string { return strings.Join(*lf, ", ") }
+
+func (lf *listFlag) Set(value string) error {
+	*lf = append(*lf, value)
+	return nil
+}
+
+// loadScope returns the scope with the given seed genres, artists and
+// playlists, and the artists and playlists in the given seeds file, if any. It
+// returns nil if there are no seeds at all, so that the whole catalogue is
+// crawled.
+func loadScope(genres, artists, playlists []string, seedsFile string) (*db.Scope, error) {
+	var scope db.Scope
+	scope.Genres = append(scope.Genres, genres...)
+	for _, artist := range artists {
+		id, err := parseSeedID("artist", artist)
+		if err != nil {
+			return nil, err
+		}
+		scope.Artists = append(scope.Artists, id)
+	}
+	for _, playlist := range playlists {
+		id, err := parseSeedID("playlist", playlist)
+		if err != nil {
+			return nil, err
+		}
+		scope.Playlists = append(scope.Playlists, id)
+	}
+	if seedsFile != "" {
+		if err := readSeedsFile(&scope, seedsFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(scope.Genres) == 0 && len(scope.Artists) == 0 && len(scope.Playlists) == 0 {
+		return nil, nil
+	}
+	return &scope, nil
+}
+
+// readSeedsFile adds the artists and playlists in the given seeds file to the
+// scope.
+func readSeedsFile(scope *db.Scope, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("error opening seeds file: %w", err)
+	}
+	defer f.Close()
+
+	var n int
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		kind, id, err := parseSeed(text)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", filename, line, err)
+		}
+		switch kind {
+		case "artist":
+			scope.Artists = append(scope.Artists, id)
+		case "playlist":
+			scope.Playlists = append(scope.Playlists, id)
+		}
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading seeds file: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("no seeds in '%s'", filename)
+	}
+	return nil
+}
+
+// parseSeedID returns the spotify ID of a seed of the given kind, given as an
+// ID, a URI, or a link.
+func parseSeedID(kind, seed string) (string, error) {
+	if !strings.Contains(seed, ":") && !strings.Contains(seed, "/") {
+		return seed, nil
+	}
+	got, id, err := parseSeed(seed)
+	if err != nil {
+		return "", err
+	}
+	if got != kind {
+		return "", fmt.Errorf("invalid seed '%s': expected a spotify %s ID or link", seed, kind)
+	}
+	return id, nil
+}
+
+// parseSeed returns the kind and spotify ID of a seed given as a spotify:
+// URI, an open.spotify.com link, or an ID, which is taken to be an artist's.
+// Only artists and playlists can be seeds.
+func parseSeed(seed string) (string, string, error) {
+	kind, id := "artist", seed
+	if rest, ok := strings.CutPrefix(seed, "spotify:"); ok {
+		kind, id, _ = strings.Cut(rest, ":")
+	} else if u, err := url.Parse(seed); err == nil && u.Host == "open.spotify.com" {
+		kind, id, _ = strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	}
+	if kind != "artist" && kind != "playlist" {
+		return "", "", fmt.Errorf("invalid seed '%s': only artists and playlists can be seeds, not %ss", seed, kind)
+	}
+	if id == "" || strings.ContainsAny(id, ":/?") {
+		return "", "", fmt.Errorf("invalid seed '%s': expected a spotify %s ID", seed, kind)
+	}
+	return kind, id, nil
+}
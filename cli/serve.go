@@ -12,12 +12,17 @@ import (
 func serve(ctx context.Context, db *db.DB, args []string) error {
 	subcmd := subcmd.New("serve", "run a web server")
 	var (
-		port = subcmd.Int("port", 9999, "http port")
+		port    = subcmd.Int("port", 9999, "http port")
+		metrics = subcmd.Bool("metrics", false, "serve prometheus metrics at /metrics")
 	)
 	if err := subcmd.Parse(args); err != nil {
 		return fmt.Errorf("flag parsing err: %w", err)
 	}
 
-	addr := fmt.Sprintf(":%d", port)
-	return server.Run(ctx, db, addr)
+	addr := fmt.Sprintf(":%d", *port)
+	var options []server.Option
+	if *metrics {
+		options = append(options, server.WithMetrics())
+	}
+	return server.Run(ctx, db, addr, options...)
 }
@@ -13,8 +13,10 @@ type Artist struct {
 
 	FetchedTracksAt      sql.NullTime
 	FetchedAlbumsAt      sql.NullTime
+	FetchedRelatedAt     sql.NullTime
 	FailedTracksAt       sql.NullTime
 	FailedAlbumsAt       sql.NullTime
+	FailedRelatedAt      sql.NullTime
 	IndexedGenresRtreeAt sql.NullTime
 	IndexedTracksRtreeAt sql.NullTime
 }
@@ -0,0 +1,10 @@
+package data
+
+// An ArtistRelation is an edge of the artist graph: an artist which Spotify
+// considers related to another. Relations aren't symmetric.
+type ArtistRelation struct {
+	ArtistSpotifyID        string
+	RelatedArtistSpotifyID string
+	// Rank orders an artist's relations, from 1, the most related.
+	Rank int
+}
@@ -27,3 +27,25 @@ type Genre struct {
 	FetchedArtistsAt sql.NullTime
 	FailedArtistsAt  sql.NullTime
 }
+
+// GenreBounds is a box within the 5-dimensional space that ENAO places genres
+// in. Each dimension is in the range [0, 1].
+type GenreBounds struct {
+	MinEnergy, MaxEnergy                     float64
+	MinDynamicVariation, MaxDynamicVariation float64
+	MinInstrumentalness, MaxInstrumentalness float64
+	MinOrganicness, MaxOrganicness           float64
+	MinBounciness, MaxBounciness             float64
+}
+
+// AllGenres returns GenreBounds covering the entire genre space. It's a
+// convenient starting point for a query that only constrains some dimensions.
+func AllGenres() GenreBounds {
+	return GenreBounds{
+		MinEnergy: 0, MaxEnergy: 1,
+		MinDynamicVariation: 0, MaxDynamicVariation: 1,
+		MinInstrumentalness: 0, MaxInstrumentalness: 1,
+		MinOrganicness: 0, MaxOrganicness: 1,
+		MinBounciness: 0, MaxBounciness: 1,
+	}
+}
@@ -0,0 +1,29 @@
+package data
+
+import "database/sql"
+
+// Playlists are fetched from Spotify. They're curated groupings of tracks.
+type Playlist struct {
+	SpotifyID      string
+	Name           string
+	Description    string
+	OwnerSpotifyID string
+	Followers      int64
+	SnapshotID     string
+
+	Tracks []PlaylistTrack `gorm:"-"`
+
+	FetchedTracksAt sql.NullTime
+	FailedTracksAt  sql.NullTime
+}
+
+// A PlaylistTrack is a track at a position in a playlist.
+type PlaylistTrack struct {
+	PlaylistSpotifyID string
+	// Position is the track's index in the playlist, from 0.
+	Position       int
+	TrackSpotifyID string
+	AddedAt        sql.NullTime
+
+	Track Track `gorm:"-"`
+}
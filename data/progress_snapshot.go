@@ -0,0 +1,29 @@
+package data
+
+import (
+	"database/sql"
+	"time"
+)
+
+// A ProgressSnapshot counts the crawl's progress at some moment.
+type ProgressSnapshot struct {
+	TakenAt time.Time
+
+	// The counts of rows which a worker has yet to try. GenresToFetchArtists
+	// isn't known for snapshots imported from log.tsv.
+	GenresToFetchArtists  sql.NullInt64
+	ArtistsToFetchTracks  int
+	ArtistsToFetchAlbums  int
+	AlbumsToFetchTracks   int
+	TracksToFetchAnalysis int
+
+	ArtistsKnown, ArtistsDone              int
+	ArtistAlbumsDone, ArtistTracksDone     int
+	AlbumsKnown, AlbumsDone                int
+	TracksKnown, TracksDone, TracksIndexed int
+
+	// SpotifyRequests counts the requests made by the fetcher's
+	// credentials in the 24 hours before the snapshot. It isn't known for
+	// snapshots imported from log.tsv.
+	SpotifyRequests sql.NullInt64
+}
@@ -34,6 +34,17 @@ type Track struct {
 	Valence          float64
 }
 
+// Features lists the audio features that make up a track's Vector.
+var Features = []string{
+	"acousticness",
+	"danceability",
+	"energy",
+	"instrumentalness",
+	"liveness",
+	"speechiness",
+	"valence",
+}
+
 func (t *Track) Vector() Vector {
 	if !t.FetchedAnalysisAt.Valid {
 		return Vector{}
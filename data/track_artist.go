@@ -11,9 +11,5 @@ type TrackArtist struct {
 type ArtistTracksRtree struct {
 	ID int64
 
-	MinEnergy, MaxEnergy                     int64
-	MinDynamicVariation, MaxDynamicVariation int64
-	MinInstrumentalness, MaxInstrumentalness int64
-	MinOrganicness, MaxOrganicness           int64
-	MinBounciness, MaxBounciness             int64
+	GenreBounds
 }
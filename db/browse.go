@@ -0,0 +1,187 @@
+//go:build sqlite_math_functions && fts5
+
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/amonks/genres/data"
+)
+
+// GetAlbum returns the album with the given spotify ID, along with its
+// artists, genres, and tracks. The tracks come with their artists, and the
+// artists with their genres.
+func (db *DB) GetAlbum(ctx context.Context, id string) (*data.Album, error) {
+	var album data.Album
+	if err := db.ro.
+		WithContext(ctx).
+		Table("albums").
+		Where("spotify_id = ?", id).
+		First(&album).
+		Error; err != nil {
+		return nil, fmt.Errorf("error getting album '%s': %w", id, err)
+	}
+
+	var artistIDs []string
+	if err := db.ro.
+		WithContext(ctx).
+		Table("album_artists").
+		Joins("join artists on artists.spotify_id = album_artists.artist_spotify_id").
+		Where("album_artists.album_spotify_id = ?", id).
+		Order("album_artists.rowid asc").
+		Pluck("album_artists.artist_spotify_id", &artistIDs).
+		Error; err != nil {
+		return nil, fmt.Errorf("error getting artists for album '%s': %w", id, err)
+	}
+	artists, err := db.GetArtists(ctx, artistIDs)
+	if err != nil {
+		return nil, fmt.Errorf("error getting artists for album '%s': %w", id, err)
+	}
+	album.Artists = artists
+
+	if err := db.ro.
+		WithContext(ctx).
+		Table("album_genres").
+		Where("album_spotify_id = ?", id).
+		Pluck("genre_name", &album.Genres).
+		Error; err != nil {
+		return nil, fmt.Errorf("error getting genres for album '%s': %w", id, err)
+	}
+
+	var trackIDs []string
+	if err := db.ro.
+		WithContext(ctx).
+		Table("tracks").
+		Joins("join album_tracks on album_tracks.track_spotify_id = tracks.spotify_id").
+		Where("album_tracks.album_spotify_id = ?", id).
+		Order("tracks.disc_number asc, tracks.track_number asc").
+		Pluck("tracks.spotify_id", &trackIDs).
+		Error; err != nil {
+		return nil, fmt.Errorf("error getting tracks for album '%s': %w", id, err)
+	}
+	tracks, err := db.GetTracks(ctx, trackIDs)
+	if err != nil {
+		return nil, fmt.Errorf("error getting tracks for album '%s': %w", id, err)
+	}
+	album.Tracks = tracks
+
+	return &album, nil
+}
+
+// GetArtistAlbums returns the albums credited to the given artist, most recent
+// first.
+func (db *DB) GetArtistAlbums(ctx context.Context, id string) ([]data.Album, error) {
+	var albums []data.Album
+	if err := db.ro.
+		WithContext(ctx).
+		Table("albums").
+		Select("albums.*").
+		Joins("join album_artists on album_artists.album_spotify_id = albums.spotify_id").
+		Where("album_artists.artist_spotify_id = ?", id).
+		Order("albums.release_date desc").
+		Find(&albums).
+		Error; err != nil {
+		return nil, fmt.Errorf("error getting albums for artist '%s': %w", id, err)
+	}
+	return albums, nil
+}
+
+// GetArtistTracks returns up to limit of the given artist's tracks, most
+// popular first, along with their artists.
+func (db *DB) GetArtistTracks(ctx context.Context, id string, limit int) ([]data.Track, error) {
+	var ids []string
+	if err := db.ro.
+		WithContext(ctx).
+		Table("tracks").
+		Joins("join track_artists on track_artists.track_spotify_id = tracks.spotify_id").
+		Where("track_artists.artist_spotify_id = ?", id).
+		Order("tracks.popularity desc").
+		Limit(limit).
+		Pluck("tracks.spotify_id", &ids).
+		Error; err != nil {
+		return nil, fmt.Errorf("error getting tracks for artist '%s': %w", id, err)
+	}
+	tracks, err := db.GetTracks(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("error getting tracks for artist '%s': %w", id, err)
+	}
+	return tracks, nil
+}
+
+// GetGenre returns the genre with the given name.
+func (db *DB) GetGenre(ctx context.Context, name string) (*data.Genre, error) {
+	var genre data.Genre
+	if err := db.ro.
+		WithContext(ctx).
+		Table("genres").
+		Where("name = ?", name).
+		First(&genre).
+		Error; err != nil {
+		return nil, fmt.Errorf("error getting genre '%s': %w", name, err)
+	}
+	return &genre, nil
+}
+
+// GetGenreArtists returns up to limit of the artists tagged with the given
+// genre, most popular first, along with their genres.
+func (db *DB) GetGenreArtists(ctx context.Context, name string, limit int) ([]data.Artist, error) {
+	var ids []string
+	if err := db.ro.
+		WithContext(ctx).
+		Table("artists").
+		Joins("join artist_genres on artist_genres.artist_spotify_id = artists.spotify_id").
+		Where("artist_genres.genre_name = ?", name).
+		Order("artists.popularity desc").
+		Limit(limit).
+		Pluck("artists.spotify_id", &ids).
+		Error; err != nil {
+		return nil, fmt.Errorf("error getting artists for genre '%s': %w", name, err)
+	}
+	artists, err := db.GetArtists(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("error getting artists for genre '%s': %w", name, err)
+	}
+	return artists, nil
+}
+
+// GetMappedGenres returns every genre which has a position on the ENAO map,
+// that is, every genre which was scraped from everynoise.com rather than
+// discovered on an artist or album.
+func (db *DB) GetMappedGenres(ctx context.Context) ([]data.Genre, error) {
+	var genres []data.Genre
+	if err := db.ro.
+		WithContext(ctx).
+		Table("genres").
+		Where(mappedGenre).
+		Order("popularity asc").
+		Find(&genres).
+		Error; err != nil {
+		return nil, fmt.Errorf("error getting mapped genres: %w", err)
+	}
+	return genres, nil
+}
+
+// GetGenreTracks returns up to limit of the tracks by artists tagged with the
+// given genre, most popular first, along with their artists.
+func (db *DB) GetGenreTracks(ctx context.Context, name string, limit int) ([]data.Track, error) {
+	var ids []string
+	if err := db.ro.
+		WithContext(ctx).
+		Table("tracks").
+		Joins("join track_artists on track_artists.track_spotify_id = tracks.spotify_id").
+		Joins("join artist_genres on artist_genres.artist_spotify_id = track_artists.artist_spotify_id").
+		Where("artist_genres.genre_name = ?", name).
+		Group("tracks.spotify_id").
+		Order("tracks.popularity desc").
+		Limit(limit).
+		Pluck("tracks.spotify_id", &ids).
+		Error; err != nil {
+		return nil, fmt.Errorf("error getting tracks for genre '%s': %w", name, err)
+	}
+	tracks, err := db.GetTracks(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("error getting tracks for genre '%s': %w", name, err)
+	}
+	return tracks, nil
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	_ "embed"
 	"fmt"
 	"log"
@@ -8,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/amonks/genres/metrics"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -15,43 +17,100 @@ import (
 
 // DB represents our sqlite3 database file.
 type DB struct {
+	filename string
+
 	rw *gorm.DB
 	ro *gorm.DB
 
 	wmu sync.Mutex
+
+	knn knnIndex
 }
 
+var writeLockWait = metrics.NewHistogram("genres_db_write_lock_wait_seconds",
+	"Time spent waiting for the database's write lock.",
+	metrics.DefaultBuckets)
+
 func (db *DB) hold() func() {
+	start := time.Now()
 	db.wmu.Lock()
+	writeLockWait.ObserveSince(start)
 	return func() { db.wmu.Unlock() }
 }
 
 //go:embed schema.sql
 var schema string
 
-// Open returns a connection to a migrated sqlite3 database file on disk,
-// creating the file and running migrations if necessary.
+// Open returns a connection to a migrated sqlite3 database file on disk. If the
+// file doesn't exist, Open creates it and applies every migration; if it does,
+// and it has pending migrations, Open returns ErrPendingMigrations.
 func Open(filename string) (*DB, error) {
-	rodb, err := openDB(filename, false)
+	db, fresh, err := open(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	rwdb, err := openDB(filename, true)
+	if fresh {
+		if _, err := db.Migrate(context.Background()); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error migrating db at '%s': %w", filename, err)
+		}
+		return db, nil
+	}
+
+	pending, err := db.PendingMigrations(context.Background())
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
+	if len(pending) > 0 {
+		db.Close()
+		return nil, fmt.Errorf("%d migrations to apply to db at '%s': %w", len(pending), filename, ErrPendingMigrations)
+	}
+
+	return db, nil
+}
+
+// OpenUnmigrated returns a connection to a sqlite3 database file on disk,
+// creating the file if necessary, without applying any migrations, so that
+// they can be applied with Migrate.
+func OpenUnmigrated(filename string) (*DB, error) {
+	db, _, err := open(filename)
+	return db, err
+}
+
+// open connects to the database file, and applies the baseline schema. It
+// reports whether the database was empty beforehand.
+func open(filename string) (*DB, bool, error) {
+	rodb, err := openDB(filename, false)
+	if err != nil {
+		return nil, false, err
+	}
+
+	rwdb, err := openDB(filename, true)
+	if err != nil {
+		return nil, false, err
+	}
 
 	db := &DB{
+		filename: filename,
+
 		ro: rodb,
 		rw: rwdb,
 	}
 
+	var tables int64
+	if err := db.rw.Raw("select count(*) from sqlite_master").Scan(&tables).Error; err != nil {
+		db.Close()
+		return nil, false, fmt.Errorf("error reading db at '%s': %w", filename, err)
+	}
+
 	if err := db.rw.Exec(schema).Error; err != nil {
-		return nil, fmt.Errorf("error migrating db at '%s': %w", filename, err)
+		db.Close()
+		return nil, false, fmt.Errorf("error creating schema in db at '%s': %w", filename, err)
 	}
 
-	return db, nil
+	return db, tables == 0, nil
 }
 
 func openDB(filename string, rw bool) (*gorm.DB, error) {
@@ -0,0 +1,270 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// MaxFailures is how many times a row may fail at a stage before
+	// it's dead, and only retried if it's requeued.
+	MaxFailures = 5
+
+	// FailureBackoff is how long after its first failure a row is
+	// retried. The wait doubles with each failure after that.
+	FailureBackoff = time.Hour
+)
+
+// A Stage is a step of the crawl which fetches something for each row of a
+// table, and which can fail for a row.
+type Stage struct {
+	// Name is the name of the worker which runs the stage, like
+	// "artist_tracks".
+	Name string
+
+	table, key string
+	// column names the stage's columns: the fetched_<column>_at,
+	// failed_<column>_at, <column>_failures, <column>_error, and
+	// retry_<column>_at columns of the table.
+	column string
+}
+
+var (
+	StageGenreArtists   = Stage{"genre_artists", "genres", "name", "artists"}
+	StageArtistAlbums   = Stage{"artist_albums", "artists", "spotify_id", "albums"}
+	StageArtistTracks   = Stage{"artist_tracks", "artists", "spotify_id", "tracks"}
+	StageAlbumTracks    = Stage{"album_tracks", "albums", "spotify_id", "tracks"}
+	StageTrackAnalyses  = Stage{"track_analysis", "tracks", "spotify_id", "analysis"}
+	StageRelatedArtists = Stage{"related_artists", "artists", "spotify_id", "related"}
+	StagePlaylistTracks = Stage{"playlists", "playlists", "spotify_id", "tracks"}
+)
+
+// Stages are the stages which can fail, in the order of the crawl.
+var Stages = []Stage{StageGenreArtists, StageArtistAlbums, StageArtistTracks, StageAlbumTracks, StageTrackAnalyses, StageRelatedArtists, StagePlaylistTracks}
+
+var ErrUnknownStage = errors.New("unknown stage")
+
+// LookupStage returns the stage with the given name.
+func LookupStage(name string) (Stage, error) {
+	for _, stage := range Stages {
+		if stage.Name == name {
+			return stage, nil
+		}
+	}
+	return Stage{}, fmt.Errorf("'%s': %w", name, ErrUnknownStage)
+}
+
+func (s Stage) fetchedColumn() string  { return "fetched_" + s.column + "_at" }
+func (s Stage) failedColumn() string   { return "failed_" + s.column + "_at" }
+func (s Stage) failuresColumn() string { return s.column + "_failures" }
+func (s Stage) errorColumn() string    { return s.column + "_error" }
+func (s Stage) retryColumn() string    { return "retry_" + s.column + "_at" }
+
+// done is a condition matching the rows the stage is done with: those it has
+// fetched, and those it has given up on after MaxFailures failures.
+func (s Stage) done() string {
+	return fmt.Sprintf("(%s is not null or (%s is not null and %s >= %d))",
+		s.fetchedColumn(), s.failedColumn(), s.failuresColumn(), MaxFailures)
+}
+
+// failureColumns selects the stage's columns as the fields of a Failure.
+func (s Stage) failureColumns() []string {
+	return []string{
+		s.key + " as key",
+		s.failuresColumn() + " as failures",
+		"coalesce(" + s.errorColumn() + ", '') as last_error",
+		s.failedColumn() + " as failed_at",
+		s.retryColumn() + " as retry_at",
+	}
+}
+
+// retryAfter returns how long to wait before retrying a row which has failed
+// the given number of times, and whether it should be retried at all.
+func retryAfter(failures int) (time.Duration, bool) {
+	if failures >= MaxFailures {
+		return 0, false
+	}
+	return FailureBackoff << (failures - 1), true
+}
+
+// markFailed records that the stage failed for the rows with the given keys,
+// and schedules them to be retried, unless they've failed too many times.
+func (db *DB) markFailed(stage Stage, keys []string, cause error) error {
+	defer db.hold()()
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	return db.rw.Transaction(func(tx *gorm.DB) error {
+		var rows []struct {
+			Key      string
+			Failures int
+		}
+		if err := tx.
+			Table(stage.table).
+			Select(stage.key+" as key", stage.failuresColumn()+" as failures").
+			Where(stage.key+" in ?", keys).
+			Find(&rows).
+			Error; err != nil {
+			return fmt.Errorf("error getting failures of %d %s: %w", len(keys), stage.table, err)
+		}
+
+		for _, row := range rows {
+			failures := row.Failures + 1
+			// Retry times are compared as text, so they're always
+			// stored in UTC.
+			var retryAt sql.NullTime
+			if wait, ok := retryAfter(failures); ok {
+				retryAt = sql.NullTime{Time: now.Add(wait).UTC(), Valid: true}
+			}
+			if err := tx.
+				Table(stage.table).
+				Where(stage.key+" = ?", row.Key).
+				Updates(map[string]any{
+					stage.failedColumn():   sql.NullTime{Time: now, Valid: true},
+					stage.failuresColumn(): failures,
+					stage.errorColumn():    cause.Error(),
+					stage.retryColumn():    retryAt,
+				}).
+				Error; err != nil {
+				return fmt.Errorf("error marking %s '%s' as failed: %w", stage.Name, row.Key, err)
+			}
+		}
+		return nil
+	})
+}
+
+// A Failure is a row which a stage has failed for.
+type Failure struct {
+	Stage     string
+	Key       string
+	Failures  int
+	LastError string
+	FailedAt  time.Time
+	// RetryAt is when the row will be retried. It's invalid if the row
+	// is dead.
+	RetryAt sql.NullTime
+}
+
+// Dead reports whether the row won't be retried unless it's requeued.
+func (f Failure) Dead() bool { return !f.RetryAt.Valid }
+
+// ListFailures returns up to limit of the rows which the stage has failed for,
+// and hasn't since fetched, most recent first. If dead is true, only dead rows
+// are listed.
+func (db *DB) ListFailures(stage Stage, dead bool, limit int) ([]Failure, error) {
+	query := db.ro.
+		Table(stage.table).
+		Select(stage.failureColumns()).
+		Where(stage.failedColumn() + " is not null").
+		Where(stage.fetchedColumn() + " is null").
+		Order(stage.failedColumn() + " desc").
+		Limit(limit)
+	if dead {
+		query = query.Where(stage.retryColumn() + " is null")
+	}
+
+	var failures []Failure
+	if err := query.Find(&failures).Error; err != nil {
+		return nil, fmt.Errorf("error listing %s failures: %w", stage.Name, err)
+	}
+	for i := range failures {
+		failures[i].Stage = stage.Name
+	}
+	return failures, nil
+}
+
+// GetFailure returns the failure of the stage for the row with the given key.
+func (db *DB) GetFailure(stage Stage, key string) (Failure, error) {
+	var failures []Failure
+	if err := db.ro.
+		Table(stage.table).
+		Select(stage.failureColumns()).
+		Where(stage.key+" = ?", key).
+		Where(stage.failedColumn() + " is not null").
+		Find(&failures).
+		Error; err != nil {
+		return Failure{}, fmt.Errorf("error getting %s failure for '%s': %w", stage.Name, key, err)
+	}
+	if len(failures) == 0 {
+		return Failure{}, fmt.Errorf("no %s failure for '%s': %w", stage.Name, key, gorm.ErrRecordNotFound)
+	}
+	failures[0].Stage = stage.Name
+	return failures[0], nil
+}
+
+// A FailureCount counts the rows a stage has failed for.
+type FailureCount struct {
+	Stage string
+	// Retrying counts the rows which are scheduled to be retried.
+	Retrying int
+	// Dead counts the rows which won't be retried unless they're
+	// requeued.
+	Dead int
+}
+
+// CountFailures counts the rows which the stage has failed for, and hasn't
+// since fetched.
+func (db *DB) CountFailures(stage Stage) (FailureCount, error) {
+	var count FailureCount
+	if err := db.ro.
+		Table(stage.table).
+		Select("count("+stage.retryColumn()+") as retrying", "count(*) - count("+stage.retryColumn()+") as dead").
+		Where(stage.failedColumn() + " is not null").
+		Where(stage.fetchedColumn() + " is null").
+		Scan(&count).
+		Error; err != nil {
+		return FailureCount{}, fmt.Errorf("error counting %s failures: %w", stage.Name, err)
+	}
+	count.Stage = stage.Name
+	return count, nil
+}
+
+// Requeue forgets the failures of the stage for the rows with the given keys,
+// so that they're fetched again as if they'd never been tried, and returns how
+// many rows were requeued.
+func (db *DB) Requeue(stage Stage, keys []string) (int, error) {
+	defer db.hold()()
+
+	result := db.rw.
+		Table(stage.table).
+		Where(stage.key+" in ?", keys).
+		Where(stage.failedColumn() + " is not null").
+		Updates(requeued(stage))
+	if result.Error != nil {
+		return 0, fmt.Errorf("error requeueing %d %s: %w", len(keys), stage.table, result.Error)
+	}
+	return int(result.RowsAffected), nil
+}
+
+// RequeueDead requeues every dead row of the stage, and returns how many
+// were requeued.
+func (db *DB) RequeueDead(stage Stage) (int, error) {
+	defer db.hold()()
+
+	result := db.rw.
+		Table(stage.table).
+		Where(stage.failedColumn() + " is not null").
+		Where(stage.fetchedColumn() + " is null").
+		Where(stage.retryColumn() + " is null").
+		Updates(requeued(stage))
+	if result.Error != nil {
+		return 0, fmt.Errorf("error requeueing dead %s: %w", stage.table, result.Error)
+	}
+	return int(result.RowsAffected), nil
+}
+
+func requeued(stage Stage) map[string]any {
+	return map[string]any{
+		stage.failedColumn():   nil,
+		stage.failuresColumn(): 0,
+		stage.errorColumn():    nil,
+		stage.retryColumn():    nil,
+	}
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amonks/genres/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestRetryAfter(t *testing.T) {
+	for failures, expected := range map[int]time.Duration{
+		1: time.Hour,
+		2: 2 * time.Hour,
+		4: 8 * time.Hour,
+	} {
+		wait, ok := retryAfter(failures)
+		assert.True(t, ok)
+		assert.Equal(t, expected, wait)
+	}
+	_, ok := retryAfter(MaxFailures)
+	assert.False(t, ok)
+}
+
+func TestFailures(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "genres.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	for _, name := range []string{"pop", "rock"} {
+		require.NoError(t, db.InsertGenre(&data.Genre{Name: name}))
+	}
+	toFetch := func() []string {
+		genres, err := db.GetGenresToFetchArtists(10, nil)
+		require.NoError(t, err)
+		return genres
+	}
+	// makeDue moves the genre's retry into the past.
+	makeDue := func(name string) {
+		require.NoError(t, db.rw.Exec("update genres set retry_artists_at = ? where name = ?", time.Now().Add(-time.Minute).UTC(), name).Error)
+	}
+	done := func() int {
+		done, err := db.CountGenresWithFetchedArtists()
+		require.NoError(t, err)
+		return done
+	}
+
+	// A failed row is retried later, not right away.
+	require.NoError(t, db.MarkGenreFailed("pop", errors.New("boom")))
+	assert.Equal(t, []string{"rock"}, toFetch())
+	failure, err := db.GetFailure(StageGenreArtists, "pop")
+	require.NoError(t, err)
+	assert.Equal(t, "genre_artists", failure.Stage)
+	assert.Equal(t, 1, failure.Failures)
+	assert.Equal(t, "boom", failure.LastError)
+	assert.False(t, failure.Dead())
+	assert.WithinDuration(t, time.Now().Add(FailureBackoff), failure.RetryAt.Time, time.Minute)
+	// It's not done while it may still be retried.
+	assert.Equal(t, 0, done())
+
+	makeDue("pop")
+	assert.ElementsMatch(t, []string{"pop", "rock"}, toFetch())
+
+	// After too many failures, it's dead.
+	for i := 1; i < MaxFailures; i++ {
+		makeDue("pop")
+		require.NoError(t, db.MarkGenreFailed("pop", errors.New("boom again")))
+	}
+	failure, err = db.GetFailure(StageGenreArtists, "pop")
+	require.NoError(t, err)
+	assert.Equal(t, MaxFailures, failure.Failures)
+	assert.Equal(t, "boom again", failure.LastError)
+	assert.True(t, failure.Dead())
+	assert.Equal(t, []string{"rock"}, toFetch())
+	assert.Equal(t, 1, done())
+
+	count, err := db.CountFailures(StageGenreArtists)
+	require.NoError(t, err)
+	assert.Equal(t, FailureCount{Stage: "genre_artists", Dead: 1}, count)
+	dead, err := db.ListFailures(StageGenreArtists, true, 10)
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	assert.Equal(t, "pop", dead[0].Key)
+
+	// Requeued rows are fetched as if they'd never been tried.
+	n, err := db.RequeueDead(StageGenreArtists)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.ElementsMatch(t, []string{"pop", "rock"}, toFetch())
+	_, err = db.GetFailure(StageGenreArtists, "pop")
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	require.NoError(t, db.MarkGenreFailed("rock", errors.New("boom")))
+	n, err = db.Requeue(StageGenreArtists, []string{"rock", "pop"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	count, err = db.CountFailures(StageGenreArtists)
+	require.NoError(t, err)
+	assert.Equal(t, FailureCount{Stage: "genre_artists"}, count)
+}
+
+func TestBatchFailures(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "genres.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.rw.Exec("insert into tracks (spotify_id, name) values ('a', 'a'), ('b', 'b'), ('c', 'c')").Error)
+	require.NoError(t, db.rw.Exec("update tracks set analysis_failures = 2 where spotify_id = 'b'").Error)
+
+	require.NoError(t, db.MarkTrackAnalysisFailed([]string{"a", "b"}, errors.New("no analysis returned")))
+	failures, err := db.ListFailures(StageTrackAnalyses, false, 10)
+	require.NoError(t, err)
+	require.Len(t, failures, 2)
+	byKey := map[string]Failure{}
+	for _, f := range failures {
+		byKey[f.Key] = f
+	}
+	assert.Equal(t, 1, byKey["a"].Failures)
+	assert.Equal(t, 3, byKey["b"].Failures)
+	assert.True(t, byKey["b"].RetryAt.Time.After(byKey["a"].RetryAt.Time))
+
+	remaining, err := db.CountTracksToFetchAnalysis()
+	require.NoError(t, err)
+	assert.Equal(t, 1, remaining)
+}
@@ -0,0 +1,199 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// A Priority orders the frontier of a stage of the crawl: the rows it has yet
+// to fetch. Unless the priority is PriorityNone, each genre the stage hasn't
+// fetched any rows of gets its most popular row fetched first, so that every
+// genre is covered early on.
+type Priority string
+
+const (
+	// PriorityNone fetches rows in no particular order. It only reads the
+	// stage's index, so it's the fastest, and the default.
+	PriorityNone Priority = "none"
+	// PriorityPopularity fetches the rows of the most popular artists
+	// first.
+	PriorityPopularity Priority = "popularity"
+	// PriorityFollowers fetches the rows of the most followed artists
+	// first.
+	PriorityFollowers Priority = "followers"
+	// PriorityCoverage fetches the rows of the genres which the stage has
+	// fetched the fewest rows of first. It counts those rows for each
+	// batch, so it's the slowest.
+	PriorityCoverage Priority = "coverage"
+)
+
+// Priorities are the priorities a stage's frontier can be ordered by.
+var Priorities = []Priority{PriorityNone, PriorityPopularity, PriorityFollowers, PriorityCoverage}
+
+var ErrUnknownPriority = errors.New("unknown priority")
+
+// ParsePriority returns the priority with the given name.
+func ParsePriority(name string) (Priority, error) {
+	for _, p := range Priorities {
+		if string(p) == name {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("'%s': %w", name, ErrUnknownPriority)
+}
+
+// A frontier describes how to order the rows a stage has yet to fetch. Its
+// SQL refers to the stage's table as t.
+type frontier struct {
+	// genres joins artist_genres, as ag, to t, through t's artists.
+	genres string
+	// artists selects the ids of t's artists.
+	artists string
+	// popularity and followers are t's artists' greatest popularity and
+	// followers.
+	popularity, followers string
+}
+
+var artistFrontier = frontier{
+	genres:     "artist_genres ag join artists t on t.spotify_id = ag.artist_spotify_id",
+	artists:    "select t.spotify_id",
+	popularity: "t.popularity",
+	followers:  "t.followers",
+}
+
+var frontiers = map[string]frontier{
+	StageArtistAlbums.Name:   artistFrontier,
+	StageArtistTracks.Name:   artistFrontier,
+	StageRelatedArtists.Name: artistFrontier,
+	StageAlbumTracks.Name: {
+		genres: "artist_genres ag" +
+			" join album_artists x on x.artist_spotify_id = ag.artist_spotify_id" +
+			" join albums t on t.spotify_id = x.album_spotify_id",
+		artists:    "select artist_spotify_id from album_artists where album_spotify_id = t.spotify_id",
+		popularity: "(select max(a.popularity) from album_artists x join artists a on a.spotify_id = x.artist_spotify_id where x.album_spotify_id = t.spotify_id)",
+		followers:  "(select max(a.followers) from album_artists x join artists a on a.spotify_id = x.artist_spotify_id where x.album_spotify_id = t.spotify_id)",
+	},
+	StageTrackAnalyses.Name: {
+		genres: "artist_genres ag" +
+			" join track_artists x on x.artist_spotify_id = ag.artist_spotify_id" +
+			" join tracks t on t.spotify_id = x.track_spotify_id",
+		artists: "select artist_spotify_id from track_artists where track_spotify_id = t.spotify_id",
+		// Tracks have their own popularity.
+		popularity: "t.popularity",
+		followers:  "(select max(a.followers) from track_artists x join artists a on a.spotify_id = x.artist_spotify_id where x.track_spotify_id = t.spotify_id)",
+	},
+}
+
+// getToFetch returns up to limit keys of the rows in scope which the stage has
+// yet to fetch, in order of the given priority. Unless the priority is
+// PriorityNone, the most popular row of each genre which the stage hasn't
+// fetched any rows of comes first.
+func (db *DB) getToFetch(stage Stage, limit int, priority Priority, scope *Scope) ([]string, error) {
+	f, ok := frontiers[stage.Name]
+	if !ok {
+		return nil, fmt.Errorf("'%s' has no frontier: %w", stage.Name, ErrUnknownStage)
+	}
+	if _, err := ParsePriority(string(priority)); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	toFetch := fmt.Sprintf("t.%s is null and (t.%s is null or t.%s <= ?)",
+		stage.fetchedColumn(), stage.failedColumn(), stage.retryColumn())
+	inScope, scopeArgs := scope.where(stage)
+	toFetch += " and " + inScope
+	toFetchArgs := append([]any{now}, scopeArgs...)
+
+	if priority == PriorityNone {
+		keys := []string{}
+		if err := db.ro.Raw("select t."+stage.key+" from "+stage.table+" t where "+toFetch+" limit ?",
+			slices.Concat(toFetchArgs, []any{limit})...).Scan(&keys).Error; err != nil {
+			return nil, fmt.Errorf("error getting %s to fetch %s: %w", stage.table, stage.column, err)
+		}
+		return keys, nil
+	}
+
+	fetched := fmt.Sprintf("t.%s is not null", stage.fetchedColumn())
+
+	// A genre's row may be another's too, so it comes in the order of its
+	// most popular genre.
+	keys := []string{}
+	if err := db.ro.Raw(`
+		select key from (
+			select (
+				select t.`+stage.key+` from `+f.genres+`
+				where ag.genre_name = g.name and `+toFetch+`
+				order by `+f.popularity+` desc
+				limit 1
+			) as key, g.popularity
+			from genres g
+			where not exists (
+				select 1 from `+f.genres+`
+				where ag.genre_name = g.name and `+fetched+`
+			)
+		)
+		where key is not null
+		group by key
+		order by max(popularity) desc
+		limit ?`, slices.Concat(toFetchArgs, []any{limit})...).Scan(&keys).Error; err != nil {
+		return nil, fmt.Errorf("error getting uncovered genres' %s to fetch %s: %w", stage.table, stage.column, err)
+	}
+	if len(keys) == limit {
+		return keys, nil
+	}
+
+	var with, order string
+	switch priority {
+	case PriorityPopularity:
+		order = f.popularity + " desc"
+	case PriorityFollowers:
+		order = f.followers + " desc"
+	case PriorityCoverage:
+		with = `with coverage as (
+			select ag.genre_name, count(distinct t.` + stage.key + `) as fetched
+			from ` + f.genres + `
+			where ` + fetched + `
+			group by ag.genre_name
+		)`
+		// Rows without genres come last.
+		coverage := `(
+			select min(coalesce(c.fetched, 0))
+			from artist_genres ag left join coverage c on c.genre_name = ag.genre_name
+			where ag.artist_spotify_id in (` + f.artists + `)
+		)`
+		order = coverage + " is null, " + coverage
+	}
+
+	query := with + " select t." + stage.key + " from " + stage.table + " t where " + toFetch
+	args := slices.Clone(toFetchArgs)
+	if len(keys) > 0 {
+		query += " and t." + stage.key + " not in ?"
+		args = append(args, keys)
+	}
+	query += " order by " + order + " limit ?"
+	args = append(args, limit-len(keys))
+
+	var rest []string
+	if err := db.ro.Raw(query, args...).Scan(&rest).Error; err != nil {
+		return nil, fmt.Errorf("error getting %s to fetch %s by %s: %w", stage.table, stage.column, priority, err)
+	}
+	return append(keys, rest...), nil
+}
+
+// GetUnfetched returns the keys of every row which the stage hasn't fetched,
+// regardless of scope or failures, in no particular order.
+func (db *DB) GetUnfetched(ctx context.Context, stage Stage) ([]string, error) {
+	keys := []string{}
+	if err := db.ro.
+		WithContext(ctx).
+		Table(stage.table).
+		Where(stage.fetchedColumn()+" is null").
+		Pluck(stage.key, &keys).
+		Error; err != nil {
+		return nil, fmt.Errorf("error getting %s without fetched %s: %w", stage.table, stage.column, err)
+	}
+	return keys, nil
+}
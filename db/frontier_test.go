@@ -0,0 +1,110 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrontier(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "genres.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	exec := func(sql string, values ...any) {
+		require.NoError(t, db.rw.Exec(sql, values...).Error)
+	}
+	exec("insert into genres (name, popularity) values ('pop', 10), ('jazz', 5), ('noise', 1)")
+	exec(`insert into artists (spotify_id, popularity, followers) values
+		('a1', 90, 10), ('a2', 50, 1000), ('a3', 20, 5), ('a4', 99, 0)`)
+	exec(`insert into artist_genres (artist_spotify_id, genre_name) values
+		('a1', 'pop'), ('a2', 'pop'), ('a3', 'jazz')`)
+
+	artists := func(limit int, priority Priority) []string {
+		artists, err := db.GetArtistsToFetchAlbums(limit, priority, nil)
+		require.NoError(t, err)
+		return artists
+	}
+
+	// By default, rows come in no particular order.
+	assert.ElementsMatch(t, []string{"a1", "a2", "a3", "a4"}, artists(10, PriorityNone))
+	assert.Len(t, artists(2, PriorityNone), 2)
+
+	// Each genre's most popular artist comes first, and then the rest, by
+	// priority.
+	assert.Equal(t, []string{"a1"}, artists(1, PriorityFollowers))
+	assert.Equal(t, []string{"a1", "a3", "a4", "a2"}, artists(10, PriorityPopularity))
+	assert.Equal(t, []string{"a1", "a3", "a2", "a4"}, artists(10, PriorityFollowers))
+
+	require.NoError(t, db.MarkArtistAlbumsFetched("a1"))
+	assert.Equal(t, []string{"a3"}, artists(1, PriorityPopularity))
+	require.NoError(t, db.MarkArtistAlbumsFetched("a3"))
+	assert.Equal(t, []string{"a4", "a2"}, artists(10, PriorityPopularity))
+	assert.ElementsMatch(t, []string{"a2", "a4"}, artists(10, PriorityNone))
+	assert.Equal(t, []string{"a2", "a4"}, artists(10, PriorityFollowers))
+
+	// Now pop has 2 artists with albums, and jazz has 1.
+	require.NoError(t, db.MarkArtistAlbumsFetched("a2"))
+	exec("insert into artists (spotify_id, popularity) values ('a5', 10), ('a6', 80)")
+	exec("insert into artist_genres (artist_spotify_id, genre_name) values ('a5', 'jazz'), ('a6', 'pop')")
+	assert.Equal(t, []string{"a4", "a6", "a5"}, artists(10, PriorityPopularity))
+	assert.Equal(t, []string{"a5", "a6", "a4"}, artists(10, PriorityCoverage))
+
+	// Other stages order rows by their artists.
+	exec("insert into albums (spotify_id) values ('b1'), ('b2'), ('b3')")
+	exec("insert into album_artists (album_spotify_id, artist_spotify_id) values ('b1', 'a2'), ('b2', 'a1'), ('b3', 'a3')")
+	albums, err := db.GetAlbumsToFetchTracks(10, PriorityFollowers, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b2", "b3", "b1"}, albums)
+
+	_, err = db.GetTracksToFetchAnalysis(10, "loudness", nil)
+	assert.ErrorIs(t, err, ErrUnknownPriority)
+}
+
+func TestScope(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "genres.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	exec := func(sql string) {
+		require.NoError(t, db.rw.Exec(sql).Error)
+	}
+	exec("insert into genres (name) values ('pop'), ('jazz')")
+	exec("insert into artists (spotify_id) values ('a1'), ('a2'), ('a3'), ('a4')")
+	exec("insert into artist_genres (artist_spotify_id, genre_name) values ('a1', 'pop'), ('a2', 'jazz'), ('a4', 'jazz')")
+	exec("insert into albums (spotify_id) values ('b1'), ('b2'), ('b3')")
+	exec("insert into album_artists (album_spotify_id, artist_spotify_id) values ('b1', 'a1'), ('b2', 'a2'), ('b3', 'a3')")
+	exec("insert into tracks (spotify_id) values ('t1'), ('t2'), ('t3')")
+	exec("insert into track_artists (track_spotify_id, artist_spotify_id) values ('t1', 'a1'), ('t2', 'a3'), ('t3', 'a3')")
+	exec("insert into album_tracks (album_spotify_id, track_spotify_id) values ('b1', 't1'), ('b2', 't2'), ('b3', 't3')")
+
+	jazz := &Scope{Genres: []string{"jazz"}}
+	genres, err := db.GetGenresToFetchArtists(10, jazz)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"jazz"}, genres)
+	artists, err := db.GetArtistsToFetchTracks(10, PriorityPopularity, jazz)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a2", "a4"}, artists)
+	albums, err := db.GetAlbumsToFetchTracks(10, PriorityPopularity, jazz)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b2"}, albums)
+	// t2 is by an artist out of scope, but it's on an album in scope.
+	tracks, err := db.GetTracksToFetchAnalysis(10, PriorityCoverage, jazz)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"t2"}, tracks)
+
+	a3 := &Scope{Artists: []string{"a3"}}
+	genres, err = db.GetGenresToFetchArtists(10, a3)
+	require.NoError(t, err)
+	assert.Empty(t, genres)
+	tracks, err = db.GetTracksToFetchAnalysis(10, PriorityFollowers, a3)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"t2", "t3"}, tracks)
+
+	// Without a scope, everything is fetched.
+	tracks, err = db.GetTracksToFetchAnalysis(10, PriorityPopularity, nil)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"t1", "t2", "t3"}, tracks)
+}
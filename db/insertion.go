@@ -46,21 +46,31 @@ func (db *DB) MarkArtistAlbumsFetched(artistSpotifyID string) error {
 	return nil
 }
 
-func (db *DB) MarkArtistAlbumsFailed(artistSpotifyID string) error {
-	defer db.hold()()
+// MarkArtistAlbumsFailed records that the artist's albums couldn't be
+// fetched, and schedules them to be tried again.
+func (db *DB) MarkArtistAlbumsFailed(artistSpotifyID string, cause error) error {
+	if artistSpotifyID == "" {
+		return fmt.Errorf("no spotify id")
+	}
+	return db.markFailed(StageArtistAlbums, []string{artistSpotifyID}, cause)
+}
 
+// MarkArtistRelatedFailed records that fetching the artist's related artists
+// failed, and schedules a retry.
+func (db *DB) MarkArtistRelatedFailed(artistSpotifyID string, cause error) error {
 	if artistSpotifyID == "" {
 		return fmt.Errorf("no spotify id")
 	}
+	return db.markFailed(StageRelatedArtists, []string{artistSpotifyID}, cause)
+}
 
-	if err := db.rw.
-		Table("artists").
-		Where("spotify_id = ?", artistSpotifyID).
-		Update("failed_albums_at", sql.NullTime{Time: time.Now(), Valid: true}).
-		Error; err != nil {
-		return fmt.Errorf("error marking artist '%s' albums as fetched: %w", artistSpotifyID, err)
+// MarkPlaylistFailed records that fetching the playlist failed, and schedules
+// a retry.
+func (db *DB) MarkPlaylistFailed(playlistSpotifyID string, cause error) error {
+	if playlistSpotifyID == "" {
+		return fmt.Errorf("no spotify id")
 	}
-	return nil
+	return db.markFailed(StagePlaylistTracks, []string{playlistSpotifyID}, cause)
 }
 
 func (db *DB) MarkGenreFetched(genreName string) error {
@@ -80,21 +90,13 @@ func (db *DB) MarkGenreFetched(genreName string) error {
 	return nil
 }
 
-func (db *DB) MarkGenreFailed(genreName string) error {
-	defer db.hold()()
-
+// MarkGenreFailed records that the genre's artists couldn't be fetched, and
+// schedules them to be tried again.
+func (db *DB) MarkGenreFailed(genreName string, cause error) error {
 	if genreName == "" {
-		return fmt.Errorf("no spotify id")
-	}
-
-	if err := db.rw.
-		Table("genres").
-		Where("name = ?", genreName).
-		Update("failed_artists_at", sql.NullTime{Time: time.Now(), Valid: true}).
-		Error; err != nil {
-		return fmt.Errorf("error marking genre '%s' as fetched: %w", genreName, err)
+		return fmt.Errorf("no genre name")
 	}
-	return nil
+	return db.markFailed(StageGenreArtists, []string{genreName}, cause)
 }
 
 func (db *DB) MarkArtistFetched(artistSpotifyID string) error {
@@ -114,34 +116,19 @@ func (db *DB) MarkArtistFetched(artistSpotifyID string) error {
 	return nil
 }
 
-func (db *DB) MarkArtistFailed(artistSpotifyID string) error {
-	defer db.hold()()
-
+// MarkArtistFailed records that the artist's top tracks couldn't be fetched,
+// and schedules them to be tried again.
+func (db *DB) MarkArtistFailed(artistSpotifyID string, cause error) error {
 	if artistSpotifyID == "" {
 		return fmt.Errorf("no spotify id")
 	}
-
-	if err := db.rw.
-		Table("artists").
-		Where("spotify_id = ?", artistSpotifyID).
-		Update("failed_tracks_at", sql.NullTime{Time: time.Now(), Valid: true}).
-		Error; err != nil {
-		return fmt.Errorf("error marking artist '%s' as fetched: %w", artistSpotifyID, err)
-	}
-	return nil
+	return db.markFailed(StageArtistTracks, []string{artistSpotifyID}, cause)
 }
 
-func (db *DB) MarkTrackAnalysisFailed(tracks []string) error {
-	defer db.hold()()
-
-	if err := db.rw.
-		Table("tracks").
-		Where("spotify_id in ?", tracks).
-		Update("failed_analysis_at", sql.NullTime{Time: time.Now(), Valid: true}).
-		Error; err != nil {
-		return fmt.Errorf("error marking %d tracks as failed", len(tracks))
-	}
-	return nil
+// MarkTrackAnalysisFailed records that the tracks' analyses couldn't be
+// fetched, and schedules them to be tried again.
+func (db *DB) MarkTrackAnalysisFailed(tracks []string, cause error) error {
+	return db.markFailed(StageTrackAnalyses, tracks, cause)
 }
 
 func (db *DB) AddTrackAnalyses(ctx context.Context, tracks []data.Track) error {
@@ -152,7 +139,7 @@ func (db *DB) AddTrackAnalyses(ctx context.Context, tracks []data.Track) error {
 			if track.SpotifyID == "" {
 				return fmt.Errorf("no spotify id")
 			}
-			if err := db.rw.
+			if err := tx.
 				Table("tracks").
 				Where("spotify_id = ?", track.SpotifyID).
 				Updates(map[string]interface{}{
@@ -178,6 +165,17 @@ func (db *DB) AddTrackAnalyses(ctx context.Context, tracks []data.Track) error {
 			if err := ctx.Err(); err != nil {
 				return fmt.Errorf("canceled: %w", err)
 			}
+
+			if err := tx.
+				Exec("insert or ignore into knn_tracks (spotify_id) values (?)", track.SpotifyID).
+				Error; err != nil {
+				return fmt.Errorf("error assigning knn id to '%s': %w", track.SpotifyID, err)
+			}
+			if err := tx.
+				Exec("insert into knn_log (track_id) select id from knn_tracks where spotify_id = ?", track.SpotifyID).
+				Error; err != nil {
+				return fmt.Errorf("error logging track analysis for '%s': %w", track.SpotifyID, err)
+			}
 		}
 
 		return nil
@@ -330,22 +328,33 @@ func (db *DB) PopulateAlbums(ctx context.Context, albums []data.Album) error {
 					return fmt.Errorf("canceled: %w", err)
 				}
 			}
+
+			// The album's artists may already have had their tracks
+			// indexed without this album.
+			var artistIDs []string
+			for _, track := range album.Tracks {
+				for _, artist := range track.Artists {
+					artistIDs = append(artistIDs, artist.SpotifyID)
+				}
+			}
+			if len(artistIDs) > 0 {
+				if err := db.
+					Table("artists").
+					Where("spotify_id in ?", artistIDs).
+					Update("indexed_tracks_rtree_at", nil).
+					Error; err != nil {
+					return fmt.Errorf("error unmarking tracks rtree for artists of album '%s': %w", album.SpotifyID, err)
+				}
+			}
 		}
 		return nil
 	})
 }
 
-func (db *DB) MarkAlbumsTracksFailed(albums []string) error {
-	defer db.hold()()
-
-	if err := db.rw.
-		Table("albums").
-		Where("spotify_id in ?", albums).
-		Update("failed_tracks_at", sql.NullTime{Time: time.Now(), Valid: true}).
-		Error; err != nil {
-		return fmt.Errorf("error marking %d albums as failed", len(albums))
-	}
-	return nil
+// MarkAlbumsTracksFailed records that the albums' tracks couldn't be fetched,
+// and schedules them to be tried again.
+func (db *DB) MarkAlbumsTracksFailed(albums []string, cause error) error {
+	return db.markFailed(StageAlbumTracks, albums, cause)
 }
 
 func (db *DB) InsertAlbum(ctx context.Context, album *data.Album) error {
@@ -527,48 +536,235 @@ func (db *DB) InsertArtist(ctx context.Context, artist *data.Artist) error {
 	}
 
 	return db.rw.Transaction(func(db *gorm.DB) error {
+		return insertArtist(ctx, db, artist)
+	})
+}
+
+// insertArtist inserts the artist, within the given transaction.
+func insertArtist(ctx context.Context, db *gorm.DB, artist *data.Artist) error {
+	if err := db.
+		Table("artists").
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(artist).
+		Error; err != nil {
+		return fmt.Errorf("error inserting artist '%s': %w", artist.SpotifyID, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("canceled: %w", err)
+	}
+
+	// linked is set if the artist gained a genre, in which case its genres
+	// must be reindexed.
+	linked := false
+	for _, genre := range artist.Genres {
+		if genre == "" {
+			return fmt.Errorf("no genre name")
+		}
+
 		if err := db.
-			Table("artists").
+			Table("genres").
 			Clauses(clause.OnConflict{DoNothing: true}).
-			Create(artist).
+			Create(&data.Genre{
+				Name: genre,
+			}).
 			Error; err != nil {
-			return fmt.Errorf("error inserting artist '%s': %w", artist.SpotifyID, err)
+			return fmt.Errorf("error inserting genre '%s' for artist '%s': %w", genre, artist.SpotifyID, err)
 		}
 		if err := ctx.Err(); err != nil {
 			return fmt.Errorf("canceled: %w", err)
 		}
 
-		for _, genre := range artist.Genres {
-			if genre == "" {
-				return fmt.Errorf("no genre name")
-			}
+		result := db.
+			Table("artist_genres").
+			Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&data.ArtistGenre{
+				ArtistSpotifyID: artist.SpotifyID,
+				GenreName:       genre,
+			})
+		if err := result.Error; err != nil {
+			return fmt.Errorf("error inserting artist_genre '%s' for artist '%s': %w", genre, artist.SpotifyID, err)
+		}
+		if result.RowsAffected > 0 {
+			linked = true
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("canceled: %w", err)
+		}
+
+	}
 
+	// The artist may already have been indexed with fewer genres. A newly
+	// inserted artist hasn't been indexed, so has nothing to reset.
+	if linked {
+		if err := db.
+			Table("artists").
+			Where("spotify_id = ?", artist.SpotifyID).
+			Update("indexed_genres_rtree_at", nil).
+			Error; err != nil {
+			return fmt.Errorf("error unmarking artist '%s' genres rtree: %w", artist.SpotifyID, err)
+		}
+
+		// Its tracks' bounds include its genres, so the albums of its
+		// tracks, and every artist credited on them, must be reindexed
+		// too.
+		if err := db.
+			Table("albums").
+			Where(`spotify_id in (
+				select album_tracks.album_spotify_id from album_tracks
+					join track_artists on track_artists.track_spotify_id = album_tracks.track_spotify_id
+				where track_artists.artist_spotify_id = ?
+			)`, artist.SpotifyID).
+			Update("indexed_tracks_rtree_at", nil).
+			Error; err != nil {
+			return fmt.Errorf("error unmarking albums of artist '%s' tracks rtree: %w", artist.SpotifyID, err)
+		}
+		if err := db.
+			Table("artists").
+			Where(`spotify_id in (
+				select credits.artist_spotify_id from track_artists
+					join track_artists as credits on credits.track_spotify_id = track_artists.track_spotify_id
+				where track_artists.artist_spotify_id = ?
+			)`, artist.SpotifyID).
+			Update("indexed_tracks_rtree_at", nil).
+			Error; err != nil {
+			return fmt.Errorf("error unmarking collaborators of artist '%s' tracks rtree: %w", artist.SpotifyID, err)
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("canceled: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// InsertArtistRelations inserts the artists related to the artist with the
+// given spotify ID, most related first, along with the relations to them, and
+// marks the artist's related artists as fetched.
+func (db *DB) InsertArtistRelations(ctx context.Context, artistSpotifyID string, related []data.Artist) error {
+	defer db.hold()()
+
+	if artistSpotifyID == "" {
+		return fmt.Errorf("no spotify id")
+	}
+
+	return db.rw.Transaction(func(db *gorm.DB) error {
+		if err := db.
+			Table("artist_relations").
+			Where("artist_spotify_id = ?", artistSpotifyID).
+			Delete(&data.ArtistRelation{}).
+			Error; err != nil {
+			return fmt.Errorf("error deleting relations of artist '%s': %w", artistSpotifyID, err)
+		}
+
+		for i := range related {
+			artist := &related[i]
+			if artist.SpotifyID == "" {
+				return fmt.Errorf("no spotify id for artist related to '%s'", artistSpotifyID)
+			}
+			if err := insertArtist(ctx, db, artist); err != nil {
+				return err
+			}
 			if err := db.
-				Table("genres").
+				Table("artist_relations").
 				Clauses(clause.OnConflict{DoNothing: true}).
-				Create(&data.Genre{
-					Name: genre,
+				Create(&data.ArtistRelation{
+					ArtistSpotifyID:        artistSpotifyID,
+					RelatedArtistSpotifyID: artist.SpotifyID,
+					Rank:                   i + 1,
 				}).
 				Error; err != nil {
-				fmt.Errorf("error inserting genre '%s' for artist '%s': %w", genre, artist.SpotifyID, err)
+				return fmt.Errorf("error inserting relation '%s' for artist '%s': %w", artist.SpotifyID, artistSpotifyID, err)
+			}
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("canceled: %w", err)
 			}
+		}
 
+		if err := db.
+			Table("artists").
+			Where("spotify_id = ?", artistSpotifyID).
+			Update("fetched_related_at", sql.NullTime{Time: time.Now(), Valid: true}).
+			Error; err != nil {
+			return fmt.Errorf("error marking artist '%s' related artists as fetched: %w", artistSpotifyID, err)
+		}
+		return nil
+	})
+}
+
+// InsertPlaylist, given a Playlist, inserts it into the playlists table, doing
+// nothing if it already exists. Its tracks are left to the playlists worker.
+func (db *DB) InsertPlaylist(playlist *data.Playlist) error {
+	defer db.hold()()
+
+	if playlist.SpotifyID == "" {
+		return fmt.Errorf("no spotify id")
+	}
+
+	if err := db.rw.
+		Table("playlists").
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(playlist).
+		Error; err != nil {
+		return fmt.Errorf("error inserting playlist '%s': %w", playlist.SpotifyID, err)
+	}
+	return nil
+}
+
+// PopulatePlaylist, given a fetched Playlist, records its details and its
+// tracks' positions, replacing any it had, and marks it as fetched. The tracks
+// themselves must already have been inserted.
+func (db *DB) PopulatePlaylist(ctx context.Context, playlist *data.Playlist) error {
+	defer db.hold()()
+
+	if playlist.SpotifyID == "" {
+		return fmt.Errorf("no spotify id")
+	}
+
+	return db.rw.Transaction(func(db *gorm.DB) error {
+		if err := db.
+			Table("playlists").
+			Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&data.Playlist{SpotifyID: playlist.SpotifyID}).
+			Error; err != nil {
+			return fmt.Errorf("error inserting playlist '%s': %w", playlist.SpotifyID, err)
+		}
+		if err := db.
+			Table("playlists").
+			Where("spotify_id = ?", playlist.SpotifyID).
+			Updates(map[string]any{
+				"name":              playlist.Name,
+				"description":       playlist.Description,
+				"owner_spotify_id":  playlist.OwnerSpotifyID,
+				"followers":         playlist.Followers,
+				"snapshot_id":       playlist.SnapshotID,
+				"fetched_tracks_at": sql.NullTime{Time: time.Now(), Valid: true},
+			}).
+			Error; err != nil {
+			return fmt.Errorf("error updating playlist '%s': %w", playlist.SpotifyID, err)
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("canceled: %w", err)
+		}
+
+		if err := db.
+			Table("playlist_tracks").
+			Where("playlist_spotify_id = ?", playlist.SpotifyID).
+			Delete(&data.PlaylistTrack{}).
+			Error; err != nil {
+			return fmt.Errorf("error deleting tracks of playlist '%s': %w", playlist.SpotifyID, err)
+		}
+		for _, track := range playlist.Tracks {
+			track.PlaylistSpotifyID = playlist.SpotifyID
 			if err := db.
-				Table("artist_genres").
-				Clauses(clause.OnConflict{DoNothing: true}).
-				Create(&data.ArtistGenre{
-					ArtistSpotifyID: artist.SpotifyID,
-					GenreName:       genre,
-				}).
+				Table("playlist_tracks").
+				Create(&track).
 				Error; err != nil {
-				return fmt.Errorf("error inserting artist_genre '%s' for artist '%s': %w", genre, artist.SpotifyID, err)
+				return fmt.Errorf("error inserting track '%s' at %d in playlist '%s': %w", track.TrackSpotifyID, track.Position, playlist.SpotifyID, err)
 			}
 			if err := ctx.Err(); err != nil {
 				return fmt.Errorf("canceled: %w", err)
 			}
-
 		}
-
 		return nil
 	})
 }
@@ -0,0 +1,228 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/amonks/genres/data"
+	"github.com/amonks/genres/knn"
+)
+
+// knnIndex is an in-memory k-d tree over the audio features of every analyzed
+// track, keyed by the tracks' ids in knn_tracks. (Not their rowids, which
+// VACUUM may renumber.)
+//
+// It's loaded from a file next to the database (see KNNFilename), which is
+// appended to by UpdateKNNIndex, and then caught up with the database by
+// reading knn_log, which records each analysis in order.
+type knnIndex struct {
+	mu sync.RWMutex
+
+	tree *knn.Tree
+	// seq is the last knn_log entry that tree reflects.
+	seq int64
+}
+
+const knnBatchSize = 100_000
+
+// KNNFilename returns the path of the nearest-neighbor index file for this
+// database.
+func (db *DB) KNNFilename() string {
+	return db.filename + ".knn"
+}
+
+// UpdateKNNIndex appends any tracks analyzed since the index file was last
+// updated to the index file, creating it if need be. It's called by the track
+// analysis worker after each batch.
+//
+// If another process appends the same entries first, UpdateKNNIndex picks up
+// from wherever that process left the file rather than appending them again.
+func (db *DB) UpdateKNNIndex(ctx context.Context) error {
+	filename := db.KNNFilename()
+	seq, err := readKNNCheckpoint(filename)
+	if err != nil {
+		return err
+	}
+
+	for {
+		ids, points, last, err := db.readKNNLog(ctx, seq)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		err = knn.AppendFile(filename, len(data.Features), ids, points, seq, last)
+		if errors.Is(err, knn.ErrCheckpointMoved) {
+			if seq, err = readKNNCheckpoint(filename); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error writing %d tracks to knn index: %w", len(ids), err)
+		}
+		if len(ids) < knnBatchSize {
+			return nil
+		}
+		seq = last
+	}
+}
+
+// readKNNCheckpoint returns the last knn_log entry in the given index file, or
+// 0 if it doesn't exist yet.
+func readKNNCheckpoint(filename string) (int64, error) {
+	seq, err := knn.ReadCheckpoint(filename, len(data.Features))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// nearestTrackIDs returns the knn_tracks ids of up to count tracks nearest to the
+// given vector, nearest first.
+func (db *DB) nearestTrackIDs(ctx context.Context, count int, input data.Vector) ([]int64, error) {
+	query := make([]float64, len(data.Features))
+	for i, feature := range data.Features {
+		query[i] = math.NaN()
+		if v, has := input[feature]; has {
+			query[i] = v
+		}
+	}
+	for feature := range input {
+		if !isFeature(feature) {
+			return nil, fmt.Errorf("unknown feature '%s'; valid features are {%s}", feature, strings.Join(data.Features, ", "))
+		}
+	}
+
+	if err := db.refreshKNN(ctx); err != nil {
+		return nil, err
+	}
+
+	db.knn.mu.RLock()
+	defer db.knn.mu.RUnlock()
+
+	neighbors, err := db.knn.tree.Nearest(query, count)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, len(neighbors))
+	for i, neighbor := range neighbors {
+		ids[i] = neighbor.ID
+	}
+	return ids, nil
+}
+
+// refreshKNN loads the index file if it hasn't been loaded, then adds any
+// tracks that have been analyzed since to the in-memory index. It only takes
+// the write lock if the log has moved past the in-memory index.
+func (db *DB) refreshKNN(ctx context.Context) error {
+	db.knn.mu.RLock()
+	loaded, seq := db.knn.tree != nil, db.knn.seq
+	db.knn.mu.RUnlock()
+	if loaded {
+		var latest int64
+		if err := db.ro.WithContext(ctx).Raw("select coalesce(max(seq), 0) from knn_log").Scan(&latest).Error; err != nil {
+			return fmt.Errorf("error reading knn log's latest entry: %w", err)
+		}
+		if latest <= seq {
+			return nil
+		}
+	}
+
+	db.knn.mu.Lock()
+	defer db.knn.mu.Unlock()
+
+	if db.knn.tree == nil {
+		tree, seq, err := knn.ReadFile(db.KNNFilename(), len(data.Features))
+		if errors.Is(err, os.ErrNotExist) {
+			tree, seq = knn.New(len(data.Features)), 0
+		} else if err != nil {
+			return err
+		}
+		db.knn.tree, db.knn.seq = tree, seq
+	}
+
+	for {
+		ids, points, last, err := db.readKNNLog(ctx, db.knn.seq)
+		if err != nil {
+			return err
+		}
+		for i, id := range ids {
+			if err := db.knn.tree.Insert(id, points[i]); err != nil {
+				return err
+			}
+		}
+		if len(ids) > 0 {
+			db.knn.seq = last
+		}
+		if len(ids) < knnBatchSize {
+			return nil
+		}
+	}
+}
+
+// readKNNLog returns up to knnBatchSize tracks from the knn log after the
+// given entry, along with the last entry returned.
+func (db *DB) readKNNLog(ctx context.Context, after int64) ([]int64, [][]float64, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, 0, fmt.Errorf("canceled: %w", err)
+	}
+
+	rows, err := db.ro.Raw(`
+		select knn_log.seq, knn_tracks.id, `+strings.Join(prefixed("tracks.", data.Features), ", ")+`
+		from knn_log
+			join knn_tracks on knn_tracks.id = knn_log.track_id
+			join tracks on tracks.spotify_id = knn_tracks.spotify_id
+		where knn_log.seq > ?
+		order by knn_log.seq asc
+		limit ?`, after, knnBatchSize).Rows()
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("error reading knn log after %d: %w", after, err)
+	}
+	defer rows.Close()
+
+	var (
+		ids    []int64
+		points [][]float64
+		last   int64
+	)
+	for rows.Next() {
+		var id int64
+		point := make([]float64, len(data.Features))
+		dest := []any{&last, &id}
+		for i := range point {
+			dest = append(dest, &point[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, nil, 0, fmt.Errorf("error scanning knn log: %w", err)
+		}
+		ids = append(ids, id)
+		points = append(points, point)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, 0, fmt.Errorf("error reading knn log: %w", err)
+	}
+	return ids, points, last, nil
+}
+
+func isFeature(name string) bool {
+	for _, feature := range data.Features {
+		if name == feature {
+			return true
+		}
+	}
+	return false
+}
+
+func prefixed(prefix string, strs []string) []string {
+	out := make([]string, len(strs))
+	for i, str := range strs {
+		out[i] = prefix + str
+	}
+	return out
+}
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// ErrPendingMigrations is returned by Open when the database has migrations
+// which haven't been applied yet. Run `genres migrate` to apply them.
+var ErrPendingMigrations = errors.New("database has pending migrations; run `genres migrate`")
+
+// A Migration is a change to the schema, from db/migrations. Migrations are
+// named like "0001_add_thing.sql", and are applied in order of version, each
+// in its own transaction.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// A MigrationStatus is a migration, along with when it was applied, if it has
+// been.
+type MigrationStatus struct {
+	Migration
+	AppliedAt sql.NullTime
+}
+
+// Migrations returns every migration, in the order they should be applied.
+func Migrations() ([]Migration, error) {
+	filenames, err := fs.Glob(migrationsFS, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, filename := range filenames {
+		base := strings.TrimSuffix(path.Base(filename), ".sql")
+		versionString, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration '%s' is not named like '0001_name.sql'", filename)
+		}
+		version, err := strconv.Atoi(versionString)
+		if err != nil {
+			return nil, fmt.Errorf("migration '%s' is not named like '0001_name.sql': %w", filename, err)
+		}
+		bs, err := migrationsFS.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("error reading migration '%s': %w", filename, err)
+		}
+		migrations = append(migrations, Migration{
+			Version: version,
+			Name:    name,
+			SQL:     string(bs),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("expected migration %d, but found %d (%s)", i+1, m.Version, m.Name)
+		}
+	}
+
+	return migrations, nil
+}
+
+// MigrationStatus returns every migration, along with when it was applied.
+func (db *DB) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []struct {
+		Version   int
+		AppliedAt time.Time
+	}
+	if err := db.ro.
+		WithContext(ctx).
+		Table("schema_migrations").
+		Find(&applied).
+		Error; err != nil {
+		return nil, fmt.Errorf("error getting applied migrations: %w", err)
+	}
+	appliedAt := make(map[int]time.Time, len(applied))
+	for _, a := range applied {
+		appliedAt[a.Version] = a.AppliedAt
+	}
+
+	statuses := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		statuses[i].Migration = m
+		if at, ok := appliedAt[m.Version]; ok {
+			statuses[i].AppliedAt = sql.NullTime{Time: at, Valid: true}
+		}
+		delete(appliedAt, m.Version)
+	}
+	for version := range appliedAt {
+		return nil, fmt.Errorf("database has migration %d, which this version of genres doesn't know about", version)
+	}
+
+	return statuses, nil
+}
+
+// PendingMigrations returns the migrations which haven't been applied yet, in
+// the order they should be applied.
+func (db *DB) PendingMigrations(ctx context.Context) ([]Migration, error) {
+	statuses, err := db.MigrationStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, s := range statuses {
+		if !s.AppliedAt.Valid {
+			pending = append(pending, s.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies every pending migration, in order, and returns the ones it
+// applied. If a migration fails, the migrations before it remain applied.
+func (db *DB) Migrate(ctx context.Context) ([]Migration, error) {
+	pending, err := db.PendingMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer db.hold()()
+
+	var applied []Migration
+	for _, m := range pending {
+		if err := ctx.Err(); err != nil {
+			return applied, fmt.Errorf("canceled: %w", err)
+		}
+		if err := db.rw.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec(m.SQL).Error; err != nil {
+				return err
+			}
+			return tx.Exec(`insert into schema_migrations (version, name, applied_at) values (?, ?, ?)`,
+				m.Version, m.Name, time.Now()).Error
+		}); err != nil {
+			return applied, fmt.Errorf("error applying migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		applied = append(applied, m)
+	}
+
+	return applied, nil
+}
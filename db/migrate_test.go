@@ -0,0 +1,116 @@
+package db
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openBaseline returns the filename of a database created with the schema from
+// before migrations existed.
+func openBaseline(t *testing.T) string {
+	filename := filepath.Join(t.TempDir(), "genres.db")
+	fixture, err := os.ReadFile("testdata/baseline.sql")
+	require.NoError(t, err)
+
+	conn, err := openDB(filename, true)
+	require.NoError(t, err)
+	require.NoError(t, conn.Exec(string(fixture)).Error)
+	sqldb, err := conn.DB()
+	require.NoError(t, err)
+	require.NoError(t, sqldb.Close())
+
+	return filename
+}
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.Version)
+		assert.NotEmpty(t, m.Name)
+	}
+}
+
+func TestOpenFresh(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "genres.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	pending, err := db.PendingMigrations(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestMigrateFromBaseline(t *testing.T) {
+	ctx := context.Background()
+	filename := openBaseline(t)
+
+	_, err := Open(filename)
+	assert.ErrorIs(t, err, ErrPendingMigrations)
+
+	db, err := OpenUnmigrated(filename)
+	require.NoError(t, err)
+
+	migrations, err := Migrations()
+	require.NoError(t, err)
+	pending, err := db.PendingMigrations(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, migrations, pending)
+
+	applied, err := db.Migrate(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, migrations, applied)
+
+	statuses, err := db.MigrationStatus(ctx)
+	require.NoError(t, err)
+	for _, s := range statuses {
+		assert.True(t, s.AppliedAt.Valid, "migration %d", s.Version)
+	}
+
+	applied, err = db.Migrate(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+	require.NoError(t, db.Close())
+
+	db, err = Open(filename)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 0001_knn_log backfills analyzed tracks, in the order they were
+	// analyzed.
+	var logged []string
+	require.NoError(t, db.ro.
+		Table("knn_log").
+		Joins("join knn_tracks on knn_tracks.id = knn_log.track_id").
+		Order("knn_log.seq asc").
+		Pluck("knn_tracks.spotify_id", &logged).
+		Error)
+	assert.Equal(t, []string{"analyzed-first", "analyzed-later"}, logged)
+
+	// 0003_failure_retries schedules failures from before failures
+	// were counted to be retried.
+	failure, err := db.GetFailure(StageTrackAnalyses, "failed")
+	require.NoError(t, err)
+	assert.Equal(t, 1, failure.Failures)
+	require.True(t, failure.RetryAt.Valid)
+	assert.WithinRange(t, failure.RetryAt.Time, time.Now().Add(FailureBackoff-time.Minute), time.Now().Add(2*FailureBackoff))
+	assert.False(t, failure.Dead())
+}
+
+func TestMigrateUnknownVersion(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "genres.db")
+	db, err := Open(filename)
+	require.NoError(t, err)
+	require.NoError(t, db.rw.Exec(`insert into schema_migrations (version, name, applied_at) values (9999, 'from the future', datetime('now'))`).Error)
+	require.NoError(t, db.Close())
+
+	_, err = Open(filename)
+	assert.ErrorContains(t, err, "9999")
+}
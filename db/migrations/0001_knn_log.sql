@@ -0,0 +1,26 @@
+-- knn_tracks gives each analyzed track a stable integer id, by
+-- which the nearest-neighbor index (see package knn) identifies
+-- it. Tracks' own rowids won't do, since tracks has a text
+-- primary key, so VACUUM may renumber them.
+create table if not exists knn_tracks (
+        id         integer primary key autoincrement,
+        spotify_id text not null unique references tracks(spotify_id)
+);
+
+-- knn_log records the order in which tracks' analyses were
+-- added, so that the nearest-neighbor index can be updated
+-- incrementally, by reading every entry after the last one it
+-- saw.
+create table if not exists knn_log (
+        seq      integer primary key autoincrement,
+        track_id integer not null references knn_tracks(id)
+);
+
+-- Backfill the log with the tracks analyzed so far.
+insert into knn_tracks (spotify_id)
+        select spotify_id from tracks
+        where fetched_analysis_at is not null
+        order by fetched_analysis_at asc;
+insert into knn_log (track_id)
+        select id from knn_tracks
+        order by id asc;
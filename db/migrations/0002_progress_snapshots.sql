@@ -0,0 +1,29 @@
+-- progress_snapshots records the crawl's progress, each time the
+-- fetcher's reporter counts it.
+create table if not exists progress_snapshots (
+        taken_at datetime primary key,
+
+        -- The *_to_fetch columns count rows which a worker has yet
+        -- to try. genres_to_fetch_artists is null for snapshots
+        -- imported from log.tsv, which didn't record it.
+        genres_to_fetch_artists  integer,
+        artists_to_fetch_tracks  integer not null,
+        artists_to_fetch_albums  integer not null,
+        albums_to_fetch_tracks   integer not null,
+        tracks_to_fetch_analysis integer not null,
+
+        artists_known      integer not null,
+        artists_done       integer not null,
+        artist_albums_done integer not null,
+        artist_tracks_done integer not null,
+        albums_known       integer not null,
+        albums_done        integer not null,
+        tracks_known       integer not null,
+        tracks_done        integer not null,
+        tracks_indexed     integer not null,
+
+        -- spotify_requests counts the requests made by the
+        -- fetcher's credentials in the 24 hours before the
+        -- snapshot. It's null for snapshots imported from log.tsv.
+        spotify_requests integer
+);
@@ -0,0 +1,53 @@
+-- Each stage which can fail for a row records how many times it
+-- has failed in <stage>_failures, the last error in <stage>_error,
+-- and when to try again in retry_<stage>_at. Rows which have
+-- failed too many times have no retry time, and are dead: only
+-- `genres failures -requeue` will try them again.
+alter table genres  add column artists_failures  integer not null default 0;
+alter table genres  add column artists_error     text;
+alter table genres  add column retry_artists_at  datetime;
+
+alter table artists add column albums_failures   integer not null default 0;
+alter table artists add column albums_error      text;
+alter table artists add column retry_albums_at   datetime;
+alter table artists add column tracks_failures   integer not null default 0;
+alter table artists add column tracks_error      text;
+alter table artists add column retry_tracks_at   datetime;
+
+alter table albums  add column tracks_failures   integer not null default 0;
+alter table albums  add column tracks_error      text;
+alter table albums  add column retry_tracks_at   datetime;
+
+alter table tracks  add column analysis_failures integer not null default 0;
+alter table tracks  add column analysis_error    text;
+alter table tracks  add column retry_analysis_at datetime;
+
+create index if not exists genres_by_retry_artists_at  on genres  ( retry_artists_at );
+create index if not exists artists_by_retry_albums_at  on artists ( retry_albums_at );
+create index if not exists artists_by_retry_tracks_at  on artists ( retry_tracks_at );
+create index if not exists albums_by_retry_tracks_at   on albums  ( retry_tracks_at );
+create index if not exists tracks_by_retry_analysis_at on tracks  ( retry_analysis_at );
+
+-- Rows which failed before failures were counted are scheduled
+-- to be retried like any other first failure, an hour or so from
+-- now, spread over a further hour so that they don't all come
+-- due at once. If they fail again they follow the usual backoff,
+-- and are dead after MaxFailures.
+--
+-- Retry times are compared as text, so they're written in the
+-- same UTC format as the ones the crawler writes.
+update genres  set artists_failures  = 1, artists_error  = 'failed before errors were recorded',
+        retry_artists_at  = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now', '+' || (3600 + abs(random() % 3600)) || ' seconds')
+        where failed_artists_at  is not null;
+update artists set albums_failures   = 1, albums_error   = 'failed before errors were recorded',
+        retry_albums_at   = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now', '+' || (3600 + abs(random() % 3600)) || ' seconds')
+        where failed_albums_at   is not null;
+update artists set tracks_failures   = 1, tracks_error   = 'failed before errors were recorded',
+        retry_tracks_at   = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now', '+' || (3600 + abs(random() % 3600)) || ' seconds')
+        where failed_tracks_at   is not null;
+update albums  set tracks_failures   = 1, tracks_error   = 'failed before errors were recorded',
+        retry_tracks_at   = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now', '+' || (3600 + abs(random() % 3600)) || ' seconds')
+        where failed_tracks_at   is not null;
+update tracks  set analysis_failures = 1, analysis_error = 'failed before errors were recorded',
+        retry_analysis_at = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now', '+' || (3600 + abs(random() % 3600)) || ' seconds')
+        where failed_analysis_at is not null;
@@ -0,0 +1,5 @@
+-- The crawl's frontier can be ordered by how popular and how
+-- followed artists are, most first.
+create index if not exists artists_by_popularity on artists ( popularity );
+create index if not exists artists_by_followers  on artists ( followers  );
+create index if not exists genres_by_popularity  on genres  ( popularity );
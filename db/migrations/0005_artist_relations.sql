@@ -0,0 +1,23 @@
+-- artist_relations holds the edges of the artist graph: the
+-- artists Spotify considers related to each artist, ranked from
+-- 1, the most related. Relations aren't symmetric.
+create table if not exists artist_relations (
+        artist_spotify_id         text references artists(spotify_id),
+        related_artist_spotify_id text references artists(spotify_id),
+        rank                      integer not null,
+
+        primary key (artist_spotify_id, related_artist_spotify_id)
+);
+
+create index if not exists artist_relations_by_related on artist_relations ( related_artist_spotify_id );
+
+-- The related_artists worker fetches each artist's relations.
+alter table artists add column fetched_related_at datetime;
+alter table artists add column failed_related_at  datetime;
+alter table artists add column related_failures   integer not null default 0;
+alter table artists add column related_error      text;
+alter table artists add column retry_related_at   datetime;
+
+create index if not exists artists_by_fetched_related_at on artists ( fetched_related_at );
+create index if not exists artists_by_failed_related_at  on artists ( failed_related_at );
+create index if not exists artists_by_retry_related_at   on artists ( retry_related_at );
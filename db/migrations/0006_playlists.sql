@@ -0,0 +1,39 @@
+-- PLAYLISTS
+--
+-- Playlists are curated groupings of tracks. They're added as
+-- seeds, with nothing but their spotify_id, and the playlists
+-- worker fills in the rest.
+create table if not exists playlists (
+        spotify_id       text primary key,
+        name             text,
+        description      text,
+        owner_spotify_id text,
+        followers        integer,
+        -- Identifies the version of the playlist which was fetched.
+        snapshot_id      text,
+
+        fetched_tracks_at datetime,
+        failed_tracks_at  datetime,
+        tracks_failures   integer not null default 0,
+        tracks_error      text,
+        retry_tracks_at   datetime
+);
+
+create index if not exists playlists_by_fetched_tracks_at on playlists ( fetched_tracks_at );
+create index if not exists playlists_by_failed_tracks_at  on playlists ( failed_tracks_at );
+create index if not exists playlists_by_retry_tracks_at   on playlists ( retry_tracks_at );
+
+-- playlist_tracks records each playlist's tracks, in order. A
+-- track may appear more than once in a playlist. Positions skip
+-- the entries which aren't Spotify tracks, like podcast episodes
+-- and local files.
+create table if not exists playlist_tracks (
+        playlist_spotify_id text references playlists(spotify_id),
+        position            integer not null,
+        track_spotify_id    text references tracks(spotify_id),
+        added_at            datetime,
+
+        primary key (playlist_spotify_id, position)
+);
+
+create index if not exists playlist_tracks_by_track on playlist_tracks ( track_spotify_id );
@@ -0,0 +1,13 @@
+-- rtree_artists and rtree_albums give artists and albums stable
+-- integer ids, by which the genre-space rtrees identify them.
+-- Their own rowids won't do, since both tables have text primary
+-- keys, so VACUUM may renumber them.
+create table if not exists rtree_artists (
+        id         integer primary key autoincrement,
+        spotify_id text not null unique references artists(spotify_id)
+);
+
+create table if not exists rtree_albums (
+        id         integer primary key autoincrement,
+        spotify_id text not null unique references albums(spotify_id)
+);
@@ -0,0 +1,49 @@
+//go:build sqlite_math_functions && fts5
+
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/amonks/genres/data"
+	"gorm.io/gorm"
+)
+
+// A PathStep is one track along a Path, along with its distance from the
+// ideal point at that step.
+type PathStep struct {
+	data.Track
+	Distance float64
+}
+
+// Path creates a playlist along a linear path between two tracks: it divides
+// the distance between them into the given number of steps, and picks the
+// track nearest to each step. The returned playlist begins with the 'from'
+// track, so it has steps+1 entries.
+//
+// If there are no analyzed tracks to choose from, the returned error wraps
+// gorm.ErrRecordNotFound.
+func (db *DB) Path(ctx context.Context, from, to *data.Track, steps int) ([]PathStep, error) {
+	fromVec, toVec := from.Vector(), to.Vector()
+	delta := fromVec.Delta(toVec)
+	path := fromVec.Path(delta, steps)
+
+	playlist := make([]PathStep, 0, steps+1)
+	playlist = append(playlist, PathStep{Track: *from})
+	for i, vec := range path {
+		results, err := db.NearestTracks(ctx, 1, vec)
+		if err != nil {
+			return nil, fmt.Errorf("error getting nearest track for step %d: %w", i+1, err)
+		}
+		if len(results) == 0 {
+			return nil, fmt.Errorf("no track for step %d: %w", i+1, gorm.ErrRecordNotFound)
+		}
+		playlist = append(playlist, PathStep{
+			Track:    results[0],
+			Distance: vec.Distance(results[0].Vector()),
+		})
+	}
+
+	return playlist, nil
+}
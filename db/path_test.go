@@ -0,0 +1,38 @@
+//go:build sqlite_math_functions && fts5
+
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/amonks/genres/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestPath(t *testing.T) {
+	db := openAnalyzed(t, 100)
+	ctx := context.Background()
+
+	from, to := &data.Track{SpotifyID: "from"}, &data.Track{SpotifyID: "to", Energy: 1}
+	path, err := db.Path(ctx, from, to, 4)
+	require.NoError(t, err)
+	require.Len(t, path, 5)
+	assert.Equal(t, "from", path[0].SpotifyID)
+	for _, step := range path[1:] {
+		assert.NotEmpty(t, step.SpotifyID)
+	}
+}
+
+func TestPathEmpty(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "genres.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	from, to := &data.Track{SpotifyID: "from"}, &data.Track{SpotifyID: "to", Energy: 1}
+	_, err = db.Path(context.Background(), from, to, 4)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+}
@@ -0,0 +1,51 @@
+//go:build sqlite_math_functions && fts5
+
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/amonks/genres/data"
+	"gorm.io/gorm"
+)
+
+// GetPlaylist returns the playlist with the given spotify ID, along with its
+// tracks, in order, and their artists.
+func (db *DB) GetPlaylist(ctx context.Context, id string) (*data.Playlist, error) {
+	var playlists []data.Playlist
+	if err := db.ro.
+		WithContext(ctx).
+		Table("playlists").
+		Where("spotify_id = ?", id).
+		Find(&playlists).
+		Error; err != nil {
+		return nil, fmt.Errorf("error getting playlist '%s': %w", id, err)
+	}
+	if len(playlists) == 0 {
+		return nil, fmt.Errorf("error getting playlist '%s': %w", id, gorm.ErrRecordNotFound)
+	}
+	playlist := &playlists[0]
+
+	if err := db.ro.
+		WithContext(ctx).
+		Table("playlist_tracks").
+		Where("playlist_spotify_id = ?", id).
+		Order("position asc").
+		Find(&playlist.Tracks).
+		Error; err != nil {
+		return nil, fmt.Errorf("error getting tracks of playlist '%s': %w", id, err)
+	}
+	ids := make([]string, len(playlist.Tracks))
+	for i, track := range playlist.Tracks {
+		ids[i] = track.TrackSpotifyID
+	}
+	tracks, err := db.GetTracks(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range playlist.Tracks {
+		playlist.Tracks[i].Track = tracks[i]
+	}
+	return playlist, nil
+}
@@ -0,0 +1,78 @@
+//go:build sqlite_math_functions && fts5
+
+package db
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/amonks/genres/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestPlaylists(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "genres.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	ctx := context.Background()
+
+	for _, id := range []string{"p1", "p2"} {
+		require.NoError(t, db.InsertPlaylist(&data.Playlist{SpotifyID: id}))
+	}
+	toFetch := func(scope *Scope) []string {
+		playlists, err := db.GetPlaylistsToFetch(10, scope)
+		require.NoError(t, err)
+		return playlists
+	}
+	assert.Equal(t, []string{"p1", "p2"}, toFetch(nil))
+	assert.Equal(t, []string{"p2"}, toFetch(&Scope{Playlists: []string{"p2"}}))
+	assert.Empty(t, toFetch(&Scope{Artists: []string{"a1"}}))
+
+	for _, id := range []string{"t1", "t2"} {
+		require.NoError(t, db.InsertTrack(ctx, &data.Track{SpotifyID: id, Name: id, Artists: []data.Artist{{SpotifyID: "a1"}}}))
+	}
+	// t1 is in the playlist twice, and there's a gap where a local file
+	// was left out.
+	playlist := &data.Playlist{
+		SpotifyID: "p1",
+		Name:      "Playlist",
+		Followers: 10,
+		Tracks: []data.PlaylistTrack{
+			{Position: 0, TrackSpotifyID: "t2"},
+			{Position: 2, TrackSpotifyID: "t1"},
+			{Position: 3, TrackSpotifyID: "t1"},
+		},
+	}
+	require.NoError(t, db.PopulatePlaylist(ctx, playlist))
+	assert.Equal(t, []string{"p2"}, toFetch(nil))
+
+	got, err := db.GetPlaylist(ctx, "p1")
+	require.NoError(t, err)
+	assert.Equal(t, "Playlist", got.Name)
+	assert.Equal(t, int64(10), got.Followers)
+	assert.True(t, got.FetchedTracksAt.Valid)
+	require.Len(t, got.Tracks, 3)
+	for i, track := range got.Tracks {
+		assert.Equal(t, playlist.Tracks[i].Position, track.Position)
+		assert.Equal(t, playlist.Tracks[i].TrackSpotifyID, track.Track.SpotifyID)
+		assert.Len(t, track.Track.Artists, 1)
+	}
+
+	// A playlist's tracks are in its scope.
+	tracks, err := db.GetTracksToFetchAnalysis(10, PriorityPopularity, &Scope{Playlists: []string{"p1"}})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"t1", "t2"}, tracks)
+	tracks, err = db.GetTracksToFetchAnalysis(10, PriorityPopularity, &Scope{Playlists: []string{"p2"}})
+	require.NoError(t, err)
+	assert.Empty(t, tracks)
+
+	require.NoError(t, db.MarkPlaylistFailed("p2", errors.New("boom")))
+	assert.Empty(t, toFetch(nil))
+
+	_, err = db.GetPlaylist(ctx, "p3")
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+}
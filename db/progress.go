@@ -1,6 +1,9 @@
 package db
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 func (db *DB) CountGenresKnown() (int, error) {
 	var count int64
@@ -17,8 +20,7 @@ func (db *DB) CountGenresWithFetchedArtists() (int, error) {
 	var count int64
 	if err := db.ro.
 		Table("genres").
-		Where("fetched_artists_at is not null").
-		Or("failed_artists_at is not null").
+		Where(StageGenreArtists.done()).
 		Count(&count).
 		Error; err != nil {
 		return 0, fmt.Errorf("error counting genres with fetched artists: %w", err)
@@ -31,7 +33,7 @@ func (db *DB) CountGenresToFetchArtists() (int, error) {
 	if err := db.ro.
 		Table("genres").
 		Where("fetched_artists_at is null").
-		Where("failed_artists_at is null").
+		Where("(failed_artists_at is null or retry_artists_at <= ?)", time.Now().UTC()).
 		Count(&count).
 		Error; err != nil {
 		return 0, fmt.Errorf("error counting genres that need to fetch artists: %w", err)
@@ -39,13 +41,17 @@ func (db *DB) CountGenresToFetchArtists() (int, error) {
 	return int(count), nil
 }
 
-func (db *DB) GetGenresToFetchArtists(limit int) ([]string, error) {
+// GetGenresToFetchArtists returns up to limit genres in scope to fetch
+// artists for.
+func (db *DB) GetGenresToFetchArtists(limit int, scope *Scope) ([]string, error) {
+	inScope, args := scope.where(StageGenreArtists)
 	genreNames := []string{}
 	if err := db.ro.
-		Table("genres").
+		Table("genres t").
 		Limit(limit).
 		Where("fetched_artists_at is null").
-		Where("failed_artists_at is null").
+		Where("(failed_artists_at is null or retry_artists_at <= ?)", time.Now().UTC()).
+		Where(inScope, args...).
 		Pluck("name", &genreNames).
 		Error; err != nil {
 		return nil, err
@@ -57,8 +63,7 @@ func (db *DB) CountArtistsWithFetchedTracks() (int, error) {
 	var count int64
 	if err := db.ro.
 		Table("artists").
-		Where("fetched_tracks_at is not null").
-		Or("failed_tracks_at is not null").
+		Where(StageArtistTracks.done()).
 		Count(&count).
 		Error; err != nil {
 		return 0, err
@@ -71,7 +76,7 @@ func (db *DB) CountArtistsToFetchTracks() (int, error) {
 	if err := db.ro.
 		Table("artists").
 		Where("fetched_tracks_at is null").
-		Where("failed_tracks_at is null").
+		Where("(failed_tracks_at is null or retry_tracks_at <= ?)", time.Now().UTC()).
 		Count(&count).
 		Error; err != nil {
 		return 0, err
@@ -79,18 +84,10 @@ func (db *DB) CountArtistsToFetchTracks() (int, error) {
 	return int(count), nil
 }
 
-func (db *DB) GetArtistsToFetchTracks(limit int) ([]string, error) {
-	artists := []string{}
-	if err := db.ro.
-		Table("artists").
-		Limit(limit).
-		Where("fetched_tracks_at is null").
-		Where("failed_tracks_at is null").
-		Pluck("spotify_id", &artists).
-		Error; err != nil {
-		return nil, err
-	}
-	return artists, nil
+// GetArtistsToFetchTracks returns up to limit artists in scope to fetch tracks
+// for, in order of the given priority.
+func (db *DB) GetArtistsToFetchTracks(limit int, priority Priority, scope *Scope) ([]string, error) {
+	return db.getToFetch(StageArtistTracks, limit, priority, scope)
 }
 
 func (db *DB) CountArtistsToFetchAlbums() (int, error) {
@@ -98,7 +95,7 @@ func (db *DB) CountArtistsToFetchAlbums() (int, error) {
 	if err := db.ro.
 		Table("artists").
 		Where("fetched_albums_at is null").
-		Where("failed_albums_at is null").
+		Where("(failed_albums_at is null or retry_albums_at <= ?)", time.Now().UTC()).
 		Count(&count).
 		Error; err != nil {
 		return 0, err
@@ -110,8 +107,7 @@ func (db *DB) CountArtistsWithFetchedAlbums() (int, error) {
 	var count int64
 	if err := db.ro.
 		Table("artists").
-		Where("fetched_albums_at is not null").
-		Or("failed_albums_at is not null").
+		Where(StageArtistAlbums.done()).
 		Count(&count).
 		Error; err != nil {
 		return 0, err
@@ -119,18 +115,61 @@ func (db *DB) CountArtistsWithFetchedAlbums() (int, error) {
 	return int(count), nil
 }
 
-func (db *DB) GetArtistsToFetchAlbums(limit int) ([]string, error) {
-	artists := []string{}
+// GetArtistsToFetchAlbums returns up to limit artists in scope to fetch albums
+// for, in order of the given priority.
+func (db *DB) GetArtistsToFetchAlbums(limit int, priority Priority, scope *Scope) ([]string, error) {
+	return db.getToFetch(StageArtistAlbums, limit, priority, scope)
+}
+
+func (db *DB) CountArtistsToFetchRelated() (int, error) {
+	var count int64
 	if err := db.ro.
 		Table("artists").
+		Where("fetched_related_at is null").
+		Where("(failed_related_at is null or retry_related_at <= ?)", time.Now().UTC()).
+		Count(&count).
+		Error; err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// GetArtistsToFetchRelated returns up to limit artists in scope to fetch
+// related artists for, in order of the given priority.
+func (db *DB) GetArtistsToFetchRelated(limit int, priority Priority, scope *Scope) ([]string, error) {
+	return db.getToFetch(StageRelatedArtists, limit, priority, scope)
+}
+
+func (db *DB) CountPlaylistsToFetch() (int, error) {
+	var count int64
+	if err := db.ro.
+		Table("playlists").
+		Where("fetched_tracks_at is null").
+		Where("(failed_tracks_at is null or retry_tracks_at <= ?)", time.Now().UTC()).
+		Count(&count).
+		Error; err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// GetPlaylistsToFetch returns up to limit playlists in scope to fetch, in the
+// order they were added.
+func (db *DB) GetPlaylistsToFetch(limit int, scope *Scope) ([]string, error) {
+	inScope, args := scope.where(StagePlaylistTracks)
+	var playlists []string
+	if err := db.ro.
+		Table("playlists t").
+		Where("fetched_tracks_at is null").
+		Where("(failed_tracks_at is null or retry_tracks_at <= ?)", time.Now().UTC()).
+		Where(inScope, args...).
+		Order("rowid asc").
 		Limit(limit).
-		Where("fetched_albums_at is null").
-		Where("failed_albums_at is null").
-		Pluck("spotify_id", &artists).
+		Pluck("spotify_id", &playlists).
 		Error; err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error getting playlists to fetch: %w", err)
 	}
-	return artists, nil
+	return playlists, nil
 }
 
 func (db *DB) CountAlbumsToFetchTracks() (int, error) {
@@ -138,7 +177,7 @@ func (db *DB) CountAlbumsToFetchTracks() (int, error) {
 	if err := db.ro.
 		Table("albums").
 		Where("fetched_tracks_at is null").
-		Where("failed_tracks_at is null").
+		Where("(failed_tracks_at is null or retry_tracks_at <= ?)", time.Now().UTC()).
 		Count(&count).
 		Error; err != nil {
 		return 0, err
@@ -150,8 +189,7 @@ func (db *DB) CountAlbumsWithFetchedTracks() (int, error) {
 	var count int64
 	if err := db.ro.
 		Table("albums").
-		Where("fetched_tracks_at is not null").
-		Or("failed_tracks_at is not null").
+		Where(StageAlbumTracks.done()).
 		Count(&count).
 		Error; err != nil {
 		return 0, err
@@ -159,14 +197,16 @@ func (db *DB) CountAlbumsWithFetchedTracks() (int, error) {
 	return int(count), nil
 }
 
-func (db *DB) GetAlbumsToRefetchTracks(limit int) ([]string, error) {
+func (db *DB) GetAlbumsToRefetchTracks(limit int, scope *Scope) ([]string, error) {
+	inScope, args := scope.where(StageAlbumTracks)
 	albums := []string{}
 	if err := db.ro.
-		Table("albums").
+		Table("albums t").
 		Limit(limit).
 		Where("fetched_tracks_at is not null").
 		Where("fetched_tracks_at < '2024-09-12 09:00:00.000000000-05:00'").
-		Where("failed_tracks_at is null").
+		Where("(failed_tracks_at is null or retry_tracks_at <= ?)", time.Now().UTC()).
+		Where(inScope, args...).
 		Pluck("spotify_id", &albums).
 		Error; err != nil {
 		return nil, err
@@ -174,26 +214,17 @@ func (db *DB) GetAlbumsToRefetchTracks(limit int) ([]string, error) {
 	return albums, nil
 }
 
-func (db *DB) GetAlbumsToFetchTracks(limit int) ([]string, error) {
-	albums := []string{}
-	if err := db.ro.
-		Table("albums").
-		Limit(limit).
-		Where("fetched_tracks_at is null").
-		Where("failed_tracks_at is null").
-		Pluck("spotify_id", &albums).
-		Error; err != nil {
-		return nil, err
-	}
-	return albums, nil
+// GetAlbumsToFetchTracks returns up to limit albums in scope to fetch tracks
+// for, in order of the given priority.
+func (db *DB) GetAlbumsToFetchTracks(limit int, priority Priority, scope *Scope) ([]string, error) {
+	return db.getToFetch(StageAlbumTracks, limit, priority, scope)
 }
 
 func (db *DB) CountTracksWithFetchedAnalysis() (int, error) {
 	var count int64
 	if err := db.ro.
 		Table("tracks").
-		Where("fetched_analysis_at is not null").
-		Or("failed_analysis_at is not null").
+		Where(StageTrackAnalyses.done()).
 		Count(&count).
 		Error; err != nil {
 		return 0, err
@@ -206,7 +237,7 @@ func (db *DB) CountTracksToFetchAnalysis() (int, error) {
 	if err := db.ro.
 		Table("tracks").
 		Where("fetched_analysis_at is null").
-		Where("failed_analysis_at is null").
+		Where("(failed_analysis_at is null or retry_analysis_at <= ?)", time.Now().UTC()).
 		Count(&count).
 		Error; err != nil {
 		return 0, err
@@ -214,18 +245,10 @@ func (db *DB) CountTracksToFetchAnalysis() (int, error) {
 	return int(count), nil
 }
 
-func (db *DB) GetTracksToFetchAnalysis(limit int) ([]string, error) {
-	tracks := []string{}
-	if err := db.ro.
-		Table("tracks").
-		Limit(limit).
-		Where("fetched_analysis_at is null").
-		Where("failed_analysis_at is null").
-		Pluck("spotify_id", &tracks).
-		Error; err != nil {
-		return nil, err
-	}
-	return tracks, nil
+// GetTracksToFetchAnalysis returns up to limit tracks in scope to fetch analysis
+// for, in order of the given priority.
+func (db *DB) GetTracksToFetchAnalysis(limit int, priority Priority, scope *Scope) ([]string, error) {
+	return db.getToFetch(StageTrackAnalyses, limit, priority, scope)
 }
 
 func (db *DB) CountArtistsKnown() (int, error) {
@@ -243,8 +266,7 @@ func (db *DB) CountArtistAlbumsDone() (int, error) {
 	var count int64
 	if err := db.ro.
 		Table("artists").
-		Where("fetched_albums_at is not null").
-		Or("failed_albums_at is not null").
+		Where(StageArtistAlbums.done()).
 		Count(&count).
 		Error; err != nil {
 		return 0, err
@@ -256,8 +278,7 @@ func (db *DB) CountArtistTracksDone() (int, error) {
 	var count int64
 	if err := db.ro.
 		Table("artists").
-		Where("fetched_tracks_at is not null").
-		Or("failed_tracks_at is not null").
+		Where(StageArtistTracks.done()).
 		Count(&count).
 		Error; err != nil {
 		return 0, err
@@ -269,8 +290,8 @@ func (db *DB) CountArtistsDone() (int, error) {
 	var count int64
 	if err := db.ro.
 		Table("artists").
-		Where("(fetched_tracks_at is not null or failed_tracks_at is not null)").
-		Where("fetched_albums_at is not null or failed_albums_at is not null").
+		Where(StageArtistTracks.done()).
+		Where(StageArtistAlbums.done()).
 		Count(&count).
 		Error; err != nil {
 		return 0, err
@@ -293,8 +314,7 @@ func (db *DB) CountAlbumsDone() (int, error) {
 	var count int64
 	if err := db.ro.
 		Table("albums").
-		Where("fetched_tracks_at is not null").
-		Or("failed_tracks_at is not null").
+		Where(StageAlbumTracks.done()).
 		Count(&count).
 		Error; err != nil {
 		return 0, err
@@ -317,8 +337,7 @@ func (db *DB) CountTracksDone() (int, error) {
 	var count int64
 	if err := db.ro.
 		Table("tracks").
-		Where("fetched_analysis_at is not null").
-		Or("failed_analysis_at is not null").
+		Where(StageTrackAnalyses.done()).
 		Count(&count).
 		Error; err != nil {
 		return 0, err
@@ -5,123 +5,202 @@ package db
 import (
 	"context"
 	"fmt"
-	"strings"
 
 	"github.com/amonks/genres/data"
+	"gorm.io/gorm"
 )
 
-// approach:
-// let's say our query is {"energy": 0.4, "liveness": 0.3}
-//  1. we set a threshold value, `epsilon`
-//  2. we query for tracks whose energy and liveness are _both_ within `epsilon`
-//     of the input values, sorted by distance
-//  3. if we didn't get enough, we repeat with a larger `epsilon`.
+// NearestTracks returns up to count analyzed tracks nearest to the given
+// vector, nearest first. Features missing from the vector are ignored.
+//
+// It uses an in-memory k-d tree (see UpdateKNNIndex), which is loaded on first
+// use and caught up with the database on every call.
 func (db *DB) NearestTracks(ctx context.Context, count int, input data.Vector) ([]data.Track, error) {
-	var ids []string
-	for epsilon := 0.01; ; epsilon *= 2 {
-		if err := ctx.Err(); err != nil {
-			return nil, fmt.Errorf("canceled: %w", err)
-		}
-
-		var terms []string
-		for k, v := range input {
-			terms = append(terms, fmt.Sprintf("pow(tracks.%s - %f, 2.0)", k, v))
-		}
-		q := db.ro.
-			Table("tracks").
-			Where("fetched_analysis_at is not null").
-			Order(fmt.Sprintf("%s asc", strings.Join(terms, " + "))).
-			Limit(count)
-		for k, v := range input {
-			q = q.Where(fmt.Sprintf("%s between %f and %f", k, v-epsilon, v+epsilon))
-		}
-		if err := q.Pluck("spotify_id", &ids).Error; err != nil {
-			return nil, fmt.Errorf("error finding tracks: %w", err)
-		}
-		if len(ids) == count {
-			break
-		}
+	knnIDs, err := db.nearestTrackIDs(ctx, count, input)
+	if err != nil {
+		return nil, fmt.Errorf("error finding tracks: %w", err)
 	}
 
-	tracks := make([]data.Track, len(ids))
-	for i, id := range ids {
-		if err := ctx.Err(); err != nil {
-			return nil, fmt.Errorf("canceled: %w", err)
-		}
-
-		track, err := db.GetTrack(ctx, id)
-		if err != nil {
-			return nil, fmt.Errorf("error getting track %d ('%s'): %w", i+1, id, err)
-		}
-		tracks[i] = *track
+	var rows []struct {
+		ID        int64
+		SpotifyID string
+	}
+	if err := db.ro.
+		WithContext(ctx).
+		Table("knn_tracks").
+		Select("id, spotify_id").
+		Where("id in ?", knnIDs).
+		Scan(&rows).
+		Error; err != nil {
+		return nil, fmt.Errorf("error getting spotify ids of %d tracks: %w", len(knnIDs), err)
+	}
+	spotifyIDs := make(map[int64]string, len(rows))
+	for _, row := range rows {
+		spotifyIDs[row.ID] = row.SpotifyID
+	}
+	ids := make([]string, len(knnIDs))
+	for i, id := range knnIDs {
+		ids[i] = spotifyIDs[id]
 	}
 
-	return tracks, nil
+	return db.GetTracks(ctx, ids)
 }
 
+// GetTrack returns the track with the given spotify ID, along with its
+// artists.
 func (db *DB) GetTrack(ctx context.Context, id string) (*data.Track, error) {
-	var track data.Track
+	tracks, err := db.GetTracks(ctx, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	return &tracks[0], nil
+}
+
+// GetTracks returns the tracks with the given spotify IDs, in the same order,
+// along with their artists and the artists' genres. If any of the tracks, or
+// any of their credited artists, doesn't exist, GetTracks returns an error
+// wrapping gorm.ErrRecordNotFound.
+func (db *DB) GetTracks(ctx context.Context, ids []string) ([]data.Track, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var rows []data.Track
 	if err := db.ro.
+		WithContext(ctx).
 		Table("tracks").
-		Where("spotify_id = ?", id).
-		First(&track).
+		Where("spotify_id in ?", ids).
+		Find(&rows).
 		Error; err != nil {
-		return nil, fmt.Errorf("error getting track '%s': %w", id, err)
+		return nil, fmt.Errorf("error getting %d tracks: %w", len(ids), err)
+	}
+	byID := make(map[string]*data.Track, len(rows))
+	for i := range rows {
+		byID[rows[i].SpotifyID] = &rows[i]
 	}
 	if err := ctx.Err(); err != nil {
 		return nil, fmt.Errorf("canceled: %w", err)
 	}
 
-	var trackArtistIDs []string
+	// Artists are returned in the order they were credited.
+	var credits []struct {
+		TrackSpotifyID  string
+		ArtistSpotifyID string
+		data.Artist
+	}
 	if err := db.ro.
+		WithContext(ctx).
 		Table("track_artists").
-		Where("track_spotify_id = ?", id).
-		Pluck("artist_spotify_id", &trackArtistIDs).
+		Select("track_artists.track_spotify_id, track_artists.artist_spotify_id, artists.*").
+		Joins("left join artists on artists.spotify_id = track_artists.artist_spotify_id").
+		Where("track_artists.track_spotify_id in ?", ids).
+		Order("track_artists.rowid asc").
+		Find(&credits).
 		Error; err != nil {
-		return nil, fmt.Errorf("error getting artist IDs for track '%s': %w", id, err)
+		return nil, fmt.Errorf("error getting artists for %d tracks: %w", len(ids), err)
 	}
-	if err := ctx.Err(); err != nil {
-		return nil, fmt.Errorf("canceled: %w", err)
+	artists := make([]data.Artist, len(credits))
+	for i, credit := range credits {
+		if credit.Artist.SpotifyID == "" {
+			return nil, fmt.Errorf("error getting artist '%s' of track '%s': %w", credit.ArtistSpotifyID, credit.TrackSpotifyID, gorm.ErrRecordNotFound)
+		}
+		artists[i] = credit.Artist
 	}
-
-	track.Artists = make([]data.Artist, len(trackArtistIDs))
-	artistCache := map[string]*data.Artist{}
-	for i, artistID := range trackArtistIDs {
-		if err := ctx.Err(); err != nil {
-			return nil, fmt.Errorf("canceled: %w", err)
+	if err := db.loadArtistGenres(ctx, artists); err != nil {
+		return nil, err
+	}
+	for i, credit := range credits {
+		if track, ok := byID[credit.TrackSpotifyID]; ok {
+			track.Artists = append(track.Artists, artists[i])
 		}
+	}
 
-		if artist, has := artistCache[artistID]; has {
-			track.Artists[i] = *artist
-			continue
+	tracks := make([]data.Track, len(ids))
+	for i, id := range ids {
+		track, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("error getting track '%s': %w", id, gorm.ErrRecordNotFound)
 		}
-		artist, err := db.GetArtist(artistID)
-		if err != nil {
-			return nil, fmt.Errorf("error getting artist '%s': %w", artistID, err)
+		if track.Artists == nil {
+			track.Artists = []data.Artist{}
 		}
-		artistCache[artistID] = artist
-		track.Artists[i] = *artist
+		tracks[i] = *track
 	}
-	return &track, nil
+	return tracks, nil
+}
+
+// GetArtist returns the artist with the given spotify ID, along with their
+// genres.
+func (db *DB) GetArtist(ctx context.Context, id string) (*data.Artist, error) {
+	artists, err := db.GetArtists(ctx, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	return &artists[0], nil
 }
 
-func (db *DB) GetArtist(id string) (*data.Artist, error) {
-	var artist data.Artist
+// GetArtists returns the artists with the given spotify IDs, in the same
+// order, along with their genres. If any of the artists doesn't exist,
+// GetArtists returns an error wrapping gorm.ErrRecordNotFound.
+func (db *DB) GetArtists(ctx context.Context, ids []string) ([]data.Artist, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var rows []data.Artist
 	if err := db.ro.
+		WithContext(ctx).
 		Table("artists").
-		Where("spotify_id = ?", id).
-		First(&artist).
+		Where("spotify_id in ?", ids).
+		Find(&rows).
 		Error; err != nil {
-		return nil, fmt.Errorf("error getting artist '%s': %w", id, err)
+		return nil, fmt.Errorf("error getting %d artists: %w", len(ids), err)
 	}
-	var genres []string
+	if err := db.loadArtistGenres(ctx, rows); err != nil {
+		return nil, err
+	}
+	byID := make(map[string]data.Artist, len(rows))
+	for _, artist := range rows {
+		byID[artist.SpotifyID] = artist
+	}
+
+	artists := make([]data.Artist, len(ids))
+	for i, id := range ids {
+		artist, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("error getting artist '%s': %w", id, gorm.ErrRecordNotFound)
+		}
+		artists[i] = artist
+	}
+	return artists, nil
+}
+
+// loadArtistGenres sets the Genres of each of the given artists, with a single
+// query.
+func (db *DB) loadArtistGenres(ctx context.Context, artists []data.Artist) error {
+	if len(artists) == 0 {
+		return nil
+	}
+	ids := make([]string, len(artists))
+	for i, artist := range artists {
+		ids[i] = artist.SpotifyID
+	}
+
+	var rows []data.ArtistGenre
 	if err := db.ro.
+		WithContext(ctx).
 		Table("artist_genres").
-		Where("artist_spotify_id = ?", id).
-		Pluck("genre_name", &genres).
+		Where("artist_spotify_id in ?", ids).
+		Find(&rows).
 		Error; err != nil {
-		return nil, fmt.Errorf("error getting genres for artist '%s': %w", id, err)
+		return fmt.Errorf("error getting genres for %d artists: %w", len(artists), err)
+	}
+	genres := make(map[string][]string, len(artists))
+	for _, row := range rows {
+		genres[row.ArtistSpotifyID] = append(genres[row.ArtistSpotifyID], row.GenreName)
+	}
+	for i := range artists {
+		artists[i].Genres = genres[artists[i].SpotifyID]
 	}
-	artist.Genres = genres
-	return &artist, nil
+	return nil
 }
@@ -0,0 +1,280 @@
+//go:build sqlite_math_functions && fts5
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/amonks/genres/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// openAnalyzed returns a database with n analyzed tracks with random
+// features.
+func openAnalyzed(tb testing.TB, n int) *DB {
+	db, err := Open(filepath.Join(tb.TempDir(), "genres.db"))
+	require.NoError(tb, err)
+	tb.Cleanup(func() { db.Close() })
+
+	var features []string
+	for _, feature := range data.Features {
+		features = append(features, fmt.Sprintf("abs(random() %% 1000000) / 1000000.0 as %s", feature))
+	}
+	require.NoError(tb, db.rw.Exec(`
+		with recursive n(i) as (select 1 union all select i + 1 from n where i < ?)
+		insert into tracks (spotify_id, name, fetched_analysis_at, `+strings.Join(data.Features, ", ")+`)
+		select 'track' || i, 'track ' || i, datetime('now'), `+strings.Join(features, ", ")+`
+		from n`, n).Error)
+	require.NoError(tb, db.rw.Exec(`insert into knn_tracks (spotify_id) select spotify_id from tracks`).Error)
+	require.NoError(tb, db.rw.Exec(`insert into knn_log (track_id) select id from knn_tracks`).Error)
+
+	return db
+}
+
+// nearestTracksScan is how NearestTracks used to work, before the knn index,
+// kept here for comparison:
+//  1. we set a threshold value, `epsilon`
+//  2. we query for tracks whose features are _all_ within `epsilon` of the
+//     input values, sorted by distance
+//  3. if we didn't get enough, we repeat with a larger `epsilon`.
+func (db *DB) nearestTracksScan(count int, input data.Vector) ([]string, error) {
+	var ids []string
+	for epsilon := 0.01; ; epsilon *= 2 {
+		var terms []string
+		for k, v := range input {
+			terms = append(terms, fmt.Sprintf("pow(tracks.%s - %f, 2.0)", k, v))
+		}
+		q := db.ro.
+			Table("tracks").
+			Where("fetched_analysis_at is not null").
+			Order(fmt.Sprintf("%s asc", strings.Join(terms, " + "))).
+			Limit(count)
+		for k, v := range input {
+			q = q.Where(fmt.Sprintf("%s between %f and %f", k, v-epsilon, v+epsilon))
+		}
+		if err := q.Pluck("spotify_id", &ids).Error; err != nil {
+			return nil, err
+		}
+		if len(ids) == count {
+			return ids, nil
+		}
+	}
+}
+
+// nearestTracksExact orders every analyzed track by distance. The scan above
+// isn't exact: a track just outside the box can be nearer than one in its
+// corner.
+func (db *DB) nearestTracksExact(count int, input data.Vector) ([]string, error) {
+	var terms []string
+	for k, v := range input {
+		terms = append(terms, fmt.Sprintf("pow(tracks.%s - %f, 2.0)", k, v))
+	}
+	var ids []string
+	if err := db.ro.
+		Table("tracks").
+		Where("fetched_analysis_at is not null").
+		Order(fmt.Sprintf("%s asc", strings.Join(terms, " + "))).
+		Limit(count).
+		Pluck("spotify_id", &ids).
+		Error; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func randomVector(rng *rand.Rand) data.Vector {
+	vec := data.Vector{}
+	for _, feature := range data.Features {
+		vec[feature] = rng.Float64()
+	}
+	return vec
+}
+
+func TestNearestTracks(t *testing.T) {
+	db := openAnalyzed(t, 2_000)
+	ctx := context.Background()
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 20; i++ {
+		input := randomVector(rng)
+		expect, err := db.nearestTracksExact(5, input)
+		require.NoError(t, err)
+
+		got, err := db.NearestTracks(ctx, 5, input)
+		require.NoError(t, err)
+		gotIDs := make([]string, len(got))
+		for i, track := range got {
+			gotIDs[i] = track.SpotifyID
+		}
+		assert.Equal(t, expect, gotIDs)
+	}
+}
+
+func TestNearestTracksFewerThanCount(t *testing.T) {
+	db := openAnalyzed(t, 3)
+
+	got, err := db.NearestTracks(context.Background(), 10, data.Vector{"energy": 0.5})
+	require.NoError(t, err)
+	assert.Len(t, got, 3)
+}
+
+func TestUpdateKNNIndex(t *testing.T) {
+	db := openAnalyzed(t, 100)
+	ctx := context.Background()
+	require.NoError(t, db.UpdateKNNIndex(ctx))
+
+	require.NoError(t, db.InsertTrack(ctx, &data.Track{SpotifyID: "new"}))
+	require.NoError(t, db.AddTrackAnalyses(ctx, []data.Track{{SpotifyID: "new", Energy: 5}}))
+	require.NoError(t, db.UpdateKNNIndex(ctx))
+
+	// a fresh process loads the file rather than reading the whole log
+	reopened, err := Open(db.filename)
+	require.NoError(t, err)
+	defer reopened.Close()
+	got, err := reopened.NearestTracks(ctx, 1, data.Vector{"energy": 5})
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, "new", got[0].SpotifyID)
+	assert.Equal(t, 101, reopened.knn.tree.Len())
+}
+
+func TestKNNReanalyzed(t *testing.T) {
+	db := openAnalyzed(t, 100)
+	ctx := context.Background()
+
+	require.NoError(t, db.InsertTrack(ctx, &data.Track{SpotifyID: "new"}))
+	require.NoError(t, db.AddTrackAnalyses(ctx, []data.Track{{SpotifyID: "new", Energy: 5}}))
+	require.NoError(t, db.UpdateKNNIndex(ctx))
+	_, err := db.NearestTracks(ctx, 1, data.Vector{"energy": 5})
+	require.NoError(t, err)
+
+	require.NoError(t, db.AddTrackAnalyses(ctx, []data.Track{{SpotifyID: "new", Energy: -5}}))
+	require.NoError(t, db.UpdateKNNIndex(ctx))
+
+	reopened, err := Open(db.filename)
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	for _, db := range []*DB{db, reopened} {
+		got, err := db.NearestTracks(ctx, 101, data.Vector{"energy": -5})
+		require.NoError(t, err)
+		require.Len(t, got, 101)
+		assert.Equal(t, "new", got[0].SpotifyID)
+		seen := map[string]bool{}
+		for _, track := range got {
+			assert.False(t, seen[track.SpotifyID], "%s returned twice", track.SpotifyID)
+			seen[track.SpotifyID] = true
+		}
+		assert.Equal(t, 101, db.knn.tree.Len())
+	}
+}
+
+func TestKNNVacuum(t *testing.T) {
+	db := openAnalyzed(t, 100)
+	ctx := context.Background()
+
+	// leave gaps in the tracks' rowids for VACUUM to close up
+	require.NoError(t, db.rw.Exec(`delete from knn_log where track_id in (select id from knn_tracks where id % 3 = 0)`).Error)
+	require.NoError(t, db.rw.Exec(`delete from knn_tracks where id % 3 = 0`).Error)
+	require.NoError(t, db.rw.Exec(`delete from tracks where spotify_id not in (select spotify_id from knn_tracks)`).Error)
+	require.NoError(t, db.UpdateKNNIndex(ctx))
+
+	input := data.Vector{"energy": 0.5, "valence": 0.5}
+	expect, err := db.NearestTracks(ctx, 10, input)
+	require.NoError(t, err)
+	require.NoError(t, db.rw.Exec(`vacuum`).Error)
+	require.NoError(t, db.Close())
+
+	reopened, err := Open(db.filename)
+	require.NoError(t, err)
+	defer reopened.Close()
+	got, err := reopened.NearestTracks(ctx, 10, input)
+	require.NoError(t, err)
+	assert.Equal(t, expect, got)
+}
+
+const benchmarkTracks = 200_000
+
+func BenchmarkNearestTracks(b *testing.B) {
+	db := openAnalyzed(b, benchmarkTracks)
+	ctx := context.Background()
+	rng := rand.New(rand.NewSource(1))
+	require.NoError(b, db.refreshKNN(ctx))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := db.nearestTrackIDs(ctx, 10, randomVector(rng)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNearestTracksScan(b *testing.B) {
+	db := openAnalyzed(b, benchmarkTracks)
+	rng := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := db.nearestTracksScan(10, randomVector(rng)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestGetTracks(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "genres.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	ctx := context.Background()
+
+	require.NoError(t, db.rw.Exec(`
+		insert into genres (name) values ('a'), ('b');
+		insert into artists (spotify_id, name) values ('x', 'x'), ('y', 'y'), ('z', 'z');
+		insert into artist_genres (artist_spotify_id, genre_name) values ('x', 'a'), ('x', 'b'), ('y', 'b');
+		insert into tracks (spotify_id, name) values ('1', 'one'), ('2', 'two'), ('3', 'three');
+		insert into track_artists (track_spotify_id, artist_spotify_id) values ('1', 'y'), ('1', 'x'), ('2', 'x');
+	`).Error)
+
+	tracks, err := db.GetTracks(ctx, []string{"3", "1", "2"})
+	require.NoError(t, err)
+	require.Len(t, tracks, 3)
+	assert.Equal(t, []string{"3", "1", "2"}, []string{tracks[0].SpotifyID, tracks[1].SpotifyID, tracks[2].SpotifyID})
+
+	assert.Empty(t, tracks[0].Artists)
+	require.Len(t, tracks[1].Artists, 2)
+	assert.Equal(t, "y", tracks[1].Artists[0].SpotifyID)
+	assert.Equal(t, []string{"b"}, tracks[1].Artists[0].Genres)
+	assert.Equal(t, "x", tracks[1].Artists[1].SpotifyID)
+	assert.ElementsMatch(t, []string{"a", "b"}, tracks[1].Artists[1].Genres)
+	require.Len(t, tracks[2].Artists, 1)
+	assert.Equal(t, "x", tracks[2].Artists[0].SpotifyID)
+
+	_, err = db.GetTracks(ctx, []string{"1", "missing"})
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	// A credited artist who's missing from artists, as can happen in
+	// databases written without foreign keys enforced, is an error too,
+	// rather than being left off the track.
+	require.NoError(t, db.rw.Exec(`
+		pragma foreign_keys = off;
+		insert into track_artists (track_spotify_id, artist_spotify_id) values ('3', 'gone');
+		pragma foreign_keys = on;
+	`).Error)
+	_, err = db.GetTracks(ctx, []string{"3"})
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+	assert.ErrorContains(t, err, "gone")
+
+	artists, err := db.GetArtists(ctx, []string{"z", "x"})
+	require.NoError(t, err)
+	require.Len(t, artists, 2)
+	assert.Equal(t, "z", artists[0].SpotifyID)
+	assert.Empty(t, artists[0].Genres)
+	assert.ElementsMatch(t, []string{"a", "b"}, artists[1].Genres)
+}
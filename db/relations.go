@@ -0,0 +1,84 @@
+//go:build sqlite_math_functions && fts5
+
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/amonks/genres/data"
+)
+
+// GetRelatedArtists returns the artists related to the artist with the given
+// spotify ID, most related first, along with their genres.
+func (db *DB) GetRelatedArtists(ctx context.Context, id string) ([]data.Artist, error) {
+	var ids []string
+	if err := db.ro.
+		WithContext(ctx).
+		Table("artist_relations").
+		Where("artist_spotify_id = ?", id).
+		Order("rank asc").
+		Pluck("related_artist_spotify_id", &ids).
+		Error; err != nil {
+		return nil, fmt.Errorf("error getting artists related to '%s': %w", id, err)
+	}
+	return db.GetArtists(ctx, ids)
+}
+
+// An ArtistNeighbor is an artist in the neighborhood of another, along with
+// the number of relations between them.
+type ArtistNeighbor struct {
+	data.Artist
+	Distance int
+}
+
+// GetArtistNeighborhood returns up to limit artists within depth relations of
+// the artist with the given spotify ID, nearest first, and then most popular
+// first. Relations are followed in both directions.
+func (db *DB) GetArtistNeighborhood(ctx context.Context, id string, depth, limit int) ([]ArtistNeighbor, error) {
+	var rows []struct {
+		SpotifyID string
+		Distance  int
+	}
+	if err := db.ro.
+		WithContext(ctx).
+		Raw(`
+			with recursive hops(spotify_id, distance) as (
+				select ?, 0
+				union
+				select case when r.artist_spotify_id = h.spotify_id
+					then r.related_artist_spotify_id
+					else r.artist_spotify_id
+				end, h.distance + 1
+				from hops h
+				join artist_relations r on r.artist_spotify_id = h.spotify_id or r.related_artist_spotify_id = h.spotify_id
+				where h.distance < ?
+			)
+			select h.spotify_id, min(h.distance) as distance
+			from hops h join artists a on a.spotify_id = h.spotify_id
+			where h.spotify_id != ?
+			group by h.spotify_id
+			order by distance asc, a.popularity desc, h.spotify_id asc
+			limit ?`, id, depth, id, limit).
+		Scan(&rows).
+		Error; err != nil {
+		return nil, fmt.Errorf("error getting neighborhood of artist '%s': %w", id, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("canceled: %w", err)
+	}
+
+	ids := make([]string, len(rows))
+	for i, row := range rows {
+		ids[i] = row.SpotifyID
+	}
+	artists, err := db.GetArtists(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	neighbors := make([]ArtistNeighbor, len(rows))
+	for i, row := range rows {
+		neighbors[i] = ArtistNeighbor{Artist: artists[i], Distance: row.Distance}
+	}
+	return neighbors, nil
+}
@@ -0,0 +1,58 @@
+//go:build sqlite_math_functions && fts5
+
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/amonks/genres/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtistRelations(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "genres.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	ctx := context.Background()
+
+	// a1 -> a2 -> a3 -> a4, and a1 -> a5.
+	require.NoError(t, db.InsertArtist(ctx, &data.Artist{SpotifyID: "a1"}))
+	relate := func(id string, related ...data.Artist) {
+		require.NoError(t, db.InsertArtistRelations(ctx, id, related))
+	}
+	relate("a1", data.Artist{SpotifyID: "a5", Popularity: 10}, data.Artist{SpotifyID: "a2", Popularity: 50, Genres: []string{"pop"}})
+	relate("a2", data.Artist{SpotifyID: "a3"})
+	relate("a3", data.Artist{SpotifyID: "a4"})
+
+	remaining, err := db.CountArtistsToFetchRelated()
+	require.NoError(t, err)
+	assert.Equal(t, 2, remaining)
+	toFetch, err := db.GetArtistsToFetchRelated(10, PriorityPopularity, nil)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a4", "a5"}, toFetch)
+
+	related, err := db.GetRelatedArtists(ctx, "a1")
+	require.NoError(t, err)
+	require.Len(t, related, 2)
+	assert.Equal(t, "a5", related[0].SpotifyID)
+	assert.Equal(t, []string{"pop"}, related[1].Genres)
+
+	neighbors := func(id string, depth, limit int) map[string]int {
+		neighborhood, err := db.GetArtistNeighborhood(ctx, id, depth, limit)
+		require.NoError(t, err)
+		distances := map[string]int{}
+		for _, neighbor := range neighborhood {
+			distances[neighbor.SpotifyID] = neighbor.Distance
+		}
+		return distances
+	}
+	assert.Equal(t, map[string]int{"a1": 1, "a3": 1}, neighbors("a2", 1, 10))
+	// Relations are followed both ways.
+	assert.Equal(t, map[string]int{"a1": 1, "a3": 1, "a4": 2, "a5": 2}, neighbors("a2", 3, 10))
+	assert.Equal(t, map[string]int{"a2": 1, "a5": 1, "a3": 2}, neighbors("a1", 2, 10))
+	// The nearest, most popular neighbors come first.
+	assert.Equal(t, map[string]int{"a2": 1}, neighbors("a1", 2, 1))
+}
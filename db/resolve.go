@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/amonks/genres/data"
+	"gorm.io/gorm"
 )
 
 func (db *DB) Resolve(ctx context.Context, input string) (*data.Track, error) {
@@ -21,12 +22,12 @@ func (db *DB) Resolve(ctx context.Context, input string) (*data.Track, error) {
 			return nil, err
 		}
 		if len(tracks) == 0 {
-			return nil, fmt.Errorf("no track found for query '%s'", arg)
+			return nil, fmt.Errorf("no track found for query '%s': %w", arg, gorm.ErrRecordNotFound)
 		}
 		return &tracks[0], nil
 	case "id":
 		return db.GetTrack(ctx, arg)
 	default:
-		return nil, fmt.Errorf("unknown search cmd '%s'", cmd)
+		return nil, fmt.Errorf("unknown search cmd '%s': %w", cmd, ErrBadQuery)
 	}
 }
@@ -0,0 +1,314 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/amonks/genres/data"
+	"gorm.io/gorm"
+)
+
+// mappedGenre is a condition matching genres that have a position in ENAO
+// genre space. Genres discovered on artists or albums, rather than scraped
+// from everynoise.com, have no position and must be excluded from bounds.
+const mappedGenre = "genres.key is not null and genres.key != ''"
+
+// genreBoundsColumns computes, in a grouped query, the bounds of the genres
+// joined as "genres".
+const genreBoundsColumns = `
+	min(genres.energy), max(genres.energy),
+	min(genres.dynamic_variation), max(genres.dynamic_variation),
+	min(genres.instrumentalness), max(genres.instrumentalness),
+	min(genres.organicness), max(genres.organicness),
+	min(genres.bounciness), max(genres.bounciness)`
+
+const rtreeColumns = `
+	id,
+	min_energy, max_energy,
+	min_dynamic_variation, max_dynamic_variation,
+	min_instrumentalness, max_instrumentalness,
+	min_organicness, max_organicness,
+	min_bounciness, max_bounciness`
+
+func (db *DB) CountArtistsToIndexGenresRtree() (int, error) {
+	var count int64
+	if err := db.ro.
+		Table("artists").
+		Where("indexed_genres_rtree_at is null").
+		Count(&count).
+		Error; err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+func (db *DB) GetArtistsToIndexGenresRtree(limit int) ([]string, error) {
+	artists := []string{}
+	if err := db.ro.
+		Table("artists").
+		Limit(limit).
+		Where("indexed_genres_rtree_at is null").
+		Pluck("spotify_id", &artists).
+		Error; err != nil {
+		return nil, err
+	}
+	return artists, nil
+}
+
+// IndexArtistsGenresRtree stores the bounds of each given artist's genres in
+// artist_genres_rtree. Artists without any mapped genres are marked as indexed
+// without being added to the tree, and removed from it if they were there
+// before.
+func (db *DB) IndexArtistsGenresRtree(ctx context.Context, artists []string) error {
+	return db.indexRtree(ctx, "artists", "artist_genres_rtree", "indexed_genres_rtree_at", artists, `
+		insert into artist_genres_rtree (`+rtreeColumns+`)
+		select rtree_artists.id, `+genreBoundsColumns+`
+		from rtree_artists
+			join artist_genres on artist_genres.artist_spotify_id = rtree_artists.spotify_id
+			join genres on genres.name = artist_genres.genre_name
+		where rtree_artists.spotify_id in ? and `+mappedGenre+`
+		group by rtree_artists.id`)
+}
+
+func (db *DB) CountArtistsToIndexTracksRtree() (int, error) {
+	var count int64
+	if err := db.ro.
+		Table("artists").
+		Where("fetched_albums_at is not null").
+		Where("indexed_tracks_rtree_at is null").
+		Count(&count).
+		Error; err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// GetArtistsToIndexTracksRtree returns artists whose tracks should be indexed.
+// We wait until an artist's albums are fetched, so that we index more than
+// just their top tracks.
+func (db *DB) GetArtistsToIndexTracksRtree(limit int) ([]string, error) {
+	artists := []string{}
+	if err := db.ro.
+		Table("artists").
+		Limit(limit).
+		Where("fetched_albums_at is not null").
+		Where("indexed_tracks_rtree_at is null").
+		Pluck("spotify_id", &artists).
+		Error; err != nil {
+		return nil, err
+	}
+	return artists, nil
+}
+
+// IndexArtistsTracksRtree stores the bounds of each given artist's tracks in
+// artist_tracks_rtree. A track's position in genre space is given by the
+// genres of all of the artists credited on it, so an artist's tracks' bounds
+// include the genres of their collaborators.
+func (db *DB) IndexArtistsTracksRtree(ctx context.Context, artists []string) error {
+	return db.indexRtree(ctx, "artists", "artist_tracks_rtree", "indexed_tracks_rtree_at", artists, `
+		insert into artist_tracks_rtree (`+rtreeColumns+`)
+		select rtree_artists.id, `+genreBoundsColumns+`
+		from rtree_artists
+			join track_artists on track_artists.artist_spotify_id = rtree_artists.spotify_id
+			join track_artists as credits on credits.track_spotify_id = track_artists.track_spotify_id
+			join artist_genres on artist_genres.artist_spotify_id = credits.artist_spotify_id
+			join genres on genres.name = artist_genres.genre_name
+		where rtree_artists.spotify_id in ? and `+mappedGenre+`
+		group by rtree_artists.id`)
+}
+
+func (db *DB) CountAlbumsToIndexTracksRtree() (int, error) {
+	var count int64
+	if err := db.ro.
+		Table("albums").
+		Where("fetched_tracks_at is not null").
+		Where("indexed_tracks_rtree_at is null").
+		Count(&count).
+		Error; err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// GetAlbumsToIndexTracksRtree returns albums whose tracks have been fetched
+// but not yet indexed.
+func (db *DB) GetAlbumsToIndexTracksRtree(limit int) ([]string, error) {
+	albums := []string{}
+	if err := db.ro.
+		Table("albums").
+		Limit(limit).
+		Where("fetched_tracks_at is not null").
+		Where("indexed_tracks_rtree_at is null").
+		Pluck("spotify_id", &albums).
+		Error; err != nil {
+		return nil, err
+	}
+	return albums, nil
+}
+
+// IndexAlbumsTracksRtree stores the bounds of each given album's tracks in
+// album_tracks_rtree, using the genres of the artists credited on each track.
+func (db *DB) IndexAlbumsTracksRtree(ctx context.Context, albums []string) error {
+	return db.indexRtree(ctx, "albums", "album_tracks_rtree", "indexed_tracks_rtree_at", albums, `
+		insert into album_tracks_rtree (`+rtreeColumns+`)
+		select rtree_albums.id, `+genreBoundsColumns+`
+		from rtree_albums
+			join album_tracks on album_tracks.album_spotify_id = rtree_albums.spotify_id
+			join track_artists on track_artists.track_spotify_id = album_tracks.track_spotify_id
+			join artist_genres on artist_genres.artist_spotify_id = track_artists.artist_spotify_id
+			join genres on genres.name = artist_genres.genre_name
+		where rtree_albums.spotify_id in ? and `+mappedGenre+`
+		group by rtree_albums.id`)
+}
+
+// indexRtree clears the given ids' rows from the given rtree, runs the given
+// insertion query for them, then marks them as indexed by setting the given
+// column. Clearing first means that rows whose bounds no longer exist, because
+// none of their genres are mapped any more, don't linger in the tree.
+//
+// Rows are identified in the rtree by their ids in rtree_<table>, which are
+// assigned here, before the insertion query runs.
+func (db *DB) indexRtree(ctx context.Context, table, rtree, column string, ids []string, query string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	defer db.hold()()
+
+	rtreeIDs := "rtree_" + table
+	return db.rw.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(fmt.Sprintf("insert or ignore into %s (spotify_id) select spotify_id from %s where spotify_id in ?", rtreeIDs, table), ids).Error; err != nil {
+			return fmt.Errorf("error assigning rtree ids to %d %s: %w", len(ids), table, err)
+		}
+		if err := tx.Exec(fmt.Sprintf("delete from %s where id in (select id from %s where spotify_id in ?)", rtree, rtreeIDs), ids).Error; err != nil {
+			return fmt.Errorf("error clearing %d %s from %s: %w", len(ids), table, rtree, err)
+		}
+		if err := tx.Exec(query, ids).Error; err != nil {
+			return fmt.Errorf("error indexing %d %s for %s: %w", len(ids), table, column, err)
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("canceled: %w", err)
+		}
+
+		if err := tx.
+			Table(table).
+			Where("spotify_id in ?", ids).
+			Update(column, sql.NullTime{Time: time.Now(), Valid: true}).
+			Error; err != nil {
+			return fmt.Errorf("error marking %d %s as %s: %w", len(ids), table, column, err)
+		}
+
+		return nil
+	})
+}
+
+// ArtistsWithGenresWithin returns up to limit artists, most popular first, who
+// have at least one genre within the given bounds.
+func (db *DB) ArtistsWithGenresWithin(ctx context.Context, bounds data.GenreBounds, limit int) ([]data.Artist, error) {
+	overlap, overlapArgs := overlaps("artist_genres_rtree", bounds)
+	within, withinArgs := within("genres", bounds)
+
+	var artists []data.Artist
+	if err := db.ro.WithContext(ctx).
+		Table("artist_genres_rtree").
+		Select("artists.*").
+		Joins("join rtree_artists on rtree_artists.id = artist_genres_rtree.id").
+		Joins("join artists on artists.spotify_id = rtree_artists.spotify_id").
+		Where(overlap, overlapArgs...).
+		Where(`exists (
+			select 1 from artist_genres
+				join genres on genres.name = artist_genres.genre_name
+			where artist_genres.artist_spotify_id = artists.spotify_id and `+within+`
+		)`, withinArgs...).
+		Order("artists.popularity desc").
+		Limit(limit).
+		Find(&artists).
+		Error; err != nil {
+		return nil, fmt.Errorf("error finding artists with genres within bounds: %w", err)
+	}
+	return artists, nil
+}
+
+// ArtistsWithTracksOverlapping returns up to limit artists, most popular
+// first, whose tracks' bounds overlap the given bounds.
+func (db *DB) ArtistsWithTracksOverlapping(ctx context.Context, bounds data.GenreBounds, limit int) ([]data.Artist, error) {
+	overlap, args := overlaps("artist_tracks_rtree", bounds)
+
+	var artists []data.Artist
+	if err := db.ro.WithContext(ctx).
+		Table("artist_tracks_rtree").
+		Select("artists.*").
+		Joins("join rtree_artists on rtree_artists.id = artist_tracks_rtree.id").
+		Joins("join artists on artists.spotify_id = rtree_artists.spotify_id").
+		Where(overlap, args...).
+		Order("artists.popularity desc").
+		Limit(limit).
+		Find(&artists).
+		Error; err != nil {
+		return nil, fmt.Errorf("error finding artists with tracks overlapping bounds: %w", err)
+	}
+	return artists, nil
+}
+
+// AlbumsWithTracksOverlapping returns up to limit albums, most popular first,
+// whose tracks' bounds overlap the given bounds.
+func (db *DB) AlbumsWithTracksOverlapping(ctx context.Context, bounds data.GenreBounds, limit int) ([]data.Album, error) {
+	overlap, args := overlaps("album_tracks_rtree", bounds)
+
+	var albums []data.Album
+	if err := db.ro.WithContext(ctx).
+		Table("album_tracks_rtree").
+		Select("albums.*").
+		Joins("join rtree_albums on rtree_albums.id = album_tracks_rtree.id").
+		Joins("join albums on albums.spotify_id = rtree_albums.spotify_id").
+		Where(overlap, args...).
+		Order("albums.popularity desc").
+		Limit(limit).
+		Find(&albums).
+		Error; err != nil {
+		return nil, fmt.Errorf("error finding albums with tracks overlapping bounds: %w", err)
+	}
+	return albums, nil
+}
+
+// overlaps returns a condition matching rows of the given rtree whose bounds
+// overlap the given bounds.
+func overlaps(rtree string, b data.GenreBounds) (string, []any) {
+	var conds []string
+	var args []any
+	for _, dim := range boundsDimensions(b) {
+		conds = append(conds, fmt.Sprintf("%s.max_%s >= ? and %s.min_%s <= ?", rtree, dim.name, rtree, dim.name))
+		args = append(args, dim.min, dim.max)
+	}
+	return strings.Join(conds, " and "), args
+}
+
+// within returns a condition matching rows of the given genres table which lie
+// within the given bounds.
+func within(genres string, b data.GenreBounds) (string, []any) {
+	var conds []string
+	var args []any
+	for _, dim := range boundsDimensions(b) {
+		conds = append(conds, fmt.Sprintf("%s.%s between ? and ?", genres, dim.name))
+		args = append(args, dim.min, dim.max)
+	}
+	return strings.Join(conds, " and "), args
+}
+
+type boundsDimension struct {
+	name     string
+	min, max float64
+}
+
+func boundsDimensions(b data.GenreBounds) []boundsDimension {
+	return []boundsDimension{
+		{"energy", b.MinEnergy, b.MaxEnergy},
+		{"dynamic_variation", b.MinDynamicVariation, b.MaxDynamicVariation},
+		{"instrumentalness", b.MinInstrumentalness, b.MaxInstrumentalness},
+		{"organicness", b.MinOrganicness, b.MaxOrganicness},
+		{"bounciness", b.MinBounciness, b.MaxBounciness},
+	}
+}
@@ -0,0 +1,249 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/amonks/genres/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cube returns bounds spanning [min, max] in every dimension.
+func cube(min, max float64) data.GenreBounds {
+	return data.GenreBounds{
+		MinEnergy: min, MaxEnergy: max,
+		MinDynamicVariation: min, MaxDynamicVariation: max,
+		MinInstrumentalness: min, MaxInstrumentalness: max,
+		MinOrganicness: min, MaxOrganicness: max,
+		MinBounciness: min, MaxBounciness: max,
+	}
+}
+
+func TestRtree(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "genres.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	ctx := context.Background()
+
+	// low and high are mapped, at 0.2 and 0.8 in every dimension; unmapped
+	// has no position. Track t1 is a collaboration between a and b, on album
+	// x; t2 is by c, whose only genre is unmapped, on album y. d has both
+	// mapped genres but no tracks.
+	require.NoError(t, db.rw.Exec(`
+		insert into genres (name, key, energy, dynamic_variation, instrumentalness, organicness, bounciness) values
+			('low', 'k1', 0.2, 0.2, 0.2, 0.2, 0.2),
+			('high', 'k2', 0.8, 0.8, 0.8, 0.8, 0.8),
+			('unmapped', null, null, null, null, null, null);
+		insert into artists (spotify_id, name, popularity, fetched_albums_at) values
+			('a', 'a', 10, datetime('now')),
+			('b', 'b', 20, datetime('now')),
+			('c', 'c', 30, datetime('now')),
+			('d', 'd', 40, datetime('now'));
+		insert into artist_genres (artist_spotify_id, genre_name) values
+			('a', 'low'), ('b', 'high'), ('c', 'unmapped'), ('d', 'low'), ('d', 'high');
+		insert into albums (spotify_id, name, popularity, fetched_tracks_at) values
+			('x', 'x', 5, datetime('now')),
+			('y', 'y', 50, datetime('now'));
+		insert into tracks (spotify_id, name) values ('t1', 't1'), ('t2', 't2');
+		insert into track_artists (track_spotify_id, artist_spotify_id) values ('t1', 'a'), ('t1', 'b'), ('t2', 'c');
+		insert into album_tracks (album_spotify_id, track_spotify_id) values ('x', 't1'), ('y', 't2');
+	`).Error)
+
+	index := func() {
+		artistGenres, err := db.GetArtistsToIndexGenresRtree(100)
+		require.NoError(t, err)
+		require.NoError(t, db.IndexArtistsGenresRtree(ctx, artistGenres))
+		artistTracks, err := db.GetArtistsToIndexTracksRtree(100)
+		require.NoError(t, err)
+		require.NoError(t, db.IndexArtistsTracksRtree(ctx, artistTracks))
+		albumTracks, err := db.GetAlbumsToIndexTracksRtree(100)
+		require.NoError(t, err)
+		require.NoError(t, db.IndexAlbumsTracksRtree(ctx, albumTracks))
+	}
+	index()
+
+	for _, count := range []func() (int, error){
+		db.CountArtistsToIndexGenresRtree,
+		db.CountArtistsToIndexTracksRtree,
+		db.CountAlbumsToIndexTracksRtree,
+	} {
+		n, err := count()
+		require.NoError(t, err)
+		assert.Zero(t, n)
+	}
+
+	artistIDs := func(artists []data.Artist, err error) []string {
+		require.NoError(t, err)
+		ids := []string{}
+		for _, artist := range artists {
+			ids = append(ids, artist.SpotifyID)
+		}
+		return ids
+	}
+	albumIDs := func(albums []data.Album, err error) []string {
+		require.NoError(t, err)
+		ids := []string{}
+		for _, album := range albums {
+			ids = append(ids, album.SpotifyID)
+		}
+		return ids
+	}
+
+	// d's bounds span 0.5, but neither of its genres is there.
+	assert.Equal(t, []string{"d", "a"}, artistIDs(db.ArtistsWithGenresWithin(ctx, cube(0.1, 0.3), 10)))
+	assert.Equal(t, []string{"d", "b"}, artistIDs(db.ArtistsWithGenresWithin(ctx, cube(0.7, 0.9), 10)))
+	assert.Equal(t, []string{}, artistIDs(db.ArtistsWithGenresWithin(ctx, cube(0.4, 0.6), 10)))
+	assert.Equal(t, []string{"d"}, artistIDs(db.ArtistsWithGenresWithin(ctx, cube(0, 1), 1)))
+
+	// a's tracks include b's genre, and vice versa.
+	assert.Equal(t, []string{"b", "a"}, artistIDs(db.ArtistsWithTracksOverlapping(ctx, cube(0.1, 0.3), 10)))
+	assert.Equal(t, []string{"b", "a"}, artistIDs(db.ArtistsWithTracksOverlapping(ctx, cube(0.4, 0.6), 10)))
+	assert.Equal(t, []string{}, artistIDs(db.ArtistsWithTracksOverlapping(ctx, cube(0.9, 1), 10)))
+
+	assert.Equal(t, []string{"x"}, albumIDs(db.AlbumsWithTracksOverlapping(ctx, cube(0.7, 0.9), 10)))
+	assert.Equal(t, []string{}, albumIDs(db.AlbumsWithTracksOverlapping(ctx, cube(0.9, 1), 10)))
+
+	// Once neither a nor b has a mapped genre, reindexing removes them, and
+	// the album of their track, from the trees.
+	require.NoError(t, db.rw.Exec(`
+		update artist_genres set genre_name = 'unmapped' where artist_spotify_id in ('a', 'b');
+		update artists set indexed_genres_rtree_at = null, indexed_tracks_rtree_at = null where spotify_id in ('a', 'b');
+		update albums set indexed_tracks_rtree_at = null;
+	`).Error)
+	index()
+
+	var indexed int64
+	require.NoError(t, db.ro.Table("artist_genres_rtree").Count(&indexed).Error)
+	assert.Equal(t, int64(1), indexed)
+	assert.Equal(t, []string{"d"}, artistIDs(db.ArtistsWithGenresWithin(ctx, cube(0, 1), 10)))
+	assert.Equal(t, []string{}, artistIDs(db.ArtistsWithTracksOverlapping(ctx, cube(0, 1), 10)))
+	assert.Equal(t, []string{}, albumIDs(db.AlbumsWithTracksOverlapping(ctx, cube(0, 1), 10)))
+}
+
+func TestReinsertedArtistRtree(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "genres.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	ctx := context.Background()
+
+	toIndex := func() int {
+		n, err := db.CountArtistsToIndexGenresRtree()
+		require.NoError(t, err)
+		return n
+	}
+
+	require.NoError(t, db.InsertArtist(ctx, &data.Artist{SpotifyID: "a", Genres: []string{"pop"}}))
+	require.NoError(t, db.InsertArtist(ctx, &data.Artist{SpotifyID: "b", Genres: []string{"rock"}}))
+	require.NoError(t, db.IndexArtistsGenresRtree(ctx, []string{"a", "b"}))
+	assert.Zero(t, toIndex())
+
+	// Seeing b again, as a's related artist, with the genres it already
+	// has, leaves it indexed.
+	require.NoError(t, db.InsertArtistRelations(ctx, "a", []data.Artist{{SpotifyID: "b", Genres: []string{"rock"}}}))
+	assert.Zero(t, toIndex())
+
+	// A new genre means it must be reindexed.
+	require.NoError(t, db.InsertArtistRelations(ctx, "a", []data.Artist{{SpotifyID: "b", Genres: []string{"rock", "punk"}}}))
+	assert.Equal(t, 1, toIndex())
+}
+
+func TestArtistGainsGenreRtree(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "genres.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	ctx := context.Background()
+
+	// a and b collaborate on t1, on album x. b arrives through the album's
+	// credits, before anything tags it with a genre.
+	require.NoError(t, db.rw.Exec(`
+		insert into genres (name, key, energy, dynamic_variation, instrumentalness, organicness, bounciness) values
+			('low', 'k1', 0.2, 0.2, 0.2, 0.2, 0.2),
+			('high', 'k2', 0.8, 0.8, 0.8, 0.8, 0.8);
+		insert into artists (spotify_id, name, popularity, fetched_albums_at) values
+			('a', 'a', 10, datetime('now')),
+			('b', 'b', 20, datetime('now'));
+		insert into artist_genres (artist_spotify_id, genre_name) values ('a', 'low');
+		insert into albums (spotify_id, name, popularity, fetched_tracks_at) values ('x', 'x', 5, datetime('now'));
+		insert into tracks (spotify_id, name) values ('t1', 't1');
+		insert into track_artists (track_spotify_id, artist_spotify_id) values ('t1', 'a'), ('t1', 'b');
+		insert into album_tracks (album_spotify_id, track_spotify_id) values ('x', 't1');
+	`).Error)
+
+	index := func() {
+		artistTracks, err := db.GetArtistsToIndexTracksRtree(100)
+		require.NoError(t, err)
+		require.NoError(t, db.IndexArtistsTracksRtree(ctx, artistTracks))
+		albumTracks, err := db.GetAlbumsToIndexTracksRtree(100)
+		require.NoError(t, err)
+		require.NoError(t, db.IndexAlbumsTracksRtree(ctx, albumTracks))
+	}
+	index()
+
+	artistIDs := func(artists []data.Artist, err error) []string {
+		require.NoError(t, err)
+		ids := []string{}
+		for _, artist := range artists {
+			ids = append(ids, artist.SpotifyID)
+		}
+		return ids
+	}
+	albumIDs := func(albums []data.Album, err error) []string {
+		require.NoError(t, err)
+		ids := []string{}
+		for _, album := range albums {
+			ids = append(ids, album.SpotifyID)
+		}
+		return ids
+	}
+
+	assert.Equal(t, []string{}, artistIDs(db.ArtistsWithTracksOverlapping(ctx, cube(0.7, 0.9), 10)))
+	assert.Equal(t, []string{}, albumIDs(db.AlbumsWithTracksOverlapping(ctx, cube(0.7, 0.9), 10)))
+
+	// Once b is tagged, the album and both artists must be reindexed, and
+	// their bounds then include b's genre.
+	require.NoError(t, db.InsertArtist(ctx, &data.Artist{SpotifyID: "b", Genres: []string{"high"}}))
+	n, err := db.CountArtistsToIndexTracksRtree()
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	n, err = db.CountAlbumsToIndexTracksRtree()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	index()
+	assert.Equal(t, []string{"b", "a"}, artistIDs(db.ArtistsWithTracksOverlapping(ctx, cube(0.7, 0.9), 10)))
+	assert.Equal(t, []string{"x"}, albumIDs(db.AlbumsWithTracksOverlapping(ctx, cube(0.7, 0.9), 10)))
+}
+
+func TestRtreeVacuum(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "genres.db"))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// a and c are tagged low, and b and d high; b and c are deleted
+	// before indexing, to leave gaps in the rowids for VACUUM to close
+	// up.
+	require.NoError(t, db.rw.Exec(`
+		insert into genres (name, key, energy, dynamic_variation, instrumentalness, organicness, bounciness) values
+			('low', 'k1', 0.2, 0.2, 0.2, 0.2, 0.2),
+			('high', 'k2', 0.8, 0.8, 0.8, 0.8, 0.8);
+		insert into artists (spotify_id, name, popularity) values ('a', 'a', 1), ('b', 'b', 2), ('c', 'c', 3), ('d', 'd', 4);
+		insert into artist_genres (artist_spotify_id, genre_name) values ('a', 'low'), ('c', 'low'), ('d', 'high');
+		delete from artist_genres where artist_spotify_id in ('b', 'c');
+		delete from artists where spotify_id in ('b', 'c');
+	`).Error)
+	require.NoError(t, db.IndexArtistsGenresRtree(ctx, []string{"a", "d"}))
+	require.NoError(t, db.rw.Exec(`vacuum`).Error)
+	require.NoError(t, db.Close())
+
+	reopened, err := Open(db.filename)
+	require.NoError(t, err)
+	defer reopened.Close()
+	for bounds, expect := range map[data.GenreBounds]string{cube(0.1, 0.3): "a", cube(0.7, 0.9): "d"} {
+		artists, err := reopened.ArtistsWithGenresWithin(ctx, bounds, 10)
+		require.NoError(t, err)
+		require.Len(t, artists, 1)
+		assert.Equal(t, expect, artists[0].SpotifyID)
+	}
+}
@@ -2,6 +2,19 @@
 -- connections to the database without corrupting data.
 pragma journal_mode='wal';
 
+-- This file is the baseline schema, and is applied every time
+-- the database is opened, so it must only ever `create ... if
+-- not exists`. Changes to the schema go in migrations/, and are
+-- applied by `genres migrate`.
+
+-- schema_migrations records which of the migrations in
+-- migrations/ have been applied.
+create table if not exists schema_migrations (
+        version    integer primary key,
+        name       text not null,
+        applied_at datetime not null
+);
+
 
 -- GENRES
 --
@@ -0,0 +1,94 @@
+package db
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// A Scope limits the crawl to what's reachable from some seeds: the seed
+// genres, the seed artists and the artists of the seed genres, and those
+// artists' albums and tracks, and the seed playlists and their tracks. A nil
+// Scope is the whole catalogue.
+type Scope struct {
+	Genres    []string
+	Artists   []string
+	Playlists []string
+}
+
+// scopeArtists selects the ids of the artists in a scope.
+const scopeArtists = "select spotify_id from artists where spotify_id in ? union select artist_spotify_id from artist_genres where genre_name in ?"
+
+// scopePlaylistTracks selects the ids of the tracks of the playlists in a
+// scope.
+const scopePlaylistTracks = "select track_spotify_id from playlist_tracks where playlist_spotify_id in ?"
+
+// scopeArg matches the references to a scope's seeds in a condition.
+var scopeArg = regexp.MustCompile(`%\[[12]\]s`)
+
+// scopes holds the conditions under which a row of each stage's table, as t,
+// is in a scope. Each %[1]s is the scope's artists, and each %[2]s is its
+// playlists' tracks.
+var scopes = map[string]string{
+	StageGenreArtists.Name: "t.name in ?",
+	StageArtistAlbums.Name: "t.spotify_id in (%[1]s)",
+	StageArtistTracks.Name: "t.spotify_id in (%[1]s)",
+	// Related artists are fetched only for the artists in scope, so the
+	// crawl doesn't wander off through the artist graph.
+	StageRelatedArtists.Name: "t.spotify_id in (%[1]s)",
+	StageAlbumTracks.Name:    "t.spotify_id in (select album_spotify_id from album_artists where artist_spotify_id in (%[1]s))",
+	// Tracks are reachable both through their own artists, and through
+	// their albums' artists, since compilations have tracks by others.
+	StageTrackAnalyses.Name: "(t.spotify_id in (select track_spotify_id from track_artists where artist_spotify_id in (%[1]s))" +
+		" or t.spotify_id in (select x.track_spotify_id from album_tracks x join album_artists y on y.album_spotify_id = x.album_spotify_id where y.artist_spotify_id in (%[1]s))" +
+		" or t.spotify_id in (%[2]s))",
+	StagePlaylistTracks.Name: "t.spotify_id in ?",
+}
+
+// where returns the condition under which a row of the stage's table, as t,
+// is in the scope, along with its arguments. It returns "true" if the scope is
+// nil.
+func (s *Scope) where(stage Stage) (string, []any) {
+	if s == nil {
+		return "true", nil
+	}
+	condition := scopes[stage.Name]
+	switch stage {
+	case StageGenreArtists:
+		return condition, []any{s.Genres}
+	case StagePlaylistTracks:
+		return condition, []any{s.Playlists}
+	}
+	var args []any
+	for _, arg := range scopeArg.FindAllString(condition, -1) {
+		if arg == "%[1]s" {
+			args = append(args, s.Artists, s.Genres)
+		} else {
+			args = append(args, s.Playlists)
+		}
+	}
+	return fmt.Sprintf(condition, scopeArtists, scopePlaylistTracks), args
+}
+
+// GetMissingArtists returns those of the given artists which aren't in the
+// database, in the same order.
+func (db *DB) GetMissingArtists(ids []string) ([]string, error) {
+	var known []string
+	if err := db.ro.
+		Table("artists").
+		Where("spotify_id in ?", ids).
+		Pluck("spotify_id", &known).
+		Error; err != nil {
+		return nil, fmt.Errorf("error getting %d artists: %w", len(ids), err)
+	}
+	isKnown := make(map[string]bool, len(known))
+	for _, id := range known {
+		isKnown[id] = true
+	}
+	var missing []string
+	for _, id := range ids {
+		if !isKnown[id] {
+			missing = append(missing, id)
+		}
+	}
+	return missing, nil
+}
@@ -3,13 +3,19 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/amonks/genres/data"
 	"gorm.io/gorm"
 )
 
+// ErrBadQuery is returned for a search query which can't be run, such as one
+// that isn't valid FTS5 syntax.
+var ErrBadQuery = errors.New("bad query")
+
 func (db *DB) Search(ctx context.Context, query string, limit int) ([]data.Track, error) {
 	var ids []string
 	if err := db.ro.
@@ -19,21 +25,24 @@ func (db *DB) Search(ctx context.Context, query string, limit int) ([]data.Track
 		Limit(limit).
 		Pluck("spotify_id", &ids).
 		Error; err != nil {
+		if isQueryError(err) {
+			return nil, fmt.Errorf("%w: %w", ErrBadQuery, err)
+		}
 		return nil, err
 	}
-	tracks := make([]data.Track, len(ids))
-	for i, id := range ids {
-		if err := ctx.Err(); err != nil {
-			return nil, fmt.Errorf("canceled: %w", err)
-		}
+	return db.GetTracks(ctx, ids)
+}
 
-		track, err := db.GetTrack(ctx, id)
-		if err != nil {
-			return nil, fmt.Errorf("error getting track '%s': %w", id, err)
+// isQueryError reports whether err is SQLite rejecting an FTS5 query: a
+// syntax error, or a column filter naming a column tracks_search doesn't have.
+func isQueryError(err error) bool {
+	msg := err.Error()
+	for _, prefix := range []string{"fts5: syntax error", "unterminated string", "unknown special query", "no such column"} {
+		if strings.HasPrefix(msg, prefix) {
+			return true
 		}
-		tracks[i] = *track
 	}
-	return tracks, nil
+	return false
 }
 
 func (db *DB) CountTracksToIndex(ctx context.Context) (int, error) {
@@ -58,18 +67,7 @@ func (db *DB) GetTracksToIndex(ctx context.Context, limit int) ([]data.Track, er
 		Error; err != nil {
 		return nil, fmt.Errorf("error getting %d tracks where indexed_search_at is null: %w", limit, err)
 	}
-	if len(ids) == 0 {
-		return nil, nil
-	}
-	tracks := make([]data.Track, len(ids))
-	for i, id := range ids {
-		track, err := db.GetTrack(ctx, id)
-		if err != nil {
-			return nil, fmt.Errorf("error getting track '%s': %w", id, err)
-		}
-		tracks[i] = *track
-	}
-	return tracks, nil
+	return db.GetTracks(ctx, ids)
 }
 
 func (db *DB) IndexTracks(ctx context.Context, tracks []data.Track) error {
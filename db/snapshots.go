@@ -0,0 +1,51 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/amonks/genres/data"
+	"gorm.io/gorm/clause"
+)
+
+// InsertProgressSnapshots inserts the given snapshots into the
+// progress_snapshots table, skipping any taken at the same moment as one
+// that's already there, and returns how many were inserted.
+func (db *DB) InsertProgressSnapshots(snapshots []data.ProgressSnapshot) (int, error) {
+	defer db.hold()()
+
+	if len(snapshots) == 0 {
+		return 0, nil
+	}
+
+	// Times are stored in UTC, so that they sort and compare as text.
+	rows := make([]data.ProgressSnapshot, len(snapshots))
+	for i, s := range snapshots {
+		s.TakenAt = s.TakenAt.UTC()
+		rows[i] = s
+	}
+
+	result := db.rw.
+		Table("progress_snapshots").
+		Clauses(clause.OnConflict{DoNothing: true}).
+		CreateInBatches(&rows, 500)
+	if result.Error != nil {
+		return 0, fmt.Errorf("error inserting progress snapshots: %w", result.Error)
+	}
+	return int(result.RowsAffected), nil
+}
+
+// GetProgressSnapshots returns the snapshots taken since the given time, in
+// the order they were taken.
+func (db *DB) GetProgressSnapshots(since time.Time) ([]data.ProgressSnapshot, error) {
+	var snapshots []data.ProgressSnapshot
+	if err := db.ro.
+		Table("progress_snapshots").
+		Where("taken_at >= ?", since.UTC()).
+		Order("taken_at asc").
+		Find(&snapshots).
+		Error; err != nil {
+		return nil, fmt.Errorf("error getting progress snapshots: %w", err)
+	}
+	return snapshots, nil
+}
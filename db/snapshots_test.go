@@ -0,0 +1,41 @@
+package db
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amonks/genres/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgressSnapshots(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "genres.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.FixedZone("EST", -5*60*60))
+	snapshots := []data.ProgressSnapshot{
+		{TakenAt: start, TracksKnown: 10},
+		{TakenAt: start.Add(time.Hour), TracksKnown: 20, SpotifyRequests: sql.NullInt64{Int64: 5, Valid: true}},
+	}
+	n, err := db.InsertProgressSnapshots(snapshots)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	// Snapshots which are already there are skipped.
+	n, err = db.InsertProgressSnapshots(append(snapshots, data.ProgressSnapshot{TakenAt: start.Add(2 * time.Hour), TracksKnown: 30}))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	got, err := db.GetProgressSnapshots(start.Add(time.Hour).UTC())
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	assert.True(t, start.Add(time.Hour).Equal(got[0].TakenAt))
+	assert.Equal(t, 20, got[0].TracksKnown)
+	assert.Equal(t, sql.NullInt64{Int64: 5, Valid: true}, got[0].SpotifyRequests)
+	assert.False(t, got[1].SpotifyRequests.Valid)
+	assert.Equal(t, 30, got[1].TracksKnown)
+}
@@ -0,0 +1,165 @@
+// Package forecast projects when each stage of the crawl will be done, from
+// the history of its progress.
+package forecast
+
+import (
+	"math"
+	"time"
+
+	"github.com/amonks/genres/data"
+)
+
+// A Stage is a step of the crawl which works through everything of some
+// kind that's known.
+type Stage struct {
+	Name string
+	// Unit is what the stage works through, like "artists".
+	Unit        string
+	Done, Known func(data.ProgressSnapshot) int
+	// PerRequest is how many units a request to Spotify finishes, at
+	// best. It's 0 for stages which don't make requests.
+	PerRequest float64
+}
+
+// Stages are the stages of the crawl which the reporter records, in the
+// order of the crawl.
+var Stages = []Stage{
+	{
+		Name:       "artist_albums",
+		Unit:       "artists",
+		Done:       func(s data.ProgressSnapshot) int { return s.ArtistAlbumsDone },
+		Known:      func(s data.ProgressSnapshot) int { return s.ArtistsKnown },
+		PerRequest: 1,
+	},
+	{
+		Name:       "artist_tracks",
+		Unit:       "artists",
+		Done:       func(s data.ProgressSnapshot) int { return s.ArtistTracksDone },
+		Known:      func(s data.ProgressSnapshot) int { return s.ArtistsKnown },
+		PerRequest: 1,
+	},
+	{
+		Name:       "album_tracks",
+		Unit:       "albums",
+		Done:       func(s data.ProgressSnapshot) int { return s.AlbumsDone },
+		Known:      func(s data.ProgressSnapshot) int { return s.AlbumsKnown },
+		PerRequest: 20,
+	},
+	{
+		Name:       "track_analysis",
+		Unit:       "tracks",
+		Done:       func(s data.ProgressSnapshot) int { return s.TracksDone },
+		Known:      func(s data.ProgressSnapshot) int { return s.TracksKnown },
+		PerRequest: 100,
+	},
+	{
+		Name:  "indexer",
+		Unit:  "tracks",
+		Done:  func(s data.ProgressSnapshot) int { return s.TracksIndexed },
+		Known: func(s data.ProgressSnapshot) int { return s.TracksKnown },
+	},
+}
+
+// A Forecast projects when a stage will be done.
+type Forecast struct {
+	Stage     string `json:"stage"`
+	Unit      string `json:"unit"`
+	Done      int    `json:"done"`
+	Known     int    `json:"known"`
+	Remaining int    `json:"remaining"`
+
+	// Rates holds the stage's rate over each window.
+	Rates []Rate `json:"rates"`
+
+	// Limit is the fastest the stage could go, if it had every request
+	// the rate limit allows to itself. It's nil for stages which don't
+	// make requests.
+	Limit *Rate `json:"limit,omitempty"`
+}
+
+// A Rate is how quickly a stage is progressing, and when it'll be done if it
+// keeps going at that rate.
+type Rate struct {
+	// Window is how far back the rate is measured, like "24h0m0s".
+	Window string `json:"window,omitempty"`
+	// Samples is how many snapshots the rate was measured from. Rates
+	// need at least two.
+	Samples int `json:"samples,omitempty"`
+	// PerHour is how many units are done each hour.
+	PerHour float64 `json:"per_hour"`
+	// DoneAt is when the stage will be done at this rate. It's nil if
+	// the stage isn't progressing, or if there's too little history
+	// to tell.
+	DoneAt *time.Time `json:"done_at"`
+}
+
+// Project forecasts each stage from the given history, which must be in
+// order, and ends with the current snapshot. Rates are measured over each of
+// the given windows, back from the current snapshot, and the rate limit's
+// requests per day bound how fast the stages can go.
+//
+// Projections assume the remaining work is what's known now, though more is
+// found as the crawl goes on, so they're optimistic for the later stages.
+func Project(history []data.ProgressSnapshot, windows []time.Duration, requestsPerDay int) []Forecast {
+	if len(history) == 0 {
+		return nil
+	}
+	current := history[len(history)-1]
+
+	forecasts := make([]Forecast, len(Stages))
+	for i, stage := range Stages {
+		f := Forecast{
+			Stage: stage.Name,
+			Unit:  stage.Unit,
+			Done:  stage.Done(current),
+			Known: stage.Known(current),
+		}
+		f.Remaining = max(0, f.Known-f.Done)
+
+		for _, window := range windows {
+			rate := Rate{Window: window.String()}
+			first, samples := earliestWithin(history, current.TakenAt.Add(-window))
+			rate.Samples = samples
+			if samples >= 2 && first.TakenAt.Before(current.TakenAt) {
+				rate.PerHour = float64(stage.Done(current)-stage.Done(first)) / current.TakenAt.Sub(first.TakenAt).Hours()
+				rate.DoneAt = doneAt(current.TakenAt, f.Remaining, rate.PerHour)
+			}
+			f.Rates = append(f.Rates, rate)
+		}
+
+		if stage.PerRequest != 0 && requestsPerDay > 0 {
+			perHour := stage.PerRequest * float64(requestsPerDay) / 24
+			f.Limit = &Rate{PerHour: perHour, DoneAt: doneAt(current.TakenAt, f.Remaining, perHour)}
+		}
+
+		forecasts[i] = f
+	}
+	return forecasts
+}
+
+// earliestWithin returns the first snapshot in the history which isn't
+// before since, and how many snapshots there are from then on.
+func earliestWithin(history []data.ProgressSnapshot, since time.Time) (data.ProgressSnapshot, int) {
+	for i, s := range history {
+		if !s.TakenAt.Before(since) {
+			return s, len(history) - i
+		}
+	}
+	return data.ProgressSnapshot{}, 0
+}
+
+func doneAt(now time.Time, remaining int, perHour float64) *time.Time {
+	if remaining == 0 {
+		return &now
+	}
+	if perHour <= 0 {
+		return nil
+	}
+	hours := float64(remaining) / perHour
+	// Durations overflow after about 292 years.
+	if hours > math.MaxInt64/float64(time.Hour) {
+		return nil
+	}
+	at := now.Add(time.Duration(hours * float64(time.Hour))).Truncate(time.Second)
+	return &at
+}
@@ -0,0 +1,70 @@
+package forecast
+
+import (
+	"testing"
+	"time"
+
+	"github.com/amonks/genres/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProject(t *testing.T) {
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	snapshot := func(hours int, tracksDone int) data.ProgressSnapshot {
+		return data.ProgressSnapshot{
+			TakenAt:      start.Add(time.Duration(hours) * time.Hour),
+			ArtistsKnown: 10, ArtistAlbumsDone: 10, ArtistTracksDone: 4,
+			TracksKnown: 1000, TracksDone: tracksDone,
+		}
+	}
+	history := []data.ProgressSnapshot{
+		snapshot(0, 0),
+		snapshot(22, 100),
+		snapshot(23, 100),
+		snapshot(24, 200),
+	}
+
+	forecasts := Project(history, []time.Duration{time.Hour, 2 * time.Hour, 24 * time.Hour, 48 * time.Hour}, 240)
+	require.Len(t, forecasts, len(Stages))
+	names := make([]string, len(forecasts))
+	for i, f := range forecasts {
+		names[i] = f.Stage
+	}
+	assert.Equal(t, []string{"artist_albums", "artist_tracks", "album_tracks", "track_analysis", "indexer"}, names)
+
+	// Finished stages are done now.
+	albums := forecasts[0]
+	assert.Equal(t, 0, albums.Remaining)
+	assert.Equal(t, start.Add(24*time.Hour), *albums.Rates[0].DoneAt)
+
+	// Stages without progress are never done.
+	tracks := forecasts[1]
+	assert.Equal(t, 6, tracks.Remaining)
+	assert.Nil(t, tracks.Rates[0].DoneAt)
+	assert.Equal(t, start.Add(24*time.Hour+36*time.Minute), *tracks.Limit.DoneAt)
+
+	analysis := forecasts[3]
+	assert.Equal(t, 800, analysis.Remaining)
+	assert.Equal(t, "1h0m0s", analysis.Rates[0].Window)
+	assert.Equal(t, 100.0, analysis.Rates[0].PerHour)
+	assert.Equal(t, start.Add(32*time.Hour), *analysis.Rates[0].DoneAt)
+	assert.Equal(t, 50.0, analysis.Rates[1].PerHour)
+	assert.InDelta(t, 200.0/24, analysis.Rates[2].PerHour, 0.001)
+	// There's only 24h of history to measure.
+	assert.Equal(t, 2, analysis.Rates[0].Samples)
+	assert.Equal(t, 4, analysis.Rates[3].Samples)
+	assert.Equal(t, Rate{Window: "48h0m0s", Samples: 4, PerHour: analysis.Rates[2].PerHour, DoneAt: analysis.Rates[2].DoneAt}, analysis.Rates[3])
+	assert.Equal(t, 1000.0, analysis.Limit.PerHour)
+
+	// Local stages aren't rate limited.
+	assert.Nil(t, forecasts[4].Limit)
+}
+
+func TestProjectWithoutHistory(t *testing.T) {
+	assert.Nil(t, Project(nil, []time.Duration{time.Hour}, 0))
+
+	forecasts := Project([]data.ProgressSnapshot{{TakenAt: time.Now(), TracksKnown: 10}}, []time.Duration{time.Hour}, 0)
+	assert.Equal(t, Rate{Window: "1h0m0s", Samples: 1}, forecasts[3].Rates[0])
+	assert.Nil(t, forecasts[3].Limit)
+}
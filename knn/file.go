@@ -0,0 +1,197 @@
+package knn
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"syscall"
+)
+
+// An index file holds a header, followed by one record per point:
+//
+//	magic      [4]byte "KNN1"
+//	dims       uint32
+//	checkpoint int64
+//	count      uint64
+//	records    count * (id int64, point dims*float32)
+//
+// A later record for an ID replaces any earlier ones, so a point can be
+// updated by appending it again.
+//
+// Appending writes the new records before rewriting the header, so a reader
+// never sees a count that includes records which haven't been written yet.
+const (
+	magic      = "KNN1"
+	headerSize = 4 + 4 + 8 + 8
+)
+
+type header struct {
+	Magic      [4]byte
+	Dims       uint32
+	Checkpoint int64
+	Count      uint64
+}
+
+// ReadFile loads the points in the given index file into a balanced tree, and
+// returns the checkpoint recorded by the last AppendFile. If the file doesn't
+// exist, the returned error wraps os.ErrNotExist.
+func ReadFile(filename string, dims int) (*Tree, int64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error opening knn index '%s': %w", filename, err)
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+		return nil, 0, fmt.Errorf("error locking knn index '%s': %w", filename, err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	r := bufio.NewReaderSize(f, 1<<20)
+	h, err := readHeader(r, filename, dims)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tree := newWithCapacity(dims, int(h.Count))
+	record := make([]byte, 8+4*dims)
+	point := make([]float64, dims)
+	for i := uint64(0); i < h.Count; i++ {
+		if _, err := io.ReadFull(r, record); err != nil {
+			return nil, 0, fmt.Errorf("error reading record %d of %d from knn index '%s': %w", i, h.Count, filename, err)
+		}
+		id := int64(binary.LittleEndian.Uint64(record))
+		for j := range point {
+			point[j] = float64(math.Float32frombits(binary.LittleEndian.Uint32(record[8+4*j:])))
+		}
+		if err := tree.push(id, point); err != nil {
+			return nil, 0, err
+		}
+	}
+	tree.balance()
+
+	return tree, h.Checkpoint, nil
+}
+
+// ReadCheckpoint returns the checkpoint recorded by the last AppendFile to the
+// given index file, without reading its points. If the file doesn't exist, the
+// returned error wraps os.ErrNotExist.
+func ReadCheckpoint(filename string, dims int) (int64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, fmt.Errorf("error opening knn index '%s': %w", filename, err)
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+		return 0, fmt.Errorf("error locking knn index '%s': %w", filename, err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	h, err := readHeader(f, filename, dims)
+	if err != nil {
+		return 0, err
+	}
+	return h.Checkpoint, nil
+}
+
+func readHeader(r io.Reader, filename string, dims int) (header, error) {
+	var h header
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return h, fmt.Errorf("error reading knn index header from '%s': %w", filename, err)
+	}
+	if string(h.Magic[:]) != magic {
+		return h, fmt.Errorf("'%s' is not a knn index", filename)
+	}
+	if int(h.Dims) != dims {
+		return h, fmt.Errorf("expected %d dimensions in knn index '%s', but it has %d", dims, filename, h.Dims)
+	}
+	return h, nil
+}
+
+// ErrCheckpointMoved is returned by AppendFile when the file's checkpoint isn't
+// the one the caller expected, because another process appended to it first.
+var ErrCheckpointMoved = errors.New("knn index checkpoint moved")
+
+// AppendFile adds the given points to the given index file, creating it if
+// need be, and moves its checkpoint from prev to next. The checkpoint's meaning
+// is up to the caller; it's meant to record how much of some external data
+// source the file reflects, so that only new data need be appended next time.
+// A file which doesn't exist yet has checkpoint 0.
+//
+// AppendFile takes an exclusive lock on the file, so it's safe for several
+// processes to append to the same file. If the file's checkpoint isn't prev,
+// nothing is written, and the returned error wraps ErrCheckpointMoved; the
+// caller should read the new checkpoint and try again from there.
+func AppendFile(filename string, dims int, ids []int64, points [][]float64, prev, next int64) error {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening knn index '%s': %w", filename, err)
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("error locking knn index '%s': %w", filename, err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	h, err := readHeader(f, filename, dims)
+	if errors.Is(err, io.EOF) {
+		h = header{Dims: uint32(dims)}
+		copy(h.Magic[:], magic)
+	} else if err != nil {
+		return err
+	}
+	if h.Checkpoint != prev {
+		return fmt.Errorf("expected checkpoint %d in knn index '%s', but it has %d: %w", prev, filename, h.Checkpoint, ErrCheckpointMoved)
+	}
+
+	// Truncate any records left over from an append that was interrupted
+	// before it could update the header.
+	end := int64(headerSize) + int64(h.Count)*int64(8+4*dims)
+	if err := f.Truncate(end); err != nil {
+		return fmt.Errorf("error truncating knn index '%s': %w", filename, err)
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		return fmt.Errorf("error seeking knn index '%s': %w", filename, err)
+	}
+
+	w := bufio.NewWriterSize(f, 1<<20)
+	record := make([]byte, 8+4*dims)
+	for i, id := range ids {
+		if len(points[i]) != dims {
+			return fmt.Errorf("expected %d dimensions for point %d, but got %d", dims, id, len(points[i]))
+		}
+		binary.LittleEndian.PutUint64(record, uint64(id))
+		for j, v := range points[i] {
+			binary.LittleEndian.PutUint32(record[8+4*j:], math.Float32bits(float32(v)))
+		}
+		if _, err := w.Write(record); err != nil {
+			return fmt.Errorf("error writing knn index '%s': %w", filename, err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("error writing knn index '%s': %w", filename, err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("error syncing knn index '%s': %w", filename, err)
+	}
+
+	h.Count += uint64(len(ids))
+	h.Checkpoint = next
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error seeking knn index '%s': %w", filename, err)
+	}
+	if err := binary.Write(f, binary.LittleEndian, &h); err != nil {
+		return fmt.Errorf("error writing knn index header to '%s': %w", filename, err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("error syncing knn index '%s': %w", filename, err)
+	}
+
+	return nil
+}
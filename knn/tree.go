@@ -0,0 +1,294 @@
+// Package knn implements a k-d tree for exact k-nearest-neighbor queries over
+// fixed-dimension points, along with a file format for persisting one.
+package knn
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+)
+
+// A Tree is a k-d tree. Points are identified by an int64 ID, and each ID has
+// at most one point: adding a point for an ID which is already present replaces
+// the old one.
+//
+// Points are stored in insertion order, in flat arrays, so that a tree of tens
+// of millions of points doesn't cost tens of millions of allocations. A
+// replaced point stays in the arrays, marked dead, until the tree is rebuilt.
+type Tree struct {
+	dims int
+
+	ids         []int64
+	coords      []float32
+	left, right []int32
+	dead        []bool
+
+	// nodes maps each ID to its live point.
+	nodes map[int64]int32
+
+	root int32
+}
+
+// New creates an empty tree for points with the given number of dimensions.
+func New(dims int) *Tree {
+	return &Tree{dims: dims, root: -1, nodes: map[int64]int32{}}
+}
+
+// Build creates a balanced tree from the given points. points[i] is the
+// position of ids[i], and must have dims entries. If an ID appears more than
+// once, its last point wins.
+func Build(dims int, ids []int64, points [][]float64) (*Tree, error) {
+	t := newWithCapacity(dims, len(ids))
+	for i, id := range ids {
+		if err := t.push(id, points[i]); err != nil {
+			return nil, err
+		}
+	}
+	t.balance()
+	return t, nil
+}
+
+func newWithCapacity(dims, capacity int) *Tree {
+	t := New(dims)
+	t.ids = make([]int64, 0, capacity)
+	t.coords = make([]float32, 0, capacity*dims)
+	t.left = make([]int32, 0, capacity)
+	t.right = make([]int32, 0, capacity)
+	t.dead = make([]bool, 0, capacity)
+	t.nodes = make(map[int64]int32, capacity)
+	return t
+}
+
+// balance rebuilds the tree structure over all of its live points.
+func (t *Tree) balance() {
+	order := make([]int32, 0, len(t.nodes))
+	for i, dead := range t.dead {
+		if !dead {
+			order = append(order, int32(i))
+		}
+	}
+	t.root = t.build(order, 0)
+}
+
+func (t *Tree) build(order []int32, depth int) int32 {
+	if len(order) == 0 {
+		return -1
+	}
+	axis := depth % t.dims
+	mid := len(order) / 2
+	t.selectNth(order, mid, axis)
+	n := order[mid]
+	t.left[n] = t.build(order[:mid], depth+1)
+	t.right[n] = t.build(order[mid+1:], depth+1)
+	return n
+}
+
+// selectNth partially sorts order along the given axis so that order[nth] is
+// in its sorted position, with nothing greater before it and nothing less
+// after it. It's quickselect, so that Build is O(n log n) rather than the
+// O(n log² n) we'd get from sorting at every level.
+func (t *Tree) selectNth(order []int32, nth int, axis int) {
+	lo, hi := 0, len(order)-1
+	for lo < hi {
+		// median of three, to avoid quadratic behavior on sorted input
+		mid := lo + (hi-lo)/2
+		if t.coord(order[mid], axis) < t.coord(order[lo], axis) {
+			order[mid], order[lo] = order[lo], order[mid]
+		}
+		if t.coord(order[hi], axis) < t.coord(order[lo], axis) {
+			order[hi], order[lo] = order[lo], order[hi]
+		}
+		if t.coord(order[mid], axis) < t.coord(order[hi], axis) {
+			order[mid], order[hi] = order[hi], order[mid]
+		}
+		pivot := t.coord(order[hi], axis)
+
+		i := lo
+		for j := lo; j < hi; j++ {
+			if t.coord(order[j], axis) < pivot {
+				order[i], order[j] = order[j], order[i]
+				i++
+			}
+		}
+		order[i], order[hi] = order[hi], order[i]
+
+		switch {
+		case nth < i:
+			hi = i - 1
+		case nth > i:
+			lo = i + 1
+		default:
+			return
+		}
+	}
+}
+
+// Len returns the number of points in the tree.
+func (t *Tree) Len() int {
+	return len(t.nodes)
+}
+
+// Dims returns the number of dimensions of the tree's points.
+func (t *Tree) Dims() int {
+	return t.dims
+}
+
+// Insert adds a point to the tree. Inserting points in a random order keeps the
+// tree reasonably balanced; Build makes a perfectly balanced one.
+//
+// Inserting an ID which is already present replaces its old point.
+func (t *Tree) Insert(id int64, point []float64) error {
+	if err := t.push(id, point); err != nil {
+		return err
+	}
+	n := int32(len(t.ids) - 1)
+
+	if t.root < 0 {
+		t.root = n
+		return nil
+	}
+	for cur, depth := t.root, 0; ; depth++ {
+		axis := depth % t.dims
+		next := &t.right[cur]
+		if t.coord(n, axis) < t.coord(cur, axis) {
+			next = &t.left[cur]
+		}
+		if *next < 0 {
+			*next = n
+			return nil
+		}
+		cur = *next
+	}
+}
+
+func (t *Tree) push(id int64, point []float64) error {
+	if len(point) != t.dims {
+		return fmt.Errorf("expected %d dimensions for point %d, but got %d", t.dims, id, len(point))
+	}
+	t.ids = append(t.ids, id)
+	for _, v := range point {
+		t.coords = append(t.coords, float32(v))
+	}
+	t.left = append(t.left, -1)
+	t.right = append(t.right, -1)
+	t.dead = append(t.dead, false)
+
+	n := int32(len(t.ids) - 1)
+	if old, ok := t.nodes[id]; ok {
+		t.dead[old] = true
+	}
+	t.nodes[id] = n
+	return nil
+}
+
+func (t *Tree) coord(n int32, axis int) float64 {
+	return float64(t.coords[int(n)*t.dims+axis])
+}
+
+// A Neighbor is a result from Nearest.
+type Neighbor struct {
+	ID       int64
+	Distance float64
+}
+
+// Nearest returns up to k points nearest to the query, nearest first, by
+// Euclidean distance.
+//
+// Dimensions of the query which are NaN are ignored, so that, for example, a
+// query can look for points near {energy: 0.5} without regard for any other
+// dimension.
+func (t *Tree) Nearest(query []float64, k int) ([]Neighbor, error) {
+	if len(query) != t.dims {
+		return nil, fmt.Errorf("expected %d dimensions for query, but got %d", t.dims, len(query))
+	}
+	if k <= 0 || t.root < 0 {
+		return nil, nil
+	}
+
+	s := search{tree: t, query: query, k: k}
+	s.visit(t.root, 0)
+
+	out := make([]Neighbor, len(s.results))
+	for i := len(out) - 1; i >= 0; i-- {
+		r := heap.Pop(&s).(result)
+		out[i] = Neighbor{ID: t.ids[r.node], Distance: math.Sqrt(r.dist2)}
+	}
+	return out, nil
+}
+
+// search holds the state of a single Nearest query. It's a max-heap of the
+// best results so far, so that the worst result is at the top, ready to be
+// replaced.
+type search struct {
+	tree  *Tree
+	query []float64
+	k     int
+
+	results []result
+}
+
+type result struct {
+	node  int32
+	dist2 float64
+}
+
+func (s *search) visit(n int32, depth int) {
+	if n < 0 {
+		return
+	}
+	t := s.tree
+
+	s.consider(n)
+
+	axis := depth % t.dims
+	q := s.query[axis]
+	if math.IsNaN(q) {
+		s.visit(t.left[n], depth+1)
+		s.visit(t.right[n], depth+1)
+		return
+	}
+
+	diff := q - t.coord(n, axis)
+	near, far := t.left[n], t.right[n]
+	if diff >= 0 {
+		near, far = far, near
+	}
+	s.visit(near, depth+1)
+	if len(s.results) < s.k || diff*diff < s.results[0].dist2 {
+		s.visit(far, depth+1)
+	}
+}
+
+func (s *search) consider(n int32) {
+	t := s.tree
+	if t.dead[n] {
+		return
+	}
+	var dist2 float64
+	for axis, q := range s.query {
+		if math.IsNaN(q) {
+			continue
+		}
+		d := q - t.coord(n, axis)
+		dist2 += d * d
+	}
+
+	if len(s.results) < s.k {
+		heap.Push(s, result{n, dist2})
+		return
+	}
+	if dist2 < s.results[0].dist2 {
+		s.results[0] = result{n, dist2}
+		heap.Fix(s, 0)
+	}
+}
+
+func (s *search) Len() int           { return len(s.results) }
+func (s *search) Less(i, j int) bool { return s.results[i].dist2 > s.results[j].dist2 }
+func (s *search) Swap(i, j int)      { s.results[i], s.results[j] = s.results[j], s.results[i] }
+func (s *search) Push(x any)         { s.results = append(s.results, x.(result)) }
+func (s *search) Pop() any {
+	r := s.results[len(s.results)-1]
+	s.results = s.results[:len(s.results)-1]
+	return r
+}
@@ -0,0 +1,195 @@
+package knn_test
+
+import (
+	"io/fs"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/amonks/genres/knn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const dims = 7
+
+func randomPoints(rng *rand.Rand, n int) ([]int64, [][]float64) {
+	ids := make([]int64, n)
+	points := make([][]float64, n)
+	for i := range points {
+		ids[i] = int64(i)
+		points[i] = make([]float64, dims)
+		for j := range points[i] {
+			points[i][j] = rng.Float64()
+		}
+	}
+	return ids, points
+}
+
+// bruteForce is the obviously-correct version of Tree.Nearest.
+func bruteForce(ids []int64, points [][]float64, query []float64, k int) []knn.Neighbor {
+	var out []knn.Neighbor
+	for i, point := range points {
+		var dist2 float64
+		for j, q := range query {
+			if math.IsNaN(q) {
+				continue
+			}
+			d := q - float64(float32(point[j]))
+			dist2 += d * d
+		}
+		out = append(out, knn.Neighbor{ID: ids[i], Distance: math.Sqrt(dist2)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Distance < out[j].Distance })
+	if len(out) > k {
+		out = out[:k]
+	}
+	return out
+}
+
+func assertNeighbors(t *testing.T, expect, got []knn.Neighbor) {
+	t.Helper()
+	require.Equal(t, len(expect), len(got))
+	for i := range expect {
+		assert.InDelta(t, expect[i].Distance, got[i].Distance, 1e-9)
+	}
+}
+
+func TestNearest(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	ids, points := randomPoints(rng, 5_000)
+
+	built, err := knn.Build(dims, ids, points)
+	require.NoError(t, err)
+
+	inserted := knn.New(dims)
+	for i, id := range ids {
+		require.NoError(t, inserted.Insert(id, points[i]))
+	}
+
+	for i := 0; i < 100; i++ {
+		_, queries := randomPoints(rng, 1)
+		query := queries[0]
+		// leave out some dimensions, as `genres find` does
+		for j := range query {
+			if rng.Intn(3) == 0 {
+				query[j] = math.NaN()
+			}
+		}
+
+		expect := bruteForce(ids, points, query, 10)
+		for _, tree := range []*knn.Tree{built, inserted} {
+			got, err := tree.Nearest(query, 10)
+			require.NoError(t, err)
+			assertNeighbors(t, expect, got)
+		}
+	}
+}
+
+func TestNearestFewerThanK(t *testing.T) {
+	tree := knn.New(2)
+	require.NoError(t, tree.Insert(1, []float64{0, 0}))
+	require.NoError(t, tree.Insert(2, []float64{1, 1}))
+
+	got, err := tree.Nearest([]float64{0.9, 0.9}, 5)
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	assert.Equal(t, int64(2), got[0].ID)
+	assert.Equal(t, int64(1), got[1].ID)
+
+	got, err = knn.New(2).Nearest([]float64{0, 0}, 5)
+	require.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+func TestInsertReplaces(t *testing.T) {
+	tree := knn.New(1)
+	require.NoError(t, tree.Insert(1, []float64{0.1}))
+	require.NoError(t, tree.Insert(2, []float64{0.6}))
+	require.NoError(t, tree.Insert(1, []float64{0.9}))
+	assert.Equal(t, 2, tree.Len())
+
+	got, err := tree.Nearest([]float64{0}, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []knn.Neighbor{
+		{ID: 2, Distance: float64(float32(0.6))},
+		{ID: 1, Distance: float64(float32(0.9))},
+	}, got)
+}
+
+func TestBuildReplaces(t *testing.T) {
+	tree, err := knn.Build(1, []int64{1, 2, 1}, [][]float64{{0.1}, {0.6}, {0.9}})
+	require.NoError(t, err)
+	assert.Equal(t, 2, tree.Len())
+
+	got, err := tree.Nearest([]float64{0}, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []knn.Neighbor{
+		{ID: 2, Distance: float64(float32(0.6))},
+		{ID: 1, Distance: float64(float32(0.9))},
+	}, got)
+}
+
+func TestFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "index.knn")
+
+	_, _, err := knn.ReadFile(filename, dims)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	rng := rand.New(rand.NewSource(1))
+	ids, points := randomPoints(rng, 1_000)
+	require.NoError(t, knn.AppendFile(filename, dims, ids[:600], points[:600], 0, 600))
+	require.NoError(t, knn.AppendFile(filename, dims, ids[600:], points[600:], 600, 1000))
+
+	// a second writer which read the checkpoint before the last append
+	err = knn.AppendFile(filename, dims, ids[600:], points[600:], 600, 1000)
+	assert.ErrorIs(t, err, knn.ErrCheckpointMoved)
+
+	checkpoint, err := knn.ReadCheckpoint(filename, dims)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), checkpoint)
+
+	tree, checkpoint, err := knn.ReadFile(filename, dims)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), checkpoint)
+	assert.Equal(t, 1_000, tree.Len())
+
+	query := points[0]
+	got, err := tree.Nearest(query, 10)
+	require.NoError(t, err)
+	assertNeighbors(t, bruteForce(ids, points, query, 10), got)
+
+	_, _, err = knn.ReadFile(filename, dims+1)
+	assert.Error(t, err)
+}
+
+func benchmarkPoints(b *testing.B) ([]int64, [][]float64, [][]float64) {
+	rng := rand.New(rand.NewSource(1))
+	ids, points := randomPoints(rng, 1_000_000)
+	_, queries := randomPoints(rng, 1_000)
+	return ids, points, queries
+}
+
+func BenchmarkNearest(b *testing.B) {
+	ids, points, queries := benchmarkPoints(b)
+	tree, err := knn.Build(dims, ids, points)
+	require.NoError(b, err)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := tree.Nearest(queries[i%len(queries)], 10); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBruteForce(b *testing.B) {
+	ids, points, queries := benchmarkPoints(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		bruteForce(ids, points, queries[i%len(queries)], 10)
+	}
+}
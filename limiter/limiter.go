@@ -1,96 +1,363 @@
+// Package limiter implements a rate limiter whose state is kept in a file, so
+// that it survives restarts and is shared by every process using the same
+// file.
+//
+// A Limiter enforces three limits at once:
+//
+//   - a token bucket, which allows a burst of requests and then a sustained
+//     rate of one request per interval
+//   - a quota on the number of requests in any 24 hours
+//   - a time before which no requests may be made at all, set when the server
+//     asks us to back off
 package limiter
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 )
 
-func New(filename string, delay time.Duration) *Limiter {
-	return &Limiter{
+// Config describes the limits a Limiter enforces. The zero Config enforces
+// none of them.
+type Config struct {
+	// Burst is the number of requests which may be made back to back.
+	Burst int
+	// Interval is the time it takes to earn back one request of the
+	// burst, so that the sustained rate is one request per Interval. If
+	// it's zero, there's no rate limit.
+	Interval time.Duration
+	// DailyQuota is the number of requests allowed in any 24 hours. If
+	// it's zero, there's no quota.
+	DailyQuota int
+	// Backoff is how long to wait after a server error.
+	Backoff time.Duration
+}
+
+// DefaultConfig allows a request per second, in bursts of up to 10, up to
+// Spotify's quota of about 6,000 requests per day.
+var DefaultConfig = Config{
+	Burst:      10,
+	Interval:   time.Second,
+	DailyQuota: 6000,
+	Backoff:    time.Minute,
+}
+
+// A Clock tells the time. The Limiter uses the real clock unless it's given
+// another WithClock.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// An Option configures a Limiter.
+type Option func(*Limiter)
+
+// WithClock sets the clock the Limiter uses to tell the time and to wait.
+func WithClock(clock Clock) Option {
+	return func(lim *Limiter) { lim.clock = clock }
+}
+
+// New returns a Limiter which persists its state to the given file. Other
+// Limiters using the same file, in this process or another, share its
+// limits.
+func New(filename string, config Config, options ...Option) *Limiter {
+	lim := &Limiter{
 		filename: filename,
-		delay:    delay,
+		config:   config,
+		clock:    realClock{},
+	}
+	for _, option := range options {
+		option(lim)
 	}
+	return lim
 }
 
 type Limiter struct {
+	mu sync.Mutex
+
 	filename string
-	delay    time.Duration
-	nextAt   time.Time
+	config   Config
+	clock    Clock
 }
 
-func (lim *Limiter) Load() error {
-	if _, err := os.Stat(lim.filename); errors.Is(err, os.ErrNotExist) {
-		return nil
-	} else if err != nil {
-		return fmt.Errorf("error statting file: %w", err)
-	}
-
-	bs, err := os.ReadFile(lim.filename)
-	if err != nil {
-		return err
-	}
+// state is what's persisted to the Limiter's file.
+type state struct {
+	// Tokens is the number of requests left in the bucket as of
+	// UpdatedAt.
+	Tokens    float64   `json:"tokens"`
+	UpdatedAt time.Time `json:"updated_at"`
 
-	lim.nextAt, err = time.Parse(time.UnixDate, string(bs))
-	if err != nil {
-		return err
-	}
+	// BlockedUntil is the time before which no requests may be made.
+	BlockedUntil time.Time `json:"blocked_until"`
 
-	return nil
+	// Requests counts the requests made in each of the last 24 hours'
+	// minutes, keyed by the minute's Unix time, whether or not there's a
+	// quota.
+	Requests map[int64]int `json:"requests,omitempty"`
 }
 
+// Wait blocks until a request may be made, and then counts one against the
+// limits.
 func (lim *Limiter) Wait(ctx context.Context) error {
-	if !lim.nextAt.IsZero() {
-		now := time.Now()
-		dur := lim.nextAt.Sub(now)
+	for {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("canceled: %w", err)
+		}
+
+		var now, at time.Time
+		if err := lim.update(func(s *state) bool {
+			now = lim.clock.Now()
+			at = lim.readyAt(s, now)
+			if at.After(now) {
+				return false
+			}
+			lim.take(s, now)
+			return true
+		}); err != nil {
+			return err
+		}
+		if !at.After(now) {
+			return nil
+		}
+
+		dur := at.Sub(now)
 		if dur > time.Second {
 			log.Printf("waiting %s until %s",
-				lim.nextAt.Sub(now).Truncate(time.Second),
-				lim.nextAt.Format(time.StampMilli))
+				dur.Truncate(time.Second),
+				at.Format(time.StampMilli))
 		}
-
-	wait:
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(dur):
-			break wait
+			return fmt.Errorf("canceled: %w", ctx.Err())
+		case <-lim.clock.After(dur):
 		}
+	}
+}
 
-		if err := os.Remove(lim.filename); err != nil &&
-			!errors.Is(err, os.ErrNotExist) {
-			return err
+// Usage describes a Limiter's recent requests.
+type Usage struct {
+	// Requests is the number of requests made in the last 24 hours.
+	Requests int
+	// DailyQuota is the configured quota, or zero if there's none.
+	DailyQuota int
+	// ReadyAt is the earliest time at which a request may be made.
+	ReadyAt time.Time
+}
+
+// Usage reports on the requests made through the Limiter's file, by this
+// Limiter or any other.
+func (lim *Limiter) Usage() (Usage, error) {
+	usage := Usage{DailyQuota: lim.config.DailyQuota}
+	if err := lim.update(func(s *state) bool {
+		usage.ReadyAt = lim.readyAt(s, lim.clock.Now())
+		for _, n := range s.Requests {
+			usage.Requests += n
 		}
+		return false
+	}); err != nil {
+		return Usage{}, err
 	}
-
-	return nil
+	return usage, nil
 }
 
+// SetNextAt blocks requests for the number of seconds in the given
+// Retry-After header value, plus one, or for a minute if it's empty.
 func (lim *Limiter) SetNextAt(secondsStr string) error {
 	if secondsStr == "" {
 		secondsStr = "60"
 	}
 	seconds, err := strconv.ParseInt(secondsStr, 10, 64)
 	if err != nil {
-		return err
+		return fmt.Errorf("error parsing Retry-After '%s': %w", secondsStr, err)
+	}
+	return lim.blockFor(time.Duration(seconds)*time.Second + time.Second)
+}
+
+// Backoff blocks requests for the configured backoff, after a server error.
+func (lim *Limiter) Backoff() error {
+	return lim.blockFor(lim.config.Backoff)
+}
+
+func (lim *Limiter) blockFor(dur time.Duration) error {
+	return lim.update(func(s *state) bool {
+		until := lim.clock.Now().Add(dur)
+		if !until.After(s.BlockedUntil) {
+			return false
+		}
+		s.BlockedUntil = until
+		return true
+	})
+}
+
+// readyAt returns the earliest time, not before now, at which a request may
+// be made.
+func (lim *Limiter) readyAt(s *state, now time.Time) time.Time {
+	at := now
+	if s.BlockedUntil.After(at) {
+		at = s.BlockedUntil
+	}
+
+	lim.refill(s, now)
+	if lim.config.Interval > 0 && s.Tokens < 1 {
+		tokenAt := now.Add(time.Duration(math.Ceil((1 - s.Tokens) * float64(lim.config.Interval))))
+		if tokenAt.After(at) {
+			at = tokenAt
+		}
 	}
-	var nextReqAt time.Time
-	waitTime := time.Duration(seconds)*time.Second + time.Second
-	lim.nextAt = time.Now().Add(waitTime)
-	if err := os.WriteFile(lim.filename, []byte(nextReqAt.Format(time.UnixDate)), 0666); err != nil {
+
+	prune(s, now)
+	if quota := lim.config.DailyQuota; quota > 0 {
+		minutes := make([]int64, 0, len(s.Requests))
+		total := 0
+		for minute, n := range s.Requests {
+			minutes = append(minutes, minute)
+			total += n
+		}
+		if total >= quota {
+			slices.Sort(minutes)
+			for _, minute := range minutes {
+				total -= s.Requests[minute]
+				if total < quota {
+					quotaAt := expiry(minute)
+					if quotaAt.After(at) {
+						at = quotaAt
+					}
+					break
+				}
+			}
+		}
+	}
+
+	return at
+}
+
+// take counts a request made at the given time.
+func (lim *Limiter) take(s *state, now time.Time) {
+	if lim.config.Interval > 0 {
+		s.Tokens--
+	}
+	if s.Requests == nil {
+		s.Requests = map[int64]int{}
+	}
+	s.Requests[now.Truncate(time.Minute).Unix()]++
+}
+
+// refill adds the tokens earned since the state was last updated.
+func (lim *Limiter) refill(s *state, now time.Time) {
+	burst := float64(max(lim.config.Burst, 1))
+	if s.UpdatedAt.IsZero() || lim.config.Interval <= 0 {
+		s.Tokens = burst
+	} else if elapsed := now.Sub(s.UpdatedAt); elapsed > 0 {
+		s.Tokens = math.Min(burst, s.Tokens+float64(elapsed)/float64(lim.config.Interval))
+	}
+	if now.After(s.UpdatedAt) {
+		s.UpdatedAt = now
+	}
+}
+
+// prune forgets the requests which no longer count against the quota.
+func prune(s *state, now time.Time) {
+	for minute := range s.Requests {
+		if !expiry(minute).After(now) {
+			delete(s.Requests, minute)
+		}
+	}
+}
+
+// expiry returns the time at which the requests made in the given minute stop
+// counting against the quota.
+func expiry(minute int64) time.Time {
+	return time.Unix(minute, 0).Add(24*time.Hour + time.Minute)
+}
+
+// update loads the state, passes it to fn, and saves it if fn returns true,
+// while holding a lock on the state file, so that no other Limiter can use
+// the state in between.
+func (lim *Limiter) update(fn func(s *state) bool) error {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+
+	lock, err := os.OpenFile(lim.filename+".lock", os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return fmt.Errorf("error opening lock file: %w", err)
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("error locking '%s': %w", lock.Name(), err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	s, err := lim.load()
+	if err != nil {
 		return err
 	}
-	return nil
+	if !fn(s) {
+		return nil
+	}
+	return lim.save(s)
 }
 
-func (lim *Limiter) Delay() {
-	lim.DelayBy(lim.delay)
+func (lim *Limiter) load() (*state, error) {
+	bs, err := os.ReadFile(lim.filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return &state{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading limiter file: %w", err)
+	}
+
+	// Older versions stored only the time of the next request.
+	if t, err := time.Parse(time.UnixDate, string(bs)); err == nil {
+		return &state{BlockedUntil: t}, nil
+	}
+
+	var s state
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return nil, fmt.Errorf("error parsing limiter file '%s': %w", lim.filename, err)
+	}
+	return &s, nil
 }
 
-func (lim *Limiter) DelayBy(time.Duration) {
-	lim.nextAt = time.Now().Add(lim.delay)
+// save writes the state to a temporary file and then renames it over the
+// limiter file, so that the file is never seen half-written.
+func (lim *Limiter) save(s *state) error {
+	bs, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("error encoding limiter state: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(lim.filename), filepath.Base(lim.filename)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating limiter file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(bs); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing limiter file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("error syncing limiter file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing limiter file: %w", err)
+	}
+	if err := os.Rename(f.Name(), lim.filename); err != nil {
+		return fmt.Errorf("error renaming limiter file: %w", err)
+	}
+	return nil
 }
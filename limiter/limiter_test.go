@@ -0,0 +1,312 @@
+package limiter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBurst(t *testing.T) {
+	clock := newFakeClock()
+	lim := New(filepath.Join(t.TempDir(), "next-req"), Config{
+		Burst:    3,
+		Interval: 10 * time.Second,
+	}, WithClock(clock))
+
+	for i := 0; i < 3; i++ {
+		assertReady(t, wait(lim))
+	}
+
+	done := wait(lim)
+	clock.waitForTimer(t)
+	clock.Advance(9 * time.Second)
+	assertBlocked(t, done)
+	clock.Advance(time.Second)
+	assertReady(t, done)
+
+	// Having waited a minute, the bucket is full again, but no fuller.
+	clock.Advance(time.Minute)
+	for i := 0; i < 3; i++ {
+		assertReady(t, wait(lim))
+	}
+	done = wait(lim)
+	clock.waitForTimer(t)
+	assertBlocked(t, done)
+	clock.Advance(10 * time.Second)
+	assertReady(t, done)
+}
+
+func TestDailyQuota(t *testing.T) {
+	clock := newFakeClock()
+	lim := New(filepath.Join(t.TempDir(), "next-req"), Config{
+		DailyQuota: 5,
+	}, WithClock(clock))
+
+	start := clock.Now()
+	for i := 0; i < 3; i++ {
+		assertReady(t, wait(lim))
+	}
+	clock.Advance(time.Hour)
+	for i := 0; i < 2; i++ {
+		assertReady(t, wait(lim))
+	}
+
+	done := wait(lim)
+	clock.waitForTimer(t)
+	clock.Advance(22 * time.Hour)
+	assertBlocked(t, done)
+
+	// The first three requests expire a day after the minute they were
+	// made in.
+	clock.Advance(start.Add(24*time.Hour + time.Minute).Sub(clock.Now()))
+	assertReady(t, done)
+	assertReady(t, wait(lim))
+	assertReady(t, wait(lim))
+
+	done = wait(lim)
+	clock.waitForTimer(t)
+	clock.Advance(time.Hour)
+	assertReady(t, done)
+}
+
+func TestUsage(t *testing.T) {
+	clock := newFakeClock()
+	filename := filepath.Join(t.TempDir(), "next-req")
+	lim := New(filename, Config{Burst: 1, Interval: time.Minute, DailyQuota: 100}, WithClock(clock))
+
+	assertReady(t, wait(lim))
+	clock.Advance(time.Hour)
+	assertReady(t, wait(lim))
+	clock.Advance(time.Minute)
+	assertReady(t, wait(lim))
+
+	// Usage is read from the file, so any Limiter can report it.
+	usage, err := New(filename, Config{DailyQuota: 100}, WithClock(clock)).Usage()
+	require.NoError(t, err)
+	assert.Equal(t, Usage{Requests: 3, DailyQuota: 100, ReadyAt: clock.Now()}, usage)
+
+	usage, err = lim.Usage()
+	require.NoError(t, err)
+	assert.Equal(t, 3, usage.Requests)
+	assert.Equal(t, clock.Now().Add(time.Minute), usage.ReadyAt)
+
+	clock.Advance(25 * time.Hour)
+	usage, err = lim.Usage()
+	require.NoError(t, err)
+	assert.Equal(t, 0, usage.Requests)
+}
+
+func TestSetNextAt(t *testing.T) {
+	clock := newFakeClock()
+	filename := filepath.Join(t.TempDir(), "next-req")
+
+	require.NoError(t, New(filename, Config{}, WithClock(clock)).SetNextAt("5"))
+
+	// A new Limiter, as in a restarted process, is blocked too.
+	lim := New(filename, Config{}, WithClock(clock))
+	done := wait(lim)
+	clock.waitForTimer(t)
+	clock.Advance(5 * time.Second)
+	assertBlocked(t, done)
+	clock.Advance(time.Second)
+	assertReady(t, done)
+
+	// A shorter block doesn't shorten a longer one.
+	require.NoError(t, lim.SetNextAt(""))
+	require.NoError(t, lim.SetNextAt("1"))
+	done = wait(lim)
+	clock.waitForTimer(t)
+	clock.Advance(2 * time.Second)
+	assertBlocked(t, done)
+	clock.Advance(59 * time.Second)
+	assertReady(t, done)
+
+	assert.Error(t, lim.SetNextAt("soon"))
+}
+
+func TestBackoff(t *testing.T) {
+	clock := newFakeClock()
+	lim := New(filepath.Join(t.TempDir(), "next-req"), Config{
+		Backoff: time.Minute,
+	}, WithClock(clock))
+
+	require.NoError(t, lim.Backoff())
+	done := wait(lim)
+	clock.waitForTimer(t)
+	clock.Advance(59 * time.Second)
+	assertBlocked(t, done)
+	clock.Advance(time.Second)
+	assertReady(t, done)
+}
+
+func TestLegacyFile(t *testing.T) {
+	clock := newFakeClock()
+	filename := filepath.Join(t.TempDir(), "next-req")
+	nextAt := clock.Now().Add(time.Minute)
+	require.NoError(t, os.WriteFile(filename, []byte(nextAt.Format(time.UnixDate)), 0666))
+
+	lim := New(filename, Config{}, WithClock(clock))
+	done := wait(lim)
+	clock.waitForTimer(t)
+	clock.Advance(30 * time.Second)
+	assertBlocked(t, done)
+	clock.Advance(30 * time.Second)
+	assertReady(t, done)
+}
+
+func TestShared(t *testing.T) {
+	clock := newFakeClock()
+	filename := filepath.Join(t.TempDir(), "next-req")
+	config := Config{Burst: 2, Interval: time.Minute}
+	a := New(filename, config, WithClock(clock))
+	b := New(filename, config, WithClock(clock))
+
+	assertReady(t, wait(a))
+	assertReady(t, wait(b))
+	done := wait(a)
+	clock.waitForTimer(t)
+	assertBlocked(t, done)
+	clock.Advance(time.Minute)
+	assertReady(t, done)
+}
+
+func TestConcurrent(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "next-req")
+	config := Config{DailyQuota: 1000}
+
+	// Each Limiter locks the file separately, as separate processes
+	// would, so no request may be lost.
+	const limiters, requests = 4, 25
+	var wg sync.WaitGroup
+	for i := 0; i < limiters; i++ {
+		lim := New(filename, config)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				assert.NoError(t, lim.Wait(context.Background()))
+			}
+		}()
+	}
+	wg.Wait()
+
+	s, err := New(filename, config).load()
+	require.NoError(t, err)
+	total := 0
+	for _, n := range s.Requests {
+		total += n
+	}
+	assert.Equal(t, limiters*requests, total)
+}
+
+func TestCanceled(t *testing.T) {
+	clock := newFakeClock()
+	lim := New(filepath.Join(t.TempDir(), "next-req"), Config{Backoff: time.Hour}, WithClock(clock))
+	require.NoError(t, lim.Backoff())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- lim.Wait(ctx) }()
+	clock.waitForTimer(t)
+	cancel()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait didn't return after its context was canceled")
+	}
+}
+
+func wait(lim *Limiter) chan error {
+	done := make(chan error, 1)
+	go func() { done <- lim.Wait(context.Background()) }()
+	return done
+}
+
+func assertReady(t *testing.T, done chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait didn't return")
+	}
+}
+
+// assertBlocked asserts that a Wait hasn't returned. It's only meaningful
+// once the Wait is waiting on the clock.
+func assertBlocked(t *testing.T, done chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		t.Fatalf("Wait returned early, with %v", err)
+	default:
+	}
+}
+
+// fakeClock only moves forward when it's advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []fakeTimer
+	created chan struct{}
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:     time.Date(2024, 1, 1, 12, 0, 30, 0, time.UTC),
+		created: make(chan struct{}, 100),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, timer)
+	c.created <- struct{}{}
+	return timer.c
+}
+
+// Advance moves the clock forward, firing the timers which come due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var pending []fakeTimer
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.c <- c.now
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+}
+
+// waitForTimer blocks until a Wait is waiting on the clock.
+func (c *fakeClock) waitForTimer(t *testing.T) {
+	t.Helper()
+	select {
+	case <-c.created:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no timer was set")
+	}
+}
@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("requests_total", "Requests made.", "endpoint", "status")
+	rows := r.NewGauge("rows", "Rows in the\ntable.")
+	latency := r.NewHistogram("latency_seconds", "Request latency.", []float64{.1, 1}, "endpoint")
+
+	requests.Inc("search", "200")
+	requests.Add(2, "search", "200")
+	requests.Inc(`a"b`, "429")
+	rows.Set(42)
+	latency.Observe(.05, "search")
+	latency.Observe(.5, "search")
+	latency.Observe(5, "search")
+
+	var b strings.Builder
+	_, err := r.WriteTo(&b)
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{endpoint="search",le="0.1"} 1
+latency_seconds_bucket{endpoint="search",le="1"} 2
+latency_seconds_bucket{endpoint="search",le="+Inf"} 3
+latency_seconds_sum{endpoint="search"} 5.55
+latency_seconds_count{endpoint="search"} 3
+# HELP requests_total Requests made.
+# TYPE requests_total counter
+requests_total{endpoint="a\"b",status="429"} 1
+requests_total{endpoint="search",status="200"} 3
+# HELP rows Rows in the\ntable.
+# TYPE rows gauge
+rows 42
+`, b.String())
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewGauge("rows", "Rows.").Set(1)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain")
+	assert.Contains(t, rec.Body.String(), "rows 1\n")
+}
+
+func TestMisuse(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("c", "C.", "label")
+	assert.Panics(t, func() { r.NewGauge("c", "C again.") })
+	assert.Panics(t, func() { c.Inc() })
+	assert.Panics(t, func() { r.NewHistogram("h", "H.", []float64{1, .1}) })
+}
@@ -0,0 +1,81 @@
+package readthrough
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Memory is a Cache which holds every entry in memory. It's meant for tests
+// and short-lived processes.
+type Memory struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+func NewMemory() *Memory {
+	return &Memory{entries: map[string][]byte{}}
+}
+
+func (m *Memory) Get(key string) (io.ReadCloser, string, error) {
+	hash := hashKey(key)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bs, ok := m.entries[key]
+	if !ok {
+		return nil, hash, fmt.Errorf("cache miss for '%s': %w", hash, ErrMiss)
+	}
+	return io.NopCloser(bytes.NewReader(bs)), hash, nil
+}
+
+func (m *Memory) Set(key string, r io.ReadCloser) (io.ReadCloser, string, error) {
+	hash := hashKey(key)
+
+	bs, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, hash, fmt.Errorf("error reading body for '%s': %w", hash, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries[key] = bs
+	return io.NopCloser(bytes.NewReader(bs)), hash, nil
+}
+
+// Walk calls fn with the key of every entry, in no particular order.
+func (m *Memory) Walk(fn func(key string) error) error {
+	m.mu.Lock()
+	keys := make([]string, 0, len(m.entries))
+	for key := range m.entries {
+		keys = append(keys, key)
+	}
+	m.mu.Unlock()
+
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Nop is a Cache which stores nothing, so every request goes to the network.
+type Nop struct{}
+
+func (Nop) Get(key string) (io.ReadCloser, string, error) {
+	hash := hashKey(key)
+	return nil, hash, fmt.Errorf("cache miss for '%s': %w", hash, ErrMiss)
+}
+
+func (Nop) Set(key string, r io.ReadCloser) (io.ReadCloser, string, error) {
+	return r, hashKey(key), nil
+}
+
+func (Nop) Walk(fn func(key string) error) error {
+	return nil
+}
@@ -7,10 +7,40 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
+// A Cache stores response bodies by key.
+type Cache interface {
+	// Get returns the body stored for the given key, along with a
+	// short identifier for the entry, for logging. If there's no entry,
+	// Get returns an error wrapping ErrMiss.
+	Get(key string) (io.ReadCloser, string, error)
+
+	// Set stores the body read from r under the given key, closes r,
+	// and returns a reader of the same body, along with a short
+	// identifier for the entry.
+	Set(key string, r io.ReadCloser) (io.ReadCloser, string, error)
+
+	// Walk calls fn with the key of every entry, stopping at the first
+	// error fn returns.
+	Walk(fn func(key string) error) error
+}
+
+var (
+	_ Cache = &ReadThrough{}
+	_ Cache = &Memory{}
+	_ Cache = Nop{}
+	_ Cache = &SQLite{}
+)
+
+// New returns a Cache which stores each entry in its own file within the
+// given directory, named by the hash of its key. The key itself is stored
+// alongside, in a file with the suffix ".key".
 func New(dir, prefix string) *ReadThrough {
 	return &ReadThrough{dir: dir, prefix: prefix}
 }
@@ -47,26 +77,95 @@ func (rt *ReadThrough) Set(key string, r io.ReadCloser) (io.ReadCloser, string,
 	}
 	path := filepath.Join(dirname, filename)
 
-	cache, err := os.Create(path)
+	// The body is written to a temporary file and then renamed into
+	// place, so that a concurrent Get never sees it half-written.
+	cache, err := os.CreateTemp(dirname, filename+".tmp-*")
 	if err != nil {
 		return nil, hash, fmt.Errorf("error opening cache file '%s' for write: %w", path, err)
 	}
-	defer cache.Close()
+	defer os.Remove(cache.Name())
 
 	var buf bytes.Buffer
 	tee := io.TeeReader(r, cache)
 	if _, err := io.Copy(&buf, tee); err != nil {
+		cache.Close()
 		return nil, hash, fmt.Errorf("error writing cache file '%s': %w", hash, err)
 	}
 	r.Close()
+	if err := cache.Chmod(0644); err != nil {
+		cache.Close()
+		return nil, hash, fmt.Errorf("error setting mode of cache file '%s': %w", hash, err)
+	}
+	if err := cache.Close(); err != nil {
+		return nil, hash, fmt.Errorf("error closing cache file '%s': %w", hash, err)
+	}
+
+	if err := os.WriteFile(path+keySuffix, []byte(key), 0644); err != nil {
+		return nil, hash, fmt.Errorf("error writing cache key file '%s': %w", hash, err)
+	}
+	if err := os.Rename(cache.Name(), path); err != nil {
+		return nil, hash, fmt.Errorf("error renaming cache file '%s': %w", hash, err)
+	}
 
 	return io.NopCloser(&buf), hash, nil
 }
 
+const keySuffix = ".key"
+
+// Walk calls fn with the key of every entry. Entries written before keys were
+// recorded have no key file, and are skipped; Walk logs how many.
+func (rt *ReadThrough) Walk(fn func(key string) error) error {
+	if _, err := os.Stat(rt.dir); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	// Files are walked in lexical order, so an entry's key file, if it
+	// has one, comes right after the entry itself.
+	var keyless int
+	var unkeyed string
+	if err := filepath.WalkDir(rt.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.Contains(d.Name(), ".tmp-") {
+			return nil
+		}
+		if !strings.HasSuffix(path, keySuffix) {
+			if unkeyed != "" {
+				keyless++
+			}
+			unkeyed = path
+			return nil
+		}
+		if path == unkeyed+keySuffix {
+			unkeyed = ""
+		}
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading cache key file '%s': %w", path, err)
+		}
+		return fn(string(bs))
+	}); err != nil {
+		return err
+	}
+	if unkeyed != "" {
+		keyless++
+	}
+
+	if keyless > 0 {
+		log.Printf("[readthrough] skipped %d cache entries without keys in '%s'", keyless, rt.dir)
+	}
+	return nil
+}
+
 func (rt *ReadThrough) hashAndFilename(key string) (string, string, string) {
-	var hasher = sha256.New()
-	hasher.Write([]byte(key))
-	hash := hex.EncodeToString(hasher.Sum(nil))
+	hash := hashKey(key)
 	first, second, third := hash[:2], hash[2:4], hash[4:]
 	return hash, filepath.Join(rt.dir, rt.prefix+first, second), third
 }
+
+func hashKey(key string) string {
+	var hasher = sha256.New()
+	hasher.Write([]byte(key))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
@@ -0,0 +1,106 @@
+package readthrough_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/amonks/genres/readthrough"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaches(t *testing.T) {
+	for name, open := range map[string]func(t *testing.T) readthrough.Cache{
+		"dir":    func(t *testing.T) readthrough.Cache { return readthrough.New(t.TempDir(), "req-") },
+		"memory": func(t *testing.T) readthrough.Cache { return readthrough.NewMemory() },
+		"sqlite": func(t *testing.T) readthrough.Cache {
+			cache, err := readthrough.OpenSQLite(filepath.Join(t.TempDir(), "cache.db"))
+			require.NoError(t, err)
+			t.Cleanup(func() { cache.Close() })
+			return cache
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cache := open(t)
+
+			_, _, err := cache.Get("https://example.com/a")
+			assert.ErrorIs(t, err, readthrough.ErrMiss)
+
+			r, setHash, err := cache.Set("https://example.com/a", io.NopCloser(strings.NewReader("body")))
+			require.NoError(t, err)
+			assert.Equal(t, "body", readAll(t, r))
+
+			r, getHash, err := cache.Get("https://example.com/a")
+			require.NoError(t, err)
+			assert.Equal(t, "body", readAll(t, r))
+			assert.Equal(t, setHash, getHash)
+
+			_, _, err = cache.Get("https://example.com/b")
+			assert.ErrorIs(t, err, readthrough.ErrMiss)
+
+			_, _, err = cache.Set("https://example.com/b?q=1", io.NopCloser(strings.NewReader("body")))
+			require.NoError(t, err)
+			var keys []string
+			require.NoError(t, cache.Walk(func(key string) error {
+				keys = append(keys, key)
+				return nil
+			}))
+			assert.ElementsMatch(t, []string{"https://example.com/a", "https://example.com/b?q=1"}, keys)
+		})
+	}
+}
+
+func TestWalkKeyless(t *testing.T) {
+	dir := t.TempDir()
+	cache := readthrough.New(dir, "req-")
+	for _, key := range []string{"https://example.com/a", "https://example.com/b"} {
+		_, _, err := cache.Set(key, io.NopCloser(strings.NewReader("body")))
+		require.NoError(t, err)
+	}
+
+	// Remove a's key file, as if it had been cached before keys were
+	// recorded.
+	keyFiles, err := filepath.Glob(filepath.Join(dir, "*", "*", "*.key"))
+	require.NoError(t, err)
+	require.Len(t, keyFiles, 2)
+	for _, keyFile := range keyFiles {
+		bs, err := os.ReadFile(keyFile)
+		require.NoError(t, err)
+		if string(bs) == "https://example.com/a" {
+			require.NoError(t, os.Remove(keyFile))
+		}
+	}
+
+	var keys []string
+	require.NoError(t, cache.Walk(func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.Equal(t, []string{"https://example.com/b"}, keys)
+
+	// It can still be read by its key.
+	r, _, err := cache.Get("https://example.com/a")
+	require.NoError(t, err)
+	assert.Equal(t, "body", readAll(t, r))
+}
+
+func TestNop(t *testing.T) {
+	var cache readthrough.Nop
+
+	r, _, err := cache.Set("https://example.com/a", io.NopCloser(strings.NewReader("body")))
+	require.NoError(t, err)
+	assert.Equal(t, "body", readAll(t, r))
+
+	_, _, err = cache.Get("https://example.com/a")
+	assert.ErrorIs(t, err, readthrough.ErrMiss)
+}
+
+func readAll(t *testing.T, r io.ReadCloser) string {
+	defer r.Close()
+	bs, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(bs)
+}
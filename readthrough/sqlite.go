@@ -0,0 +1,107 @@
+package readthrough
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// SQLite is a Cache which stores entries as blobs in a sqlite3 database file,
+// which is friendlier to backups and filesystems than millions of small files.
+type SQLite struct {
+	db *gorm.DB
+}
+
+type sqliteEntry struct {
+	Hash string
+	Key  string
+	Body []byte
+}
+
+// OpenSQLite returns a Cache backed by the given sqlite3 database file,
+// creating it if necessary.
+func OpenSQLite(filename string) (*SQLite, error) {
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("%s?_journal_mode=wal&_synchronous=1&_busy_timeout=5000", filename)), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error opening cache db '%s': %w", filename, err)
+	}
+	if err := db.Exec(`
+		create table if not exists entries (
+			hash text primary key,
+			key  text not null,
+			body blob not null
+		)`).Error; err != nil {
+		return nil, fmt.Errorf("error creating cache table in '%s': %w", filename, err)
+	}
+	return &SQLite{db: db}, nil
+}
+
+func (c *SQLite) Get(key string) (io.ReadCloser, string, error) {
+	hash := hashKey(key)
+
+	var entry sqliteEntry
+	if err := c.db.
+		Table("entries").
+		Where("hash = ?", hash).
+		Take(&entry).
+		Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, hash, fmt.Errorf("cache miss for '%s': %w", hash, ErrMiss)
+	} else if err != nil {
+		return nil, hash, fmt.Errorf("error reading cache entry '%s': %w", hash, err)
+	}
+
+	return io.NopCloser(bytes.NewReader(entry.Body)), hash, nil
+}
+
+func (c *SQLite) Set(key string, r io.ReadCloser) (io.ReadCloser, string, error) {
+	hash := hashKey(key)
+
+	bs, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, hash, fmt.Errorf("error reading body for '%s': %w", hash, err)
+	}
+
+	if err := c.db.
+		Exec("insert or replace into entries (hash, key, body) values (?, ?, ?)", hash, key, bs).
+		Error; err != nil {
+		return nil, hash, fmt.Errorf("error writing cache entry '%s': %w", hash, err)
+	}
+
+	return io.NopCloser(bytes.NewReader(bs)), hash, nil
+}
+
+// Walk calls fn with the key of every entry, in the order they were stored.
+func (c *SQLite) Walk(fn func(key string) error) error {
+	rows, err := c.db.Table("entries").Select("key").Order("rowid asc").Rows()
+	if err != nil {
+		return fmt.Errorf("error listing cache entries: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return fmt.Errorf("error reading cache entry: %w", err)
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (c *SQLite) Close() error {
+	db, err := c.db.DB()
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
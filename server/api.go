@@ -0,0 +1,251 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/amonks/genres/data"
+	"github.com/amonks/genres/db"
+	"gorm.io/gorm"
+)
+
+// These bound the work a single request can ask for.
+const (
+	maxSearchCount    = 100
+	maxNeighborsCount = 100
+	maxPathSteps      = 100
+)
+
+// registerAPI adds the JSON endpoints to the given mux. Each endpoint takes
+// query parameters that mirror the flags of the corresponding CLI command.
+func registerAPI(mux *http.ServeMux, db *db.DB) {
+	// GET /api/search?query=...&count=1
+	mux.HandleFunc("GET /api/search", func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query().Get("query")
+		if query == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("missing 'query'"))
+			return
+		}
+		count, err := intParam(req, "count", 1, maxSearchCount)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		tracks, err := db.Search(req.Context(), query, count)
+		if err != nil {
+			writeError(w, lookupStatus(err), fmt.Errorf("error in search for '%s': %w", query, err))
+			return
+		}
+
+		writeJSON(w, tracks)
+	})
+
+	// GET /api/find?count=1&energy=0.5&valence=0.2...
+	mux.HandleFunc("GET /api/find", func(w http.ResponseWriter, req *http.Request) {
+		count, err := intParam(req, "count", 1, maxNeighborsCount)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		input := data.Vector{}
+		for _, feature := range data.Features {
+			if req.URL.Query().Get(feature) == "" {
+				continue
+			}
+			v, err := floatParam(req, feature)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			input[feature] = v
+		}
+		if len(input) == 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("must specify at least one feature"))
+			return
+		}
+
+		tracks, err := db.NearestTracks(req.Context(), count, input)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeJSON(w, tracks)
+	})
+
+	// GET /api/neighbors?query=...&count=5
+	mux.HandleFunc("GET /api/neighbors", func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query().Get("query")
+		if query == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("missing 'query'"))
+			return
+		}
+		count, err := intParam(req, "count", 5, maxNeighborsCount)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		results, err := db.Search(req.Context(), query, 1)
+		if err != nil {
+			writeError(w, lookupStatus(err), fmt.Errorf("error in search for '%s': %w", query, err))
+			return
+		}
+		if len(results) == 0 {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no track found for query '%s'", query))
+			return
+		}
+
+		track := results[0]
+		tracks, err := db.NearestTracks(req.Context(), count+1, track.Vector())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("error finding neighbors of '%s': %w", track.SpotifyID, err))
+			return
+		}
+
+		writeJSON(w, tracks)
+	})
+
+	// GET /api/path?from=...&to=...&steps=5
+	mux.HandleFunc("GET /api/path", func(w http.ResponseWriter, req *http.Request) {
+		from, to := req.URL.Query().Get("from"), req.URL.Query().Get("to")
+		if from == "" || to == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("must specify 'from' and 'to'"))
+			return
+		}
+		steps, err := intParam(req, "steps", 5, maxPathSteps)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		fromTrack, err := db.Resolve(req.Context(), from)
+		if err != nil {
+			writeError(w, lookupStatus(err), fmt.Errorf("error getting 'from' track '%s': %w", from, err))
+			return
+		}
+		toTrack, err := db.Resolve(req.Context(), to)
+		if err != nil {
+			writeError(w, lookupStatus(err), fmt.Errorf("error getting 'to' track '%s': %w", to, err))
+			return
+		}
+
+		playlist, err := db.Path(req.Context(), fromTrack, toTrack, steps)
+		if err != nil {
+			writeError(w, lookupStatus(err), err)
+			return
+		}
+
+		writeJSON(w, playlist)
+	})
+
+	// GET /api/resolve?query=id:...
+	//
+	// The query is interpreted as in db.Resolve: either "id:<spotify id>",
+	// "q:<search query>", or a bare spotify id.
+	mux.HandleFunc("GET /api/resolve", func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query().Get("query")
+		if query == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("missing 'query'"))
+			return
+		}
+
+		track, err := db.Resolve(req.Context(), query)
+		if err != nil {
+			writeError(w, lookupStatus(err), err)
+			return
+		}
+
+		writeJSON(w, track)
+	})
+
+	// GET /api/genres/{name}
+	//
+	// Returns the genre along with its most popular artists and tracks, for
+	// the genre map.
+	mux.HandleFunc("GET /api/genres/{name}", func(w http.ResponseWriter, req *http.Request) {
+		genre, err := db.GetGenre(req.Context(), req.PathValue("name"))
+		if err != nil {
+			writeError(w, lookupStatus(err), err)
+			return
+		}
+		artists, err := db.GetGenreArtists(req.Context(), genre.Name, 50)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		tracks, err := db.GetGenreTracks(req.Context(), genre.Name, 50)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeJSON(w, map[string]any{
+			"Genre":   genre,
+			"Artists": artists,
+			"Tracks":  tracks,
+		})
+	})
+}
+
+// intParam returns the value of the named parameter, which must be between 1
+// and limit, or def if it's missing.
+func intParam(req *http.Request, name string, def, limit int) (int, error) {
+	str := req.URL.Query().Get(name)
+	if str == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid '%s': %w", name, err)
+	}
+	if v < 1 {
+		return 0, fmt.Errorf("invalid '%s': must be positive", name)
+	}
+	if v > limit {
+		return 0, fmt.Errorf("invalid '%s': must be at most %d", name, limit)
+	}
+	return v, nil
+}
+
+func floatParam(req *http.Request, name string) (float64, error) {
+	v, err := strconv.ParseFloat(req.URL.Query().Get(name), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid '%s': %w", name, err)
+	}
+	return v, nil
+}
+
+// lookupStatus returns the status for an error looking up a requested
+// record: 400 if the request can't be run, 404 if the record doesn't exist,
+// and 500 for anything else.
+func lookupStatus(err error) int {
+	if errors.Is(err, db.ErrBadQuery) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("[server] error encoding response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/amonks/genres/data"
+	"github.com/amonks/genres/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openAPI serves the JSON endpoints over a database holding three tracks by
+// one artist in the genre "pop", on one album. If analyzed is false, the
+// tracks have no audio features.
+func openAPI(t *testing.T, analyzed bool) (*db.DB, *httptest.Server) {
+	return openServer(t, analyzed, registerAPI)
+}
+
+// openServer serves the endpoints added by register over the database
+// described in openAPI.
+func openServer(t *testing.T, analyzed bool, register func(*http.ServeMux, *db.DB)) (*db.DB, *httptest.Server) {
+	database, err := db.Open(filepath.Join(t.TempDir(), "genres.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { database.Close() })
+	ctx := context.Background()
+
+	require.NoError(t, database.InsertGenre(&data.Genre{Name: "pop", Key: "k"}))
+	artist := data.Artist{SpotifyID: "a1", Name: "artist", Genres: []string{"pop"}}
+	require.NoError(t, database.InsertArtist(ctx, &artist))
+	tracks := []data.Track{
+		{SpotifyID: "t1", Name: "one", AlbumSpotifyID: "al1", AlbumName: "album", Artists: []data.Artist{artist}, Energy: 0.1},
+		{SpotifyID: "t2", Name: "two", AlbumSpotifyID: "al1", AlbumName: "album", Artists: []data.Artist{artist}, Energy: 0.5},
+		{SpotifyID: "t3", Name: "three", AlbumSpotifyID: "al1", AlbumName: "album", Artists: []data.Artist{artist}, Energy: 0.9},
+	}
+	for i := range tracks {
+		require.NoError(t, database.InsertTrack(ctx, &tracks[i]))
+	}
+	if analyzed {
+		require.NoError(t, database.AddTrackAnalyses(ctx, tracks))
+	}
+	require.NoError(t, database.IndexTracks(ctx, tracks))
+
+	mux := http.NewServeMux()
+	register(mux, database)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return database, srv
+}
+
+// get requests the given path, decodes the JSON response into v if it isn't
+// nil, and returns the response's status.
+func get(t *testing.T, srv *httptest.Server, path string, v any) int {
+	resp, err := http.Get(srv.URL + path)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	if v != nil && resp.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp.StatusCode
+}
+
+func trackIDs(tracks []data.Track) []string {
+	ids := make([]string, len(tracks))
+	for i, track := range tracks {
+		ids[i] = track.SpotifyID
+	}
+	return ids
+}
+
+func TestAPISearch(t *testing.T) {
+	_, srv := openAPI(t, true)
+
+	var tracks []data.Track
+	assert.Equal(t, http.StatusOK, get(t, srv, "/api/search?query=two", &tracks))
+	assert.Equal(t, []string{"t2"}, trackIDs(tracks))
+
+	assert.Equal(t, http.StatusBadRequest, get(t, srv, "/api/search", nil))
+	assert.Equal(t, http.StatusBadRequest, get(t, srv, "/api/search?query=two&count=0", nil))
+	assert.Equal(t, http.StatusOK, get(t, srv, "/api/search?query=two&count=100", nil))
+	assert.Equal(t, http.StatusBadRequest, get(t, srv, "/api/search?query=two&count=101", nil))
+	assert.Equal(t, http.StatusBadRequest, get(t, srv, "/api/search?query=%22two", nil))
+	assert.Equal(t, http.StatusBadRequest, get(t, srv, "/api/search?query=loudness:two", nil))
+}
+
+func TestAPIFind(t *testing.T) {
+	_, srv := openAPI(t, true)
+
+	var tracks []data.Track
+	assert.Equal(t, http.StatusOK, get(t, srv, "/api/find?energy=1&count=2", &tracks))
+	assert.Equal(t, []string{"t3", "t2"}, trackIDs(tracks))
+
+	assert.Equal(t, http.StatusBadRequest, get(t, srv, "/api/find", nil))
+	assert.Equal(t, http.StatusBadRequest, get(t, srv, "/api/find?energy=loud", nil))
+	assert.Equal(t, http.StatusBadRequest, get(t, srv, "/api/find?energy=1&count=100000000", nil))
+}
+
+func TestAPINeighbors(t *testing.T) {
+	_, srv := openAPI(t, true)
+
+	var tracks []data.Track
+	assert.Equal(t, http.StatusOK, get(t, srv, "/api/neighbors?query=one&count=1", &tracks))
+	assert.Equal(t, []string{"t1", "t2"}, trackIDs(tracks))
+
+	assert.Equal(t, http.StatusNotFound, get(t, srv, "/api/neighbors?query=nothing", nil))
+	assert.Equal(t, http.StatusBadRequest, get(t, srv, "/api/neighbors?query=one&count=100000000", nil))
+	assert.Equal(t, http.StatusBadRequest, get(t, srv, "/api/neighbors?query=%22one", nil))
+}
+
+func TestAPIPath(t *testing.T) {
+	_, srv := openAPI(t, true)
+
+	var path []db.PathStep
+	assert.Equal(t, http.StatusOK, get(t, srv, "/api/path?from=t1&to=t3&steps=2", &path))
+	require.Len(t, path, 3)
+	assert.Equal(t, []string{"t1", "t2", "t3"}, []string{path[0].SpotifyID, path[1].SpotifyID, path[2].SpotifyID})
+
+	assert.Equal(t, http.StatusBadRequest, get(t, srv, "/api/path?from=t1", nil))
+	assert.Equal(t, http.StatusBadRequest, get(t, srv, "/api/path?from=t1&to=t3&steps=101", nil))
+	assert.Equal(t, http.StatusNotFound, get(t, srv, "/api/path?from=missing&to=t3", nil))
+	assert.Equal(t, http.StatusNotFound, get(t, srv, "/api/path?from=t1&to=q:nothing", nil))
+}
+
+func TestAPIPathEmpty(t *testing.T) {
+	// The tracks exist, but there are no analyzed tracks to put between
+	// them.
+	_, srv := openAPI(t, false)
+	assert.Equal(t, http.StatusNotFound, get(t, srv, "/api/path?from=t1&to=t3", nil))
+}
+
+func TestAPIResolve(t *testing.T) {
+	_, srv := openAPI(t, true)
+
+	var track data.Track
+	assert.Equal(t, http.StatusOK, get(t, srv, "/api/resolve?query=q:three", &track))
+	assert.Equal(t, "t3", track.SpotifyID)
+	require.Len(t, track.Artists, 1)
+	assert.Equal(t, "a1", track.Artists[0].SpotifyID)
+
+	assert.Equal(t, http.StatusNotFound, get(t, srv, "/api/resolve?query=id:missing", nil))
+	assert.Equal(t, http.StatusBadRequest, get(t, srv, "/api/resolve?query=loudness:three", nil))
+	assert.Equal(t, http.StatusBadRequest, get(t, srv, "/api/resolve?query=q:%22three", nil))
+}
+
+func TestAPIGenre(t *testing.T) {
+	_, srv := openAPI(t, true)
+
+	var genre struct {
+		Genre   data.Genre
+		Artists []data.Artist
+		Tracks  []data.Track
+	}
+	assert.Equal(t, http.StatusOK, get(t, srv, "/api/genres/pop", &genre))
+	assert.Equal(t, "pop", genre.Genre.Name)
+	require.Len(t, genre.Artists, 1)
+	assert.Equal(t, []string{"pop"}, genre.Artists[0].Genres)
+	assert.ElementsMatch(t, []string{"t1", "t2", "t3"}, trackIDs(genre.Tracks))
+
+	assert.Equal(t, http.StatusNotFound, get(t, srv, "/api/genres/missing", nil))
+}
+
+func TestAPIInternalError(t *testing.T) {
+	database, srv := openAPI(t, true)
+	require.NoError(t, database.Close())
+
+	assert.Equal(t, http.StatusInternalServerError, get(t, srv, "/api/genres/pop", nil))
+	assert.Equal(t, http.StatusInternalServerError, get(t, srv, "/api/resolve?query=t1", nil))
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/amonks/genres/data"
+)
+
+// A genreMap lays genres out the way everynoise.com does: organicness on the
+// y axis, bounciness on the x axis, popularity as font size, and energy,
+// dynamic variation, and instrumentalness as the red, green, and blue color
+// channels. This inverts the normalization done in enao.Visualization.ToGenres.
+type genreMap struct {
+	Width, Height int
+	Genres        []mapGenre
+}
+
+type mapGenre struct {
+	Name     string
+	X, Y     int
+	FontSize int
+	Color    string
+}
+
+const (
+	genreMapWidth       = 1600
+	genreMapHeightPer   = 3 // px of height per genre, so the map isn't too crowded
+	genreMapMinHeight   = 800
+	genreMapMinFontSize = 9
+	genreMapMaxFontSize = 24
+	genreMapMargin      = 200 // keeps labels at the right edge on the canvas
+)
+
+// newGenreMap lays out the given genres, leaving out any without a position,
+// which weren't scraped from everynoise.com.
+func newGenreMap(genres []data.Genre) *genreMap {
+	var mapped []data.Genre
+	for _, genre := range genres {
+		if genre.Key != "" {
+			mapped = append(mapped, genre)
+		}
+	}
+
+	height := max(genreMapMinHeight, len(mapped)*genreMapHeightPer)
+	m := &genreMap{
+		Width:  genreMapWidth + genreMapMargin,
+		Height: height + genreMapMaxFontSize,
+		Genres: make([]mapGenre, len(mapped)),
+	}
+	for i, genre := range mapped {
+		m.Genres[i] = mapGenre{
+			Name:     genre.Name,
+			X:        int(genre.Bounciness * genreMapWidth),
+			Y:        int(genre.Organicness*float64(height)) + genreMapMaxFontSize,
+			FontSize: genreMapMinFontSize + int(genre.Popularity*(genreMapMaxFontSize-genreMapMinFontSize)),
+			Color: fmt.Sprintf("#%02x%02x%02x",
+				channel(genre.Energy),
+				channel(genre.DynamicVariation),
+				channel(genre.Instrumentalness)),
+		}
+	}
+	return m
+}
+
+func channel(v float64) int {
+	return int(min(max(v, 0), 1) * 255)
+}
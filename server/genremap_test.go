@@ -0,0 +1,51 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/amonks/genres/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenreMapLayout(t *testing.T) {
+	m := newGenreMap([]data.Genre{
+		{Name: "origin", Key: "k1"},
+		{Name: "unmapped"},
+		{Name: "corner", Key: "k2", Energy: 1, DynamicVariation: 0.5, Instrumentalness: 2, Organicness: 1, Bounciness: 1, Popularity: 1},
+	})
+
+	assert.Equal(t, genreMapWidth+genreMapMargin, m.Width)
+	assert.Equal(t, genreMapMinHeight+genreMapMaxFontSize, m.Height)
+	assert.Equal(t, []mapGenre{
+		{Name: "origin", X: 0, Y: genreMapMaxFontSize, FontSize: genreMapMinFontSize, Color: "#000000"},
+		{Name: "corner", X: genreMapWidth, Y: genreMapMinHeight + genreMapMaxFontSize, FontSize: genreMapMaxFontSize, Color: "#ff7fff"},
+	}, m.Genres)
+}
+
+func TestGenreMapHeight(t *testing.T) {
+	genres := make([]data.Genre, genreMapMinHeight)
+	for i := range genres {
+		genres[i] = data.Genre{Name: "g", Key: "k"}
+	}
+	m := newGenreMap(genres)
+	assert.Equal(t, genreMapMinHeight*genreMapHeightPer+genreMapMaxFontSize, m.Height)
+}
+
+func TestGenreMapPage(t *testing.T) {
+	database, srv := openServer(t, true, registerHTML)
+	// openServer's artist is tagged "pop"; these add one more mapped
+	// genre, and one which was discovered on an artist, and so has no
+	// position.
+	require.NoError(t, database.InsertGenre(&data.Genre{Name: "rock", Key: "k2", Organicness: 0.5}))
+	require.NoError(t, database.InsertGenre(&data.Genre{Name: "unmapped"}))
+
+	status, body := getPage(t, srv, "/map")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 2, strings.Count(body, "<text "))
+	assert.Contains(t, body, `href="/genres/pop"`)
+	assert.Contains(t, body, `href="/genres/rock"`)
+	assert.NotContains(t, body, "unmapped")
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/amonks/genres/data"
+	"github.com/amonks/genres/db"
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+var templateFuncs = template.FuncMap{
+	"pathEscape": url.PathEscape,
+	"percent":    func(v float64) string { return fmt.Sprintf("%.0f%%", v*100) },
+	"distance":   func(a, b data.Vector) string { return fmt.Sprintf("%.3f", a.Distance(b)) },
+}
+
+// pages holds one template per page, each sharing the layout in
+// templates/layout.html.
+var pages = map[string]*template.Template{}
+
+func init() {
+	for _, page := range []string{"index", "track", "artist", "album", "genre", "map"} {
+		pages[page] = template.Must(template.New("layout.html").
+			Funcs(templateFuncs).
+			ParseFS(templateFS, "templates/layout.html", "templates/"+page+".html"))
+	}
+}
+
+// registerHTML adds the server-rendered browsing pages to the given mux.
+func registerHTML(mux *http.ServeMux, db *db.DB) {
+	// GET /?q=...
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query().Get("q")
+		var tracks []data.Track
+		if query != "" {
+			var err error
+			tracks, err = db.Search(req.Context(), query, 50)
+			if err != nil {
+				renderError(w, lookupStatus(err), fmt.Errorf("error in search for '%s': %w", query, err))
+				return
+			}
+		}
+
+		render(w, "index", map[string]any{
+			"Query":  query,
+			"Tracks": tracks,
+		})
+	})
+
+	mux.HandleFunc("GET /tracks/{id}", func(w http.ResponseWriter, req *http.Request) {
+		track, err := db.GetTrack(req.Context(), req.PathValue("id"))
+		if err != nil {
+			renderError(w, lookupStatus(err), err)
+			return
+		}
+
+		var neighbors []data.Track
+		if track.FetchedAnalysisAt.Valid {
+			neighbors, err = db.NearestTracks(req.Context(), 11, track.Vector())
+			if err != nil {
+				renderError(w, http.StatusInternalServerError, fmt.Errorf("error finding neighbors of '%s': %w", track.SpotifyID, err))
+				return
+			}
+		}
+
+		render(w, "track", map[string]any{
+			"Track":     track,
+			"Neighbors": neighbors,
+		})
+	})
+
+	mux.HandleFunc("GET /artists/{id}", func(w http.ResponseWriter, req *http.Request) {
+		artist, err := db.GetArtist(req.Context(), req.PathValue("id"))
+		if err != nil {
+			renderError(w, lookupStatus(err), err)
+			return
+		}
+		albums, err := db.GetArtistAlbums(req.Context(), artist.SpotifyID)
+		if err != nil {
+			renderError(w, http.StatusInternalServerError, err)
+			return
+		}
+		tracks, err := db.GetArtistTracks(req.Context(), artist.SpotifyID, 20)
+		if err != nil {
+			renderError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		render(w, "artist", map[string]any{
+			"Artist": artist,
+			"Albums": albums,
+			"Tracks": tracks,
+		})
+	})
+
+	mux.HandleFunc("GET /albums/{id}", func(w http.ResponseWriter, req *http.Request) {
+		album, err := db.GetAlbum(req.Context(), req.PathValue("id"))
+		if err != nil {
+			renderError(w, lookupStatus(err), err)
+			return
+		}
+
+		render(w, "album", map[string]any{
+			"Album": album,
+		})
+	})
+
+	mux.HandleFunc("GET /genres/{name}", func(w http.ResponseWriter, req *http.Request) {
+		genre, err := db.GetGenre(req.Context(), req.PathValue("name"))
+		if err != nil {
+			renderError(w, lookupStatus(err), err)
+			return
+		}
+		artists, err := db.GetGenreArtists(req.Context(), genre.Name, 100)
+		if err != nil {
+			renderError(w, http.StatusInternalServerError, err)
+			return
+		}
+		tracks, err := db.GetGenreTracks(req.Context(), genre.Name, 20)
+		if err != nil {
+			renderError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		render(w, "genre", map[string]any{
+			"Genre":   genre,
+			"Artists": artists,
+			"Tracks":  tracks,
+		})
+	})
+
+	mux.HandleFunc("GET /map", func(w http.ResponseWriter, req *http.Request) {
+		genres, err := db.GetMappedGenres(req.Context())
+		if err != nil {
+			renderError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		render(w, "map", map[string]any{
+			"Map": newGenreMap(genres),
+		})
+	})
+}
+
+// render executes the named page template into a buffer before writing it, so
+// that a template error results in an error page rather than half a page.
+func render(w http.ResponseWriter, page string, data map[string]any) {
+	var buf bytes.Buffer
+	if err := pages[page].Execute(&buf, data); err != nil {
+		log.Printf("[server] error rendering '%s': %s", page, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+func renderError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintln(w, err.Error())
+}
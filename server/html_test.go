@@ -0,0 +1,73 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// getPage requests the given path and returns the response's status and
+// body.
+func getPage(t *testing.T, srv *httptest.Server, path string) (int, string) {
+	resp, err := http.Get(srv.URL + path)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	if resp.StatusCode == http.StatusOK {
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestHTMLSearch(t *testing.T) {
+	_, srv := openServer(t, true, registerHTML)
+
+	status, body := getPage(t, srv, "/?q=two")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `href="/tracks/t2"`)
+	assert.NotContains(t, body, `href="/tracks/t1"`)
+
+	status, _ = getPage(t, srv, "/")
+	assert.Equal(t, http.StatusOK, status)
+
+	status, _ = getPage(t, srv, "/?q=%22two")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestHTMLPages(t *testing.T) {
+	_, srv := openServer(t, true, registerHTML)
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		expect string
+	}{
+		{"/tracks/t1", http.StatusOK, "one"},
+		{"/tracks/missing", http.StatusNotFound, ""},
+		{"/artists/a1", http.StatusOK, "artist"},
+		{"/artists/missing", http.StatusNotFound, ""},
+		{"/albums/al1", http.StatusOK, "album"},
+		{"/albums/missing", http.StatusNotFound, ""},
+		{"/genres/pop", http.StatusOK, "pop"},
+		{"/genres/missing", http.StatusNotFound, ""},
+	} {
+		status, body := getPage(t, srv, tc.path)
+		assert.Equal(t, tc.status, status, tc.path)
+		assert.Contains(t, body, tc.expect, tc.path)
+	}
+}
+
+func TestHTMLInternalError(t *testing.T) {
+	database, srv := openServer(t, true, registerHTML)
+	require.NoError(t, database.Close())
+
+	for _, path := range []string{"/?q=two", "/tracks/t1", "/artists/a1", "/albums/al1", "/genres/pop"} {
+		status, _ := getPage(t, srv, path)
+		assert.Equal(t, http.StatusInternalServerError, status, path)
+	}
+}
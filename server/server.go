@@ -5,12 +5,24 @@ import (
 	"net/http"
 
 	"github.com/amonks/genres/db"
+	"github.com/amonks/genres/metrics"
 )
 
-func Run(ctx context.Context, db *db.DB, addr string) error {
+// An Option configures Run.
+type Option func(*http.ServeMux)
+
+// WithMetrics serves prometheus metrics at /metrics.
+func WithMetrics() Option {
+	return func(mux *http.ServeMux) { mux.Handle("GET /metrics", metrics.Default) }
+}
+
+func Run(ctx context.Context, db *db.DB, addr string, options ...Option) error {
 	mux := http.NewServeMux()
-	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, req *http.Request) {
-	})
+	registerHTML(mux, db)
+	registerAPI(mux, db)
+	for _, option := range options {
+		option(mux)
+	}
 
 	srv := http.Server{Addr: addr, Handler: mux}
 
@@ -3,7 +3,6 @@ package spotify
 import (
 	"context"
 	"database/sql"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,58 +11,245 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/amonks/genres/data"
 	"github.com/amonks/genres/limiter"
+	"github.com/amonks/genres/metrics"
 	"github.com/amonks/genres/readthrough"
 	"github.com/amonks/genres/request"
 )
 
 const (
-	nextReqFilename = "next-req"
-	cacheDir        = "/data/tank/genres/req-cache"
-	// cacheDir = "req-cache"
+	// DefaultLimiterFile is the prefix of the files where each
+	// credential's rate limiter state is persisted, unless the client is
+	// created WithLimiterFile. See LimiterFile.
+	DefaultLimiterFile = "next-req"
+	// DefaultCacheDir is where responses are cached, unless the client is
+	// created with WithCacheDir or WithCache.
+	DefaultCacheDir = "/data/tank/genres/req-cache"
+	// DefaultConcurrency is the number of requests which may be in flight
+	// at once, unless the client is created WithConcurrency.
+	DefaultConcurrency = 4
 )
 
-// New creates a new Spotify client, with the given clientID and clientSecret.
-func New(clientID, clientSecret string) (*Client, error) {
-	lim := limiter.New(nextReqFilename, time.Second)
-	if err := lim.Load(); err != nil {
-		return nil, err
-	}
+const (
+	defaultBaseURL     = "https://api.spotify.com"
+	defaultAccountsURL = "https://accounts.spotify.com"
+)
 
+// A Credential is a client ID and secret for the Spotify Web API.
+type Credential struct {
+	ClientID     string
+	ClientSecret string
+}
+
+// ErrNoCredentials is returned when every one of a client's credentials has
+// been disabled.
+var ErrNoCredentials = errors.New("no usable credentials")
+
+// LimiterFile returns the file where the rate limiter state for the given
+// client ID is persisted, given the limiter file prefix.
+func LimiterFile(prefix, clientID string) string {
+	return prefix + "-" + clientID
+}
+
+// TokenFile returns the file where the access token for the given client ID
+// is persisted, alongside its rate limiter state.
+func TokenFile(prefix, clientID string) string {
+	return LimiterFile(prefix, clientID) + ".token"
+}
+
+// New creates a new Spotify client, which spreads its requests over the
+// given credentials. Each credential has its own access token and rate
+// limiter.
+func New(credentials []Credential, options ...Option) (*Client, error) {
 	client := &Client{
-		lim:   lim,
-		cache: readthrough.New(cacheDir, "req-"),
+		baseURL:     defaultBaseURL,
+		accountsURL: defaultAccountsURL,
+		httpClient:  http.DefaultClient,
+
+		limiterFile:   DefaultLimiterFile,
+		limiterConfig: limiter.DefaultConfig,
+		cacheDir:      DefaultCacheDir,
+		concurrency:   DefaultConcurrency,
+	}
+	for _, option := range options {
+		option(client)
+	}
+	client.slots = make(chan struct{}, max(client.concurrency, 1))
+	client.ctx, client.cancel = context.WithCancel(context.Background())
 
-		clientID:     clientID,
-		clientSecret: clientSecret,
+	if len(credentials) == 0 && !client.cacheOnly {
+		return nil, fmt.Errorf("no credentials given")
+	}
+	if len(credentials) > 0 {
+		if err := migrateLimiterFile(client.limiterFile, credentials[0].ClientID); err != nil {
+			return nil, err
+		}
+	}
+	seen := map[string]bool{}
+	for _, cred := range credentials {
+		if seen[cred.ClientID] {
+			return nil, fmt.Errorf("duplicate client ID '%s'", cred.ClientID)
+		}
+		seen[cred.ClientID] = true
+		client.credentials = append(client.credentials, &credential{
+			Credential: cred,
+			lim:        limiter.New(LimiterFile(client.limiterFile, cred.ClientID), client.limiterConfig),
+			tokenFile:  TokenFile(client.limiterFile, cred.ClientID),
+		})
+	}
+	if client.cache == nil {
+		client.cache = readthrough.New(client.cacheDir, "req-")
 	}
 
 	return client, nil
 }
 
+// Close cancels the client's background token refreshes.
+func (spo *Client) Close() {
+	spo.cancel()
+}
+
+// migrateLimiterFile moves the limiter state which older versions kept in a
+// single file, named by the prefix itself, to the given client ID's file, so
+// that a Retry-After block and the requests counted against the quota carry
+// over. If the client ID already has a file, the old one is left alone.
+func migrateLimiterFile(prefix, clientID string) error {
+	// Link, unlike Rename, fails rather than replacing an existing file.
+	err := os.Link(prefix, LimiterFile(prefix, clientID))
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error migrating limiter file '%s': %w", prefix, err)
+	}
+	if err := os.Remove(prefix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error removing old limiter file '%s': %w", prefix, err)
+	}
+	return nil
+}
+
+// An Option configures a Client.
+type Option func(*Client)
+
+// WithBaseURL sets the URL of the Web API, in place of
+// https://api.spotify.com.
+func WithBaseURL(baseURL string) Option {
+	return func(spo *Client) { spo.baseURL = strings.TrimSuffix(baseURL, "/") }
+}
+
+// WithAccountsURL sets the URL of the accounts service, which issues access
+// tokens, in place of https://accounts.spotify.com.
+func WithAccountsURL(accountsURL string) Option {
+	return func(spo *Client) { spo.accountsURL = strings.TrimSuffix(accountsURL, "/") }
+}
+
+// WithHTTPClient sets the HTTP client used for every request, in place of
+// http.DefaultClient.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(spo *Client) { spo.httpClient = httpClient }
+}
+
+// WithLimiterFile sets the prefix of the files where each credential's rate
+// limiter state is persisted, in place of DefaultLimiterFile.
+func WithLimiterFile(prefix string) Option {
+	return func(spo *Client) { spo.limiterFile = prefix }
+}
+
+// WithLimiterConfig sets the limits on each credential's requests, in place
+// of limiter.DefaultConfig.
+func WithLimiterConfig(config limiter.Config) Option {
+	return func(spo *Client) { spo.limiterConfig = config }
+}
+
+// WithConcurrency sets the number of requests which may be in flight at
+// once, in place of DefaultConcurrency. Each request is still admitted by
+// its credential's rate limiter.
+func WithConcurrency(n int) Option {
+	return func(spo *Client) { spo.concurrency = n }
+}
+
+// WithCacheDir sets the directory where responses are cached, in place of
+// DefaultCacheDir.
+func WithCacheDir(dir string) Option {
+	return func(spo *Client) { spo.cacheDir = dir }
+}
+
+// WithCache sets the cache of responses, in place of a directory of files
+// within the cache dir.
+func WithCache(cache readthrough.Cache) Option {
+	return func(spo *Client) { spo.cache = cache }
+}
+
+// WithCacheOnly makes the client serve every request from its cache, and
+// never touch the network. Requests whose responses aren't cached fail with
+// ErrNotCached.
+func WithCacheOnly() Option {
+	return func(spo *Client) { spo.cacheOnly = true }
+}
+
 type Client struct {
+	// mu guards the credentials' tokens and disabled errors.
 	mu sync.Mutex
 
-	lim   *limiter.Limiter
-	cache *readthrough.ReadThrough
+	baseURL     string
+	accountsURL string
+	httpClient  *http.Client
+
+	limiterFile   string
+	limiterConfig limiter.Config
+	cacheDir      string
+
+	cache     readthrough.Cache
+	cacheOnly bool
+
+	// slots holds a value for each request in flight.
+	concurrency int
+	slots       chan struct{}
+
+	credentials []*credential
 
-	clientID     string
-	clientSecret string
+	// ctx lives as long as the client, bounding its background token
+	// refreshes, and cancel ends it when the client is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// A credential is a Credential with its own token and rate limiter.
+type credential struct {
+	Credential
+	lim       *limiter.Limiter
+	tokenFile string
 
 	accessToken string
 	expiresAt   time.Time
+	// refreshing is true while the token is refreshed in the background.
+	refreshing bool
+	// fetching is closed when the token which a request is fetching in
+	// the foreground has been fetched. It's nil if none is.
+	fetching chan struct{}
+	// tokenFailures counts the transient failures to fetch a token in a
+	// row, and tokenRetryAt is when to try again.
+	tokenFailures int
+	tokenRetryAt  time.Time
+	// rejected is the last token the Web API rejected, which mustn't be
+	// loaded from the token file again.
+	rejected string
+
+	// disabled holds the error which disabled the credential, if any.
+	disabled error
 }
 
 func (spo *Client) FetchAlbums(ctx context.Context, albumSpotifyIDs []string) ([]data.Album, error) {
 	query := url.Values{}
 	query.Add("ids", strings.Join(albumSpotifyIDs, ","))
 
-	resp, err := spo.get(ctx, "https://api.spotify.com/v1/albums", query)
+	resp, err := spo.get(ctx, "albums", spo.baseURL+"/v1/albums", query)
 	if err != nil {
 		return nil, err
 	}
@@ -139,7 +325,7 @@ func (spo *Client) FetchAlbums(ctx context.Context, albumSpotifyIDs []string) ([
 			query := url.Values{}
 			query.Add("limit", "50")
 			query.Add("offset", fmt.Sprintf("%d", offset))
-			resp, err := spo.get(ctx, fmt.Sprintf("https://api.spotify.com/v1/albums/%s/tracks", fetched.ID), query)
+			resp, err := spo.get(ctx, "album_tracks", fmt.Sprintf("%s/v1/albums/%s/tracks", spo.baseURL, fetched.ID), query)
 			if err != nil {
 				return nil, err
 			}
@@ -185,15 +371,15 @@ func (spo *Client) FetchAlbums(ctx context.Context, albumSpotifyIDs []string) ([
 
 type albumsTracks struct {
 	Albums []struct {
-		AlbumType   string
-		TotalTracks int64
+		AlbumType   string `json:"album_type"`
+		TotalTracks int64  `json:"total_tracks"`
 		ID          string
 		Images      []struct {
 			URL string
 		}
 		Name                 string
-		ReleaseDate          string
-		ReleaseDatePrecision string
+		ReleaseDate          string `json:"release_date"`
+		ReleaseDatePrecision string `json:"release_date_precision"`
 		Artists              []struct {
 			Name string
 			ID   string
@@ -211,8 +397,8 @@ type albumsTracks struct {
 				Name       string
 				Popularity int64
 
-				DiscNumber  int64
-				TrackNumber int64
+				DiscNumber  int64 `json:"disc_number"`
+				TrackNumber int64 `json:"track_number"`
 
 				Artists []struct {
 					ID   string
@@ -238,8 +424,8 @@ type albumTracksPage struct {
 		Name       string
 		Popularity int64
 
-		DiscNumber  int64
-		TrackNumber int64
+		DiscNumber  int64 `json:"disc_number"`
+		TrackNumber int64 `json:"track_number"`
 
 		Artists []struct {
 			ID   string
@@ -248,6 +434,33 @@ type albumTracksPage struct {
 	}
 }
 
+// FetchRelatedArtists fetches the artists which Spotify considers similar to
+// the given artist, most similar first. There are up to 20.
+func (spo *Client) FetchRelatedArtists(ctx context.Context, artistID string) ([]data.Artist, error) {
+	resp, err := spo.get(ctx, "related_artists", fmt.Sprintf("%s/v1/artists/%s/related-artists", spo.baseURL, artistID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Close()
+	var results struct {
+		Artists []artistObject
+	}
+	dec := json.NewDecoder(resp)
+	if err := dec.Decode(&results); err != nil {
+		return nil, fmt.Errorf("related artists decode error: %w", err)
+	}
+
+	artists := make([]data.Artist, len(results.Artists))
+	for i, obj := range results.Artists {
+		if obj.ID == "" {
+			return nil, fmt.Errorf("empty spotify id for related artist %d", i)
+		}
+		artists[i] = obj.artist()
+	}
+	return artists, nil
+}
+
 func (spo *Client) FetchArtistAlbums(ctx context.Context, artistSpotifyID string) ([]data.Album, error) {
 	var albums []data.Album
 	for offset := 0; offset < 1000; offset += 50 {
@@ -297,7 +510,7 @@ func (spo *Client) fetchArtistAlbumsPage(ctx context.Context, artistSpotifyID st
 	query.Add("offset", fmt.Sprintf("%d", offset))
 	query.Add("include_groups", "album,single")
 
-	resp, err := spo.get(ctx, fmt.Sprintf("https://api.spotify.com/v1/artists/%s/albums", artistSpotifyID), query)
+	resp, err := spo.get(ctx, "artist_albums", fmt.Sprintf("%s/v1/artists/%s/albums", spo.baseURL, artistSpotifyID), query)
 	if err != nil {
 		return nil, err
 	}
@@ -321,15 +534,15 @@ type artistAlbumsPage struct {
 	Previous string
 
 	Items []struct {
-		AlbumType   string
-		TotalTracks int64
+		AlbumType   string `json:"album_type"`
+		TotalTracks int64  `json:"total_tracks"`
 		ID          string
 		Images      []struct {
 			URL string
 		}
 		Name                 string
-		ReleaseDate          string
-		ReleaseDatePrecision string
+		ReleaseDate          string `json:"release_date"`
+		ReleaseDatePrecision string `json:"release_date_precision"`
 		Artists              []struct {
 			Name string
 			ID   string
@@ -340,7 +553,7 @@ type artistAlbumsPage struct {
 func (spo *Client) FetchTrackAnalyses(ctx context.Context, ids []string) ([]data.Track, error) {
 	query := url.Values{}
 	query.Set("ids", strings.Join(ids, ","))
-	resp, err := spo.get(ctx, "https://api.spotify.com/v1/audio-features", query)
+	resp, err := spo.get(ctx, "audio_features", spo.baseURL+"/v1/audio-features", query)
 	if err != nil {
 		return nil, err
 	}
@@ -394,7 +607,7 @@ type trackAnalysesResults struct {
 		Key           int64
 		Mode          int64
 		Tempo         float64
-		TimeSignature int64
+		TimeSignature int64 `json:"time_signature"`
 		DurationMS    int64 `json:"duration_ms"`
 
 		Acousticness     float64
@@ -409,7 +622,7 @@ type trackAnalysesResults struct {
 }
 
 func (spo *Client) FetchArtistTracks(ctx context.Context, artistID string) ([]data.Track, error) {
-	resp, err := spo.get(ctx, fmt.Sprintf("https://api.spotify.com/v1/artists/%s/top-tracks", artistID), nil)
+	resp, err := spo.get(ctx, "artist_top_tracks", fmt.Sprintf("%s/v1/artists/%s/top-tracks", spo.baseURL, artistID), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -455,8 +668,8 @@ type topTracksResults struct {
 			ID   string
 			Name string
 		}
-		DiscNumber  int64
-		TrackNumber int64
+		DiscNumber  int64 `json:"disc_number"`
+		TrackNumber int64 `json:"track_number"`
 
 		Artists []struct {
 			ID   string
@@ -486,14 +699,6 @@ func (spo *Client) FetchGenre(ctx context.Context, name string) ([]data.Artist,
 			return nil, err
 		}
 		for _, item := range resp.Artists.Items {
-			var imageURL string
-			var maxSize int64
-			for _, image := range item.Images {
-				if image.Width > maxSize {
-					imageURL = image.URL
-					maxSize = image.Width
-				}
-			}
 			hasOriginalGenre := false
 			for _, genre := range item.Genres {
 				if genre == name {
@@ -504,14 +709,7 @@ func (spo *Client) FetchGenre(ctx context.Context, name string) ([]data.Artist,
 			if !hasOriginalGenre {
 				item.Genres = append(item.Genres, name)
 			}
-			artists = append(artists, data.Artist{
-				SpotifyID:  item.ID,
-				Name:       item.Name,
-				ImageURL:   imageURL,
-				Followers:  item.Followers.Total,
-				Popularity: item.Popularity,
-				Genres:     item.Genres,
-			})
+			artists = append(artists, item.artist())
 		}
 
 		// intentionally not respecting the "next: null" pagination
@@ -533,7 +731,7 @@ func (spo *Client) fetchGenrePage(ctx context.Context, name string, offset int)
 	query.Add("limit", "50")
 	query.Add("offset", fmt.Sprintf("%d", offset))
 
-	resp, err := spo.get(ctx, "https://api.spotify.com/v1/search", query)
+	resp, err := spo.get(ctx, "search", spo.baseURL+"/v1/search", query)
 	if err != nil {
 		return nil, err
 	}
@@ -557,82 +755,369 @@ type genreSearchResultsPage struct {
 		Next     string
 		Previous string
 
-		Items []struct {
-			Followers struct {
-				Total int64
-			}
-			Genres []string
-			ID     string
-			Images []struct {
-				Height int64
-				Width  int64
-				URL    string
-			}
+		Items []artistObject
+	}
+}
+
+type artistObject struct {
+	Followers struct {
+		Total int64
+	}
+	Genres []string
+	ID     string
+	Images []struct {
+		Height int64
+		Width  int64
+		URL    string
+	}
+	Name       string
+	Popularity int64
+}
+
+func (obj artistObject) artist() data.Artist {
+	var imageURL string
+	var maxSize int64
+	for _, image := range obj.Images {
+		if image.Width > maxSize {
+			imageURL = image.URL
+			maxSize = image.Width
+		}
+	}
+	return data.Artist{
+		SpotifyID:  obj.ID,
+		Name:       obj.Name,
+		ImageURL:   imageURL,
+		Followers:  obj.Followers.Total,
+		Popularity: obj.Popularity,
+		Genres:     obj.Genres,
+	}
+}
+
+// FetchArtists fetches the artists with the given IDs, of which there may be
+// up to 50. Artists which Spotify doesn't know are left out.
+func (spo *Client) FetchArtists(ctx context.Context, ids []string) ([]data.Artist, error) {
+	query := url.Values{}
+	query.Set("ids", strings.Join(ids, ","))
+	resp, err := spo.get(ctx, "artists", spo.baseURL+"/v1/artists", query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Close()
+	var results struct {
+		Artists []*artistObject
+	}
+	dec := json.NewDecoder(resp)
+	if err := dec.Decode(&results); err != nil {
+		return nil, fmt.Errorf("artists decode error: %w", err)
+	}
+
+	var artists []data.Artist
+	for _, obj := range results.Artists {
+		if obj == nil || obj.ID == "" {
+			continue
+		}
+		artists = append(artists, obj.artist())
+	}
+	return artists, nil
+}
+
+// FetchPlaylist fetches the playlist with the given ID, and pages through all
+// of its tracks. Entries which aren't Spotify tracks, like podcast episodes
+// and local files, are left out, but the remaining tracks keep their
+// positions.
+func (spo *Client) FetchPlaylist(ctx context.Context, playlistID string) (*data.Playlist, error) {
+	resp, err := spo.get(ctx, "playlist", fmt.Sprintf("%s/v1/playlists/%s", spo.baseURL, playlistID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Close()
+	var results struct {
+		ID          string
+		Name        string
+		Description string
+		Owner       struct {
+			ID string
+		}
+		Followers struct {
+			Total int64
+		}
+		SnapshotID string `json:"snapshot_id"`
+		Tracks     playlistTracksPage
+	}
+	dec := json.NewDecoder(resp)
+	if err := dec.Decode(&results); err != nil {
+		return nil, fmt.Errorf("playlist decode error: %w", err)
+	}
+	if results.ID == "" {
+		return nil, fmt.Errorf("empty spotify id for playlist '%s'", playlistID)
+	}
+
+	playlist := &data.Playlist{
+		SpotifyID:      results.ID,
+		Name:           results.Name,
+		Description:    results.Description,
+		OwnerSpotifyID: results.Owner.ID,
+		Followers:      results.Followers.Total,
+		SnapshotID:     results.SnapshotID,
+	}
+	page := &results.Tracks
+	for offset := 0; ; {
+		playlist.Tracks = append(playlist.Tracks, page.tracks(playlist.SpotifyID, offset)...)
+		offset += len(page.Items)
+		if page.Next == "" || len(page.Items) == 0 || offset >= page.Total {
+			break
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		page, err = spo.fetchPlaylistTracksPage(ctx, playlistID, offset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return playlist, nil
+}
+
+func (spo *Client) fetchPlaylistTracksPage(ctx context.Context, playlistID string, offset int) (*playlistTracksPage, error) {
+	query := url.Values{}
+	query.Add("limit", "100")
+	query.Add("offset", fmt.Sprintf("%d", offset))
+
+	resp, err := spo.get(ctx, "playlist_tracks", fmt.Sprintf("%s/v1/playlists/%s/tracks", spo.baseURL, playlistID), query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Close()
+	var results playlistTracksPage
+	dec := json.NewDecoder(resp)
+	if err := dec.Decode(&results); err != nil {
+		return nil, fmt.Errorf("playlist tracks decode error: %w", err)
+	}
+
+	return &results, nil
+}
+
+type playlistTracksPage struct {
+	Limit  int
+	Offset int
+	Total  int
+
+	Next     string
+	Previous string
+
+	Items []struct {
+		AddedAt time.Time `json:"added_at"`
+		IsLocal bool      `json:"is_local"`
+		// Track is null for entries which have been removed from
+		// Spotify.
+		Track *struct {
+			// Type is "track", or "episode" for podcast episodes.
+			Type       string
+			ID         string
 			Name       string
 			Popularity int64
+
+			Album struct {
+				ID   string
+				Name string
+			}
+			DiscNumber  int64 `json:"disc_number"`
+			TrackNumber int64 `json:"track_number"`
+
+			Artists []struct {
+				ID   string
+				Name string
+			}
 		}
 	}
 }
 
+// tracks returns the page's tracks, given the position of its first entry.
+func (page *playlistTracksPage) tracks(playlistID string, offset int) []data.PlaylistTrack {
+	var tracks []data.PlaylistTrack
+	for i, item := range page.Items {
+		track := item.Track
+		if item.IsLocal || track == nil || track.Type != "track" || track.ID == "" {
+			continue
+		}
+		pt := data.PlaylistTrack{
+			PlaylistSpotifyID: playlistID,
+			Position:          offset + i,
+			TrackSpotifyID:    track.ID,
+			AddedAt:           sql.NullTime{Time: item.AddedAt, Valid: !item.AddedAt.IsZero()},
+			Track: data.Track{
+				SpotifyID:  track.ID,
+				Name:       track.Name,
+				Popularity: track.Popularity,
+
+				AlbumSpotifyID: track.Album.ID,
+				AlbumName:      track.Album.Name,
+				DiscNumber:     track.DiscNumber,
+				TrackNumber:    track.TrackNumber,
+			},
+		}
+		for _, artist := range track.Artists {
+			if artist.ID == "" {
+				continue
+			}
+			pt.Track.Artists = append(pt.Track.Artists, data.Artist{
+				SpotifyID: artist.ID,
+				Name:      artist.Name,
+			})
+		}
+		tracks = append(tracks, pt)
+	}
+	return tracks
+}
+
 var ErrSpotify = errors.New("<spotify error>")
 
-func (spo *Client) get(ctx context.Context, baseURL string, query url.Values) (io.ReadCloser, error) {
-	spo.mu.Lock()
-	defer spo.mu.Unlock()
+// A StatusError is returned for a response from Spotify with an error status,
+// other than those get retries itself. It wraps ErrSpotify.
+type StatusError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: status %d: %s", ErrSpotify, e.StatusCode, e.Err)
+}
 
+func (e *StatusError) Unwrap() []error { return []error{ErrSpotify, e.Err} }
+
+// ErrNotCached is returned by a client created WithCacheOnly, for a request
+// whose response isn't in the cache.
+var ErrNotCached = errors.New("response not cached")
+
+var (
+	requests = metrics.NewCounter("genres_spotify_requests_total",
+		"Requests made to the Spotify Web API, by endpoint and response status. Rate limited requests have status 429, and bad gateways 502.",
+		"endpoint", "status")
+	requestDuration = metrics.NewHistogram("genres_spotify_request_duration_seconds",
+		"Time until the Spotify Web API responded to requests, by endpoint.",
+		metrics.DefaultBuckets, "endpoint")
+	limiterWait = metrics.NewHistogram("genres_spotify_limiter_wait_seconds",
+		"Time requests waited for a credential's rate limiter.",
+		metrics.DefaultBuckets)
+	cacheLookups = metrics.NewCounter("genres_spotify_cache_lookups_total",
+		"Lookups of responses in the cache, by endpoint and result: hit, miss or error.",
+		"endpoint", "result")
+)
+
+// get fetches the given URL, from the cache if possible. endpoint names the
+// kind of request, for metrics.
+func (spo *Client) get(ctx context.Context, endpoint, baseURL string, query url.Values) (io.ReadCloser, error) {
 	url, _ := url.Parse(baseURL)
 	url.RawQuery = query.Encode()
 
 	if got, key, err := spo.cache.Get(url.String()); err != nil && !errors.Is(err, readthrough.ErrMiss) {
+		cacheLookups.Inc(endpoint, "error")
 		return nil, err
 	} else if err == nil {
-		log.Printf("[spotify] cache hit for '%s'", key)
+		cacheLookups.Inc(endpoint, "hit")
+		if !spo.cacheOnly {
+			log.Printf("[spotify] cache hit for '%s'", key)
+		}
 		return got, nil
 	}
+	cacheLookups.Inc(endpoint, "miss")
+	if spo.cacheOnly {
+		return nil, fmt.Errorf("'%s': %w", url.String(), ErrNotCached)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("canceled: %w", ctx.Err())
+	case spo.slots <- struct{}{}:
+	}
+	defer func() { <-spo.slots }()
+
+	// A 401 means the token was revoked or expired early, so it's
+	// refreshed and the request retried, but only once.
+	refreshed := false
+	tokenAttempts := 0
 
 retry:
-	if err := spo.lim.Wait(ctx); err != nil {
-		return nil, fmt.Errorf("rate limiter error: %w", err)
+	cred, err := spo.credential()
+	if err != nil {
+		return nil, err
 	}
 
-	req, err := http.NewRequest("GET", url.String(), nil)
+	token, err := spo.token(ctx, cred)
 	if err != nil {
-		return nil, fmt.Errorf("request error: %w", err)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, fmt.Errorf("canceled: %w", ctxErr)
+		}
+		// A disabled credential is skipped, so it doesn't count.
+		if !errors.Is(err, errInvalidClient) {
+			tokenAttempts++
+		}
+		if tokenAttempts >= maxTokenAttempts {
+			return nil, fmt.Errorf("error getting token after %d attempts: %w", tokenAttempts, err)
+		}
+		goto retry
+	}
+
+	waitStart := time.Now()
+	if err := cred.lim.Wait(ctx); err != nil {
+		return nil, fmt.Errorf("rate limiter error: %w", err)
 	}
+	limiterWait.ObserveSince(waitStart)
 
-	token, err := spo.token()
+	req, err := http.NewRequestWithContext(ctx, "GET", url.String(), nil)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("request error: %w", err)
 	}
 	req.Header.Set("Authorization", token)
 
-	resp, err := http.DefaultClient.Do(req)
+	reqStart := time.Now()
+	resp, err := spo.httpClient.Do(req)
 	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, fmt.Errorf("canceled: %w", ctxErr)
+		}
+		requests.Inc(endpoint, "error")
 		return nil, fmt.Errorf("request error: %w", err)
 	}
+	requests.Inc(endpoint, strconv.Itoa(resp.StatusCode))
+	requestDuration.ObserveSince(reqStart, endpoint)
 	switch resp.StatusCode {
+	case 401:
+		if !refreshed {
+			resp.Body.Close()
+			refreshed = true
+			spo.rejectToken(cred, token)
+			goto retry
+		}
+
 	case 429:
-		if err := spo.lim.SetNextAt(resp.Header.Get("Retry-After")); err != nil {
+		resp.Body.Close()
+		if err := cred.lim.SetNextAt(resp.Header.Get("Retry-After")); err != nil {
 			return nil, err
 		}
 		goto retry
 
 	case 502:
-		spo.lim.DelayBy(time.Minute)
+		resp.Body.Close()
+		if err := cred.lim.Backoff(); err != nil {
+			return nil, err
+		}
 		goto retry
 	}
 	if err := request.Error(resp); err != nil {
 		bs, dumpErr := httputil.DumpRequest(req, false)
 		if dumpErr != nil {
 			log.Printf("error dumping request: %s", dumpErr)
-			return nil, errors.Join(ErrSpotify, fmt.Errorf("error fetching:\n--req--\n%s\n--error--\n%w\n^^^^^^^^^", url.String(), err))
+			return nil, &StatusError{resp.StatusCode, fmt.Errorf("error fetching:\n--req--\n%s\n--error--\n%w\n^^^^^^^^^", url.String(), err)}
 		} else {
-			return nil, errors.Join(ErrSpotify, fmt.Errorf("error fetching:\n%s\n--resp--\n%w\n^^^^^^^^", string(bs), err))
+			return nil, &StatusError{resp.StatusCode, fmt.Errorf("error fetching:\n%s\n--resp--\n%w\n^^^^^^^^", string(bs), err)}
 		}
 	}
 
-	spo.lim.Delay()
-
 	r, hash, err := spo.cache.Set(url.String(), resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("error writing cache file '%s': %w", hash, err)
@@ -641,52 +1126,53 @@ retry:
 	return r, nil
 }
 
-type tokenResult struct {
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
-	ExpiresIn   int64  `json:"expires_in"`
-}
-
-func (spo *Client) token() (string, error) {
-	if spo.accessToken == "" || spo.expiresAt.Before(time.Now().Add(time.Second)) {
-		if err := spo.fetchToken(); err != nil {
-			return "", err
+// Requests returns how many requests the client's credentials have made in
+// the last 24 hours, including those made by other processes sharing their
+// limiter files.
+func (spo *Client) Requests() (int, error) {
+	total := 0
+	for _, cred := range spo.credentials {
+		usage, err := cred.lim.Usage()
+		if err != nil {
+			return 0, fmt.Errorf("rate limiter error: %w", err)
 		}
+		total += usage.Requests
 	}
-	return fmt.Sprintf("Bearer %s", spo.accessToken), nil
+	return total, nil
 }
 
-func (spo *Client) fetchToken() error {
-	form := url.Values{}
-	form.Set("grant_type", "client_credentials")
-	url := "https://accounts.spotify.com/api/token"
-	req, err := http.NewRequest("POST", url, strings.NewReader(form.Encode()))
-	if err != nil {
-		return fmt.Errorf("token request error: %w", err)
-	}
-	up := fmt.Sprintf("%s:%s", spo.clientID, spo.clientSecret)
-	credential := base64.StdEncoding.EncodeToString([]byte(up))
-	req.Header.Set("Authorization", fmt.Sprintf("Basic %s", credential))
-	req.Header.Set("Content-type", "application/x-www-form-urlencoded")
+// credential returns the usable credential which can make a request
+// soonest.
+func (spo *Client) credential() (*credential, error) {
+	spo.mu.Lock()
+	defer spo.mu.Unlock()
 
-	requestAt := time.Now()
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("token request error: %w", err)
-	}
-	defer resp.Body.Close()
-	if err := request.Error(resp); err != nil {
-		return fmt.Errorf("token fetch error: %w", err)
+	var (
+		best   *credential
+		bestAt time.Time
+		errs   []error
+	)
+	for _, cred := range spo.credentials {
+		if cred.disabled != nil {
+			errs = append(errs, fmt.Errorf("client ID '%s': %w", cred.ClientID, cred.disabled))
+			continue
+		}
+		usage, err := cred.lim.Usage()
+		if err != nil {
+			return nil, fmt.Errorf("rate limiter error: %w", err)
+		}
+		// A credential which failed to fetch a token isn't ready
+		// until it may try again.
+		readyAt := usage.ReadyAt
+		if cred.tokenRetryAt.After(readyAt) {
+			readyAt = cred.tokenRetryAt
+		}
+		if best == nil || readyAt.Before(bestAt) {
+			best, bestAt = cred, readyAt
+		}
 	}
-
-	var result tokenResult
-	dec := json.NewDecoder(resp.Body)
-	if err := dec.Decode(&result); err != nil {
-		return fmt.Errorf("token decode error: %w", err)
+	if best == nil {
+		return nil, errors.Join(append([]error{ErrNoCredentials}, errs...)...)
 	}
-
-	spo.accessToken = result.AccessToken
-	spo.expiresAt = requestAt.Add(time.Duration(result.ExpiresIn) * time.Second)
-
-	return nil
+	return best, nil
 }
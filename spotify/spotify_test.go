@@ -0,0 +1,447 @@
+package spotify_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amonks/genres/limiter"
+	"github.com/amonks/genres/readthrough"
+	"github.com/amonks/genres/spotify"
+	"github.com/amonks/genres/spotifytest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newClient(t *testing.T, srv *spotifytest.Server, options ...spotify.Option) *spotify.Client {
+	return newClientWithCredentials(t, srv, []spotify.Credential{{
+		ClientID:     spotifytest.ClientID,
+		ClientSecret: spotifytest.ClientSecret,
+	}}, options...)
+}
+
+func newClientWithCredentials(t *testing.T, srv *spotifytest.Server, credentials []spotify.Credential, options ...spotify.Option) *spotify.Client {
+	dir := t.TempDir()
+	options = append(append(srv.Options(),
+		spotify.WithLimiterFile(filepath.Join(dir, "next-req")),
+		spotify.WithLimiterConfig(limiter.Config{}),
+		spotify.WithCache(readthrough.NewMemory())),
+		options...)
+	spo, err := spotify.New(credentials, options...)
+	require.NoError(t, err)
+	t.Cleanup(spo.Close)
+	return spo
+}
+
+func TestFetchGenre(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	spo := newClient(t, srv)
+
+	genre := srv.Catalog.Genres[0]
+	artists, err := spo.FetchGenre(context.Background(), genre)
+	require.NoError(t, err)
+
+	expected := srv.Catalog.ArtistsInGenre(genre)
+	require.Len(t, artists, len(expected))
+	for i, artist := range artists {
+		assert.Equal(t, expected[i].ID, artist.SpotifyID)
+		assert.Equal(t, expected[i].Followers, artist.Followers)
+		assert.Contains(t, artist.Genres, genre)
+		assert.NotEmpty(t, artist.ImageURL)
+	}
+	assert.Equal(t, 1, srv.Tokens())
+}
+
+func TestFetchArtists(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	spo := newClient(t, srv)
+
+	expected := srv.Catalog.Artists[1]
+	artists, err := spo.FetchArtists(context.Background(), []string{expected.ID, "unknown"})
+	require.NoError(t, err)
+	require.Len(t, artists, 1)
+	assert.Equal(t, expected.ID, artists[0].SpotifyID)
+	assert.Equal(t, expected.Name, artists[0].Name)
+	assert.Equal(t, expected.Genres, artists[0].Genres)
+	assert.Equal(t, expected.Popularity, artists[0].Popularity)
+}
+
+func TestFetchRelatedArtists(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	spo := newClient(t, srv)
+
+	artist := srv.Catalog.Artists[4]
+	related, err := spo.FetchRelatedArtists(context.Background(), artist.ID)
+	require.NoError(t, err)
+	require.Len(t, related, len(artist.Related))
+	for i, id := range artist.Related {
+		assert.Equal(t, id, related[i].SpotifyID)
+		assert.Equal(t, srv.Catalog.Artist(id).Genres, related[i].Genres)
+	}
+}
+
+func TestFetchPlaylist(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	spo := newClient(t, srv)
+
+	expected := srv.Catalog.Playlists[0]
+	playlist, err := spo.FetchPlaylist(context.Background(), expected.ID)
+	require.NoError(t, err)
+	assert.Equal(t, expected.Name, playlist.Name)
+	assert.Equal(t, expected.Owner, playlist.OwnerSpotifyID)
+	assert.Equal(t, expected.Followers, playlist.Followers)
+	assert.Equal(t, expected.SnapshotID, playlist.SnapshotID)
+
+	// The local file is left out, but the tracks after it keep their
+	// positions.
+	require.Len(t, playlist.Tracks, len(expected.Tracks)-1)
+	for _, track := range playlist.Tracks {
+		require.NotEmpty(t, track.TrackSpotifyID)
+		assert.Equal(t, expected.Tracks[track.Position], track.TrackSpotifyID)
+		assert.Equal(t, expected.ID, track.PlaylistSpotifyID)
+		assert.True(t, track.AddedAt.Valid)
+		catalogTrack := srv.Catalog.Track(track.TrackSpotifyID)
+		assert.Equal(t, catalogTrack.Album, track.Track.AlbumSpotifyID)
+		assert.Len(t, track.Track.Artists, len(catalogTrack.Artists))
+	}
+	assert.Equal(t, 4, playlist.Tracks[3].Position)
+	assert.Equal(t, 1, srv.Requests("/v1/playlists/"+expected.ID+"/tracks"))
+
+	_, err = spo.FetchPlaylist(context.Background(), "nonexistent")
+	assert.ErrorIs(t, err, spotify.ErrSpotify)
+	var statusErr *spotify.StatusError
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, 404, statusErr.StatusCode)
+}
+
+func TestFetchAlbums(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	spo := newClient(t, srv)
+
+	// The first album has more tracks than fit on a page.
+	expected := srv.Catalog.Albums[:2]
+	albums, err := spo.FetchAlbums(context.Background(), []string{expected[0].ID, expected[1].ID})
+	require.NoError(t, err)
+	require.Len(t, albums, 2)
+
+	for i, album := range albums {
+		assert.Equal(t, expected[i].ID, album.SpotifyID)
+		assert.Equal(t, expected[i].Type, album.Type)
+		assert.Equal(t, expected[i].ReleaseDate, album.ReleaseDate)
+		assert.Equal(t, expected[i].ReleaseDatePrecision, album.ReleaseDatePrecision)
+		assert.Equal(t, int64(len(expected[i].Tracks)), album.TotalTracks)
+		require.Len(t, album.Tracks, len(expected[i].Tracks))
+		for j, track := range album.Tracks {
+			assert.Equal(t, expected[i].Tracks[j], track.SpotifyID)
+			assert.Equal(t, srv.Catalog.Track(track.SpotifyID).TrackNumber, track.TrackNumber)
+			assert.Equal(t, srv.Catalog.Track(track.SpotifyID).DiscNumber, track.DiscNumber)
+		}
+	}
+	assert.Equal(t, 2, srv.Requests("/v1/albums/"+expected[0].ID+"/tracks"))
+}
+
+func TestFetchTrackAnalyses(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	spo := newClient(t, srv)
+
+	expected := srv.Catalog.Tracks[0]
+	tracks, err := spo.FetchTrackAnalyses(context.Background(), []string{expected.ID})
+	require.NoError(t, err)
+	require.Len(t, tracks, 1)
+	assert.Equal(t, expected.ID, tracks[0].SpotifyID)
+	assert.Equal(t, expected.Energy, tracks[0].Energy)
+	assert.Equal(t, expected.TimeSignature, tracks[0].TimeSignature)
+	assert.Equal(t, expected.DurationMS, tracks[0].DurationMS)
+}
+
+func TestRetries(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	spo := newClient(t, srv)
+
+	artist := srv.Catalog.Artists[0]
+	srv.BadGatewayNext()
+	srv.RateLimitNext(0)
+
+	start := time.Now()
+	tracks, err := spo.FetchArtistTracks(context.Background(), artist.ID)
+	require.NoError(t, err)
+	assert.Len(t, tracks, len(artist.TopTracks))
+	assert.Equal(t, 3, srv.Requests("/v1/artists/"+artist.ID+"/top-tracks"))
+
+	// The limiter waits a second longer than Retry-After.
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+
+	// The response was cached, so asking again doesn't make a request.
+	_, err = spo.FetchArtistTracks(context.Background(), artist.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 3, srv.Requests("/v1/artists/"+artist.ID+"/top-tracks"))
+}
+
+func TestCredentialRotation(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	srv.AddCredential("second-client-id", "second-client-secret")
+
+	// Each credential may make one request an hour.
+	spo := newClientWithCredentials(t, srv, []spotify.Credential{
+		{ClientID: spotifytest.ClientID, ClientSecret: spotifytest.ClientSecret},
+		{ClientID: "second-client-id", ClientSecret: "second-client-secret"},
+	}, spotify.WithLimiterConfig(limiter.Config{Burst: 1, Interval: time.Hour}))
+
+	ctx := context.Background()
+	_, err := spo.FetchArtistTracks(ctx, srv.Catalog.Artists[0].ID)
+	require.NoError(t, err)
+	_, err = spo.FetchArtistTracks(ctx, srv.Catalog.Artists[1].ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, srv.RequestsBy(spotifytest.ClientID))
+	assert.Equal(t, 1, srv.RequestsBy("second-client-id"))
+	requests, err := spo.Requests()
+	require.NoError(t, err)
+	assert.Equal(t, 2, requests)
+
+	// Both credentials have used up their requests.
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = spo.FetchArtistTracks(ctx, srv.Catalog.Artists[2].ID)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestCredentialRateLimited(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	srv.AddCredential("second-client-id", "second-client-secret")
+	spo := newClientWithCredentials(t, srv, []spotify.Credential{
+		{ClientID: spotifytest.ClientID, ClientSecret: spotifytest.ClientSecret},
+		{ClientID: "second-client-id", ClientSecret: "second-client-secret"},
+	})
+
+	// The rate limited credential waits, and the other one makes the
+	// request instead.
+	srv.RateLimitNext(30)
+	start := time.Now()
+	_, err := spo.FetchArtistTracks(context.Background(), srv.Catalog.Artists[0].ID)
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, 1, srv.RequestsBy("second-client-id"))
+}
+
+func TestDisabledCredential(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+
+	spo := newClientWithCredentials(t, srv, []spotify.Credential{
+		{ClientID: "unknown-client-id", ClientSecret: "unknown-client-secret"},
+		{ClientID: spotifytest.ClientID, ClientSecret: spotifytest.ClientSecret},
+	})
+	_, err := spo.FetchArtistTracks(context.Background(), srv.Catalog.Artists[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, srv.RequestsBy(spotifytest.ClientID))
+	assert.Equal(t, 1, srv.Tokens())
+
+	spo = newClientWithCredentials(t, srv, []spotify.Credential{
+		{ClientID: spotifytest.ClientID, ClientSecret: "wrong-secret"},
+	})
+	_, err = spo.FetchArtistTracks(context.Background(), srv.Catalog.Artists[0].ID)
+	assert.ErrorIs(t, err, spotify.ErrNoCredentials)
+}
+
+func TestTokenUnavailable(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	spo := newClient(t, srv)
+
+	// The credential isn't disabled: the token is fetched again after a
+	// backoff, and the request succeeds.
+	srv.TokenUnavailableNext()
+	_, err := spo.FetchArtistTracks(context.Background(), srv.Catalog.Artists[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, srv.Tokens())
+	assert.Equal(t, 1, srv.RequestsBy(spotifytest.ClientID))
+}
+
+func TestTokenUnavailableTooLong(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	spo := newClient(t, srv)
+
+	// After a few attempts, the request fails rather than waiting for the
+	// accounts service forever.
+	for range 10 {
+		srv.TokenUnavailableNext()
+	}
+	_, err := spo.FetchArtistTracks(context.Background(), srv.Catalog.Artists[0].ID)
+	var statusErr *spotify.StatusError
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, 503, statusErr.StatusCode)
+	assert.Equal(t, 0, srv.Tokens())
+	assert.Equal(t, 0, srv.RequestsBy(spotifytest.ClientID))
+}
+
+func TestTokenRefreshCanceledOnClose(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	spo := newClient(t, srv)
+
+	srv.SetTokenLifetime(2 * time.Minute)
+	_, err := spo.FetchArtistTracks(context.Background(), srv.Catalog.Artists[0].ID)
+	require.NoError(t, err)
+
+	// Once the client is closed, using the token doesn't refresh it.
+	spo.Close()
+	_, err = spo.FetchArtistTracks(context.Background(), srv.Catalog.Artists[1].ID)
+	require.NoError(t, err)
+	assert.Never(t, func() bool { return srv.Tokens() > 1 }, 200*time.Millisecond, 10*time.Millisecond)
+}
+
+func TestConcurrency(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	srv.SetLatency(100 * time.Millisecond)
+	spo := newClient(t, srv, spotify.WithConcurrency(3))
+
+	var wg sync.WaitGroup
+	for _, artist := range srv.Catalog.Artists {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := spo.FetchArtistTracks(context.Background(), artist.ID)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 3, srv.MaxInFlight())
+	assert.Equal(t, 1, srv.Tokens())
+}
+
+func TestCacheHitDuringRetryAfter(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	spo := newClient(t, srv)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cached, waiting := srv.Catalog.Artists[0].ID, srv.Catalog.Artists[1].ID
+	_, err := spo.FetchArtistTracks(ctx, cached)
+	require.NoError(t, err)
+
+	// This request waits a minute for its Retry-After.
+	srv.RateLimitNext(60)
+	done := make(chan error, 1)
+	go func() {
+		_, err := spo.FetchArtistTracks(ctx, waiting)
+		done <- err
+	}()
+	for srv.Requests("/v1/artists/"+waiting+"/top-tracks") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Meanwhile, cache hits don't wait.
+	start := time.Now()
+	_, err = spo.FetchArtistTracks(ctx, cached)
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestTokenPersisted(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	limiterFile := filepath.Join(t.TempDir(), "next-req")
+
+	spo := newClient(t, srv, spotify.WithLimiterFile(limiterFile))
+	_, err := spo.FetchArtistTracks(context.Background(), srv.Catalog.Artists[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, srv.Tokens())
+
+	info, err := os.Stat(spotify.TokenFile(limiterFile, spotifytest.ClientID))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// A new client, as in a restarted process, reuses the token.
+	spo = newClient(t, srv, spotify.WithLimiterFile(limiterFile))
+	_, err = spo.FetchArtistTracks(context.Background(), srv.Catalog.Artists[1].ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, srv.Tokens())
+}
+
+func TestTokenRejected(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	limiterFile := filepath.Join(t.TempDir(), "next-req")
+	spo := newClient(t, srv, spotify.WithLimiterFile(limiterFile))
+
+	_, err := spo.FetchArtistTracks(context.Background(), srv.Catalog.Artists[0].ID)
+	require.NoError(t, err)
+
+	// After a 401, the client fetches a new token and retries.
+	srv.RevokeTokens()
+	_, err = spo.FetchArtistTracks(context.Background(), srv.Catalog.Artists[1].ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, srv.Tokens())
+	assert.Equal(t, 2, srv.Requests("/v1/artists/"+srv.Catalog.Artists[1].ID+"/top-tracks"))
+
+	// The rejected token isn't loaded by a restarted client.
+	spo = newClient(t, srv, spotify.WithLimiterFile(limiterFile))
+	_, err = spo.FetchArtistTracks(context.Background(), srv.Catalog.Artists[2].ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, srv.Tokens())
+}
+
+func TestTokenRefreshedInBackground(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	spo := newClient(t, srv)
+
+	// The first token is used, but expires soon enough that using it
+	// again refreshes it.
+	srv.SetTokenLifetime(2 * time.Minute)
+	_, err := spo.FetchArtistTracks(context.Background(), srv.Catalog.Artists[0].ID)
+	require.NoError(t, err)
+	srv.SetTokenLifetime(time.Hour)
+	_, err = spo.FetchArtistTracks(context.Background(), srv.Catalog.Artists[1].ID)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return srv.Tokens() == 2 }, 5*time.Second, 10*time.Millisecond)
+	_, err = spo.FetchArtistTracks(context.Background(), srv.Catalog.Artists[2].ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, srv.Tokens())
+}
+
+func TestLegacyLimiterFile(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	dir := t.TempDir()
+	prefix := filepath.Join(dir, "next-req")
+
+	// Older versions kept a single file, holding the time before which
+	// no requests may be made.
+	blockedUntil := time.Now().Add(time.Hour).Truncate(time.Second)
+	require.NoError(t, os.WriteFile(prefix, []byte(blockedUntil.Format(time.UnixDate)), 0644))
+
+	_, err := spotify.New([]spotify.Credential{
+		{ClientID: "first", ClientSecret: "secret"},
+		{ClientID: "second", ClientSecret: "secret"},
+	}, append(srv.Options(), spotify.WithLimiterFile(prefix))...)
+	require.NoError(t, err)
+
+	_, err = os.Stat(prefix)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	usage, err := limiter.New(spotify.LimiterFile(prefix, "first"), limiter.Config{}).Usage()
+	require.NoError(t, err)
+	assert.True(t, usage.ReadyAt.Equal(blockedUntil), "ready at %s, not %s", usage.ReadyAt, blockedUntil)
+	_, err = os.Stat(spotify.LimiterFile(prefix, "second"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
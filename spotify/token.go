@@ -0,0 +1,285 @@
+package spotify
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/amonks/genres/request"
+)
+
+const (
+	// tokenRefreshWindow is how long before its expiry a token is
+	// refreshed in the background.
+	tokenRefreshWindow = 5 * time.Minute
+
+	// tokenBackoff is how long to wait before fetching a token again
+	// after a transient failure. The wait doubles with each failure in a
+	// row, up to maxTokenBackoff.
+	tokenBackoff    = time.Second
+	maxTokenBackoff = time.Minute
+
+	// maxTokenAttempts is how many times a request tries to get a token
+	// before it fails with the last error.
+	maxTokenAttempts = 3
+)
+
+// errInvalidClient is returned when the accounts service rejects a
+// credential's client ID or secret, which disables the credential.
+var errInvalidClient = errors.New("invalid client")
+
+type tokenResult struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// savedToken is what's persisted to a credential's token file.
+type savedToken struct {
+	AccessToken string    `json:"access_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// token returns the authorization header for the given credential. It uses
+// the credential's token file if it has no token of its own, and fetches a
+// new token if that's missing or expired. A token which expires soon is
+// refreshed in the background.
+//
+// Tokens are fetched without holding the client's lock, so that a slow
+// accounts service only holds up the requests which need the token. If the
+// accounts service rejects the credential, it's disabled; other failures are
+// retried after a backoff.
+func (spo *Client) token(ctx context.Context, cred *credential) (string, error) {
+	spo.mu.Lock()
+	defer spo.mu.Unlock()
+
+	for {
+		if cred.disabled != nil {
+			return "", cred.disabled
+		}
+		if cred.accessToken == "" {
+			if err := spo.loadToken(cred); err != nil {
+				log.Printf("[spotify] error loading token for client ID '%s': %s", cred.ClientID, err)
+			}
+		}
+
+		now := time.Now()
+		if cred.accessToken != "" && !cred.expiresAt.Before(now.Add(time.Second)) {
+			if cred.expiresAt.Before(now.Add(tokenRefreshWindow)) && !cred.refreshing {
+				cred.refreshing = true
+				go spo.refreshToken(cred)
+			}
+			return fmt.Sprintf("Bearer %s", cred.accessToken), nil
+		}
+
+		if cred.fetching == nil {
+			break
+		}
+		// Another request is fetching a token, so wait for it.
+		fetching := cred.fetching
+		spo.mu.Unlock()
+		select {
+		case <-fetching:
+			spo.mu.Lock()
+		case <-ctx.Done():
+			spo.mu.Lock()
+			return "", fmt.Errorf("canceled: %w", ctx.Err())
+		}
+	}
+
+	fetching := make(chan struct{})
+	cred.fetching = fetching
+	retryAt := cred.tokenRetryAt
+	spo.mu.Unlock()
+	accessToken, expiresAt, err := spo.fetchTokenAt(ctx, cred, retryAt)
+	spo.mu.Lock()
+	cred.fetching = nil
+	close(fetching)
+
+	switch {
+	case err == nil:
+		cred.tokenFailures = 0
+		cred.tokenRetryAt = time.Time{}
+		spo.setToken(cred, accessToken, expiresAt)
+		return fmt.Sprintf("Bearer %s", cred.accessToken), nil
+	case errors.Is(err, errInvalidClient):
+		log.Printf("[spotify] disabling client ID '%s': %s", cred.ClientID, err)
+		cred.disabled = err
+		return "", err
+	case ctx.Err() != nil:
+		return "", err
+	default:
+		cred.tokenFailures++
+		wait := min(tokenBackoff<<(cred.tokenFailures-1), maxTokenBackoff)
+		cred.tokenRetryAt = time.Now().Add(wait)
+		log.Printf("[spotify] error fetching token for client ID '%s' (retry %d in %s): %s", cred.ClientID, cred.tokenFailures, wait, err)
+		return "", err
+	}
+}
+
+// fetchTokenAt waits until the given time, and then fetches a new token for
+// the given credential.
+func (spo *Client) fetchTokenAt(ctx context.Context, cred *credential, at time.Time) (string, time.Time, error) {
+	if wait := time.Until(at); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return "", time.Time{}, fmt.Errorf("canceled: %w", ctx.Err())
+		}
+	}
+	return spo.fetchToken(ctx, cred)
+}
+
+// refreshToken fetches a new token for the given credential, until the client
+// is closed. A failure is only logged, since the current token is still good
+// for a while.
+func (spo *Client) refreshToken(cred *credential) {
+	accessToken, expiresAt, err := spo.fetchToken(spo.ctx, cred)
+
+	spo.mu.Lock()
+	defer spo.mu.Unlock()
+	cred.refreshing = false
+	if spo.ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		log.Printf("[spotify] error refreshing token for client ID '%s': %s", cred.ClientID, err)
+		return
+	}
+	spo.setToken(cred, accessToken, expiresAt)
+}
+
+// rejectToken forgets the given authorization header's token, if it's still
+// the credential's, so that the next request fetches another.
+func (spo *Client) rejectToken(cred *credential, header string) {
+	spo.mu.Lock()
+	defer spo.mu.Unlock()
+
+	if header != fmt.Sprintf("Bearer %s", cred.accessToken) {
+		return
+	}
+	log.Printf("[spotify] token for client ID '%s' was rejected", cred.ClientID)
+	cred.rejected = cred.accessToken
+	cred.accessToken = ""
+	cred.expiresAt = time.Time{}
+}
+
+// setToken sets the credential's token and saves it to its token file.
+func (spo *Client) setToken(cred *credential, accessToken string, expiresAt time.Time) {
+	cred.accessToken = accessToken
+	cred.expiresAt = expiresAt
+	if err := saveToken(cred.tokenFile, savedToken{accessToken, expiresAt}); err != nil {
+		log.Printf("[spotify] error saving token for client ID '%s': %s", cred.ClientID, err)
+	}
+}
+
+// loadToken sets the credential's token from its token file, unless the
+// saved token has expired or was rejected.
+func (spo *Client) loadToken(cred *credential) error {
+	bs, err := os.ReadFile(cred.tokenFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error reading token file: %w", err)
+	}
+
+	var saved savedToken
+	if err := json.Unmarshal(bs, &saved); err != nil {
+		return fmt.Errorf("error parsing token file '%s': %w", cred.tokenFile, err)
+	}
+	if saved.AccessToken == cred.rejected || saved.ExpiresAt.Before(time.Now().Add(time.Second)) {
+		return nil
+	}
+	cred.accessToken = saved.AccessToken
+	cred.expiresAt = saved.ExpiresAt
+	return nil
+}
+
+// saveToken writes the token to a temporary file, readable only by its
+// owner, and renames it over the token file.
+func saveToken(filename string, token savedToken) error {
+	bs, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("error encoding token: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating token file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return fmt.Errorf("error setting mode of token file: %w", err)
+	}
+	if _, err := f.Write(bs); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing token file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing token file: %w", err)
+	}
+	if err := os.Rename(f.Name(), filename); err != nil {
+		return fmt.Errorf("error renaming token file: %w", err)
+	}
+	return nil
+}
+
+// fetchToken fetches a new token for the given credential from the accounts
+// service. It returns an error wrapping errInvalidClient if the accounts
+// service rejects the credential.
+func (spo *Client) fetchToken(ctx context.Context, cred *credential) (string, time.Time, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	url := spo.accountsURL + "/api/token"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("token request error: %w", err)
+	}
+	up := fmt.Sprintf("%s:%s", cred.ClientID, cred.ClientSecret)
+	credential := base64.StdEncoding.EncodeToString([]byte(up))
+	req.Header.Set("Authorization", fmt.Sprintf("Basic %s", credential))
+	req.Header.Set("Content-type", "application/x-www-form-urlencoded")
+
+	requestAt := time.Now()
+	resp, err := spo.httpClient.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("token request error: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+		var result struct {
+			Error            string
+			ErrorDescription string `json:"error_description"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err == nil && result.Error == "invalid_client" {
+			return "", time.Time{}, fmt.Errorf("token fetch error: %w: %s", errInvalidClient, result.ErrorDescription)
+		}
+		return "", time.Time{}, fmt.Errorf("token fetch error: http status code %d: %s", resp.StatusCode, result.Error)
+	}
+	if err := request.Error(resp); err != nil {
+		// Server errors are a StatusError, like the Web API's, so that
+		// they're known to be transient.
+		if resp.StatusCode >= 500 {
+			return "", time.Time{}, &StatusError{resp.StatusCode, fmt.Errorf("token fetch error: %w", err)}
+		}
+		return "", time.Time{}, fmt.Errorf("token fetch error: %w", err)
+	}
+
+	var result tokenResult
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&result); err != nil {
+		return "", time.Time{}, fmt.Errorf("token decode error: %w", err)
+	}
+
+	return result.AccessToken, requestAt.Add(time.Duration(result.ExpiresIn) * time.Second), nil
+}
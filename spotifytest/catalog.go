@@ -0,0 +1,289 @@
+package spotifytest
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"sort"
+)
+
+// A Catalog is the music a Server knows about.
+type Catalog struct {
+	Genres    []string
+	Artists   []*Artist
+	Albums    []*Album
+	Tracks    []*Track
+	Playlists []*Playlist
+
+	artists   map[string]*Artist
+	albums    map[string]*Album
+	tracks    map[string]*Track
+	playlists map[string]*Playlist
+}
+
+type Artist struct {
+	ID         string
+	Name       string
+	Genres     []string
+	Followers  int64
+	Popularity int64
+
+	// Albums holds the IDs of the artist's albums, newest first.
+	Albums []string
+	// TopTracks holds the IDs of up to 10 of the artist's tracks.
+	TopTracks []string
+	// Related holds the IDs of the artists similar to the artist, most
+	// similar first.
+	Related []string
+}
+
+type Album struct {
+	ID                   string
+	Name                 string
+	Type                 string
+	ReleaseDate          string
+	ReleaseDatePrecision string
+	Popularity           int64
+	Genres               []string
+
+	Artists []string
+	Tracks  []string
+}
+
+type Playlist struct {
+	ID          string
+	Name        string
+	Description string
+	Owner       string
+	Followers   int64
+	SnapshotID  string
+
+	// Tracks holds the IDs of the playlist's tracks, in order. An empty
+	// ID is a local file, which Spotify lists without a track ID.
+	Tracks []string
+}
+
+type Track struct {
+	ID          string
+	Name        string
+	Popularity  int64
+	Album       string
+	DiscNumber  int64
+	TrackNumber int64
+	Artists     []string
+
+	// Analyzed is false for tracks whose audio features are null, as
+	// Spotify's are for some tracks.
+	Analyzed bool
+
+	Key           int64
+	Mode          int64
+	Tempo         float64
+	TimeSignature int64
+	DurationMS    int64
+
+	Acousticness     float64
+	Danceability     float64
+	Energy           float64
+	Instrumentalness float64
+	Liveness         float64
+	Loudness         float64
+	Speechiness      float64
+	Valence          float64
+}
+
+// NewCatalog returns a small catalog, the same every time:
+//
+//   - 2 genres
+//   - 5 artists, each in one genre, except the first, who is in both
+//   - 8 albums per artist, for 40 in total
+//   - 5 tracks per album, except the first album, which has 105 tracks,
+//     so that its tracks span three pages, for 300 tracks in total
+//
+// Every fifth track features the next artist, and every track has audio
+// features. Each artist is related to the next two.
+//
+// There's also a playlist of every other track, up to 120 of them, so that
+// they span two pages. Its fourth entry is a local file.
+//
+// The counts are multiples of the fetchers' batch sizes, so that a complete
+// crawl leaves nothing unfetched.
+func NewCatalog() *Catalog {
+	rng := rand.New(rand.NewSource(1))
+	c := &Catalog{
+		Genres: []string{"chamber pop", "dream pop"},
+	}
+
+	const artistCount = 5
+	for i := 0; i < artistCount; i++ {
+		artist := &Artist{
+			ID:         spotifyID("artist", i),
+			Name:       fmt.Sprintf("Artist %d", i),
+			Genres:     []string{c.Genres[i%len(c.Genres)]},
+			Followers:  int64(1000 * (artistCount - i)),
+			Popularity: int64(80 - 10*i),
+		}
+		if i == 0 {
+			artist.Genres = c.Genres
+		}
+		c.Artists = append(c.Artists, artist)
+	}
+
+	for i, artist := range c.Artists {
+		for j := 1; j <= 2; j++ {
+			artist.Related = append(artist.Related, c.Artists[(i+j)%len(c.Artists)].ID)
+		}
+	}
+
+	for i, artist := range c.Artists {
+		featured := c.Artists[(i+1)%len(c.Artists)]
+		for j := 0; j < 8; j++ {
+			album := &Album{
+				ID:         spotifyID("album", len(c.Albums)),
+				Name:       fmt.Sprintf("%s, Album %d", artist.Name, j),
+				Type:       "album",
+				Popularity: int64(rng.Intn(100)),
+				Artists:    []string{artist.ID},
+			}
+			year := 2020 - j
+			switch j % 3 {
+			case 0:
+				album.ReleaseDate, album.ReleaseDatePrecision = fmt.Sprintf("%d-%02d-%02d", year, j+1, j+10), "day"
+			case 1:
+				album.ReleaseDate, album.ReleaseDatePrecision = fmt.Sprintf("%d-%02d", year, j+1), "month"
+			case 2:
+				album.ReleaseDate, album.ReleaseDatePrecision = fmt.Sprintf("%d", year), "year"
+			}
+			if j%2 == 1 {
+				album.Type = "single"
+			}
+
+			trackCount := 5
+			if len(c.Albums) == 0 {
+				trackCount = 105
+			}
+			for k := 0; k < trackCount; k++ {
+				track := &Track{
+					ID:          spotifyID("track", len(c.Tracks)),
+					Name:        fmt.Sprintf("%s, Track %d", album.Name, k+1),
+					Popularity:  int64(rng.Intn(100)),
+					Album:       album.ID,
+					DiscNumber:  int64(k/50 + 1),
+					TrackNumber: int64(k%50 + 1),
+					Artists:     []string{artist.ID},
+					Analyzed:    true,
+
+					Key:           int64(rng.Intn(12)),
+					Mode:          int64(rng.Intn(2)),
+					Tempo:         60 + rng.Float64()*120,
+					TimeSignature: 4,
+					DurationMS:    int64(120_000 + rng.Intn(240_000)),
+
+					Acousticness:     rng.Float64(),
+					Danceability:     rng.Float64(),
+					Energy:           rng.Float64(),
+					Instrumentalness: rng.Float64(),
+					Liveness:         rng.Float64(),
+					Loudness:         -60 + rng.Float64()*60,
+					Speechiness:      rng.Float64(),
+					Valence:          rng.Float64(),
+				}
+				if len(c.Tracks)%5 == 4 {
+					track.Artists = append(track.Artists, featured.ID)
+				}
+				album.Tracks = append(album.Tracks, track.ID)
+				c.Tracks = append(c.Tracks, track)
+			}
+
+			artist.Albums = append(artist.Albums, album.ID)
+			c.Albums = append(c.Albums, album)
+		}
+	}
+
+	playlist := &Playlist{
+		ID:          spotifyID("playlist", 0),
+		Name:        "Playlist 0",
+		Description: "Every other track",
+		Owner:       "spotifytest",
+		Followers:   100,
+		SnapshotID:  spotifyID("snapshot", 0),
+	}
+	for i := 0; i < 120; i++ {
+		playlist.Tracks = append(playlist.Tracks, c.Tracks[2*i].ID)
+	}
+	playlist.Tracks[3] = ""
+	c.Playlists = append(c.Playlists, playlist)
+
+	c.index()
+
+	for _, artist := range c.Artists {
+		var tracks []*Track
+		for _, album := range artist.Albums {
+			for _, track := range c.albums[album].Tracks {
+				tracks = append(tracks, c.tracks[track])
+			}
+		}
+		sort.SliceStable(tracks, func(i, j int) bool { return tracks[i].Popularity > tracks[j].Popularity })
+		for i := 0; i < len(tracks) && i < 10; i++ {
+			artist.TopTracks = append(artist.TopTracks, tracks[i].ID)
+		}
+	}
+
+	return c
+}
+
+// Artist returns the artist with the given ID, or nil.
+func (c *Catalog) Artist(id string) *Artist { return c.artists[id] }
+
+// Album returns the album with the given ID, or nil.
+func (c *Catalog) Album(id string) *Album { return c.albums[id] }
+
+// Track returns the track with the given ID, or nil.
+func (c *Catalog) Track(id string) *Track { return c.tracks[id] }
+
+// Playlist returns the playlist with the given ID, or nil.
+func (c *Catalog) Playlist(id string) *Playlist { return c.playlists[id] }
+
+// ArtistsInGenre returns the artists in the given genre, most popular first,
+// as Spotify's genre search does.
+func (c *Catalog) ArtistsInGenre(genre string) []*Artist {
+	var artists []*Artist
+	for _, artist := range c.Artists {
+		for _, g := range artist.Genres {
+			if g == genre {
+				artists = append(artists, artist)
+				break
+			}
+		}
+	}
+	sort.SliceStable(artists, func(i, j int) bool { return artists[i].Popularity > artists[j].Popularity })
+	return artists
+}
+
+func (c *Catalog) index() {
+	c.artists = make(map[string]*Artist, len(c.Artists))
+	for _, artist := range c.Artists {
+		c.artists[artist.ID] = artist
+	}
+	c.albums = make(map[string]*Album, len(c.Albums))
+	for _, album := range c.Albums {
+		c.albums[album.ID] = album
+	}
+	c.tracks = make(map[string]*Track, len(c.Tracks))
+	for _, track := range c.Tracks {
+		c.tracks[track.ID] = track
+	}
+	c.playlists = make(map[string]*Playlist, len(c.Playlists))
+	for _, playlist := range c.Playlists {
+		c.playlists[playlist.ID] = playlist
+	}
+}
+
+// spotifyID returns a 22-character base-62 ID, like Spotify's, which is
+// always the same for the given kind and number.
+func spotifyID(kind string, n int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d", kind, n)))
+	id := new(big.Int).SetBytes(sum[:]).Text(62)
+	return id[:22]
+}
@@ -0,0 +1,711 @@
+// Package spotifytest provides a fake Spotify Web API, serving a Catalog, for
+// testing spotify.Client and the fetch workers without network access or
+// credentials.
+//
+// Responses are shaped like Spotify's, including the fields which
+// spotify.Client ignores, so that tests catch decoding mistakes.
+package spotifytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amonks/genres/spotify"
+)
+
+// A Server accepts these credentials, and any added with AddCredential.
+const (
+	ClientID     = "spotifytest-client-id"
+	ClientSecret = "spotifytest-client-secret"
+)
+
+// A Server is a fake Spotify Web API and accounts service.
+type Server struct {
+	*httptest.Server
+	Catalog *Catalog
+
+	mu          sync.Mutex
+	faults      []fault
+	requests    map[string]int
+	credentials map[string]string
+	// tokenClients holds the client ID each token was issued to, so that
+	// token-n was issued to tokenClients[n-1].
+	tokenClients   []string
+	clientRequests map[string]int
+	// Tokens up to token-revoked are no longer accepted.
+	revoked       int
+	tokenLifetime time.Duration
+	// tokenFaults is how many of the next token requests fail with a 503.
+	tokenFaults int
+
+	latency     time.Duration
+	inFlight    int
+	maxInFlight int
+}
+
+type fault struct {
+	status     int
+	retryAfter string
+}
+
+// NewServer starts a Server serving the given catalog. It should be closed
+// when the test is done.
+func NewServer(catalog *Catalog) *Server {
+	s := &Server{
+		Catalog:        catalog,
+		requests:       map[string]int{},
+		credentials:    map[string]string{ClientID: ClientSecret},
+		clientRequests: map[string]int{},
+		tokenLifetime:  time.Hour,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/token", s.handleToken)
+	mux.HandleFunc("GET /v1/search", s.api(s.handleSearch))
+	mux.HandleFunc("GET /v1/artists", s.api(s.handleArtists))
+	mux.HandleFunc("GET /v1/artists/{id}/albums", s.api(s.handleArtistAlbums))
+	mux.HandleFunc("GET /v1/artists/{id}/top-tracks", s.api(s.handleTopTracks))
+	mux.HandleFunc("GET /v1/artists/{id}/related-artists", s.api(s.handleRelatedArtists))
+	mux.HandleFunc("GET /v1/albums", s.api(s.handleAlbums))
+	mux.HandleFunc("GET /v1/albums/{id}/tracks", s.api(s.handleAlbumTracks))
+	mux.HandleFunc("GET /v1/audio-features", s.api(s.handleAudioFeatures))
+	mux.HandleFunc("GET /v1/playlists/{id}", s.api(s.handlePlaylist))
+	mux.HandleFunc("GET /v1/playlists/{id}/tracks", s.api(s.handlePlaylistTracks))
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Options returns the options for a spotify.Client which talks to this server.
+func (s *Server) Options() []spotify.Option {
+	return []spotify.Option{
+		spotify.WithBaseURL(s.URL),
+		spotify.WithAccountsURL(s.URL),
+		spotify.WithHTTPClient(s.Client()),
+	}
+}
+
+// AddCredential makes the server accept another client ID and secret.
+func (s *Server) AddCredential(clientID, clientSecret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credentials[clientID] = clientSecret
+}
+
+// RevokeTokens makes the server reject every token issued so far, with a
+// 401.
+func (s *Server) RevokeTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked = len(s.tokenClients)
+}
+
+// SetTokenLifetime sets how long the tokens the server issues are valid for,
+// in place of an hour.
+func (s *Server) SetTokenLifetime(lifetime time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokenLifetime = lifetime
+}
+
+// SetLatency makes every Web API request take at least the given time.
+func (s *Server) SetLatency(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = latency
+}
+
+// MaxInFlight returns the largest number of Web API requests which have been
+// in flight at once.
+func (s *Server) MaxInFlight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxInFlight
+}
+
+// RateLimitNext makes the next Web API request fail with a 429, asking the
+// client to retry after the given number of seconds.
+func (s *Server) RateLimitNext(retryAfterSeconds int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, fault{http.StatusTooManyRequests, strconv.Itoa(retryAfterSeconds)})
+}
+
+// BadGatewayNext makes the next Web API request fail with a 502, as Spotify's
+// do from time to time.
+func (s *Server) BadGatewayNext() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, fault{status: http.StatusBadGateway})
+}
+
+// TokenUnavailableNext makes the next token request fail with a 503, as if
+// the accounts service were briefly down.
+func (s *Server) TokenUnavailableNext() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokenFaults++
+}
+
+// Requests returns the number of Web API requests made to the given path,
+// such as "/v1/albums", including ones which failed.
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// Tokens returns the number of access tokens issued.
+func (s *Server) Tokens() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.tokenClients)
+}
+
+// RequestsBy returns the number of Web API requests made with tokens issued
+// to the given client ID.
+func (s *Server) RequestsBy(clientID string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clientRequests[clientID]
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, req *http.Request) {
+	clientID, clientSecret, ok := req.BasicAuth()
+	s.mu.Lock()
+	secret, known := s.credentials[clientID]
+	unavailable := s.tokenFaults > 0
+	if unavailable {
+		s.tokenFaults--
+	}
+	s.mu.Unlock()
+	if unavailable {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "<html><body><h1>503 Service Unavailable</h1></body></html>")
+		return
+	}
+	if !ok || !known || clientSecret != secret {
+		writeJSON(w, http.StatusBadRequest, map[string]any{
+			"error":             "invalid_client",
+			"error_description": "Invalid client",
+		})
+		return
+	}
+	if err := req.ParseForm(); err != nil || req.PostForm.Get("grant_type") != "client_credentials" {
+		writeJSON(w, http.StatusBadRequest, map[string]any{
+			"error":             "unsupported_grant_type",
+			"error_description": "grant_type parameter is missing",
+		})
+		return
+	}
+
+	s.mu.Lock()
+	s.tokenClients = append(s.tokenClients, clientID)
+	token := fmt.Sprintf("token-%d", len(s.tokenClients))
+	lifetime := s.tokenLifetime
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(lifetime.Seconds()),
+	})
+}
+
+// api wraps a Web API handler with authentication, request counting, and
+// injected faults.
+func (s *Server) api(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		s.mu.Lock()
+		s.requests[req.URL.Path]++
+		var f *fault
+		if len(s.faults) > 0 {
+			f = &s.faults[0]
+			s.faults = s.faults[1:]
+		}
+		tokenClients, revoked := s.tokenClients, s.revoked
+		latency := s.latency
+		s.inFlight++
+		s.maxInFlight = max(s.maxInFlight, s.inFlight)
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			s.inFlight--
+			s.mu.Unlock()
+		}()
+		time.Sleep(latency)
+
+		if f != nil {
+			if f.retryAfter != "" {
+				w.Header().Set("Retry-After", f.retryAfter)
+			}
+			if f.status == http.StatusBadGateway {
+				w.Header().Set("Content-Type", "text/html")
+				w.WriteHeader(f.status)
+				fmt.Fprintln(w, "<html><body><h1>502 Bad Gateway</h1></body></html>")
+				return
+			}
+			writeError(w, f.status, "API rate limit exceeded")
+			return
+		}
+
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer token-")
+		n, err := strconv.Atoi(token)
+		if !ok || err != nil || n <= revoked || n > len(tokenClients) {
+			writeError(w, http.StatusUnauthorized, "Invalid access token")
+			return
+		}
+		s.mu.Lock()
+		s.clientRequests[tokenClients[n-1]]++
+		s.mu.Unlock()
+
+		handler(w, req)
+	}
+}
+
+var genreQuery = regexp.MustCompile(`^genre:"(.*)"$`)
+
+func (s *Server) handleSearch(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if query.Get("type") != "artist" {
+		writeError(w, http.StatusBadRequest, "Only searches for artists are supported")
+		return
+	}
+	match := genreQuery.FindStringSubmatch(query.Get("query"))
+	if match == nil {
+		writeError(w, http.StatusBadRequest, "Only genre searches are supported")
+		return
+	}
+	limit, offset, ok := pagination(w, query, 50)
+	if !ok {
+		return
+	}
+
+	artists := s.Catalog.ArtistsInGenre(match[1])
+	var items []any
+	for _, artist := range page(artists, limit, offset) {
+		items = append(items, s.artistObject(artist))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"artists": s.paging(req, items, len(artists), limit, offset),
+	})
+}
+
+func (s *Server) handleArtists(w http.ResponseWriter, req *http.Request) {
+	ids, ok := idsParam(w, req, 50)
+	if !ok {
+		return
+	}
+
+	artists := make([]any, len(ids))
+	for i, id := range ids {
+		if artist := s.Catalog.Artist(id); artist != nil {
+			artists[i] = s.artistObject(artist)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"artists": artists})
+}
+
+func (s *Server) handleArtistAlbums(w http.ResponseWriter, req *http.Request) {
+	artist := s.Catalog.Artist(req.PathValue("id"))
+	if artist == nil {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	limit, offset, ok := pagination(w, req.URL.Query(), 50)
+	if !ok {
+		return
+	}
+
+	var items []any
+	for _, id := range page(artist.Albums, limit, offset) {
+		album := s.simplifiedAlbumObject(s.Catalog.Album(id))
+		album["album_group"] = album["album_type"]
+		items = append(items, album)
+	}
+	writeJSON(w, http.StatusOK, s.paging(req, items, len(artist.Albums), limit, offset))
+}
+
+func (s *Server) handleTopTracks(w http.ResponseWriter, req *http.Request) {
+	artist := s.Catalog.Artist(req.PathValue("id"))
+	if artist == nil {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	tracks := []any{}
+	for _, id := range artist.TopTracks {
+		tracks = append(tracks, s.trackObject(s.Catalog.Track(id)))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"tracks": tracks})
+}
+
+func (s *Server) handleRelatedArtists(w http.ResponseWriter, req *http.Request) {
+	artist := s.Catalog.Artist(req.PathValue("id"))
+	if artist == nil {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	artists := []any{}
+	for _, id := range artist.Related {
+		artists = append(artists, s.artistObject(s.Catalog.Artist(id)))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"artists": artists})
+}
+
+func (s *Server) handleAlbums(w http.ResponseWriter, req *http.Request) {
+	ids, ok := idsParam(w, req, 20)
+	if !ok {
+		return
+	}
+
+	albums := make([]any, len(ids))
+	for i, id := range ids {
+		album := s.Catalog.Album(id)
+		if album == nil {
+			continue
+		}
+		obj := s.simplifiedAlbumObject(album)
+		obj["genres"] = nonNil(album.Genres)
+		obj["popularity"] = album.Popularity
+		obj["label"] = "spotifytest"
+		obj["copyrights"] = []any{}
+		obj["external_ids"] = map[string]any{"upc": fmt.Sprintf("%012d", i)}
+
+		const limit = 50
+		var items []any
+		for _, track := range page(album.Tracks, limit, 0) {
+			items = append(items, s.simplifiedTrackObject(s.Catalog.Track(track)))
+		}
+		pageURL := fmt.Sprintf("%s/v1/albums/%s/tracks", s.URL, album.ID)
+		obj["tracks"] = pagingObject(pageURL, url.Values{}, items, len(album.Tracks), limit, 0)
+		albums[i] = obj
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"albums": albums})
+}
+
+func (s *Server) handleAlbumTracks(w http.ResponseWriter, req *http.Request) {
+	album := s.Catalog.Album(req.PathValue("id"))
+	if album == nil {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	limit, offset, ok := pagination(w, req.URL.Query(), 50)
+	if !ok {
+		return
+	}
+
+	var items []any
+	for _, id := range page(album.Tracks, limit, offset) {
+		items = append(items, s.simplifiedTrackObject(s.Catalog.Track(id)))
+	}
+	writeJSON(w, http.StatusOK, s.paging(req, items, len(album.Tracks), limit, offset))
+}
+
+func (s *Server) handleAudioFeatures(w http.ResponseWriter, req *http.Request) {
+	ids, ok := idsParam(w, req, 100)
+	if !ok {
+		return
+	}
+
+	features := make([]any, len(ids))
+	for i, id := range ids {
+		track := s.Catalog.Track(id)
+		if track == nil || !track.Analyzed {
+			continue
+		}
+		features[i] = map[string]any{
+			"acousticness":     track.Acousticness,
+			"analysis_url":     fmt.Sprintf("%s/v1/audio-analysis/%s", s.URL, track.ID),
+			"danceability":     track.Danceability,
+			"duration_ms":      track.DurationMS,
+			"energy":           track.Energy,
+			"id":               track.ID,
+			"instrumentalness": track.Instrumentalness,
+			"key":              track.Key,
+			"liveness":         track.Liveness,
+			"loudness":         track.Loudness,
+			"mode":             track.Mode,
+			"speechiness":      track.Speechiness,
+			"tempo":            track.Tempo,
+			"time_signature":   track.TimeSignature,
+			"track_href":       fmt.Sprintf("%s/v1/tracks/%s", s.URL, track.ID),
+			"type":             "audio_features",
+			"uri":              "spotify:track:" + track.ID,
+			"valence":          track.Valence,
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"audio_features": features})
+}
+
+func (s *Server) handlePlaylist(w http.ResponseWriter, req *http.Request) {
+	playlist := s.Catalog.Playlist(req.PathValue("id"))
+	if playlist == nil {
+		writeError(w, http.StatusNotFound, "Resource not found")
+		return
+	}
+
+	// The playlist object embeds the first page of its tracks.
+	const limit = 100
+	pageURL := fmt.Sprintf("%s/v1/playlists/%s/tracks", s.URL, playlist.ID)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"collaborative": false,
+		"description":   playlist.Description,
+		"external_urls": map[string]any{"spotify": "https://open.spotify.com/playlist/" + playlist.ID},
+		"followers":     map[string]any{"href": nil, "total": playlist.Followers},
+		"href":          fmt.Sprintf("%s/v1/playlists/%s", s.URL, playlist.ID),
+		"id":            playlist.ID,
+		"images":        s.images("playlist", playlist.ID),
+		"name":          playlist.Name,
+		"owner":         map[string]any{"id": playlist.Owner, "type": "user", "uri": "spotify:user:" + playlist.Owner},
+		"public":        true,
+		"snapshot_id":   playlist.SnapshotID,
+		"tracks":        pagingObject(pageURL, url.Values{}, s.playlistTrackObjects(playlist, limit, 0), len(playlist.Tracks), limit, 0),
+		"type":          "playlist",
+		"uri":           "spotify:playlist:" + playlist.ID,
+	})
+}
+
+func (s *Server) handlePlaylistTracks(w http.ResponseWriter, req *http.Request) {
+	playlist := s.Catalog.Playlist(req.PathValue("id"))
+	if playlist == nil {
+		writeError(w, http.StatusNotFound, "Resource not found")
+		return
+	}
+	limit, offset, ok := pagination(w, req.URL.Query(), 100)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.paging(req, s.playlistTrackObjects(playlist, limit, offset), len(playlist.Tracks), limit, offset))
+}
+
+// playlistTrackObjects returns a page of the playlist's entries, as Spotify's
+// playlist track objects.
+func (s *Server) playlistTrackObjects(playlist *Playlist, limit, offset int) []any {
+	var items []any
+	for i, id := range page(playlist.Tracks, limit, offset) {
+		item := map[string]any{
+			"added_at": time.Date(2020, 1, 1, 0, 0, offset+i, 0, time.UTC).Format(time.RFC3339),
+			"added_by": map[string]any{"id": playlist.Owner, "type": "user"},
+			"is_local": id == "",
+		}
+		if id == "" {
+			item["track"] = map[string]any{
+				"id":       nil,
+				"is_local": true,
+				"name":     "Local File",
+				"type":     "track",
+				"uri":      "spotify:local:::local+file:180",
+			}
+		} else {
+			item["track"] = s.trackObject(s.Catalog.Track(id))
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func (s *Server) artistObject(artist *Artist) map[string]any {
+	obj := s.simplifiedArtistObject(artist)
+	obj["followers"] = map[string]any{"href": nil, "total": artist.Followers}
+	obj["genres"] = nonNil(artist.Genres)
+	obj["images"] = s.images("artist", artist.ID)
+	obj["popularity"] = artist.Popularity
+	return obj
+}
+
+func (s *Server) simplifiedArtistObject(artist *Artist) map[string]any {
+	return map[string]any{
+		"external_urls": map[string]any{"spotify": "https://open.spotify.com/artist/" + artist.ID},
+		"href":          fmt.Sprintf("%s/v1/artists/%s", s.URL, artist.ID),
+		"id":            artist.ID,
+		"name":          artist.Name,
+		"type":          "artist",
+		"uri":           "spotify:artist:" + artist.ID,
+	}
+}
+
+func (s *Server) simplifiedAlbumObject(album *Album) map[string]any {
+	artists := make([]any, len(album.Artists))
+	for i, id := range album.Artists {
+		artists[i] = s.simplifiedArtistObject(s.Catalog.Artist(id))
+	}
+	return map[string]any{
+		"album_type":             album.Type,
+		"total_tracks":           len(album.Tracks),
+		"available_markets":      []string{"US"},
+		"external_urls":          map[string]any{"spotify": "https://open.spotify.com/album/" + album.ID},
+		"href":                   fmt.Sprintf("%s/v1/albums/%s", s.URL, album.ID),
+		"id":                     album.ID,
+		"images":                 s.images("album", album.ID),
+		"name":                   album.Name,
+		"release_date":           album.ReleaseDate,
+		"release_date_precision": album.ReleaseDatePrecision,
+		"type":                   "album",
+		"uri":                    "spotify:album:" + album.ID,
+		"artists":                artists,
+	}
+}
+
+func (s *Server) simplifiedTrackObject(track *Track) map[string]any {
+	artists := make([]any, len(track.Artists))
+	for i, id := range track.Artists {
+		artists[i] = s.simplifiedArtistObject(s.Catalog.Artist(id))
+	}
+	return map[string]any{
+		"artists":           artists,
+		"available_markets": []string{"US"},
+		"disc_number":       track.DiscNumber,
+		"duration_ms":       track.DurationMS,
+		"explicit":          false,
+		"external_urls":     map[string]any{"spotify": "https://open.spotify.com/track/" + track.ID},
+		"href":              fmt.Sprintf("%s/v1/tracks/%s", s.URL, track.ID),
+		"id":                track.ID,
+		"is_local":          false,
+		"name":              track.Name,
+		"preview_url":       nil,
+		"track_number":      track.TrackNumber,
+		"type":              "track",
+		"uri":               "spotify:track:" + track.ID,
+	}
+}
+
+func (s *Server) trackObject(track *Track) map[string]any {
+	obj := s.simplifiedTrackObject(track)
+	obj["album"] = s.simplifiedAlbumObject(s.Catalog.Album(track.Album))
+	obj["external_ids"] = map[string]any{"isrc": "QZ" + strings.ToUpper(track.ID[:10])}
+	obj["popularity"] = track.Popularity
+	return obj
+}
+
+func (s *Server) images(kind, id string) []any {
+	var images []any
+	for _, size := range []int{640, 300, 64} {
+		images = append(images, map[string]any{
+			"url":    fmt.Sprintf("%s/images/%s/%s/%d.jpg", s.URL, kind, id, size),
+			"height": size,
+			"width":  size,
+		})
+	}
+	return images
+}
+
+func (s *Server) paging(req *http.Request, items []any, total, limit, offset int) map[string]any {
+	return pagingObject(s.URL+req.URL.Path, req.URL.Query(), items, total, limit, offset)
+}
+
+// pagingObject returns a Spotify paging object. Its next and previous URLs are
+// the given URL and query with a different offset.
+func pagingObject(base string, query url.Values, items []any, total, limit, offset int) map[string]any {
+	if items == nil {
+		items = []any{}
+	}
+	pageURL := func(offset int) string {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		q.Set("limit", strconv.Itoa(limit))
+		q.Set("offset", strconv.Itoa(offset))
+		return base + "?" + q.Encode()
+	}
+
+	obj := map[string]any{
+		"href":     pageURL(offset),
+		"items":    items,
+		"limit":    limit,
+		"offset":   offset,
+		"total":    total,
+		"next":     nil,
+		"previous": nil,
+	}
+	if offset+limit < total {
+		obj["next"] = pageURL(offset + limit)
+	}
+	if offset > 0 {
+		obj["previous"] = pageURL(max(0, offset-limit))
+	}
+	return obj
+}
+
+func page[T any](all []T, limit, offset int) []T {
+	if offset >= len(all) {
+		return nil
+	}
+	return all[offset:min(len(all), offset+limit)]
+}
+
+// pagination parses the limit and offset query parameters, writing an error
+// and returning false if they're invalid. Limits may be up to maxLimit.
+func pagination(w http.ResponseWriter, query url.Values, maxLimit int) (int, int, bool) {
+	limit, offset := 20, 0
+	if str := query.Get("limit"); str != "" {
+		v, err := strconv.Atoi(str)
+		if err != nil || v < 1 || v > maxLimit {
+			writeError(w, http.StatusBadRequest, "Invalid limit")
+			return 0, 0, false
+		}
+		limit = v
+	}
+	if str := query.Get("offset"); str != "" {
+		v, err := strconv.Atoi(str)
+		if err != nil || v < 0 {
+			writeError(w, http.StatusBadRequest, "Invalid offset")
+			return 0, 0, false
+		}
+		offset = v
+	}
+	return limit, offset, true
+}
+
+// idsParam parses the comma-separated ids query parameter, writing an error
+// and returning false if there are none or more than limit.
+func idsParam(w http.ResponseWriter, req *http.Request, limit int) ([]string, bool) {
+	str := req.URL.Query().Get("ids")
+	if str == "" {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return nil, false
+	}
+	ids := strings.Split(str, ",")
+	if len(ids) > limit {
+		writeError(w, http.StatusBadRequest, "Too many ids requested")
+		return nil, false
+	}
+	return ids, true
+}
+
+func nonNil(strs []string) []string {
+	if strs == nil {
+		return []string{}
+	}
+	return strs
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]any{
+		"error": map[string]any{
+			"status":  status,
+			"message": message,
+		},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[spotifytest] error encoding response: %s", err)
+	}
+}
@@ -10,27 +10,27 @@ import (
 	"github.com/amonks/genres/spotify"
 )
 
-func runAlbumTracksRefetcher(ctx context.Context, c chan<- struct{}, db *db.DB, spo *spotify.Client) error {
+func runAlbumTracksRefetcher(ctx context.Context, c chan<- struct{}, db *db.DB, spo *spotify.Client, f frontier) error {
 	for {
 		if err := ctx.Err(); err != nil {
 			return fmt.Errorf("canceled: %w", err)
 		}
 
 		const count = 20
-		albums, err := db.GetAlbumsToRefetchTracks(count)
+		albums, err := db.GetAlbumsToRefetchTracks(count, f.scope)
 		if err != nil {
 			return err
 		}
 		if len(albums) == 0 {
 			return nil
 		}
-		if len(albums) < count {
+		if !f.worthFetching(len(albums), count) {
 			return nil
 		}
 
 		fetched, err := spo.FetchAlbums(ctx, albums)
 		if err != nil && errors.Is(err, spotify.ErrSpotify) {
-			if markErr := db.MarkAlbumsTracksFailed(albums); markErr != nil {
+			if markErr := db.MarkAlbumsTracksFailed(albums, err); markErr != nil {
 				return markErr
 			}
 			log.Printf("failed to fetch %d albums: %s", len(albums), err)
@@ -10,13 +10,13 @@ import (
 	"github.com/amonks/genres/spotify"
 )
 
-func runArtistAlbumsFetcher(ctx context.Context, c chan<- struct{}, db *db.DB, spo *spotify.Client) error {
+func runArtistAlbumsFetcher(ctx context.Context, c chan<- struct{}, db *db.DB, spo *spotify.Client, f frontier) error {
 	for {
 		if err := ctx.Err(); err != nil {
 			return fmt.Errorf("canceled: %w", err)
 		}
 
-		artists, err := db.GetArtistsToFetchAlbums(1)
+		artists, err := db.GetArtistsToFetchAlbums(1, f.priority, f.scope)
 		if err != nil {
 			return err
 		}
@@ -28,7 +28,7 @@ func runArtistAlbumsFetcher(ctx context.Context, c chan<- struct{}, db *db.DB, s
 
 		albums, err := spo.FetchArtistAlbums(ctx, artist)
 		if err != nil && errors.Is(err, spotify.ErrSpotify) {
-			if markErr := db.MarkArtistAlbumsFailed(artist); markErr != nil {
+			if markErr := db.MarkArtistAlbumsFailed(artist, err); markErr != nil {
 				return markErr
 			}
 			log.Printf("failed to fetch artist albums '%s': %s", artist, err)
@@ -11,13 +11,13 @@ import (
 	"github.com/amonks/genres/spotify"
 )
 
-func runArtistTracksFetcher(ctx context.Context, c chan<- struct{}, db *db.DB, spo *spotify.Client) error {
+func runArtistTracksFetcher(ctx context.Context, c chan<- struct{}, db *db.DB, spo *spotify.Client, f frontier) error {
 	for {
 		if err := ctx.Err(); err != nil {
 			return fmt.Errorf("canceled: %w", err)
 		}
 
-		artists, err := db.GetArtistsToFetchTracks(1)
+		artists, err := db.GetArtistsToFetchTracks(1, f.priority, f.scope)
 		if err != nil {
 			return err
 		}
@@ -29,7 +29,7 @@ func runArtistTracksFetcher(ctx context.Context, c chan<- struct{}, db *db.DB, s
 
 		tracks, err := spo.FetchArtistTracks(ctx, artist)
 		if err != nil && errors.Is(err, spotify.ErrSpotify) {
-			if markErr := db.MarkArtistFailed(artist); markErr != nil {
+			if markErr := db.MarkArtistFailed(artist, err); markErr != nil {
 				return markErr
 			}
 			log.Printf("failed to fetch artist '%s': %s", artist, err)
@@ -0,0 +1,192 @@
+package workers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The states a worker can be in.
+const (
+	// StateRunning workers are working through a batch.
+	StateRunning = "running"
+	// StateIdle workers have run out of work, and wait to be triggered.
+	StateIdle = "idle"
+	// StateBackingOff workers wait to retry after a transient error.
+	StateBackingOff = "backing_off"
+	// StateFailed workers stopped with a fatal error.
+	StateFailed = "failed"
+	// StatePaused workers won't start another batch until they're resumed.
+	StatePaused = "paused"
+)
+
+// WorkerStatus describes a worker of a running engine.
+type WorkerStatus struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+
+	// Batches is the number of batches the worker has processed.
+	Batches          int       `json:"batches"`
+	LastBatchAt      time.Time `json:"last_batch_at"`
+	LastBatchSeconds float64   `json:"last_batch_seconds"`
+
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at"`
+}
+
+// A Control reports on and controls the workers of a running engine. Pass
+// one to Run WithControl, and serve it over HTTP:
+//
+//	GET  /workers                 lists each worker's status
+//	POST /workers/{name}/pause    pauses a worker after its current batch
+//	POST /workers/{name}/resume   resumes a paused worker
+//	POST /workers/{name}/trigger  starts an idle worker
+type Control struct {
+	mu  sync.Mutex
+	eng *engine
+	mux *http.ServeMux
+}
+
+var errNoWorker = errors.New("no such worker")
+
+// NewControl returns a Control, which does nothing until it's passed to Run.
+func NewControl() *Control {
+	c := &Control{mux: http.NewServeMux()}
+	c.mux.HandleFunc("GET /workers", func(w http.ResponseWriter, req *http.Request) {
+		statuses, err := c.Status()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statuses)
+	})
+	for action, f := range map[string]func(string) error{
+		"pause":   c.Pause,
+		"resume":  c.Resume,
+		"trigger": c.Trigger,
+	} {
+		c.mux.HandleFunc("POST /workers/{name}/"+action, func(w http.ResponseWriter, req *http.Request) {
+			if err := f(req.PathValue("name")); errors.Is(err, errNoWorker) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		})
+	}
+	return c
+}
+
+func (c *Control) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	c.mux.ServeHTTP(w, req)
+}
+
+func (c *Control) attach(eng *engine) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.eng = eng
+}
+
+func (c *Control) engine() (*engine, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.eng == nil {
+		return nil, fmt.Errorf("no workers are running")
+	}
+	return c.eng, nil
+}
+
+// Status returns the status of each worker, sorted by name.
+func (c *Control) Status() ([]WorkerStatus, error) {
+	eng, err := c.engine()
+	if err != nil {
+		return nil, err
+	}
+
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+	var statuses []WorkerStatus
+	for _, worker := range eng.workers {
+		status := worker.status
+		if worker.paused && status.State != StateFailed {
+			status.State = StatePaused
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses, nil
+}
+
+// Pause stops the named worker from starting another batch, or from being
+// started, until it's resumed. A running worker finishes the batch it's
+// working on, and may finish one more, before it stops.
+func (c *Control) Pause(name string) error {
+	eng, worker, err := c.worker(name)
+	if err != nil {
+		return err
+	}
+	defer eng.mu.Unlock()
+
+	if !worker.paused {
+		worker.paused = true
+		worker.resumed = make(chan struct{})
+	}
+	return nil
+}
+
+// Resume lets a paused worker carry on, and starts it if it was triggered
+// while it was paused.
+func (c *Control) Resume(name string) error {
+	eng, worker, err := c.worker(name)
+	if err != nil {
+		return err
+	}
+	defer eng.mu.Unlock()
+
+	if !worker.paused {
+		return nil
+	}
+	worker.paused = false
+	close(worker.resumed)
+	if worker.pending && !worker.isRunning && eng.ctx.Err() == nil {
+		eng.run(name)
+	}
+	return nil
+}
+
+// Trigger starts the named worker, if it isn't running already.
+func (c *Control) Trigger(name string) error {
+	eng, worker, err := c.worker(name)
+	if err != nil {
+		return err
+	}
+	paused := worker.paused
+	eng.mu.Unlock()
+
+	if paused {
+		return fmt.Errorf("worker '%s' is paused", name)
+	}
+	eng.retrigger(name)
+	return nil
+}
+
+// worker returns the engine and the named worker, with the engine locked.
+func (c *Control) worker(name string) (*engine, *worker, error) {
+	eng, err := c.engine()
+	if err != nil {
+		return nil, nil, err
+	}
+	eng.mu.Lock()
+	worker, ok := eng.workers[name]
+	if !ok {
+		eng.mu.Unlock()
+		return nil, nil, fmt.Errorf("%w: '%s'", errNoWorker, name)
+	}
+	return eng, worker, nil
+}
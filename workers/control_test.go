@@ -0,0 +1,156 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startControlled starts an engine with a worker named "w", which processes
+// one batch per value sent on the returned channel, and stops when there are
+// none, unless keepRunning is true. Another worker runs until the test is
+// done, as the reporter does, so that the engine doesn't stop with "w".
+func startControlled(t *testing.T, keepRunning bool) (*Control, chan<- struct{}) {
+	work := make(chan struct{}, 100)
+	eng := newEngine()
+	eng.add("w", testPolicy, func(ctx context.Context, c chan<- struct{}) error {
+		for {
+			if keepRunning {
+				select {
+				case <-ctx.Done():
+					return fmt.Errorf("canceled: %w", ctx.Err())
+				case <-work:
+				}
+			} else {
+				select {
+				case <-work:
+				default:
+					return nil
+				}
+			}
+			c <- struct{}{}
+		}
+	})
+
+	eng.add("reporter", testPolicy, func(ctx context.Context, c chan<- struct{}) error {
+		<-ctx.Done()
+		return fmt.Errorf("canceled: %w", ctx.Err())
+	})
+
+	control := NewControl()
+	eng.control = control
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- eng.start(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		assert.NoError(t, <-done)
+	})
+	require.Eventually(t, func() bool {
+		_, err := control.Status()
+		return err == nil
+	}, 5*time.Second, time.Millisecond)
+
+	return control, work
+}
+
+// status returns the status of the worker "w".
+func status(t *testing.T, control *Control) WorkerStatus {
+	statuses, err := control.Status()
+	require.NoError(t, err)
+	require.Len(t, statuses, 2)
+	return statuses[1]
+}
+
+func TestControlTrigger(t *testing.T) {
+	control, work := startControlled(t, false)
+
+	require.Eventually(t, func() bool { return status(t, control).State == StateIdle }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, 0, status(t, control).Batches)
+
+	work <- struct{}{}
+	work <- struct{}{}
+	require.NoError(t, control.Trigger("w"))
+	require.Eventually(t, func() bool {
+		s := status(t, control)
+		return s.State == StateIdle && s.Batches == 2
+	}, 5*time.Second, time.Millisecond)
+	assert.False(t, status(t, control).LastBatchAt.IsZero())
+
+	// Paused workers can't be triggered.
+	require.NoError(t, control.Pause("w"))
+	assert.Equal(t, StatePaused, status(t, control).State)
+	assert.Error(t, control.Trigger("w"))
+	require.NoError(t, control.Resume("w"))
+	assert.Equal(t, StateIdle, status(t, control).State)
+
+	assert.ErrorIs(t, control.Trigger("nope"), errNoWorker)
+}
+
+func TestControlPause(t *testing.T) {
+	control, work := startControlled(t, true)
+
+	work <- struct{}{}
+	require.Eventually(t, func() bool { return status(t, control).Batches == 1 }, 5*time.Second, time.Millisecond)
+
+	// The paused worker reports one more batch, and then stops.
+	require.NoError(t, control.Pause("w"))
+	for i := 0; i < 3; i++ {
+		work <- struct{}{}
+	}
+	require.Eventually(t, func() bool { return status(t, control).Batches == 2 }, 5*time.Second, time.Millisecond)
+	require.Never(t, func() bool { return status(t, control).Batches > 2 }, 100*time.Millisecond, time.Millisecond)
+	assert.Equal(t, StatePaused, status(t, control).State)
+
+	require.NoError(t, control.Resume("w"))
+	require.Eventually(t, func() bool { return status(t, control).Batches == 4 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, StateRunning, status(t, control).State)
+}
+
+func TestControlHTTP(t *testing.T) {
+	control, _ := startControlled(t, true)
+	srv := httptest.NewServer(control)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/workers")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var statuses []WorkerStatus
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&statuses))
+	require.Len(t, statuses, 2)
+	assert.Equal(t, "reporter", statuses[0].Name)
+	assert.Equal(t, "w", statuses[1].Name)
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/workers/w/pause", http.StatusNoContent},
+		{"/workers/w/trigger", http.StatusConflict},
+		{"/workers/w/resume", http.StatusNoContent},
+		{"/workers/nope/pause", http.StatusNotFound},
+	} {
+		resp, err := http.Post(srv.URL+tc.path, "", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, tc.status, resp.StatusCode, tc.path)
+	}
+}
+
+func TestControlNotRunning(t *testing.T) {
+	srv := httptest.NewServer(NewControl())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/workers")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
@@ -10,13 +10,13 @@ import (
 	"github.com/amonks/genres/spotify"
 )
 
-func runGenreArtistsFetcher(ctx context.Context, c chan<- struct{}, db *db.DB, spo *spotify.Client) error {
+func runGenreArtistsFetcher(ctx context.Context, c chan<- struct{}, db *db.DB, spo *spotify.Client, f frontier) error {
 	for {
 		if err := ctx.Err(); err != nil {
 			return fmt.Errorf("canceled: %w", err)
 		}
 
-		genres, err := db.GetGenresToFetchArtists(1)
+		genres, err := db.GetGenresToFetchArtists(1, f.scope)
 		if err != nil {
 			return fmt.Errorf("error getting artistless genre: %w", err)
 		}
@@ -28,7 +28,7 @@ func runGenreArtistsFetcher(ctx context.Context, c chan<- struct{}, db *db.DB, s
 
 		artists, err := spo.FetchGenre(ctx, genreName)
 		if err != nil && errors.Is(err, spotify.ErrSpotify) {
-			if markErr := db.MarkGenreFailed(genreName); markErr != nil {
+			if markErr := db.MarkGenreFailed(genreName, err); markErr != nil {
 				return markErr
 			}
 			log.Printf("failed to fetch genre %s: %s", genreName, err)
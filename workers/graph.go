@@ -0,0 +1,313 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/amonks/genres/db"
+	"github.com/amonks/genres/spotify"
+)
+
+// A resource is a kind of data which workers produce and consume.
+type resource string
+
+const (
+	resourceGenres   resource = "genres"
+	resourceArtists  resource = "artists"
+	resourceAlbums   resource = "albums"
+	resourceTracks   resource = "tracks"
+	resourceAnalyses resource = "analyses"
+	// resourceRelations are artists found through others' related
+	// artists. They're a resource of their own, since the worker which
+	// finds them also consumes artists.
+	resourceRelations resource = "relations"
+)
+
+var resources = []resource{resourceGenres, resourceArtists, resourceAlbums, resourceTracks, resourceAnalyses, resourceRelations}
+
+// A spec describes a worker. Whenever a worker makes progress, the workers
+// which consume what it produces are started again, if they've stopped.
+type spec struct {
+	name     string
+	consumes []resource
+	produces []resource
+	policy   policy
+	run      func(ctx context.Context, c chan<- struct{}, db *db.DB, spo *spotify.Client) error
+
+	// fetch is run instead of run by workers which fetch from a
+	// frontier.
+	fetch func(ctx context.Context, c chan<- struct{}, db *db.DB, spo *spotify.Client, f frontier) error
+	// prioritized is set for workers whose frontier can be prioritized.
+	prioritized bool
+	// byDefault is set for workers which run when none are named.
+	byDefault bool
+}
+
+// A frontier is what a worker fetches from: the rows in scope which it has
+// yet to fetch, in order of a priority.
+type frontier struct {
+	priority db.Priority
+	scope    *db.Scope
+}
+
+// worthFetching reports whether a batch of n rows is worth fetching, for a
+// worker which fetches up to size rows at a time. Workers wait for full
+// batches, since more rows turn up as the crawl goes on, except in a scope,
+// whose frontier runs out.
+func (f frontier) worthFetching(n, size int) bool {
+	return n >= size || f.scope != nil
+}
+
+var specs = []spec{
+	{
+		name:     "genres",
+		produces: []resource{resourceGenres},
+		policy:   defaultPolicy,
+		run: func(ctx context.Context, c chan<- struct{}, db *db.DB, spo *spotify.Client) error {
+			return runGenresFetcher(ctx, c, db)
+		},
+		byDefault: true,
+	},
+	{
+		name:      "genre_artists",
+		consumes:  []resource{resourceGenres},
+		produces:  []resource{resourceArtists},
+		policy:    defaultPolicy,
+		fetch:     runGenreArtistsFetcher,
+		byDefault: true,
+	},
+	{
+		name:     "playlists",
+		produces: []resource{resourceArtists, resourceAlbums, resourceTracks},
+		policy:   defaultPolicy,
+		fetch:    runPlaylistsFetcher,
+	},
+	{
+		name:        "artist_albums",
+		consumes:    []resource{resourceArtists, resourceRelations},
+		produces:    []resource{resourceAlbums},
+		policy:      defaultPolicy,
+		fetch:       runArtistAlbumsFetcher,
+		prioritized: true,
+		byDefault:   true,
+	},
+	{
+		name:        "artist_tracks",
+		consumes:    []resource{resourceArtists, resourceRelations},
+		produces:    []resource{resourceAlbums, resourceTracks},
+		policy:      defaultPolicy,
+		fetch:       runArtistTracksFetcher,
+		prioritized: true,
+	},
+	{
+		name:        "related_artists",
+		consumes:    []resource{resourceArtists},
+		produces:    []resource{resourceRelations},
+		policy:      defaultPolicy,
+		fetch:       runRelatedArtistsFetcher,
+		prioritized: true,
+	},
+	{
+		name:        "album_tracks",
+		consumes:    []resource{resourceAlbums},
+		produces:    []resource{resourceTracks},
+		policy:      defaultPolicy,
+		fetch:       runAlbumTracksFetcher,
+		prioritized: true,
+		byDefault:   true,
+	},
+	{
+		name:      "album_tracks_refetch",
+		consumes:  []resource{resourceAlbums},
+		produces:  []resource{resourceTracks},
+		policy:    defaultPolicy,
+		fetch:     runAlbumTracksRefetcher,
+		byDefault: true,
+	},
+	{
+		name:        "track_analysis",
+		consumes:    []resource{resourceTracks},
+		produces:    []resource{resourceAnalyses},
+		policy:      defaultPolicy,
+		fetch:       runTrackAnalysisFetcher,
+		prioritized: true,
+		byDefault:   true,
+	},
+	{
+		name:     "indexer",
+		consumes: []resource{resourceAnalyses},
+		policy:   localPolicy,
+		run: func(ctx context.Context, c chan<- struct{}, db *db.DB, spo *spotify.Client) error {
+			return runIndexer(ctx, c, db)
+		},
+		byDefault: true,
+	},
+	{
+		name:     "rtree_indexer",
+		consumes: []resource{resourceArtists, resourceAlbums, resourceTracks, resourceRelations},
+		policy:   localPolicy,
+		run: func(ctx context.Context, c chan<- struct{}, db *db.DB, spo *spotify.Client) error {
+			return runRtreeIndexer(ctx, c, db)
+		},
+	},
+}
+
+// Names returns the names of the workers which can be run, in the order of
+// the crawl.
+func Names() []string {
+	names := make([]string, len(specs))
+	for i, spec := range specs {
+		names[i] = spec.name
+	}
+	return names
+}
+
+// Defaults returns the names of the workers which run when none are named, in
+// the order of the crawl: those which crawl outward from every genre, and the
+// indexer, which keeps up with their analyses. The others, most of which spend
+// quota on other endpoints, only run when they're named.
+func Defaults() []string {
+	var names []string
+	for _, spec := range specs {
+		if spec.byDefault {
+			names = append(names, spec.name)
+		}
+	}
+	return names
+}
+
+// Prioritized returns the names of the workers whose frontier can be
+// prioritized, in the order of the crawl.
+func Prioritized() []string {
+	var names []string
+	for _, spec := range specs {
+		if spec.prioritized {
+			names = append(names, spec.name)
+		}
+	}
+	return names
+}
+
+// lookupSpecs returns the specs of the named workers, in the order of the
+// crawl.
+func lookupSpecs(names []string) ([]spec, error) {
+	for _, name := range names {
+		if !slices.ContainsFunc(specs, func(s spec) bool { return s.name == name }) {
+			return nil, fmt.Errorf("unsupported worker '%s'", name)
+		}
+	}
+	var selected []spec
+	for _, spec := range specs {
+		if slices.Contains(names, spec.name) {
+			selected = append(selected, spec)
+		}
+	}
+	return selected, nil
+}
+
+// triggers maps the name of each of the given workers to the names of the
+// others which consume what it produces.
+func triggers(specs []spec) map[string][]string {
+	triggers := map[string][]string{}
+	for _, from := range specs {
+		for _, to := range specs {
+			if from.name == to.name {
+				continue
+			}
+			for _, r := range from.produces {
+				if slices.Contains(to.consumes, r) {
+					triggers[from.name] = append(triggers[from.name], to.name)
+					break
+				}
+			}
+		}
+	}
+	return triggers
+}
+
+// validate checks that the given workers only use known resources, and that
+// none of them triggers itself, directly or through others, since that would
+// retrigger them forever.
+func validate(specs []spec) error {
+	for _, spec := range specs {
+		for _, r := range append(slices.Clone(spec.consumes), spec.produces...) {
+			if !slices.Contains(resources, r) {
+				return fmt.Errorf("worker '%s' uses unknown resource '%s'", spec.name, r)
+			}
+		}
+		for _, r := range spec.produces {
+			if slices.Contains(spec.consumes, r) {
+				return fmt.Errorf("worker '%s' consumes the %s it produces", spec.name, r)
+			}
+		}
+	}
+
+	triggers := triggers(specs)
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := map[string]int{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("workers trigger each other in a cycle: %s", strings.Join(append(path, name), " -> "))
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, next := range triggers[name] {
+			if err := visit(next, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+	for _, spec := range specs {
+		if err := visit(spec.name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PrintGraph writes a table of the named workers, what they consume and
+// produce, and which of the others they trigger.
+func PrintGraph(w io.Writer, names []string) error {
+	specs, err := lookupSpecs(names)
+	if err != nil {
+		return err
+	}
+	if err := validate(specs); err != nil {
+		return err
+	}
+	triggers := triggers(specs)
+
+	join := func(rs []resource) string {
+		if len(rs) == 0 {
+			return "-"
+		}
+		strs := make([]string, len(rs))
+		for i, r := range rs {
+			strs[i] = string(r)
+		}
+		return strings.Join(strs, ", ")
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "WORKER\tCONSUMES\tPRODUCES\tTRIGGERS\n")
+	for _, spec := range specs {
+		triggered := "-"
+		if len(triggers[spec.name]) > 0 {
+			triggered = strings.Join(triggers[spec.name], ", ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", spec.name, join(spec.consumes), join(spec.produces), triggered)
+	}
+	return tw.Flush()
+}
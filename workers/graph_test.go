@@ -0,0 +1,81 @@
+package workers
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpecsValid(t *testing.T) {
+	assert.NoError(t, validate(specs))
+}
+
+func TestTriggers(t *testing.T) {
+	all := triggers(specs)
+	assert.Equal(t, []string{"genre_artists"}, all["genres"])
+	assert.Equal(t, []string{"album_tracks", "album_tracks_refetch", "rtree_indexer"}, all["artist_albums"])
+	assert.Equal(t, []string{"indexer"}, all["track_analysis"])
+	assert.Equal(t, []string{"artist_albums", "artist_tracks", "related_artists", "album_tracks", "album_tracks_refetch", "track_analysis", "rtree_indexer"}, all["playlists"])
+	assert.Equal(t, []string{"artist_albums", "artist_tracks", "rtree_indexer"}, all["related_artists"])
+	assert.Empty(t, all["indexer"])
+
+	// Only the given workers are triggered.
+	selected, err := lookupSpecs([]string{"track_analysis", "artist_albums", "album_tracks"})
+	require.NoError(t, err)
+	some := triggers(selected)
+	assert.Equal(t, []string{"album_tracks"}, some["artist_albums"])
+	assert.Equal(t, []string{"track_analysis"}, some["album_tracks"])
+	assert.Empty(t, some["track_analysis"])
+}
+
+func TestLookupSpecs(t *testing.T) {
+	selected, err := lookupSpecs([]string{"indexer", "genres"})
+	require.NoError(t, err)
+	require.Len(t, selected, 2)
+	assert.Equal(t, "genres", selected[0].name)
+	assert.Equal(t, "indexer", selected[1].name)
+
+	_, err = lookupSpecs([]string{"genres", "reticulator"})
+	assert.ErrorContains(t, err, "reticulator")
+}
+
+func TestDefaults(t *testing.T) {
+	// The workers the crawl has always run, plus the indexer, which
+	// track_analysis's analyses trigger.
+	assert.Equal(t, []string{"genres", "genre_artists", "artist_albums", "album_tracks", "album_tracks_refetch", "track_analysis", "indexer"}, Defaults())
+
+	selected, err := lookupSpecs(Defaults())
+	require.NoError(t, err)
+	assert.NoError(t, validate(selected))
+	for _, name := range triggers(selected)["track_analysis"] {
+		assert.Contains(t, Defaults(), name)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	assert.ErrorContains(t, validate([]spec{
+		{name: "a", consumes: []resource{resourceArtists}, produces: []resource{resourceAlbums}},
+		{name: "b", consumes: []resource{resourceAlbums}, produces: []resource{resourceTracks}},
+		{name: "c", consumes: []resource{resourceTracks}, produces: []resource{resourceArtists}},
+	}), "a -> b -> c -> a")
+
+	assert.ErrorContains(t, validate([]spec{
+		{name: "a", consumes: []resource{resourceArtists}, produces: []resource{resourceArtists}},
+	}), "consumes the artists it produces")
+
+	assert.ErrorContains(t, validate([]spec{
+		{name: "a", produces: []resource{"playlists"}},
+	}), "unknown resource 'playlists'")
+}
+
+func TestPrintGraph(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, PrintGraph(&buf, []string{"genres", "genre_artists"}))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, []string{"genres", "-", "genres", "genre_artists"}, strings.Fields(lines[1]))
+	assert.Equal(t, []string{"genre_artists", "genres", "artists", "-"}, strings.Fields(lines[2]))
+}
@@ -0,0 +1,66 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/amonks/genres/data"
+	"github.com/amonks/genres/db"
+	"github.com/amonks/genres/spotify"
+)
+
+// runPlaylistsFetcher fetches the seed playlists, and inserts their tracks,
+// along with the tracks' albums and artists, so that the other workers fetch
+// and analyze them.
+func runPlaylistsFetcher(ctx context.Context, c chan<- struct{}, db *db.DB, spo *spotify.Client, f frontier) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("canceled: %w", err)
+		}
+
+		playlists, err := db.GetPlaylistsToFetch(1, f.scope)
+		if err != nil {
+			return err
+		}
+		if len(playlists) == 0 {
+			return nil
+		}
+
+		id := playlists[0]
+
+		playlist, err := spo.FetchPlaylist(ctx, id)
+		if err != nil && errors.Is(err, spotify.ErrSpotify) {
+			if markErr := db.MarkPlaylistFailed(id, err); markErr != nil {
+				return markErr
+			}
+			log.Printf("failed to fetch playlist '%s': %s", id, err)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// Record the playlist under the ID it was added by.
+		playlist.SpotifyID = id
+		if err := insertPlaylist(ctx, db, playlist); err != nil {
+			return err
+		}
+
+		c <- struct{}{}
+	}
+}
+
+// insertPlaylist inserts a fetched playlist's tracks, and their albums, and
+// then the playlist itself.
+func insertPlaylist(ctx context.Context, db *db.DB, playlist *data.Playlist) error {
+	for _, entry := range playlist.Tracks {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("canceled: %w", err)
+		}
+
+		if err := db.InsertTrack(ctx, &entry.Track); err != nil {
+			return err
+		}
+	}
+	return db.PopulatePlaylist(ctx, playlist)
+}
@@ -0,0 +1,45 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/amonks/genres/db"
+	"github.com/amonks/genres/spotify"
+)
+
+func runRelatedArtistsFetcher(ctx context.Context, c chan<- struct{}, db *db.DB, spo *spotify.Client, f frontier) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("canceled: %w", err)
+		}
+
+		artists, err := db.GetArtistsToFetchRelated(1, f.priority, f.scope)
+		if err != nil {
+			return err
+		}
+		if len(artists) == 0 {
+			return nil
+		}
+
+		artist := artists[0]
+
+		related, err := spo.FetchRelatedArtists(ctx, artist)
+		if err != nil && errors.Is(err, spotify.ErrSpotify) {
+			if markErr := db.MarkArtistRelatedFailed(artist, err); markErr != nil {
+				return markErr
+			}
+			log.Printf("failed to fetch related artists '%s': %s", artist, err)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := db.InsertArtistRelations(ctx, artist, related); err != nil {
+			return err
+		}
+
+		c <- struct{}{}
+	}
+}
@@ -0,0 +1,332 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/amonks/genres/data"
+	"github.com/amonks/genres/db"
+	"github.com/amonks/genres/readthrough"
+	"github.com/amonks/genres/spotify"
+)
+
+// Replay rebuilds the database from the responses in the given cache, without
+// making any requests to Spotify, by passing each cached response through the
+// same parsing and insertion code as the fetch workers.
+//
+// spo must be created WithCacheOnly, and with the same cache.
+//
+// If enao is true, Replay first fetches the genres from everynoise.com, like
+// the genres worker, since they aren't in the cache.
+//
+// Replay proceeds in the order of the fetch workers, so that, for example,
+// every artist is known before their albums are inserted. Responses which
+// depend on others that aren't cached, such as a page of search results
+// without the page before it, are skipped.
+//
+// Responses cached before their URLs were recorded can't be found by walking
+// the cache. For stages which fetch one response per row, like an artist's
+// albums, Replay also tries the URL of every row the stage hasn't fetched
+// once it's replayed the rest, so those responses are replayed too. Batched
+// responses, for albums' tracks and tracks' analyses, can't be found that way,
+// since the batches aren't known.
+func Replay(ctx context.Context, db *db.DB, spo *spotify.Client, cache readthrough.Cache, enao bool) error {
+	c := make(chan struct{})
+	defer close(c)
+	go func() {
+		for range c {
+		}
+	}()
+
+	if enao {
+		if err := runGenresFetcher(ctx, c, db); err != nil {
+			return fmt.Errorf("error fetching genres: %w", err)
+		}
+	}
+
+	// The cache is walked once, sorting each key into the stage which
+	// replays it, since walking a large cache is slow.
+	keys := make([][]string, len(replayStages))
+	if err := cache.Walk(func(key string) error {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("canceled: %w", err)
+		}
+		u, err := url.Parse(key)
+		if err != nil {
+			return nil
+		}
+		for i, stage := range replayStages {
+			if stage.match(u) {
+				keys[i] = append(keys[i], key)
+				break
+			}
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("error walking cache: %w", err)
+	}
+
+	for i, stage := range replayStages {
+		var replayed, skipped int
+		for _, key := range keys[i] {
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("canceled: %w", err)
+			}
+			u, _ := url.Parse(key)
+			err := stage.replay(ctx, db, spo, u)
+			if errors.Is(err, spotify.ErrNotCached) {
+				log.Printf("[replay] %s: skipping '%s': %s", stage.name, key, err)
+				skipped++
+				continue
+			} else if err != nil {
+				return fmt.Errorf("error in %s: error replaying '%s': %w", stage.name, key, err)
+			}
+			replayed++
+		}
+		log.Printf("[replay] %s: replayed %d responses, skipped %d", stage.name, replayed, skipped)
+
+		if stage.unkeyed == nil {
+			continue
+		}
+		unfetched, err := db.GetUnfetched(ctx, stage.stage)
+		if err != nil {
+			return fmt.Errorf("error in %s: %w", stage.name, err)
+		}
+		var backfilled int
+		for _, key := range unfetched {
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("canceled: %w", err)
+			}
+			err := stage.replay(ctx, db, spo, stage.unkeyed(key))
+			if errors.Is(err, spotify.ErrNotCached) {
+				continue
+			} else if err != nil {
+				return fmt.Errorf("error in %s: error replaying unkeyed '%s': %w", stage.name, key, err)
+			}
+			backfilled++
+		}
+		log.Printf("[replay] %s: replayed %d responses without keys, of %d unfetched", stage.name, backfilled, len(unfetched))
+	}
+
+	if err := db.UpdateKNNIndex(ctx); err != nil {
+		return err
+	}
+	if err := runIndexer(ctx, c, db); err != nil {
+		return err
+	}
+	if err := runRtreeIndexer(ctx, c, db); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// A replayStage replays one kind of response: those whose URLs match.
+//
+// If the stage fetches one response per row of its db.Stage, unkeyed returns
+// the URL of the response for the row with the given key, which replay
+// accepts even though it has no host.
+type replayStage struct {
+	name    string
+	match   func(u *url.URL) bool
+	replay  func(ctx context.Context, db *db.DB, spo *spotify.Client, u *url.URL) error
+	stage   db.Stage
+	unkeyed func(key string) *url.URL
+}
+
+var (
+	genreSearchQuery = regexp.MustCompile(`^genre:"(.*)"$`)
+	artistAlbumsPath = regexp.MustCompile(`^/v1/artists/([^/]+)/albums$`)
+	artistTracksPath = regexp.MustCompile(`^/v1/artists/([^/]+)/top-tracks$`)
+	relatedPath      = regexp.MustCompile(`^/v1/artists/([^/]+)/related-artists$`)
+	playlistPath     = regexp.MustCompile(`^/v1/playlists/([^/]+)$`)
+)
+
+var replayStages = []replayStage{
+	{"genre_artists", matchGenreArtists, replayGenreArtists, db.StageGenreArtists, genreArtistsURL},
+	{"related_artists", matchPath(relatedPath), replayRelatedArtists, db.StageRelatedArtists, pathURL("/v1/artists/%s/related-artists")},
+	{"playlists", matchPath(playlistPath), replayPlaylists, db.StagePlaylistTracks, pathURL("/v1/playlists/%s")},
+	{"artist_albums", matchArtistAlbums, replayArtistAlbums, db.StageArtistAlbums, pathURL("/v1/artists/%s/albums")},
+	{"artist_tracks", matchPath(artistTracksPath), replayArtistTracks, db.StageArtistTracks, pathURL("/v1/artists/%s/top-tracks")},
+	{"album_tracks", matchIDs("/v1/albums"), replayAlbumTracks, db.StageAlbumTracks, nil},
+	{"track_analysis", matchIDs("/v1/audio-features"), replayTrackAnalysis, db.StageTrackAnalyses, nil},
+}
+
+// pathURL returns the URLs of the given path, formatted with a row's key.
+func pathURL(format string) func(key string) *url.URL {
+	return func(key string) *url.URL { return &url.URL{Path: fmt.Sprintf(format, key)} }
+}
+
+func genreArtistsURL(genre string) *url.URL {
+	query := url.Values{}
+	query.Set("type", "artist")
+	query.Set("query", fmt.Sprintf(`genre:"%s"`, genre))
+	return &url.URL{Path: "/v1/search", RawQuery: query.Encode()}
+}
+
+// matchPath matches URLs whose paths match the given pattern.
+func matchPath(pattern *regexp.Regexp) func(u *url.URL) bool {
+	return func(u *url.URL) bool { return pattern.MatchString(u.Path) }
+}
+
+// matchIDs matches URLs for the given path with a list of ids.
+func matchIDs(path string) func(u *url.URL) bool {
+	return func(u *url.URL) bool { return u.Path == path && u.Query().Get("ids") != "" }
+}
+
+// isFirstPage reports whether the given URL is for the first page of a
+// paginated endpoint. Later pages are replayed along with the first.
+func isFirstPage(u *url.URL) bool {
+	offset := u.Query().Get("offset")
+	return offset == "" || offset == "0"
+}
+
+func matchGenreArtists(u *url.URL) bool {
+	return u.Path == "/v1/search" && u.Query().Get("type") == "artist" && isFirstPage(u) &&
+		genreSearchQuery.MatchString(u.Query().Get("query"))
+}
+
+func replayGenreArtists(ctx context.Context, db *db.DB, spo *spotify.Client, u *url.URL) error {
+	genreName := genreSearchQuery.FindStringSubmatch(u.Query().Get("query"))[1]
+
+	artists, err := spo.FetchGenre(ctx, genreName)
+	if err != nil {
+		return err
+	}
+
+	if err := db.InsertGenre(&data.Genre{Name: genreName}); err != nil {
+		return err
+	}
+	for _, artist := range artists {
+		if err := db.InsertArtist(ctx, &artist); err != nil {
+			return err
+		}
+	}
+	if len(artists) > 0 {
+		if err := db.MarkGenreFetched(genreName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func replayRelatedArtists(ctx context.Context, db *db.DB, spo *spotify.Client, u *url.URL) error {
+	artist := relatedPath.FindStringSubmatch(u.Path)[1]
+
+	related, err := spo.FetchRelatedArtists(ctx, artist)
+	if err != nil {
+		return err
+	}
+	if err := db.InsertArtistRelations(ctx, artist, related); err != nil {
+		return err
+	}
+	return nil
+}
+
+func replayPlaylists(ctx context.Context, db *db.DB, spo *spotify.Client, u *url.URL) error {
+	match := playlistPath.FindStringSubmatch(u.Path)
+
+	playlist, err := spo.FetchPlaylist(ctx, match[1])
+	if err != nil {
+		return err
+	}
+	playlist.SpotifyID = match[1]
+	if err := insertPlaylist(ctx, db, playlist); err != nil {
+		return err
+	}
+	return nil
+}
+
+func matchArtistAlbums(u *url.URL) bool {
+	return artistAlbumsPath.MatchString(u.Path) && isFirstPage(u)
+}
+
+func replayArtistAlbums(ctx context.Context, db *db.DB, spo *spotify.Client, u *url.URL) error {
+	artist := artistAlbumsPath.FindStringSubmatch(u.Path)[1]
+
+	albums, err := spo.FetchArtistAlbums(ctx, artist)
+	if err != nil {
+		return err
+	}
+	for _, album := range albums {
+		if err := db.InsertAlbum(ctx, &album); err != nil {
+			return err
+		}
+	}
+	if err := db.MarkArtistAlbumsFetched(artist); err != nil {
+		return err
+	}
+	return nil
+}
+
+func replayArtistTracks(ctx context.Context, db *db.DB, spo *spotify.Client, u *url.URL) error {
+	artist := artistTracksPath.FindStringSubmatch(u.Path)[1]
+
+	tracks, err := spo.FetchArtistTracks(ctx, artist)
+	if err != nil {
+		return err
+	}
+	for _, track := range tracks {
+		if err := db.InsertTrack(ctx, &track); err != nil {
+			return err
+		}
+		if err := db.InsertAlbum(ctx, &data.Album{
+			SpotifyID: track.AlbumSpotifyID,
+			Name:      track.AlbumName,
+		}); err != nil {
+			return err
+		}
+	}
+	if err := db.MarkArtistFetched(artist); err != nil {
+		return err
+	}
+	return nil
+}
+
+func replayAlbumTracks(ctx context.Context, db *db.DB, spo *spotify.Client, u *url.URL) error {
+	ids := strings.Split(u.Query().Get("ids"), ",")
+
+	albums, err := spo.FetchAlbums(ctx, ids)
+	if err != nil {
+		return err
+	}
+	if err := db.PopulateAlbums(ctx, albums); err != nil {
+		return err
+	}
+	return nil
+}
+
+func replayTrackAnalysis(ctx context.Context, db *db.DB, spo *spotify.Client, u *url.URL) error {
+	ids := strings.Split(u.Query().Get("ids"), ",")
+
+	analyses, err := spo.FetchTrackAnalyses(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	got := make(map[string]struct{}, len(analyses))
+	for _, analysis := range analyses {
+		got[analysis.SpotifyID] = struct{}{}
+	}
+	var failed []string
+	for _, id := range ids {
+		if _, ok := got[id]; !ok {
+			failed = append(failed, id)
+		}
+	}
+	if len(failed) > 0 {
+		if err := db.MarkTrackAnalysisFailed(failed, errNoAnalysis); err != nil {
+			return err
+		}
+	}
+
+	if err := db.AddTrackAnalyses(ctx, analyses); err != nil {
+		return err
+	}
+	return nil
+}
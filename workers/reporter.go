@@ -1,51 +1,36 @@
 package workers
 
 import (
+	"bufio"
 	"context"
+	"database/sql"
 	"fmt"
-	"os"
+	"io"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/amonks/genres/data"
 	"github.com/amonks/genres/db"
+	"github.com/amonks/genres/metrics"
+	"github.com/amonks/genres/spotify"
 )
 
-func runReporter(ctx context.Context, c chan<- struct{}, db *db.DB, duration time.Duration) error {
-	logfile, err := os.OpenFile("log.tsv", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		return err
-	}
-	defer logfile.Close()
-
-	var todo TODO
-	var todoErr error
-	todo, todoErr = gatherInfo(ctx, db)
-	if todoErr != nil {
-		return fmt.Errorf("reporting error: %w", todoErr)
-	}
-
+// runReporter records a snapshot of the crawl's progress in the database
+// every duration.
+func runReporter(ctx context.Context, c chan<- struct{}, db *db.DB, spo *spotify.Client, duration time.Duration) error {
 	tick := time.NewTicker(duration)
+	defer tick.Stop()
 
 	for {
-		todo, todoErr = gatherInfo(ctx, db)
-		if todoErr != nil {
-			return fmt.Errorf("reporting error: %w", todoErr)
+		snapshot, err := gatherInfo(ctx, db, spo)
+		if err != nil {
+			return fmt.Errorf("reporting error: %w", err)
 		}
-
-		fmt.Fprintf(logfile,
-			"%s\t"+
-				"%d\t%d\t"+
-				"%d\t%d\t"+
-				"%d\t%d\t"+
-				"%d\t"+
-				"%d\t%d\n",
-
-			time.Now().Format(time.DateTime),
-			todo.TracksKnown, todo.TracksDone,
-			todo.ArtistsKnown, todo.ArtistsDone,
-			todo.AlbumsKnown, todo.AlbumsDone,
-			todo.TracksIndexed,
-			todo.ArtistAlbumsDone, todo.ArtistTracksDone,
-		)
+		if _, err := db.InsertProgressSnapshots([]data.ProgressSnapshot{snapshot}); err != nil {
+			return fmt.Errorf("reporting error: %w", err)
+		}
+		setBacklog(snapshot)
 		c <- struct{}{}
 
 		select {
@@ -54,105 +39,122 @@ func runReporter(ctx context.Context, c chan<- struct{}, db *db.DB, duration tim
 
 		case <-tick.C:
 		}
-
 	}
 }
 
-type TODO struct {
-	GenresToFetchArtists  int
-	ArtistsToFetchTracks  int
-	ArtistsToFetchAlbums  int
-	AlbumsToFetchTracks   int
-	TracksToFetchAnalysis int
-
-	ArtistsKnown, ArtistsDone              int
-	ArtistAlbumsDone, ArtistTracksDone     int
-	AlbumsKnown, AlbumsDone                int
-	TracksKnown, TracksDone, TracksIndexed int
-}
-
-func gatherInfo(ctx context.Context, db *db.DB) (TODO, error) {
-	todo := TODO{}
-	if count, err := db.CountTracksKnown(); err != nil {
-		return todo, err
-	} else {
-		todo.TracksKnown = count
-	}
-	if err := ctx.Err(); err != nil {
-		return TODO{}, fmt.Errorf("canceled: %w", err)
-	}
-
-	if count, err := db.CountTracksDone(); err != nil {
-		return todo, err
-	} else {
-		todo.TracksDone = count
-	}
-	if err := ctx.Err(); err != nil {
-		return TODO{}, fmt.Errorf("canceled: %w", err)
+var backlog = metrics.NewGauge("genres_crawl_rows",
+	"Rows known to the crawl, and those done at each of its stages, as counted by the reporter every 10 minutes.",
+	"count")
+
+// setBacklog sets the backlog gauges.
+func setBacklog(snapshot data.ProgressSnapshot) {
+	for count, n := range map[string]int{
+		"artists_known":      snapshot.ArtistsKnown,
+		"artists_done":       snapshot.ArtistsDone,
+		"artist_albums_done": snapshot.ArtistAlbumsDone,
+		"artist_tracks_done": snapshot.ArtistTracksDone,
+		"albums_known":       snapshot.AlbumsKnown,
+		"albums_done":        snapshot.AlbumsDone,
+		"tracks_known":       snapshot.TracksKnown,
+		"tracks_done":        snapshot.TracksDone,
+		"tracks_indexed":     snapshot.TracksIndexed,
+	} {
+		backlog.Set(float64(n), count)
 	}
+}
 
-	if count, err := db.CountTracksIndexed(); err != nil {
-		return todo, err
-	} else {
-		todo.TracksIndexed = count
-	}
-	if err := ctx.Err(); err != nil {
-		return TODO{}, fmt.Errorf("canceled: %w", err)
+func gatherInfo(ctx context.Context, db *db.DB, spo *spotify.Client) (data.ProgressSnapshot, error) {
+	snapshot := data.ProgressSnapshot{TakenAt: time.Now()}
+
+	var genresToFetchArtists int
+	for _, count := range []struct {
+		dest *int
+		f    func() (int, error)
+	}{
+		{&genresToFetchArtists, db.CountGenresToFetchArtists},
+		{&snapshot.ArtistsToFetchTracks, db.CountArtistsToFetchTracks},
+		{&snapshot.ArtistsToFetchAlbums, db.CountArtistsToFetchAlbums},
+		{&snapshot.AlbumsToFetchTracks, db.CountAlbumsToFetchTracks},
+		{&snapshot.TracksToFetchAnalysis, db.CountTracksToFetchAnalysis},
+		{&snapshot.TracksKnown, db.CountTracksKnown},
+		{&snapshot.TracksDone, db.CountTracksDone},
+		{&snapshot.TracksIndexed, db.CountTracksIndexed},
+		{&snapshot.AlbumsKnown, db.CountAlbumsKnown},
+		{&snapshot.AlbumsDone, db.CountAlbumsDone},
+		{&snapshot.ArtistsKnown, db.CountArtistsKnown},
+		{&snapshot.ArtistAlbumsDone, db.CountArtistAlbumsDone},
+		{&snapshot.ArtistTracksDone, db.CountArtistTracksDone},
+		{&snapshot.ArtistsDone, db.CountArtistsDone},
+	} {
+		n, err := count.f()
+		if err != nil {
+			return data.ProgressSnapshot{}, err
+		}
+		*count.dest = n
+		if err := ctx.Err(); err != nil {
+			return data.ProgressSnapshot{}, fmt.Errorf("canceled: %w", err)
+		}
 	}
+	snapshot.GenresToFetchArtists = sql.NullInt64{Int64: int64(genresToFetchArtists), Valid: true}
 
-	if count, err := db.CountAlbumsKnown(); err != nil {
-		return todo, err
-	} else {
-		todo.AlbumsKnown = count
-	}
-	if err := ctx.Err(); err != nil {
-		return TODO{}, fmt.Errorf("canceled: %w", err)
+	requests, err := spo.Requests()
+	if err != nil {
+		return data.ProgressSnapshot{}, err
 	}
+	snapshot.SpotifyRequests = sql.NullInt64{Int64: int64(requests), Valid: true}
 
-	if count, err := db.CountAlbumsDone(); err != nil {
-		return todo, err
-	} else {
-		todo.AlbumsDone = count
-	}
-	if err := ctx.Err(); err != nil {
-		return TODO{}, fmt.Errorf("canceled: %w", err)
-	}
+	return snapshot, nil
+}
 
-	if count, err := db.CountArtistsKnown(); err != nil {
-		return todo, err
-	} else {
-		todo.ArtistsKnown = count
-	}
-	if err := ctx.Err(); err != nil {
-		return TODO{}, fmt.Errorf("canceled: %w", err)
-	}
+// ReadLog reads the snapshots in a log.tsv file, which the reporter used to
+// write before it recorded them in the database. Each line holds a local
+// time, and then the tracks known and done, the artists known and done, the
+// albums known and done, the tracks indexed, and the artists whose albums and
+// whose tracks are done.
+func ReadLog(r io.Reader) ([]data.ProgressSnapshot, error) {
+	var snapshots []data.ProgressSnapshot
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) != 10 {
+			return nil, fmt.Errorf("line %d: expected 10 fields, got %d", line, len(fields))
+		}
 
-	if count, err := db.CountArtistAlbumsDone(); err != nil {
-		return todo, err
-	} else {
-		todo.ArtistAlbumsDone = count
-	}
-	if err := ctx.Err(); err != nil {
-		return TODO{}, fmt.Errorf("canceled: %w", err)
-	}
+		var s data.ProgressSnapshot
+		takenAt, err := time.ParseInLocation(time.DateTime, fields[0], time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: error parsing time: %w", line, err)
+		}
+		s.TakenAt = takenAt
+		for i, dest := range []*int{
+			&s.TracksKnown, &s.TracksDone,
+			&s.ArtistsKnown, &s.ArtistsDone,
+			&s.AlbumsKnown, &s.AlbumsDone,
+			&s.TracksIndexed,
+			&s.ArtistAlbumsDone, &s.ArtistTracksDone,
+		} {
+			n, err := strconv.Atoi(fields[i+1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: error parsing field %d: %w", line, i+2, err)
+			}
+			*dest = n
+		}
 
-	if count, err := db.CountArtistTracksDone(); err != nil {
-		return todo, err
-	} else {
-		todo.ArtistTracksDone = count
-	}
-	if err := ctx.Err(); err != nil {
-		return TODO{}, fmt.Errorf("canceled: %w", err)
-	}
+		// Everything that isn't done is yet to be tried, since rows
+		// are done once they've been fetched or have failed.
+		s.ArtistsToFetchTracks = s.ArtistsKnown - s.ArtistTracksDone
+		s.ArtistsToFetchAlbums = s.ArtistsKnown - s.ArtistAlbumsDone
+		s.AlbumsToFetchTracks = s.AlbumsKnown - s.AlbumsDone
+		s.TracksToFetchAnalysis = s.TracksKnown - s.TracksDone
 
-	if count, err := db.CountArtistsDone(); err != nil {
-		return todo, err
-	} else {
-		todo.ArtistsDone = count
+		snapshots = append(snapshots, s)
 	}
-	if err := ctx.Err(); err != nil {
-		return TODO{}, fmt.Errorf("canceled: %w", err)
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading log: %w", err)
 	}
-
-	return todo, nil
+	return snapshots, nil
 }
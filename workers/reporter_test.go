@@ -0,0 +1,43 @@
+package workers_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amonks/genres/data"
+	"github.com/amonks/genres/workers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadLog(t *testing.T) {
+	snapshots, err := workers.ReadLog(strings.NewReader(
+		"2024-05-01 10:00:00\t100\t10\t50\t5\t30\t3\t8\t6\t7\n" +
+			"\n" +
+			"2024-05-01 10:10:00\t200\t20\t60\t6\t40\t4\t18\t7\t8\n"))
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	assert.Equal(t, data.ProgressSnapshot{
+		TakenAt:               time.Date(2024, 5, 1, 10, 0, 0, 0, time.Local),
+		ArtistsToFetchTracks:  43,
+		ArtistsToFetchAlbums:  44,
+		AlbumsToFetchTracks:   27,
+		TracksToFetchAnalysis: 90,
+		TracksKnown:           100,
+		TracksDone:            10,
+		ArtistsKnown:          50,
+		ArtistsDone:           5,
+		AlbumsKnown:           30,
+		AlbumsDone:            3,
+		TracksIndexed:         8,
+		ArtistAlbumsDone:      6,
+		ArtistTracksDone:      7,
+	}, snapshots[0])
+	assert.Equal(t, 18, snapshots[1].TracksIndexed)
+
+	_, err = workers.ReadLog(strings.NewReader("2024-05-01 10:00:00\t100\n"))
+	assert.ErrorContains(t, err, "line 1")
+	_, err = workers.ReadLog(strings.NewReader("2024-05-01 10:00:00\t100\t10\t50\t5\t30\t3\t8\t6\tx\n"))
+	assert.ErrorContains(t, err, "field 10")
+}
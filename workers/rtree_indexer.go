@@ -0,0 +1,50 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/amonks/genres/db"
+)
+
+// runRtreeIndexer populates the artist_genres_rtree, artist_tracks_rtree, and
+// album_tracks_rtree tables, in batches, until there's nothing left to index.
+func runRtreeIndexer(ctx context.Context, c chan<- struct{}, db *db.DB) error {
+	const batchSize = 1_000
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("canceled: %w", err)
+		}
+
+		artistGenres, err := db.GetArtistsToIndexGenresRtree(batchSize)
+		if err != nil {
+			return fmt.Errorf("error getting %d artists to index genres: %w", batchSize, err)
+		}
+		if err := db.IndexArtistsGenresRtree(ctx, artistGenres); err != nil {
+			return fmt.Errorf("error indexing genres of %d artists: %w", len(artistGenres), err)
+		}
+
+		artistTracks, err := db.GetArtistsToIndexTracksRtree(batchSize)
+		if err != nil {
+			return fmt.Errorf("error getting %d artists to index tracks: %w", batchSize, err)
+		}
+		if err := db.IndexArtistsTracksRtree(ctx, artistTracks); err != nil {
+			return fmt.Errorf("error indexing tracks of %d artists: %w", len(artistTracks), err)
+		}
+
+		albumTracks, err := db.GetAlbumsToIndexTracksRtree(batchSize)
+		if err != nil {
+			return fmt.Errorf("error getting %d albums to index tracks: %w", batchSize, err)
+		}
+		if err := db.IndexAlbumsTracksRtree(ctx, albumTracks); err != nil {
+			return fmt.Errorf("error indexing tracks of %d albums: %w", len(albumTracks), err)
+		}
+
+		if len(artistGenres) == 0 && len(artistTracks) == 0 && len(albumTracks) == 0 {
+			return nil
+		}
+
+		c <- struct{}{}
+	}
+}
@@ -0,0 +1,54 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/amonks/genres/data"
+	"github.com/amonks/genres/db"
+	"github.com/amonks/genres/spotify"
+)
+
+// seed adds a scope's seeds to the database, so that the workers can fetch
+// what's reachable from them: its genres and playlists, and those of its
+// artists which aren't there yet, fetched from Spotify.
+func seed(ctx context.Context, db *db.DB, spo *spotify.Client, scope *db.Scope) error {
+	for _, genre := range scope.Genres {
+		if err := db.InsertGenre(&data.Genre{Name: genre}); err != nil {
+			return err
+		}
+	}
+	for _, playlist := range scope.Playlists {
+		if err := db.InsertPlaylist(&data.Playlist{SpotifyID: playlist}); err != nil {
+			return err
+		}
+	}
+
+	missing, err := db.GetMissingArtists(scope.Artists)
+	if err != nil {
+		return err
+	}
+	for len(missing) > 0 {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("canceled: %w", err)
+		}
+
+		batch := missing[:min(50, len(missing))]
+		missing = missing[len(batch):]
+
+		artists, err := spo.FetchArtists(ctx, batch)
+		if err != nil {
+			return fmt.Errorf("error fetching %d seed artists: %w", len(batch), err)
+		}
+		if len(artists) < len(batch) {
+			log.Printf("spotify doesn't know %d of %d seed artists", len(batch)-len(artists), len(batch))
+		}
+		for _, artist := range artists {
+			if err := db.InsertArtist(ctx, &artist); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
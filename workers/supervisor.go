@@ -0,0 +1,129 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/amonks/genres/spotify"
+	"github.com/mattn/go-sqlite3"
+)
+
+// A policy says how a worker is restarted after a transient error.
+type policy struct {
+	// maxRetries is how many transient errors in a row are retried
+	// before the worker gives up. If it's negative, there's no limit.
+	maxRetries int
+	// minBackoff is the wait before the first retry, and doubles with
+	// each one after, up to maxBackoff.
+	minBackoff, maxBackoff time.Duration
+}
+
+// defaultPolicy retries forever, since most transient errors are Spotify or
+// the network having a bad few minutes.
+var defaultPolicy = policy{
+	maxRetries: -1,
+	minBackoff: time.Second,
+	maxBackoff: 5 * time.Minute,
+}
+
+// localPolicy is for workers which only use the database, whose transient
+// errors should clear up quickly.
+var localPolicy = policy{
+	maxRetries: 10,
+	minBackoff: 100 * time.Millisecond,
+	maxBackoff: 30 * time.Second,
+}
+
+func (p policy) backoff(retry int) time.Duration {
+	backoff := p.minBackoff
+	for i := 1; i < retry && backoff < p.maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, p.maxBackoff)
+}
+
+// isTransient reports whether the given error may go away if the worker is
+// run again: Spotify server errors and rate limits, network errors, and sqlite
+// being busy. Other Spotify errors, like a 404, will just happen again.
+func isTransient(err error) bool {
+	var statusErr *spotify.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
+
+// supervise runs f until it returns nil or a fatal error, restarting it after
+// transient errors according to the policy. The count of retries is reset
+// whenever f makes progress, by sending on c. setState is told when the
+// worker backs off after an error, and when it's running again.
+func supervise(ctx context.Context, name string, p policy, c chan<- struct{}, f func(context.Context, chan<- struct{}) error, setState func(state string, err error)) error {
+	retries := 0
+	for {
+		progressed, err := runOnce(ctx, c, f)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			// The worker was canceled, which isn't its failure.
+			return nil
+		}
+		if !isTransient(err) {
+			return err
+		}
+
+		if progressed {
+			retries = 0
+		}
+		retries++
+		if p.maxRetries >= 0 && retries > p.maxRetries {
+			return fmt.Errorf("giving up after %d retries: %w", p.maxRetries, err)
+		}
+
+		backoff := p.backoff(retries)
+		log.Printf("error:\t%s\t%s (retry %d in %s)", name, err, retries, backoff)
+		setState(StateBackingOff, err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		setState(StateRunning, nil)
+	}
+}
+
+// runOnce runs f, forwarding its progress to c, and reports whether it made
+// any.
+func runOnce(ctx context.Context, c chan<- struct{}, f func(context.Context, chan<- struct{}) error) (bool, error) {
+	progressed := false
+	progress, forwarded := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for range progress {
+			progressed = true
+			c <- struct{}{}
+		}
+	}()
+
+	err := f(ctx, progress)
+	close(progress)
+	<-forwarded
+	return progressed, err
+}
@@ -0,0 +1,157 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/amonks/genres/spotify"
+	"github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testPolicy = policy{
+	maxRetries: 3,
+	minBackoff: time.Millisecond,
+	maxBackoff: 4 * time.Millisecond,
+}
+
+func nopSetState(string, error) {}
+
+// unavailable is a transient error, as returned by the Spotify client.
+var unavailable = &spotify.StatusError{StatusCode: 503, Err: errors.New("service unavailable")}
+
+func TestIsTransient(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		transient bool
+	}{
+		{fmt.Errorf("error fetching album: %w", unavailable), true},
+		{&spotify.StatusError{StatusCode: 429, Err: errors.New("too many requests")}, true},
+		{&spotify.StatusError{StatusCode: 404, Err: errors.New("not found")}, false},
+		{&spotify.StatusError{StatusCode: 400, Err: errors.New("bad request")}, false},
+		{fmt.Errorf("request error: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}), true},
+		{fmt.Errorf("error inserting: %w", sqlite3.Error{Code: sqlite3.ErrBusy}), true},
+		{sqlite3.Error{Code: sqlite3.ErrConstraint}, false},
+		{spotify.ErrNoCredentials, false},
+		{errors.New("no artists for genre 'pop'"), false},
+	} {
+		assert.Equal(t, tc.transient, isTransient(tc.err), "%v", tc.err)
+	}
+}
+
+func TestPolicyBackoff(t *testing.T) {
+	assert.Equal(t, time.Second, defaultPolicy.backoff(1))
+	assert.Equal(t, 2*time.Second, defaultPolicy.backoff(2))
+	assert.Equal(t, 8*time.Second, defaultPolicy.backoff(4))
+	assert.Equal(t, 5*time.Minute, defaultPolicy.backoff(100))
+}
+
+func TestSuperviseRetries(t *testing.T) {
+	c := make(chan struct{}, 10)
+	attempts := 0
+	var states []string
+	err := supervise(context.Background(), "flaky", testPolicy, c, func(ctx context.Context, c chan<- struct{}) error {
+		attempts++
+		if attempts < 3 {
+			return unavailable
+		}
+		return nil
+	}, func(state string, err error) {
+		states = append(states, state)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, []string{StateBackingOff, StateRunning, StateBackingOff, StateRunning}, states)
+}
+
+func TestSuperviseGivesUp(t *testing.T) {
+	c := make(chan struct{}, 10)
+	attempts := 0
+	err := supervise(context.Background(), "broken", testPolicy, c, func(ctx context.Context, c chan<- struct{}) error {
+		attempts++
+		return unavailable
+	}, nopSetState)
+	assert.ErrorIs(t, err, spotify.ErrSpotify)
+	assert.Equal(t, 4, attempts)
+}
+
+func TestSupervisePermanent(t *testing.T) {
+	c := make(chan struct{}, 10)
+	attempts := 0
+	notFound := &spotify.StatusError{StatusCode: 404, Err: errors.New("not found")}
+	err := supervise(context.Background(), "missing", testPolicy, c, func(ctx context.Context, c chan<- struct{}) error {
+		attempts++
+		return notFound
+	}, nopSetState)
+	assert.ErrorIs(t, err, notFound)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestSuperviseResetsAfterProgress(t *testing.T) {
+	c := make(chan struct{}, 10)
+	attempts := 0
+	err := supervise(context.Background(), "slow", testPolicy, c, func(ctx context.Context, c chan<- struct{}) error {
+		attempts++
+		if attempts == 8 {
+			return nil
+		}
+		if attempts%2 == 0 {
+			c <- struct{}{}
+		}
+		return unavailable
+	}, nopSetState)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, attempts)
+}
+
+func TestEngineFatal(t *testing.T) {
+	eng := newEngine()
+
+	fatal := errors.New("fatal")
+	eng.add("fails", testPolicy, func(ctx context.Context, c chan<- struct{}) error {
+		return fatal
+	})
+	eng.add("gives_up", testPolicy, func(ctx context.Context, c chan<- struct{}) error {
+		return unavailable
+	})
+	canceled := make(chan struct{})
+	eng.add("waits", testPolicy, func(ctx context.Context, c chan<- struct{}) error {
+		<-ctx.Done()
+		close(canceled)
+		return fmt.Errorf("canceled: %w", ctx.Err())
+	})
+
+	done := make(chan error)
+	go func() { done <- eng.start(context.Background()) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("engine didn't stop")
+	}
+	<-canceled
+	require.Error(t, err)
+	assert.ErrorIs(t, err, fatal)
+	assert.Contains(t, err.Error(), "worker fails")
+	assert.NotContains(t, err.Error(), "worker waits")
+}
+
+func TestEngineCanceled(t *testing.T) {
+	eng := newEngine()
+	eng.add("waits", testPolicy, func(ctx context.Context, c chan<- struct{}) error {
+		<-ctx.Done()
+		return fmt.Errorf("canceled: %w", ctx.Err())
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- eng.start(ctx) }()
+	cancel()
+	assert.NoError(t, <-done)
+}
@@ -2,26 +2,30 @@ package workers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/amonks/genres/db"
 	"github.com/amonks/genres/spotify"
 )
 
-func runTrackAnalysisFetcher(ctx context.Context, c chan<- struct{}, db *db.DB, spo *spotify.Client) error {
+// errNoAnalysis is recorded for tracks which Spotify returned no analysis for.
+var errNoAnalysis = errors.New("no analysis returned")
+
+func runTrackAnalysisFetcher(ctx context.Context, c chan<- struct{}, db *db.DB, spo *spotify.Client, f frontier) error {
 	for {
 		if err := ctx.Err(); err != nil {
 			return fmt.Errorf("canceled: %w", err)
 		}
 
-		tracks, err := db.GetTracksToFetchAnalysis(100)
+		tracks, err := db.GetTracksToFetchAnalysis(100, f.priority, f.scope)
 		if err != nil {
 			return err
 		}
 		if len(tracks) == 0 {
 			return nil
 		}
-		if len(tracks) < 100 {
+		if !f.worthFetching(len(tracks), 100) {
 			return nil
 		}
 
@@ -41,14 +45,17 @@ func runTrackAnalysisFetcher(ctx context.Context, c chan<- struct{}, db *db.DB,
 					failed = append(failed, expected)
 				}
 			}
-			if err := db.MarkTrackAnalysisFailed(failed); err != nil {
-				return fmt.Errorf("error marking %d tracks as failed", len(failed))
+			if err := db.MarkTrackAnalysisFailed(failed, errNoAnalysis); err != nil {
+				return fmt.Errorf("error marking %d tracks as failed: %w", len(failed), err)
 			}
 		}
 
 		if err := db.AddTrackAnalyses(ctx, analyses); err != nil {
 			return err
 		}
+		if err := db.UpdateKNNIndex(ctx); err != nil {
+			return err
+		}
 
 		c <- struct{}{}
 	}
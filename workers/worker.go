@@ -2,31 +2,72 @@ package workers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/amonks/genres/db"
+	"github.com/amonks/genres/metrics"
 	"github.com/amonks/genres/spotify"
 	"golang.org/x/sync/errgroup"
 )
 
 type worker struct {
 	f         func(context.Context, chan<- struct{}) error
+	policy    policy
 	isRunning bool
+
+	// paused workers aren't started, and stop after their next batch
+	// until they're resumed, when resumed is closed.
+	paused  bool
+	resumed chan struct{}
+	// pending is set when a paused worker is retriggered, so that it's
+	// started when it's resumed.
+	pending bool
+
+	status WorkerStatus
 }
 
 type engine struct {
 	mu      sync.Mutex
-	workers map[string]worker
+	workers map[string]*worker
+
+	// triggers maps each worker's name to the workers to retrigger when
+	// it makes progress.
+	triggers map[string][]string
+
+	control *Control
+
+	// priorities maps the names of prioritized workers to the priority
+	// their frontier is fetched in, if it isn't db.PriorityNone.
+	priorities map[string]db.Priority
+	// scope limits what the workers fetch, if it isn't nil.
+	scope *db.Scope
+
+	// These are set by start.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	g      *errgroup.Group
+	events chan report
+	errs   []error
 }
 
-func (eng *engine) add(name string, f func(context.Context, chan<- struct{}) error) {
+func newEngine() *engine {
+	return &engine{workers: map[string]*worker{}}
+}
+
+func (eng *engine) add(name string, p policy, f func(context.Context, chan<- struct{}) error) {
 	eng.mu.Lock()
 	defer eng.mu.Unlock()
 
-	eng.workers[name] = worker{f: f}
+	eng.workers[name] = &worker{
+		f:      f,
+		policy: p,
+		status: WorkerStatus{Name: name, State: StateIdle},
+	}
 }
 
 type report struct {
@@ -34,131 +75,241 @@ type report struct {
 	dur  time.Duration
 }
 
+// start runs the workers, and retriggers them as their dependencies make
+// progress, until they've all stopped. A worker which fails with a fatal
+// error, or runs out of retries, stops all the others, and start returns the
+// fatal errors, joined.
 func (eng *engine) start(ctx context.Context) error {
 	ctx, cancel := context.WithCancelCause(ctx)
-
-	g := new(errgroup.Group)
-	events := make(chan report)
-
-	run := func(name string) {
-		worker := eng.workers[name]
-		worker.isRunning = true
-		f := worker.f
-		eng.workers[name] = worker
-
-		g.Go(func() error {
-			theseEvents := make(chan struct{})
-			go func() {
-				start := time.Now()
-				for range theseEvents {
-					now := time.Now()
-					dur := now.Sub(start).Truncate(time.Millisecond * 10)
-					start = now
-					events <- report{name, dur}
-				}
-			}()
-			if theseEvents == nil {
-				return fmt.Errorf("theseEvents is nil")
-			}
-			if f == nil {
-				return fmt.Errorf("f is nil")
-			}
-			err := f(ctx, theseEvents)
-			if err != nil {
-				log.Printf("error:\t%s\t%s", name, err)
-				cancel(err)
-			}
-			go func() {
-				eng.mu.Lock()
-				defer eng.mu.Unlock()
-
-				worker := eng.workers[name]
-				worker.isRunning = false
-				eng.workers[name] = worker
-			}()
-			return err
-		})
-	}
+	defer cancel(nil)
 
 	func() {
 		eng.mu.Lock()
 		defer eng.mu.Unlock()
 
+		eng.ctx, eng.cancel = ctx, cancel
+		eng.g = new(errgroup.Group)
+		eng.events = make(chan report)
 		for name := range eng.workers {
-			run(name)
+			eng.run(name)
+		}
+		if eng.control != nil {
+			eng.control.attach(eng)
 		}
 	}()
 
-	retrigger := func(name string) {
+	go func() {
+		for rep := range eng.events {
+			ev, dur := rep.name, rep.dur
+
+			log.Printf("batch (%s):\t%s", dur, ev)
+
+			for _, name := range eng.triggers[ev] {
+				eng.retrigger(name)
+			}
+		}
+	}()
+
+	eng.g.Wait()
+
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+	close(eng.events)
+	return errors.Join(eng.errs...)
+}
+
+// run starts the named worker, unless it's paused. eng.mu must be held.
+func (eng *engine) run(name string) {
+	worker := eng.workers[name]
+	if worker.paused {
+		worker.pending = true
+		return
+	}
+	worker.isRunning = true
+	worker.pending = false
+	worker.status.State = StateRunning
+	f, p := worker.f, worker.policy
+	ctx := eng.ctx
+
+	eng.g.Go(func() error {
+		theseEvents, reported := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(reported)
+			start := time.Now()
+			for range theseEvents {
+				now := time.Now()
+				dur := now.Sub(start).Truncate(time.Millisecond * 10)
+				eng.recordBatch(name, now, dur)
+				eng.events <- report{name, dur}
+				eng.waitUntilResumed(ctx, name)
+				start = time.Now()
+			}
+		}()
+
+		err := supervise(ctx, name, p, theseEvents, f, func(state string, err error) {
+			eng.setState(name, state, err)
+		})
+		close(theseEvents)
+		<-reported
+
 		eng.mu.Lock()
 		defer eng.mu.Unlock()
+		worker.isRunning = false
+		worker.status.State = StateIdle
+		if err != nil {
+			worker.status.State = StateFailed
+			worker.status.LastError = err.Error()
+			worker.status.LastErrorAt = time.Now()
 
-		if worker, has := eng.workers[name]; has && worker.isRunning {
-			return
+			err = fmt.Errorf("worker %s: %w", name, err)
+			log.Printf("fatal:\t%s", err)
+			eng.errs = append(eng.errs, err)
+			eng.cancel(err)
 		}
+		return err
+	})
+}
+
+// retrigger starts the named worker, if it's registered and not running.
+func (eng *engine) retrigger(name string) {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
 
-		run(name)
+	if worker, has := eng.workers[name]; !has || worker.isRunning || eng.ctx.Err() != nil {
+		return
 	}
 
-	go func() {
-		for rep := range events {
-			ev, dur := rep.name, rep.dur
+	eng.run(name)
+}
 
-			log.Printf("batch (%s):\t%s", dur, ev)
+var batchDuration = metrics.NewHistogram("genres_worker_batch_seconds",
+	"Time each worker took to process a batch, by worker.",
+	metrics.DefaultBuckets, "worker")
+
+func (eng *engine) recordBatch(name string, at time.Time, dur time.Duration) {
+	batchDuration.Observe(dur.Seconds(), name)
 
-			switch ev {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
 
-			case "genres":
-				retrigger("genre_artists")
+	status := &eng.workers[name].status
+	status.Batches++
+	status.LastBatchAt = at
+	status.LastBatchSeconds = dur.Seconds()
+}
+
+func (eng *engine) setState(name, state string, err error) {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
 
-			case "track_analysis":
-				retrigger("indexer")
+	status := &eng.workers[name].status
+	status.State = state
+	if err != nil {
+		status.LastError = err.Error()
+		status.LastErrorAt = time.Now()
+	}
+}
 
-			case "album_tracks":
-				retrigger("track_analysis")
+// waitUntilResumed blocks while the named worker is paused.
+func (eng *engine) waitUntilResumed(ctx context.Context, name string) {
+	eng.mu.Lock()
+	worker := eng.workers[name]
+	if !worker.paused {
+		eng.mu.Unlock()
+		return
+	}
+	resumed := worker.resumed
+	eng.mu.Unlock()
 
-			case "artist_albums":
-				retrigger("album_tracks")
+	select {
+	case <-ctx.Done():
+	case <-resumed:
+	}
+}
 
-			case "artist_tracks":
-				retrigger("track_analysis")
-			}
-		}
-	}()
+// An Option configures Run.
+type Option func(*engine)
 
-	g.Wait()
+// WithControl lets the given Control report on and control the workers.
+func WithControl(c *Control) Option {
+	return func(eng *engine) { eng.control = c }
+}
+
+// WithPriorities sets the priority each of the named workers fetches its
+// frontier in. Only workers listed by Prioritized have priorities.
+func WithPriorities(priorities map[string]db.Priority) Option {
+	return func(eng *engine) { eng.priorities = priorities }
+}
 
+func validatePriorities(priorities map[string]db.Priority) error {
+	for name, priority := range priorities {
+		if !slices.Contains(Prioritized(), name) {
+			return fmt.Errorf("worker '%s' has no priority", name)
+		}
+		if _, err := db.ParsePriority(string(priority)); err != nil {
+			return fmt.Errorf("worker '%s': %w", name, err)
+		}
+	}
 	return nil
 }
 
-func Run(ctx context.Context, db *db.DB, spo *spotify.Client, workers []string) error {
-	eng := engine{
-		workers: map[string]worker{},
+// WithScope limits the workers to fetching what's reachable from the scope's
+// seeds, which Run adds to the database first.
+func WithScope(scope *db.Scope) Option {
+	return func(eng *engine) { eng.scope = scope }
+}
+
+// frontier returns the frontier the named worker fetches from.
+func (eng *engine) frontier(name string) frontier {
+	f := frontier{priority: db.PriorityNone, scope: eng.scope}
+	if priority, ok := eng.priorities[name]; ok {
+		f.priority = priority
+	}
+	return f
+}
+
+func withFrontier(fetch func(context.Context, chan<- struct{}, *db.DB, *spotify.Client, frontier) error, f frontier) func(context.Context, chan<- struct{}, *db.DB, *spotify.Client) error {
+	return func(ctx context.Context, c chan<- struct{}, db *db.DB, spo *spotify.Client) error {
+		return fetch(ctx, c, db, spo, f)
 	}
+}
 
-	for _, worker := range workers {
-		switch worker {
-		case "album_tracks":
-			eng.add("album_tracks", func(ctx context.Context, c chan<- struct{}) error { return runAlbumTracksFetcher(ctx, c, db, spo) })
-		case "artist_albums":
-			eng.add("artist_albums", func(ctx context.Context, c chan<- struct{}) error { return runArtistAlbumsFetcher(ctx, c, db, spo) })
-		case "artist_tracks":
-			eng.add("artist_tracks", func(ctx context.Context, c chan<- struct{}) error { return runArtistTracksFetcher(ctx, c, db, spo) })
-		case "genre_artists":
-			eng.add("genre_artists", func(ctx context.Context, c chan<- struct{}) error { return runGenreArtistsFetcher(ctx, c, db, spo) })
-		case "genres":
-			eng.add("genres", func(ctx context.Context, c chan<- struct{}) error { return runGenresFetcher(ctx, c, db) })
-		case "track_analysis":
-			eng.add("track_analysis", func(ctx context.Context, c chan<- struct{}) error { return runTrackAnalysisFetcher(ctx, c, db, spo) })
-			eng.add("indexer", func(ctx context.Context, c chan<- struct{}) error { return runIndexer(ctx, c, db) })
-		case "album_tracks_refetch":
-			eng.add("album_tracks_refetch", func(ctx context.Context, c chan<- struct{}) error { return runAlbumTracksRefetcher(ctx, c, db, spo) })
-		default:
-			return fmt.Errorf("unsupported worker '%s'", worker)
+// Run runs the named workers until ctx is canceled or they've all stopped.
+// Transient errors are retried; if any worker fails otherwise, Run stops the
+// rest and returns the failures.
+func Run(ctx context.Context, db *db.DB, spo *spotify.Client, workers []string, options ...Option) error {
+	eng := newEngine()
+	for _, option := range options {
+		option(eng)
+	}
+
+	specs, err := lookupSpecs(workers)
+	if err != nil {
+		return err
+	}
+	if err := validate(specs); err != nil {
+		return err
+	}
+	if err := validatePriorities(eng.priorities); err != nil {
+		return err
+	}
+	if eng.scope != nil {
+		if err := seed(ctx, db, spo, eng.scope); err != nil {
+			return err
+		}
+	}
+	eng.triggers = triggers(specs)
+	for _, spec := range specs {
+		run := spec.run
+		if spec.fetch != nil {
+			run = withFrontier(spec.fetch, eng.frontier(spec.name))
 		}
+		eng.add(spec.name, spec.policy, func(ctx context.Context, c chan<- struct{}) error { return run(ctx, c, db, spo) })
 	}
 
-	eng.add("reporter", func(ctx context.Context, c chan<- struct{}) error { return runReporter(ctx, c, db, time.Minute*10) })
+	eng.add("reporter", localPolicy, func(ctx context.Context, c chan<- struct{}) error {
+		return runReporter(ctx, c, db, spo, time.Minute*10)
+	})
 
 	return eng.start(ctx)
 }
@@ -0,0 +1,414 @@
+package workers_test
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amonks/genres/data"
+	"github.com/amonks/genres/db"
+	"github.com/amonks/genres/limiter"
+	"github.com/amonks/genres/readthrough"
+	"github.com/amonks/genres/spotify"
+	"github.com/amonks/genres/spotifytest"
+	"github.com/amonks/genres/workers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCrawl crawls the fake Spotify API from a database with nothing but
+// genres in it, and checks that it ends up with the whole catalog.
+func TestCrawl(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	catalog := srv.Catalog
+
+	db := crawl(t, srv, readthrough.NewMemory())
+
+	artistsKnown, err := db.CountArtistsKnown()
+	require.NoError(t, err)
+	assert.Equal(t, len(catalog.Artists), artistsKnown)
+	albumsKnown, err := db.CountAlbumsKnown()
+	require.NoError(t, err)
+	assert.Equal(t, len(catalog.Albums), albumsKnown)
+	tracksKnown, err := db.CountTracksKnown()
+	require.NoError(t, err)
+	assert.Equal(t, len(catalog.Tracks), tracksKnown)
+
+	// The reporter recorded a snapshot each time the workers were run.
+	snapshots, err := db.GetProgressSnapshots(time.Time{})
+	require.NoError(t, err)
+	require.NotEmpty(t, snapshots)
+	assert.Equal(t, int64(len(catalog.Genres)), snapshots[0].GenresToFetchArtists.Int64)
+	assert.True(t, snapshots[len(snapshots)-1].SpotifyRequests.Valid)
+
+	ctx := context.Background()
+	for _, expected := range []*spotifytest.Track{catalog.Tracks[0], catalog.Tracks[104], catalog.Tracks[len(catalog.Tracks)-1]} {
+		track, err := db.GetTrack(ctx, expected.ID)
+		require.NoError(t, err)
+		assert.Equal(t, expected.Name, track.Name)
+		assert.Equal(t, expected.TrackNumber, track.TrackNumber)
+		assert.Equal(t, expected.DiscNumber, track.DiscNumber)
+		assert.Equal(t, expected.Energy, track.Energy)
+		assert.Equal(t, expected.TimeSignature, track.TimeSignature)
+		require.Len(t, track.Artists, len(expected.Artists))
+		for i, artist := range track.Artists {
+			assert.Equal(t, expected.Artists[i], artist.SpotifyID)
+		}
+
+		neighbors, err := db.NearestTracks(ctx, 1, track.Vector())
+		require.NoError(t, err)
+		require.Len(t, neighbors, 1)
+		assert.Equal(t, expected.ID, neighbors[0].SpotifyID)
+	}
+
+	album, err := db.GetAlbum(ctx, catalog.Albums[1].ID)
+	require.NoError(t, err)
+	assert.Equal(t, catalog.Albums[1].Type, album.Type)
+	assert.Equal(t, catalog.Albums[1].ReleaseDate, album.ReleaseDate)
+	assert.Equal(t, catalog.Albums[1].ReleaseDatePrecision, album.ReleaseDatePrecision)
+	require.NotEmpty(t, album.Tracks)
+	assert.NotEmpty(t, album.Tracks[0].Artists)
+	require.NotEmpty(t, album.Artists)
+
+	results, err := db.Search(ctx, `"`+catalog.Tracks[7].Name+`"`, 1)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, catalog.Tracks[7].ID, results[0].SpotifyID)
+}
+
+// TestScopedCrawl crawls only what's reachable from a seed artist, starting
+// from an empty database.
+func TestScopedCrawl(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	seed := srv.Catalog.Artists[3]
+	scope := &db.Scope{Artists: []string{seed.ID}}
+
+	scoped, spo := open(t, srv, readthrough.NewMemory())
+	empty := func(get func(int, db.Priority, *db.Scope) ([]string, error)) bool {
+		keys, err := get(1, db.PriorityPopularity, scope)
+		require.NoError(t, err)
+		return len(keys) == 0
+	}
+	withScope := workers.WithScope(scope)
+	runUntil(t, scoped, spo, []string{"artist_albums", "artist_tracks"}, func() bool {
+		// Run adds the seed before it starts the workers.
+		missing, err := scoped.GetMissingArtists(scope.Artists)
+		require.NoError(t, err)
+		return len(missing) == 0 && empty(scoped.GetArtistsToFetchAlbums) && empty(scoped.GetArtistsToFetchTracks)
+	}, withScope)
+	runUntil(t, scoped, spo, []string{"album_tracks"}, func() bool {
+		return empty(scoped.GetAlbumsToFetchTracks)
+	}, withScope)
+	runUntil(t, scoped, spo, []string{"track_analysis"}, func() bool {
+		return empty(scoped.GetTracksToFetchAnalysis)
+	}, withScope)
+	assert.Equal(t, 1, srv.Requests("/v1/artists"))
+
+	// The artists featured on the seed's tracks are known, but they're out
+	// of scope.
+	artistsKnown, err := scoped.CountArtistsKnown()
+	require.NoError(t, err)
+	assert.Equal(t, 2, artistsKnown)
+	for _, count := range []struct {
+		f        func() (int, error)
+		expected int
+	}{
+		{scoped.CountArtistsWithFetchedAlbums, 1},
+		{scoped.CountArtistsWithFetchedTracks, 1},
+		{scoped.CountAlbumsWithFetchedTracks, len(seed.Albums)},
+		{scoped.CountTracksWithFetchedAnalysis, 5 * len(seed.Albums)},
+	} {
+		got, err := count.f()
+		require.NoError(t, err)
+		assert.Equal(t, count.expected, got)
+	}
+}
+
+// TestRelatedArtists discovers the whole catalog's artists through the
+// related artists of one.
+func TestRelatedArtists(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	catalog := srv.Catalog
+	seed := catalog.Artists[0]
+
+	related, spo := open(t, srv, readthrough.NewMemory())
+	ctx := context.Background()
+	require.NoError(t, related.InsertArtist(ctx, &data.Artist{SpotifyID: seed.ID}))
+
+	runUntil(t, related, spo, []string{"related_artists"}, func() bool {
+		n, err := related.CountArtistsToFetchRelated()
+		require.NoError(t, err)
+		return n == 0
+	})
+
+	artistsKnown, err := related.CountArtistsKnown()
+	require.NoError(t, err)
+	assert.Equal(t, len(catalog.Artists), artistsKnown)
+
+	artists, err := related.GetRelatedArtists(ctx, seed.ID)
+	require.NoError(t, err)
+	require.Len(t, artists, len(seed.Related))
+	for i, artist := range artists {
+		assert.Equal(t, seed.Related[i], artist.SpotifyID)
+	}
+
+	// Each artist is related to the next two, so the two before the seed
+	// are related to it.
+	neighbors, err := related.GetArtistNeighborhood(ctx, seed.ID, 1, 10)
+	require.NoError(t, err)
+	assert.Len(t, neighbors, 4)
+}
+
+// TestPlaylists crawls a seed playlist, and analyzes its tracks.
+func TestPlaylists(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	expected := srv.Catalog.Playlists[0]
+	scope := &db.Scope{Playlists: []string{expected.ID}}
+
+	crawled, spo := open(t, srv, readthrough.NewMemory())
+	withScope := workers.WithScope(scope)
+	runUntil(t, crawled, spo, []string{"playlists"}, func() bool {
+		n, err := crawled.CountPlaylistsToFetch()
+		require.NoError(t, err)
+		// Run adds the seed before it starts the workers.
+		return n == 0 && srv.Requests("/v1/playlists/"+expected.ID) > 0
+	}, withScope)
+	runUntil(t, crawled, spo, []string{"track_analysis"}, func() bool {
+		tracks, err := crawled.GetTracksToFetchAnalysis(1, db.PriorityPopularity, scope)
+		require.NoError(t, err)
+		return len(tracks) == 0
+	}, withScope)
+
+	// The local file is left out.
+	analyzed, err := crawled.CountTracksWithFetchedAnalysis()
+	require.NoError(t, err)
+	assert.Equal(t, len(expected.Tracks)-1, analyzed)
+
+	playlist, err := crawled.GetPlaylist(context.Background(), expected.ID)
+	require.NoError(t, err)
+	assert.Equal(t, expected.Name, playlist.Name)
+	require.Len(t, playlist.Tracks, len(expected.Tracks)-1)
+	for _, track := range playlist.Tracks {
+		assert.Equal(t, expected.Tracks[track.Position], track.Track.SpotifyID)
+		assert.True(t, track.Track.FetchedAnalysisAt.Valid)
+	}
+}
+
+// TestReplay rebuilds a crawled database from the crawl's cache, and checks
+// that it ends up the same.
+func TestReplay(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	cache := readthrough.NewMemory()
+	crawled := crawl(t, srv, cache)
+
+	replayed, err := db.Open(filepath.Join(t.TempDir(), "replayed.db"))
+	require.NoError(t, err)
+	defer replayed.Close()
+	for _, genre := range srv.Catalog.Genres {
+		require.NoError(t, replayed.InsertGenre(&data.Genre{Name: genre, Key: genre}))
+	}
+
+	// Cache keys are URLs on the fake server, rather than on Spotify.
+	spo, err := spotify.New(nil, spotify.WithBaseURL(srv.URL), spotify.WithCache(cache), spotify.WithCacheOnly())
+	require.NoError(t, err)
+	walks := &countingWalks{Cache: cache}
+	require.NoError(t, workers.Replay(context.Background(), replayed, spo, walks, false))
+	assert.Equal(t, 1, walks.n)
+
+	for _, count := range []func(*db.DB) (int, error){
+		(*db.DB).CountGenresWithFetchedArtists,
+		(*db.DB).CountArtistsKnown,
+		(*db.DB).CountArtistsWithFetchedAlbums,
+		(*db.DB).CountArtistsWithFetchedTracks,
+		(*db.DB).CountAlbumsKnown,
+		(*db.DB).CountAlbumsWithFetchedTracks,
+		(*db.DB).CountTracksKnown,
+		(*db.DB).CountTracksWithFetchedAnalysis,
+		(*db.DB).CountTracksIndexed,
+	} {
+		expected, err := count(crawled)
+		require.NoError(t, err)
+		got, err := count(replayed)
+		require.NoError(t, err)
+		assert.Equal(t, expected, got)
+	}
+
+	ctx := context.Background()
+	for _, track := range srv.Catalog.Tracks[:10] {
+		expected, err := crawled.GetTrack(ctx, track.ID)
+		require.NoError(t, err)
+		got, err := replayed.GetTrack(ctx, track.ID)
+		require.NoError(t, err)
+		assert.Equal(t, expected.Vector(), got.Vector())
+		assert.Equal(t, len(expected.Artists), len(got.Artists))
+	}
+}
+
+// TestReplayUnkeyed replays a cache whose per-artist and per-genre responses
+// were written before keys were recorded, as would be the case for a cache
+// from before replay existed, and checks that they're replayed anyway.
+func TestReplayUnkeyed(t *testing.T) {
+	srv := spotifytest.NewServer(spotifytest.NewCatalog())
+	defer srv.Close()
+	dir := t.TempDir()
+	cache := readthrough.New(dir, "req-")
+	crawled := crawl(t, srv, cache)
+
+	var removed int
+	require.NoError(t, filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !strings.HasSuffix(path, ".key") {
+			return err
+		}
+		key, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if strings.Contains(string(key), "ids=") {
+			return nil
+		}
+		removed++
+		return os.Remove(path)
+	}))
+	require.NotZero(t, removed)
+
+	replayed, err := db.Open(filepath.Join(t.TempDir(), "replayed.db"))
+	require.NoError(t, err)
+	defer replayed.Close()
+	for _, genre := range srv.Catalog.Genres {
+		require.NoError(t, replayed.InsertGenre(&data.Genre{Name: genre, Key: genre}))
+	}
+
+	spo, err := spotify.New(nil, spotify.WithBaseURL(srv.URL), spotify.WithCache(cache), spotify.WithCacheOnly())
+	require.NoError(t, err)
+	require.NoError(t, workers.Replay(context.Background(), replayed, spo, cache, false))
+
+	for _, count := range []func(*db.DB) (int, error){
+		(*db.DB).CountGenresWithFetchedArtists,
+		(*db.DB).CountArtistsKnown,
+		(*db.DB).CountArtistsWithFetchedAlbums,
+		(*db.DB).CountArtistsWithFetchedTracks,
+		(*db.DB).CountAlbumsKnown,
+		(*db.DB).CountAlbumsWithFetchedTracks,
+		(*db.DB).CountTracksKnown,
+		(*db.DB).CountTracksWithFetchedAnalysis,
+	} {
+		expected, err := count(crawled)
+		require.NoError(t, err)
+		got, err := count(replayed)
+		require.NoError(t, err)
+		assert.Equal(t, expected, got)
+	}
+}
+
+// countingWalks counts the calls to its Cache's Walk.
+type countingWalks struct {
+	readthrough.Cache
+	n int
+}
+
+func (c *countingWalks) Walk(fn func(key string) error) error {
+	c.n++
+	return c.Cache.Walk(fn)
+}
+
+// crawl runs the fetch workers against the given server, caching responses in
+// the given cache, starting from a database with nothing but genres in it, and
+// returns the database.
+func crawl(t *testing.T, srv *spotifytest.Server, cache readthrough.Cache) *db.DB {
+	db, spo := open(t, srv, cache)
+
+	for i, genre := range srv.Catalog.Genres {
+		require.NoError(t, db.InsertGenre(&data.Genre{Name: genre, Key: genre, Energy: float64(i)}))
+	}
+
+	// Some transient failures along the way.
+	srv.BadGatewayNext()
+	srv.RateLimitNext(0)
+
+	// Each worker is only retriggered by its upstream's progress, so
+	// running them all at once would make the test depend on scheduling.
+	// Instead, we run one stage at a time, each until it's done.
+	runUntil(t, db, spo, []string{"genre_artists", "rtree_indexer"}, func() bool {
+		n, err := db.CountGenresToFetchArtists()
+		require.NoError(t, err)
+		return n == 0
+	})
+	runUntil(t, db, spo, []string{"artist_albums", "artist_tracks"}, func() bool {
+		albums, err := db.CountArtistsToFetchAlbums()
+		require.NoError(t, err)
+		tracks, err := db.CountArtistsToFetchTracks()
+		require.NoError(t, err)
+		return albums == 0 && tracks == 0
+	})
+	runUntil(t, db, spo, []string{"album_tracks", "rtree_indexer"}, func() bool {
+		n, err := db.CountAlbumsToFetchTracks()
+		require.NoError(t, err)
+		return n == 0
+	})
+	runUntil(t, db, spo, []string{"track_analysis", "indexer"}, func() bool {
+		analysis, err := db.CountTracksToFetchAnalysis()
+		require.NoError(t, err)
+		index, err := db.CountTracksToIndex(context.Background())
+		require.NoError(t, err)
+		return analysis == 0 && index == 0
+	})
+
+	return db
+}
+
+// open returns an empty database, and a client for the given server which
+// caches responses in the given cache.
+func open(t *testing.T, srv *spotifytest.Server, cache readthrough.Cache) (*db.DB, *spotify.Client) {
+	dir := t.TempDir()
+
+	spo, err := spotify.New([]spotify.Credential{{
+		ClientID:     spotifytest.ClientID,
+		ClientSecret: spotifytest.ClientSecret,
+	}}, append(srv.Options(),
+		spotify.WithLimiterFile(filepath.Join(dir, "next-req")),
+		spotify.WithLimiterConfig(limiter.Config{}),
+		spotify.WithCache(cache))...)
+	require.NoError(t, err)
+
+	db, err := db.Open(filepath.Join(dir, "genres.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	return db, spo
+}
+
+// runUntil runs the given workers until done returns true, failing the test if
+// they stop first, or take more than 30 seconds.
+func runUntil(t *testing.T, db *db.DB, spo *spotify.Client, names []string, done func() bool, options ...workers.Option) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan error)
+	go func() { stopped <- workers.Run(ctx, db, spo, names, options...) }()
+
+	timeout := time.After(30 * time.Second)
+	for !done() {
+		select {
+		case err := <-stopped:
+			t.Fatalf("workers %v stopped before they were done: %v", names, err)
+		case <-timeout:
+			cancel()
+			<-stopped
+			t.Fatalf("workers %v took too long", names)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	cancel()
+	assert.NoError(t, <-stopped)
+}